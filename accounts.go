@@ -0,0 +1,571 @@
+// accounts.go - User accounts and poll ownership
+// Visitors can register at /register and sign in at /login. Passwords are
+// stored as salted PBKDF2-HMAC-SHA256 hashes in a self-describing format
+// ("pbkdf2-sha256$iterations$salt$hash"), so the cost can be raised later
+// without invalidating existing accounts. Signing in sets a signed session
+// cookie, valid for 30 days.
+//
+// Polls created by a signed-in user are owned by them. Only the owner or
+// an admin can edit, close, reopen, reset or delete a poll; polls without
+// an owner (created signed out, or before accounts existed) can only be
+// changed by admins. Admins are the users named in ADMIN_USERS
+// (comma-separated) and anyone with the ADMIN_PASSWORD of the dashboard.
+// /my lists the signed-in user's polls with the dashboard's actions.
+//
+// With STORAGE=file, accounts are saved to users.json in the data
+// directory; with STORAGE=redis, every node shares them (see
+// redisstore.go).
+
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	sessionCookieName = "quickpoll_session"
+	sessionMaxAge     = 30 * 24 * time.Hour
+	minPasswordLength = 8
+)
+
+// passwordIterations is the PBKDF2 cost of new password hashes
+var passwordIterations = 210000
+
+// Account errors
+var (
+	ErrInvalidLogin = errors.New("incorrect user name or password")
+	ErrForbidden    = errors.New("only the poll's owner or an admin can change it")
+)
+
+type userContextKey struct{}
+
+// User is a registered account
+type User struct {
+	ID           string    `json:"id"`
+	Name         string    `json:"name"`
+	PasswordHash string    `json:"password_hash"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// Users is the registry of accounts
+type Users struct {
+	mu     sync.RWMutex
+	byID   map[string]*User
+	byName map[string]*User
+	path   string // where accounts are saved; empty keeps them in memory
+	// shared keeps the accounts in Redis instead, for every node
+	shared *redisDoc
+}
+
+// NewUsers creates an in-memory account registry
+func NewUsers() *Users {
+	return &Users{byID: make(map[string]*User), byName: make(map[string]*User)}
+}
+
+// OpenUsers creates a registry saved to path, loading the accounts already
+// there
+func OpenUsers(path string) (*Users, error) {
+	u := NewUsers()
+	u.path = path
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return u, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := u.loadLocked(data); err != nil {
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+	return u, nil
+}
+
+// OpenSharedUsers creates a registry kept in Redis, where every node sees
+// the same accounts
+func OpenSharedUsers(client *RedisClient) (*Users, error) {
+	u := NewUsers()
+	u.shared = newRedisDoc(client, "users")
+	if err := u.shared.sync(u.loadLocked); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// loadLocked replaces the accounts with saved ones. The caller must hold
+// u.mu.
+func (u *Users) loadLocked(data []byte) error {
+	var users []*User
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &users); err != nil {
+			return err
+		}
+	}
+	u.byID = make(map[string]*User, len(users))
+	u.byName = make(map[string]*User, len(users))
+	for _, user := range users {
+		u.byID[user.ID] = user
+		u.byName[user.Name] = user
+	}
+	return nil
+}
+
+// find returns the account pick selects. Accounts never change once
+// registered, so shared ones are only reloaded when pick finds none.
+func (u *Users) find(pick func() *User) *User {
+	u.mu.RLock()
+	user := pick()
+	u.mu.RUnlock()
+	if user != nil || u.shared == nil {
+		return user
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if err := u.shared.sync(u.loadLocked); err != nil {
+		log.Printf("Failed to reload accounts: %v", err)
+	}
+	return pick()
+}
+
+// normalizeUserName lowercases a user name so names differing only in
+// case cannot be registered twice
+func normalizeUserName(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+// validateUserName checks that a name is 3 to 32 letters, digits, dots,
+// dashes or underscores
+func validateUserName(name string) error {
+	if len(name) < 3 || len(name) > 32 {
+		return &ValidationError{Field: "name", Message: "User name must be 3 to 32 characters"}
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || strings.ContainsRune("._-", c)) {
+			return &ValidationError{Field: "name", Message: "User name can only contain letters, digits, dots, dashes and underscores"}
+		}
+	}
+	return nil
+}
+
+// Register creates an account
+func (u *Users) Register(name, password string) (*User, error) {
+	name = normalizeUserName(name)
+	if err := validateUserName(name); err != nil {
+		return nil, err
+	}
+	if len(password) < minPasswordLength {
+		return nil, &ValidationError{Field: "password", Message: fmt.Sprintf("Password must be at least %d characters", minPasswordLength)}
+	}
+	id, err := NewID(KindUser)
+	if err != nil {
+		return nil, err
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+	user := &User{ID: id, Name: name, PasswordHash: hash, CreatedAt: time.Now()}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if err := u.shared.sync(u.loadLocked); err != nil {
+		return nil, err
+	}
+	if _, taken := u.byName[name]; taken {
+		return nil, &ValidationError{Field: "name", Message: "That user name is taken"}
+	}
+	u.byID[user.ID] = user
+	u.byName[name] = user
+	if err := u.saveLocked(); err != nil {
+		delete(u.byID, user.ID)
+		delete(u.byName, name)
+		return nil, err
+	}
+	copy := *user
+	return &copy, nil
+}
+
+// Authenticate returns the account with the given name and password
+func (u *Users) Authenticate(name, password string) (*User, error) {
+	user := u.find(func() *User { return u.byName[normalizeUserName(name)] })
+	if user == nil {
+		// Hash anyway so the response time does not reveal which names
+		// are registered
+		if _, err := hashPassword(password); err != nil {
+			return nil, err
+		}
+		return nil, ErrInvalidLogin
+	}
+	if !checkPassword(user.PasswordHash, password) {
+		return nil, ErrInvalidLogin
+	}
+	copy := *user
+	return &copy, nil
+}
+
+// Get returns a copy of the account with the given ID
+func (u *Users) Get(id string) (*User, bool) {
+	user := u.find(func() *User { return u.byID[id] })
+	if user == nil {
+		return nil, false
+	}
+	copy := *user
+	return &copy, true
+}
+
+// Name returns the name of the account with the given ID, or ""
+func (u *Users) Name(id string) string {
+	if user := u.find(func() *User { return u.byID[id] }); user != nil {
+		return user.Name
+	}
+	return ""
+}
+
+// saveLocked writes the accounts to disk or Redis. The caller must hold
+// u.mu.
+func (u *Users) saveLocked() error {
+	if u.path == "" && u.shared == nil {
+		return nil
+	}
+	users := make([]*User, 0, len(u.byID))
+	for _, user := range u.byID {
+		users = append(users, user)
+	}
+	data, err := json.MarshalIndent(users, "", "  ")
+	if err != nil {
+		return err
+	}
+	if u.shared != nil {
+		return u.shared.save(data)
+	}
+	return writeFileAtomic(u.path, data)
+}
+
+// hashPassword returns a salted PBKDF2 hash of password. It fails with
+// ErrEntropy if no salt can be generated.
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := randRead(salt); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrEntropy, err)
+	}
+	key := pbkdf2SHA256([]byte(password), salt, passwordIterations)
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", passwordIterations,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// checkPassword reports whether password matches a hash from hashPassword
+func checkPassword(hash, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations < 1 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	got := pbkdf2SHA256([]byte(password), salt, iterations)
+	return subtle.ConstantTimeCompare(got, want) == 1
+}
+
+// pbkdf2SHA256 derives a 32-byte key as in RFC 8018. One block of output
+// is all a password hash needs.
+func pbkdf2SHA256(password, salt []byte, iterations int) []byte {
+	mac := hmac.New(sha256.New, password)
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+	key := append([]byte(nil), u...)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+	return key
+}
+
+// adminUsersFromEnv reads ADMIN_USERS
+func adminUsersFromEnv() map[string]bool {
+	admins := make(map[string]bool)
+	for _, name := range strings.Split(os.Getenv("ADMIN_USERS"), ",") {
+		if name = normalizeUserName(name); name != "" {
+			admins[name] = true
+		}
+	}
+	return admins
+}
+
+// newUsersFromEnv keeps accounts next to the polls when they are stored in
+// files or Redis
+func newUsersFromEnv() (*Users, error) {
+	switch strings.ToLower(os.Getenv("STORAGE")) {
+	case "file":
+		return OpenUsers(dataDir() + "/users.json")
+	case "redis":
+		return OpenSharedUsers(redisClientFromEnv())
+	}
+	return NewUsers(), nil
+}
+
+// startSession signs user in by setting the session cookie
+func (app *App) startSession(w http.ResponseWriter, r *http.Request, user *User) {
+	payload := user.ID + ":" + strconv.FormatInt(time.Now().Add(sessionMaxAge).Unix(), 10)
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    payload + "." + app.sessions.sign(payload),
+		Path:     "/",
+		MaxAge:   int(sessionMaxAge.Seconds()),
+		HttpOnly: true,
+		Secure:   isSecureRequest(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// endSession signs the caller out
+func (app *App) endSession(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   isSecureRequest(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// sessionUser returns the account of a valid, unexpired session cookie
+func (app *App) sessionUser(r *http.Request) *User {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return nil
+	}
+	payload, ok := app.sessions.Verify(cookie.Value)
+	if !ok {
+		return nil
+	}
+	userID, expiry, _ := strings.Cut(payload, ":")
+	if unix, err := strconv.ParseInt(expiry, 10, 64); err != nil || time.Now().Unix() > unix {
+		return nil
+	}
+	user, _ := app.users.Get(userID)
+	return user
+}
+
+// withUser attaches the signed-in account to the request context. Changes
+// sent from another site's pages are treated as signed out, so a forged
+// form cannot act for the user.
+func (app *App) withUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		safe := r.Method == http.MethodGet || r.Method == http.MethodHead
+		if safe || sameOrigin(r) {
+			if user := app.sessionUser(r); user != nil {
+				r = r.WithContext(context.WithValue(r.Context(), userContextKey{}, user))
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// userFromRequest returns the account attached by withUser, or nil
+func userFromRequest(r *http.Request) *User {
+	user, _ := r.Context().Value(userContextKey{}).(*User)
+	return user
+}
+
+// ownerID returns the ID of the signed-in account, which owns the polls
+// the request creates
+func ownerID(r *http.Request) string {
+	if user := userFromRequest(r); user != nil {
+		return user.ID
+	}
+	return ""
+}
+
+// isAdmin reports whether the caller may manage every poll
+func (app *App) isAdmin(r *http.Request) bool {
+	if app.adminAuthorized(r) {
+		return true
+	}
+	user := userFromRequest(r)
+	return user != nil && app.adminUsers[user.Name]
+}
+
+// canManage reports whether the caller may change poll
+func (app *App) canManage(r *http.Request, poll *Poll) bool {
+	if app.isAdmin(r) {
+		return true
+	}
+	user := userFromRequest(r)
+	return user != nil && poll.OwnerID != "" && poll.OwnerID == user.ID
+}
+
+// checkManage returns ErrForbidden unless the caller may change the poll
+func (app *App) checkManage(r *http.Request, pollID string) error {
+	poll, err := app.store.Get(pollID)
+	if err != nil {
+		return err
+	}
+	if !app.canManage(r, poll) {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// withOwners fills in the owner names of polls for display
+func (app *App) withOwners(polls ...*Poll) {
+	for _, poll := range polls {
+		if poll.OwnerID != "" {
+			poll.OwnerName = app.users.Name(poll.OwnerID)
+		}
+	}
+}
+
+// RegisterHandler serves the registration form
+func (app *App) RegisterHandler(w http.ResponseWriter, r *http.Request) {
+	app.accountForm(w, r, "Create an account", func(name, password string) (*User, error) {
+		user, err := app.users.Register(name, password)
+		if err == nil {
+			log.Printf("Registered user %s", user.Name)
+		}
+		return user, err
+	})
+}
+
+// LoginHandler serves the sign-in form
+func (app *App) LoginHandler(w http.ResponseWriter, r *http.Request) {
+	app.accountForm(w, r, "Sign in", app.users.Authenticate)
+}
+
+// accountForm shows a name and password form and, on POST, signs in the
+// account returned by submit
+func (app *App) accountForm(w http.ResponseWriter, r *http.Request, title string, submit func(name, password string) (*User, error)) {
+	data := map[string]interface{}{"Title": title, "Action": r.URL.Path}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if !sameOrigin(r) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		user, err := submit(r.FormValue("name"), r.FormValue("password"))
+		if err == nil {
+			app.startSession(w, r, user)
+			http.Redirect(w, r, "/my", http.StatusSeeOther)
+			return
+		}
+		status, body := errorBody(err)
+		w.WriteHeader(status)
+		data["Error"] = body.Message
+		data["Name"] = r.FormValue("name")
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	tmpl := template.Must(template.New("account").Parse(accountTemplate))
+	tmpl.Execute(w, data)
+}
+
+// LogoutHandler signs the caller out
+func (app *App) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	app.endSession(w, r)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// MyPollsHandler serves /my, the signed-in user's polls, and the actions
+// under /my/polls/
+func (app *App) MyPollsHandler(w http.ResponseWriter, r *http.Request) {
+	user := userFromRequest(r)
+	if user == nil {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/my"), "/")
+	switch {
+	case path == "" && r.Method == http.MethodGet:
+		var polls []*Poll
+		for _, poll := range app.store.List() {
+			if poll.OwnerID == user.ID {
+				polls = append(polls, poll)
+			}
+		}
+		app.renderPollTable(w, r, "My polls", "/my", polls)
+	case strings.HasPrefix(path, "polls/") && r.Method == http.MethodPost:
+		pollID, action, _ := strings.Cut(strings.TrimPrefix(path, "polls/"), "/")
+		app.moderate(w, r, "/my", pollID, action)
+	case path == "" || strings.HasPrefix(path, "polls/"):
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+const accountTemplate = baseStyle + `
+    <div class="container mx-auto px-4 py-8 max-w-md">
+        <a href="/" class="inline-flex items-center text-indigo-600 hover:text-indigo-800 mb-6">
+            ← Back to polls
+        </a>
+
+        <div class="bg-white rounded-2xl shadow-xl p-8">
+            <h1 class="text-3xl font-bold text-gray-800 mb-6">{{.Title}}</h1>
+
+            {{if .Error}}
+            <p class="mb-4 px-4 py-3 rounded-xl bg-red-50 text-red-800 text-sm">{{.Error}}</p>
+            {{end}}
+
+            <form method="POST" action="{{.Action}}" class="space-y-6">
+                <div>
+                    <label for="name" class="block text-sm font-medium text-gray-700 mb-2">User name</label>
+                    <input type="text" id="name" name="name" value="{{.Name}}" required autocomplete="username"
+                        class="w-full px-4 py-3 border border-gray-300 rounded-xl focus:ring-2 focus:ring-indigo-500 focus:border-transparent">
+                </div>
+                <div>
+                    <label for="password" class="block text-sm font-medium text-gray-700 mb-2">Password</label>
+                    <input type="password" id="password" name="password" required
+                        autocomplete="{{if eq .Action "/register"}}new-password{{else}}current-password{{end}}"
+                        class="w-full px-4 py-3 border border-gray-300 rounded-xl focus:ring-2 focus:ring-indigo-500 focus:border-transparent">
+                </div>
+                <button type="submit"
+                    class="w-full px-6 py-3 bg-gradient-to-r from-indigo-600 to-purple-600 text-white font-semibold rounded-xl shadow-lg hover:shadow-xl transition-all duration-200">
+                    {{.Title}}
+                </button>
+            </form>
+
+            <p class="mt-6 text-sm text-gray-500 text-center">
+                {{if eq .Action "/register"}}Already registered? <a href="/login" class="text-indigo-600">Sign in</a>
+                {{else}}No account yet? <a href="/register" class="text-indigo-600">Register</a>{{end}}
+            </p>
+        </div>
+    </div>
+` + baseEnd
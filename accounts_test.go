@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func init() {
+	// Full-cost hashes make every registration take a noticeable time
+	passwordIterations = 1000
+}
+
+// registerUser creates an account with a fixed password
+func registerUser(t *testing.T, app *App, name string) *User {
+	t.Helper()
+	user, err := app.users.Register(name, "correct horse")
+	if err != nil {
+		t.Fatalf("Register %s: %v", name, err)
+	}
+	return user
+}
+
+// signInAccount attaches a session cookie for user to a request
+func signInAccount(app *App, req *http.Request, user *User) {
+	rec := httptest.NewRecorder()
+	app.startSession(rec, req, user)
+	for _, cookie := range rec.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+}
+
+// accountCall sends a JSON request signed in as user
+func accountCall(t *testing.T, app *App, user *User, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	signInAccount(app, req, user)
+	rec := httptest.NewRecorder()
+	app.Routes().ServeHTTP(rec, req)
+	return rec
+}
+
+// TestPasswordHash checks that hashes verify only the right password and
+// are salted.
+func TestPasswordHash(t *testing.T) {
+	hash, err := hashPassword("hunter22")
+	if err != nil || !checkPassword(hash, "hunter22") {
+		t.Errorf("Expected the password to match its hash, got %v", err)
+	}
+	if checkPassword(hash, "hunter23") || checkPassword("garbage", "hunter22") {
+		t.Error("Expected a wrong password or malformed hash to fail")
+	}
+	if again, _ := hashPassword("hunter22"); again == hash {
+		t.Error("Expected a new salt for every hash")
+	}
+}
+
+// TestPasswordHashEntropy fails the request, not the server, when no salt
+// can be generated.
+func TestPasswordHashEntropy(t *testing.T) {
+	app := NewApp()
+	failingRand(t)
+
+	if _, err := app.users.Authenticate("nobody", "hunter22"); !errors.Is(err, ErrEntropy) {
+		t.Errorf("Expected ErrEntropy signing in, got %v", err)
+	}
+	if _, err := app.users.Register("ada", "hunter22"); !errors.Is(err, ErrEntropy) {
+		t.Errorf("Expected ErrEntropy registering, got %v", err)
+	}
+	if err := applyVisibility(&Poll{}, PollInput{Visibility: "password", Password: "hunter22"}); !errors.Is(err, ErrEntropy) {
+		t.Errorf("Expected ErrEntropy protecting a poll, got %v", err)
+	}
+	rec := apiCall(t, app, http.MethodPost, "/api/polls", `{"question":"Q?","options":["A","B"],"visibility":"password","password":"hunter22"}`, "")
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("Expected 500, got %d", rec.Code)
+	}
+}
+
+// TestUsersRegister enforces unique names and password rules and keeps
+// accounts across restarts.
+func TestUsersRegister(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	users, err := OpenUsers(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := users.Register("Alice", "correct horse"); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	if _, err := users.Register("alice", "another one"); err == nil {
+		t.Error("Expected a name differing only in case to be taken")
+	}
+	if _, err := users.Register("bob", "short"); err == nil {
+		t.Error("Expected a short password to be rejected")
+	}
+	if _, err := users.Register("no spaces", "correct horse"); err == nil {
+		t.Error("Expected an invalid name to be rejected")
+	}
+
+	reopened, err := OpenUsers(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reopened.Authenticate("ALICE", "correct horse"); err != nil {
+		t.Errorf("Expected the saved account to sign in, got %v", err)
+	}
+	if _, err := reopened.Authenticate("alice", "wrong password"); err != ErrInvalidLogin {
+		t.Errorf("Expected ErrInvalidLogin, got %v", err)
+	}
+}
+
+// TestLoginFlow registers through the form, creates an owned poll and
+// lists it under /my.
+func TestLoginFlow(t *testing.T) {
+	app := NewApp()
+	form := url.Values{"name": {"carol"}, "password": {"correct horse"}}
+	req := httptest.NewRequest(http.MethodPost, "/register", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	app.Routes().ServeHTTP(rec, req)
+	if rec.Code != http.StatusSeeOther || len(rec.Result().Cookies()) == 0 {
+		t.Fatalf("Expected a session after registering, got %d", rec.Code)
+	}
+	session := rec.Result().Cookies()[0]
+
+	form = url.Values{"question": {"Lunch?"}, "options": {"Pizza\nSushi"}}
+	req = httptest.NewRequest(http.MethodPost, "/create", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(session)
+	app.Routes().ServeHTTP(httptest.NewRecorder(), req)
+	polls := app.store.List()
+	if len(polls) != 1 || polls[0].OwnerID == "" {
+		t.Fatalf("Expected an owned poll, got %+v", polls)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/my", nil)
+	req.AddCookie(session)
+	rec = httptest.NewRecorder()
+	app.Routes().ServeHTTP(rec, req)
+	if !strings.Contains(rec.Body.String(), "/my/polls/"+polls[0].ID+"/close") {
+		t.Errorf("Expected /my to list the poll")
+	}
+
+	form = url.Values{"name": {"carol"}, "password": {"wrong password"}}
+	req = httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec = httptest.NewRecorder()
+	app.Routes().ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized || len(rec.Result().Cookies()) != 0 {
+		t.Errorf("Expected a failed sign-in, got %d", rec.Code)
+	}
+}
+
+// TestPollOwnership lets only the owner or an admin change a poll.
+func TestPollOwnership(t *testing.T) {
+	app := NewApp()
+	owner := registerUser(t, app, "owner")
+	other := registerUser(t, app, "other")
+	boss := registerUser(t, app, "boss")
+	app.adminUsers = map[string]bool{"boss": true}
+
+	rec := accountCall(t, app, owner, http.MethodPost, "/api/polls", `{"question":"Q?","options":["A","B"]}`)
+	var poll Poll
+	json.NewDecoder(rec.Body).Decode(&poll)
+	if poll.OwnerID != owner.ID {
+		t.Fatalf("Expected the poll owned by the creator, got %q", poll.OwnerID)
+	}
+
+	if rec := apiCall(t, app, http.MethodPatch, "/api/polls/"+poll.ID, `{"question":"Mine?"}`, ""); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 signed out, got %d", rec.Code)
+	}
+	rec = accountCall(t, app, other, http.MethodDelete, "/api/polls/"+poll.ID, "")
+	if code := decodeAPIError(t, rec); rec.Code != http.StatusForbidden || code != "forbidden" {
+		t.Errorf("Expected forbidden for another user, got %d %s", rec.Code, code)
+	}
+	if rec := accountCall(t, app, owner, http.MethodPatch, "/api/polls/"+poll.ID, `{"question":"Ours?"}`); rec.Code != http.StatusOK {
+		t.Errorf("Expected the owner to edit, got %d", rec.Code)
+	}
+
+	// Other users cannot use the owner's actions under /my either
+	req := httptest.NewRequest(http.MethodPost, "/my/polls/"+poll.ID+"/close", nil)
+	signInAccount(app, req, other)
+	app.Routes().ServeHTTP(httptest.NewRecorder(), req)
+	if got, _ := app.store.Get(poll.ID); got.IsExpired() {
+		t.Error("Expected another user's close to be refused")
+	}
+
+	rec = accountCall(t, app, boss, http.MethodGet, "/admin", "")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "by owner") {
+		t.Errorf("Expected an admin user to see the dashboard, got %d", rec.Code)
+	}
+	if rec := accountCall(t, app, boss, http.MethodDelete, "/api/polls/"+poll.ID, ""); rec.Code != http.StatusNoContent {
+		t.Errorf("Expected an admin to delete, got %d", rec.Code)
+	}
+}
+
+// TestSessionCrossOrigin ignores the session on changes posted from
+// another site.
+func TestSessionCrossOrigin(t *testing.T) {
+	app := NewApp()
+	owner := registerUser(t, app, "owner")
+	poll := &Poll{Question: "Q?", Options: []Option{{ID: "a", Text: "A"}, {ID: "b", Text: "B"}}, OwnerID: owner.ID}
+	app.store.Create(poll)
+
+	req := httptest.NewRequest(http.MethodDelete, "/api/polls/"+poll.ID, nil)
+	req.Header.Set("Origin", "https://evil.example")
+	signInAccount(app, req, owner)
+	rec := httptest.NewRecorder()
+	app.Routes().ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("Expected 403, got %d", rec.Code)
+	}
+}
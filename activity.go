@@ -0,0 +1,325 @@
+// activity.go - Activity stream across all polls
+// /events and /ws stream what happens to every poll: creations, vote counts,
+// closings and deletions, each as a typed event. Vote counts and closings
+// are taken from the per-poll events on the message bus, so they arrive
+// throttled like everywhere else; creations and deletions are published to
+// the bus on their own. Filters narrow the stream:
+//   ?type=created,closed   only these event types
+//   ?poll=<id>,<id>        only these polls
+// Only public polls appear (see visibility.go), deletions included. The
+// stream has no event IDs and is not replayed after a reconnect; a client
+// that needs the full picture reloads /api/polls.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Activity event types
+const (
+	ActivityCreated = "created"
+	ActivityVotes   = "votes"
+	ActivityClosed  = "closed"
+	ActivityDeleted = "deleted"
+)
+
+// Activity is something that happened to a poll. Poll holds the poll's
+// state afterwards and is omitted for deletions. Votes events are also sent
+// when a poll is edited or opens.
+type Activity struct {
+	Type   string          `json:"type"`
+	PollID string          `json:"poll_id"`
+	Poll   json.RawMessage `json:"poll,omitempty"`
+}
+
+// ActivityFilter selects the activity a client receives. Empty sets match
+// everything.
+type ActivityFilter struct {
+	Types map[string]bool
+	Polls map[string]bool
+}
+
+// Match reports whether a passes the filter
+func (f ActivityFilter) Match(a Activity) bool {
+	return (len(f.Types) == 0 || f.Types[a.Type]) && (len(f.Polls) == 0 || f.Polls[a.PollID])
+}
+
+// parseActivityFilter reads the type and poll query parameters
+func parseActivityFilter(query url.Values) (ActivityFilter, error) {
+	filter := ActivityFilter{Types: listParam(query.Get("type")), Polls: listParam(query.Get("poll"))}
+	for t := range filter.Types {
+		switch t {
+		case ActivityCreated, ActivityVotes, ActivityClosed, ActivityDeleted:
+		default:
+			return filter, &ValidationError{Field: "type", Message: fmt.Sprintf("unknown activity type %q", t)}
+		}
+	}
+	return filter, nil
+}
+
+// listParam splits a comma-separated query value into a set
+func listParam(value string) map[string]bool {
+	set := make(map[string]bool)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			set[item] = true
+		}
+	}
+	return set
+}
+
+// activitySubscriber is one client of the activity stream
+type activitySubscriber struct {
+	subscriber
+	filter ActivityFilter
+}
+
+// ActivityFeed fans activity out to the clients of this node
+type ActivityFeed struct {
+	mu          sync.Mutex
+	subscribers map[chan Activity]*activitySubscriber
+	// hidden holds the last votes activity of each poll whose results are
+	// hidden; a repeat of it only says that someone voted
+	hidden map[string]string
+}
+
+// NewActivityFeed creates an empty activity feed
+func NewActivityFeed() *ActivityFeed {
+	return &ActivityFeed{subscribers: make(map[chan Activity]*activitySubscriber), hidden: make(map[string]string)}
+}
+
+// repeatsHidden reports whether a is a votes activity of a poll with
+// hidden results that repeats the last one, and remembers it
+func (f *ActivityFeed) repeatsHidden(a Activity, hidden bool) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !hidden || a.Type != ActivityVotes {
+		delete(f.hidden, a.PollID)
+		return false
+	}
+	if f.hidden[a.PollID] == string(a.Poll) {
+		return true
+	}
+	f.hidden[a.PollID] = string(a.Poll)
+	return false
+}
+
+// Subscribe registers a client that receives the activity matching filter
+func (f *ActivityFeed) Subscribe(filter ActivityFilter) chan Activity {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	ch := make(chan Activity, 32)
+	f.subscribers[ch] = &activitySubscriber{filter: filter}
+	return ch
+}
+
+// Unsubscribe removes a client. It is a no-op for evicted clients.
+func (f *ActivityFeed) Unsubscribe(ch chan Activity) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, exists := f.subscribers[ch]; exists {
+		delete(f.subscribers, ch)
+		close(ch)
+	}
+}
+
+// Publish sends a to every matching client. Activity is dropped for clients
+// that are behind, and clients stuck for subscriberStallTimeout are evicted.
+func (f *ActivityFeed) Publish(a Activity) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if a.Type == ActivityDeleted {
+		delete(f.hidden, a.PollID)
+	}
+	now := time.Now()
+	for ch, sub := range f.subscribers {
+		if !sub.filter.Match(a) {
+			continue
+		}
+		select {
+		case ch <- a:
+			sub.fullSince = time.Time{}
+		default:
+			if sub.stalled(now) {
+				delete(f.subscribers, ch)
+				close(ch)
+				log.Printf("Evicted stalled activity subscriber")
+			}
+		}
+	}
+}
+
+// activityFromEvent turns a poll event into activity. Only full updates
+// and closings are activity; replays and deltas are per-client.
+func activityFromEvent(pollID string, ev Event) (Activity, bool) {
+	a := Activity{PollID: pollID, Poll: json.RawMessage(ev.Data)}
+	switch ev.Type {
+	case "":
+		a.Type = ActivityVotes
+	case "closed":
+		a.Type = ActivityClosed
+	default:
+		return a, false
+	}
+	return a, true
+}
+
+// event encodes a for the SSE and WebSocket streams
+func (a Activity) event() Event {
+	data, _ := json.Marshal(a)
+	return Event{Type: a.Type, Data: string(data)}
+}
+
+// deliverEvent passes a poll event received from the bus to this node's
+// subscribers and activity stream
+func (app *App) deliverEvent(pollID string, ev Event) {
+	if !app.broadcaster.BroadcastEvent(pollID, ev) {
+		return
+	}
+	if ev.Type == "closed" {
+		app.questionClosed(pollID)
+	}
+	public := publicResultsEvent(ev)
+	if a, ok := activityFromEvent(pollID, public); ok && publicActivity(ev) && !app.activity.repeatsHidden(a, public.Data != ev.Data) {
+		app.activity.Publish(a)
+	}
+}
+
+// publishActivity sends activity that is not a poll event through the bus,
+// delivering it locally if the bus is unavailable
+func (app *App) publishActivity(a Activity) {
+	if err := app.bus.Publish(BusMessage{PollID: a.PollID, Activity: &a}); err != nil {
+		log.Printf("Failed to publish %s activity for poll %s: %v", a.Type, a.PollID, err)
+		app.activity.Publish(a)
+	}
+}
+
+// pollCreated announces a new poll to the activity stream and webhooks
+func (app *App) pollCreated(poll *Poll) {
+	if poll.IsPublic() {
+		data, _ := json.Marshal(poll)
+		app.publishActivity(Activity{Type: ActivityCreated, PollID: poll.ID, Poll: data})
+	}
+	app.webhooks.Notify(WebhookCreated, poll)
+}
+
+// pollDeleted announces a deleted poll
+func (app *App) pollDeleted(poll *Poll) {
+	if poll.IsPublic() {
+		app.publishActivity(Activity{Type: ActivityDeleted, PollID: poll.ID})
+	}
+}
+
+// ActivityHandler streams activity across all polls over SSE
+func (app *App) ActivityHandler(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseActivityFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, ok := w.(http.Flusher); !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	ch := app.activity.Subscribe(filter)
+	defer app.activity.Unsubscribe(ch)
+
+	conn := newSSEConn(w)
+	if err := conn.send(fmt.Sprintf("retry: %d\n\n", sseRetryInterval.Milliseconds())); err != nil {
+		app.reapConnection("activity SSE", "*", err)
+		return
+	}
+
+	heartbeat := time.NewTicker(sseHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		var err error
+		select {
+		case a, ok := <-ch:
+			if !ok {
+				return
+			}
+			err = conn.sendEvents([]Event{a.event()})
+		case <-heartbeat.C:
+			err = conn.send(": heartbeat\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		if err != nil {
+			app.reapConnection("activity SSE", "*", err)
+			return
+		}
+	}
+}
+
+// ActivityWebSocketHandler streams activity across all polls over a
+// WebSocket. Each message is an Activity object.
+func (app *App) ActivityWebSocketHandler(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseActivityFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ws, err := upgradeWebSocket(w, r)
+	if err != nil {
+		log.Printf("WebSocket upgrade failed for activity stream: %v", err)
+		return
+	}
+	defer ws.conn.Close()
+
+	ch := app.activity.Subscribe(filter)
+	defer app.activity.Unsubscribe(ch)
+
+	// The stream is one-way; reading only answers pings and closes
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			if _, err := ws.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+
+	for {
+		var err error
+		select {
+		case a, ok := <-ch:
+			if !ok {
+				ws.Close(wsCloseGoingAway, "subscriber stalled")
+				return
+			}
+			err = ws.writeEvents([]Event{a.event()})
+		case <-ping.C:
+			err = ws.writeFrame(wsOpPing, nil)
+		case <-done:
+			return
+		}
+		if err != nil {
+			app.reapConnection("activity WebSocket", "*", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// nextActivity waits for the next activity on ch
+func nextActivity(t *testing.T, ch chan Activity) Activity {
+	t.Helper()
+	select {
+	case a := <-ch:
+		return a
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for activity")
+		return Activity{}
+	}
+}
+
+// TestActivityFilter parses and applies the query filters.
+func TestActivityFilter(t *testing.T) {
+	filter, err := parseActivityFilter(url.Values{"type": {"created, closed"}, "poll": {"p1"}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !filter.Match(Activity{Type: ActivityCreated, PollID: "p1"}) {
+		t.Error("Expected created activity of p1 to match")
+	}
+	if filter.Match(Activity{Type: ActivityVotes, PollID: "p1"}) || filter.Match(Activity{Type: ActivityClosed, PollID: "p2"}) {
+		t.Error("Expected other types and polls to be filtered out")
+	}
+	if !(ActivityFilter{}).Match(Activity{Type: ActivityDeleted, PollID: "p3"}) {
+		t.Error("Expected an empty filter to match everything")
+	}
+	if _, err := parseActivityFilter(url.Values{"type": {"bogus"}}); err == nil {
+		t.Error("Expected an unknown type to be rejected")
+	}
+}
+
+// TestActivityAcrossNodes follows a poll's lifecycle on one node from the
+// activity feed of another.
+func TestActivityAcrossNodes(t *testing.T) {
+	bus := NewLocalBus()
+	store := NewStore()
+	nodeA := NewAppWithBus(store, bus)
+	nodeB := NewAppWithBus(store, bus)
+
+	ch := nodeB.activity.Subscribe(ActivityFilter{})
+	defer nodeB.activity.Unsubscribe(ch)
+
+	owner := registerUser(t, nodeA, "owner")
+	rec := accountCall(t, nodeA, owner, http.MethodPost, "/api/polls", `{"question":"Q?","options":["A","B"]}`)
+	var poll Poll
+	json.NewDecoder(rec.Body).Decode(&poll)
+	if a := nextActivity(t, ch); a.Type != ActivityCreated || a.PollID != poll.ID {
+		t.Fatalf("Expected created activity, got %+v", a)
+	}
+
+	apiCall(t, nodeA, http.MethodPost, "/api/polls/"+poll.ID+"/votes", `{"options":["`+poll.Options[0].ID+`"]}`, "v1")
+	a := nextActivity(t, ch)
+	var voted Poll
+	json.Unmarshal(a.Poll, &voted)
+	if a.Type != ActivityVotes || voted.Options[0].Votes != 1 {
+		t.Fatalf("Expected votes activity with the new count, got %+v", a)
+	}
+
+	accountCall(t, nodeA, owner, http.MethodDelete, "/api/polls/"+poll.ID, "")
+	if a := nextActivity(t, ch); a.Type != ActivityDeleted || a.Poll != nil {
+		t.Fatalf("Expected deleted activity without a poll, got %+v", a)
+	}
+}
+
+// TestActivityHandler streams filtered activity over SSE.
+func TestActivityHandler(t *testing.T) {
+	app := NewApp()
+	server := httptest.NewServer(app.Routes())
+	defer server.Close()
+
+	if resp, err := http.Get(server.URL + "/events?type=bogus"); err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for an unknown type, got %v %v", resp, err)
+	}
+
+	resp, err := http.Get(server.URL + "/events?type=deleted")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	br := bufio.NewReader(resp.Body)
+	if line, _ := br.ReadString('\n'); !strings.HasPrefix(line, "retry:") {
+		t.Fatalf("Expected retry hint, got %q", line)
+	}
+	waitFor(t, "activity subscriber", func() bool {
+		app.activity.mu.Lock()
+		defer app.activity.mu.Unlock()
+		return len(app.activity.subscribers) == 1
+	})
+
+	app.pollDeleted(&Poll{ID: "p0", Question: "Secret?", Visibility: VisibilityPrivate})
+	app.pollCreated(&Poll{ID: "p1", Question: "Q?"})
+	app.pollDeleted(&Poll{ID: "p1", Question: "Q?"})
+
+	var lines []string
+	for len(lines) < 2 {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if lines[0] != "event: deleted" || lines[1] != `data: {"type":"deleted","poll_id":"p1"}` {
+		t.Errorf("Expected only the public poll's deletion, got %q", lines)
+	}
+}
@@ -0,0 +1,280 @@
+// admin.go - Admin dashboard
+// /admin lists every poll with its votes and live viewers and lets an
+// administrator close a poll early, reopen it, reset its votes, edit its
+// question or delete it. Every change is broadcast like a vote, so open
+// poll pages update at once. The area uses HTTP Basic authentication with
+// the password in ADMIN_PASSWORD (any user name), or the accounts named in
+// ADMIN_USERS (see accounts.go), and is disabled when neither is set. The
+// same table and actions serve owners at /my. Actions are POSTed forms that
+// are only accepted from pages of this site.
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// ErrPollNotClosed is returned when reopening a poll that is not closed
+var ErrPollNotClosed = errors.New("poll is not closed")
+
+// closeNow closes a poll at now, freezing its results
+func (p *Poll) closeNow(now time.Time) error {
+	if p.StatusAt(now) == PollClosed {
+		return ErrPollExpired
+	}
+	if p.OpensAt.After(now) {
+		p.OpensAt = now
+	}
+	p.ExpiresAt = now
+	p.finalize(now)
+	return nil
+}
+
+// reopen opens a closed poll again, without an expiry
+func (p *Poll) reopen(now time.Time) error {
+	if p.StatusAt(now) != PollClosed {
+		return ErrPollNotClosed
+	}
+	p.ExpiresAt = time.Time{}
+	p.Final = nil
+	p.Status = PollOpen
+	return nil
+}
+
+// resetVotes discards all ballots. The final results of a closed poll are
+// reset too.
+func (p *Poll) resetVotes() {
+	p.Ballots = nil
+	p.Voters = nil
+	for i := range p.Options {
+		p.Options[i].Votes = 0
+	}
+	p.BallotCount = 0
+	p.Runoff = nil
+	p.recount()
+	if p.Final != nil {
+		p.finalize(p.Final.ClosedAt)
+	}
+}
+
+// deletePoll removes a poll and everything kept about it. It fails with
+// ErrPollNotFound if the poll does not exist.
+func (app *App) deletePoll(pollID string) error {
+	poll, err := app.store.Get(pollID)
+	if err != nil {
+		return err
+	}
+	if !app.store.Delete(pollID) {
+		return ErrPollNotFound
+	}
+	app.broadcaster.Forget(pollID)
+	app.coalescer.Forget(pollID)
+	app.pollDeleted(poll)
+	log.Printf("Deleted poll: %s", pollID)
+	return nil
+}
+
+// adminPasswordFromEnv reads ADMIN_PASSWORD
+func adminPasswordFromEnv() string {
+	return os.Getenv("ADMIN_PASSWORD")
+}
+
+// adminAuthorized checks the Basic authentication password of r
+func (app *App) adminAuthorized(r *http.Request) bool {
+	_, password, ok := r.BasicAuth()
+	if !ok || app.adminPassword == "" {
+		return false
+	}
+	// Comparing hashes keeps the comparison constant-time whatever the
+	// lengths
+	got := sha256.Sum256([]byte(password))
+	want := sha256.Sum256([]byte(app.adminPassword))
+	return subtle.ConstantTimeCompare(got[:], want[:]) == 1
+}
+
+// adminPollRow is one poll in the dashboard
+type adminPollRow struct {
+	*Poll
+	Status PollStatus
+}
+
+// AdminHandler serves /admin and the actions under /admin/polls/
+func (app *App) AdminHandler(w http.ResponseWriter, r *http.Request) {
+	if app.adminPassword == "" && len(app.adminUsers) == 0 {
+		http.Error(w, "The admin area is disabled; set ADMIN_PASSWORD or ADMIN_USERS to enable it", http.StatusNotFound)
+		return
+	}
+	if !app.isAdmin(r) {
+		if app.adminPassword == "" {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="QuickPoll admin", charset="UTF-8"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin"), "/")
+	switch {
+	case path == "" && r.Method == http.MethodGet:
+		app.renderPollTable(w, r, "Admin", "/admin", app.store.List())
+	case strings.HasPrefix(path, "polls/") && r.Method == http.MethodPost:
+		pollID, action, _ := strings.Cut(strings.TrimPrefix(path, "polls/"), "/")
+		app.moderate(w, r, "/admin", pollID, action)
+	case path == "" || strings.HasPrefix(path, "polls/"):
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// renderPollTable shows polls with their moderation actions, which are
+// posted to base/polls/{id}/{action}
+func (app *App) renderPollTable(w http.ResponseWriter, r *http.Request, title, base string, polls []*Poll) {
+	now := time.Now()
+	app.withViewers(polls...)
+	app.withOwners(polls...)
+	rows := make([]adminPollRow, len(polls))
+	for i, poll := range polls {
+		rows[i] = adminPollRow{Poll: poll, Status: poll.StatusAt(now)}
+	}
+
+	tmpl := template.Must(template.New("admin").Parse(adminTemplate))
+	tmpl.Execute(w, map[string]interface{}{
+		"Title":  title,
+		"Base":   base,
+		"Polls":  rows,
+		"Stats":  app.broadcaster.Stats(),
+		"Admin":  base == "/admin",
+		"Notice": r.URL.Query().Get("notice"),
+	})
+}
+
+// moderate applies one moderation action and returns to base
+func (app *App) moderate(w http.ResponseWriter, r *http.Request, base, pollID, action string) {
+	// Browsers send stored Basic credentials with any request, so a form
+	// on another site must not be able to trigger actions
+	if !sameOrigin(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	var poll *Poll
+	err := app.checkManage(r, pollID)
+	now := time.Now()
+	switch {
+	case err != nil:
+	case action == "close":
+		poll, err = app.store.Update(pollID, func(p *Poll) error { return p.closeNow(now) })
+	case action == "reopen":
+		poll, err = app.store.Update(pollID, func(p *Poll) error { return p.reopen(now) })
+	case action == "reset":
+		poll, err = app.store.Update(pollID, func(p *Poll) error {
+			p.resetVotes()
+			return nil
+		})
+	case action == "edit":
+		question := strings.TrimSpace(r.FormValue("question"))
+		poll, err = app.store.Update(pollID, func(p *Poll) error {
+			if question == "" {
+				return &ValidationError{Field: "question", Message: "Question is required"}
+			}
+			p.Question = question
+			return nil
+		})
+	case action == "delete":
+		err = app.deletePoll(pollID)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	notice := "Poll " + pollID + ": " + action + " done"
+	if err != nil {
+		notice = "Poll " + pollID + ": " + action + " failed: " + err.Error()
+	} else if poll != nil {
+		log.Printf("Moderation action %s on poll %s", action, pollID)
+		app.scheduler.Wake()
+		if action == "close" {
+			app.broadcastPollEvent(poll, "closed")
+			app.webhooks.Notify(WebhookClosed, poll)
+		} else {
+			app.broadcastPoll(poll)
+		}
+	}
+	http.Redirect(w, r, base+"?notice="+url.QueryEscape(notice), http.StatusSeeOther)
+}
+
+const adminTemplate = baseStyle + `
+    <div class="container mx-auto px-4 py-8 max-w-6xl">
+        <div class="flex justify-between items-center mb-6">
+            <h1 class="text-3xl font-bold text-gray-800">{{.Title}}</h1>
+            <a href="/" class="text-indigo-600 hover:text-indigo-800">← Back to polls</a>
+        </div>
+
+        {{if .Notice}}
+        <p class="mb-4 px-4 py-3 rounded-xl bg-indigo-50 text-indigo-800 text-sm">{{.Notice}}</p>
+        {{end}}
+
+        {{if .Admin}}
+        <p class="text-gray-500 mb-6">{{.Stats.Polls}} polls with live connections · {{.Stats.Subscribers}} connected · {{.Stats.Reaped}} connections reaped</p>
+        {{end}}
+
+        <div class="bg-white rounded-2xl shadow-xl overflow-x-auto">
+            <table class="w-full text-sm">
+                <thead class="bg-gray-50 text-left text-gray-600">
+                    <tr>
+                        <th class="px-4 py-3">Question</th>
+                        <th class="px-4 py-3">Status</th>
+                        <th class="px-4 py-3 text-right">Votes</th>
+                        <th class="px-4 py-3 text-right">Watching</th>
+                        <th class="px-4 py-3">Created</th>
+                        <th class="px-4 py-3">Actions</th>
+                    </tr>
+                </thead>
+                <tbody>
+                    {{$base := .Base}}
+                    {{range .Polls}}
+                    <tr class="border-t border-gray-100 align-top">
+                        <td class="px-4 py-3">
+                            <form method="POST" action="{{$base}}/polls/{{.ID}}/edit" class="flex space-x-2">
+                                <input type="text" name="question" value="{{.Question}}" required
+                                    class="flex-1 px-2 py-1 border border-gray-300 rounded-lg">
+                                <button type="submit" class="px-2 py-1 bg-gray-100 hover:bg-gray-200 rounded-lg">Save</button>
+                            </form>
+                            <a href="/poll/{{.ID}}" class="text-xs text-indigo-600">{{.ID}}</a>
+                            {{if .OwnerName}}<span class="text-xs text-gray-500">by {{.OwnerName}}</span>{{end}}
+                        </td>
+                        <td class="px-4 py-3">{{.Status}}</td>
+                        <td class="px-4 py-3 text-right">{{.TotalBallots}}</td>
+                        <td class="px-4 py-3 text-right">{{.Viewers}}</td>
+                        <td class="px-4 py-3 text-gray-500">{{.CreatedAt.Format "Jan 2, 15:04"}}</td>
+                        <td class="px-4 py-3">
+                            <div class="flex flex-wrap gap-2">
+                                {{if eq .Status "closed"}}
+                                <form method="POST" action="{{$base}}/polls/{{.ID}}/reopen"><button class="px-2 py-1 bg-green-100 text-green-800 rounded-lg">Reopen</button></form>
+                                {{else}}
+                                <form method="POST" action="{{$base}}/polls/{{.ID}}/close"><button class="px-2 py-1 bg-yellow-100 text-yellow-800 rounded-lg">Close</button></form>
+                                {{end}}
+                                <form method="POST" action="{{$base}}/polls/{{.ID}}/reset" onsubmit="return confirm('Discard all votes of this poll?')"><button class="px-2 py-1 bg-gray-100 text-gray-800 rounded-lg">Reset votes</button></form>
+                                <form method="POST" action="{{$base}}/polls/{{.ID}}/delete" onsubmit="return confirm('Delete this poll?')"><button class="px-2 py-1 bg-red-100 text-red-800 rounded-lg">Delete</button></form>
+                            </div>
+                        </td>
+                    </tr>
+                    {{else}}
+                    <tr><td colspan="6" class="px-4 py-6 text-center text-gray-500">No polls</td></tr>
+                    {{end}}
+                </tbody>
+            </table>
+        </div>
+    </div>
+` + baseEnd
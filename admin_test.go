@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// adminCall sends an authenticated request to the admin area
+func adminCall(t *testing.T, app *App, method, path string, form url.Values) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("admin", "secret")
+	rec := httptest.NewRecorder()
+	app.Routes().ServeHTTP(rec, req)
+	return rec
+}
+
+// lastEvent returns the type of the latest event broadcast for a poll
+func lastEvent(t *testing.T, app *App, pollID string) string {
+	t.Helper()
+	events := app.broadcaster.Since(pollID, 0)
+	if len(events) == 0 {
+		t.Fatal("Expected a broadcast")
+	}
+	return events[len(events)-1].Type
+}
+
+// TestAdminAuth disables the area without a password and asks for it.
+func TestAdminAuth(t *testing.T) {
+	app := NewApp()
+	if rec := adminCall(t, app, http.MethodGet, "/admin", nil); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 without ADMIN_PASSWORD, got %d", rec.Code)
+	}
+
+	app.adminPassword = "other"
+	rec := adminCall(t, app, http.MethodGet, "/admin", nil)
+	if rec.Code != http.StatusUnauthorized || rec.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("Expected a Basic challenge, got %d", rec.Code)
+	}
+
+	app.adminPassword = "secret"
+	poll := exportedPoll(t, app)
+	rec = adminCall(t, app, http.MethodGet, "/admin", nil)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "/admin/polls/"+poll.ID+"/close") {
+		t.Errorf("Expected the dashboard to list the poll, got %d", rec.Code)
+	}
+}
+
+// TestAdminActions closes, reopens, resets, edits and deletes a poll,
+// broadcasting each change.
+func TestAdminActions(t *testing.T) {
+	app := NewApp()
+	app.adminPassword = "secret"
+	poll := exportedPoll(t, app)
+	base := "/admin/polls/" + poll.ID + "/"
+
+	if rec := adminCall(t, app, http.MethodPost, base+"close", nil); rec.Code != http.StatusSeeOther {
+		t.Fatalf("Expected a redirect, got %d", rec.Code)
+	}
+	closed, _ := app.store.Get(poll.ID)
+	if !closed.IsExpired() || closed.Final == nil || lastEvent(t, app, poll.ID) != "closed" {
+		t.Fatalf("Expected a closed poll and event, got %+v", closed)
+	}
+
+	adminCall(t, app, http.MethodPost, base+"reopen", nil)
+	reopened, _ := app.store.Get(poll.ID)
+	if !reopened.IsOpen() || reopened.Final != nil {
+		t.Errorf("Expected the poll open again, got %+v", reopened)
+	}
+
+	adminCall(t, app, http.MethodPost, base+"reset", nil)
+	reset, _ := app.store.Get(poll.ID)
+	if reset.TotalBallots() != 0 || reset.Options[0].Votes != 0 || len(reset.Ballots) != 0 {
+		t.Errorf("Expected no votes after a reset, got %+v", reset)
+	}
+	if lastEvent(t, app, poll.ID) != "" {
+		t.Errorf("Expected an update broadcast after a reset")
+	}
+
+	adminCall(t, app, http.MethodPost, base+"edit", url.Values{"question": {"Best snack?"}})
+	rec := adminCall(t, app, http.MethodPost, base+"edit", url.Values{"question": {" "}})
+	if edited, _ := app.store.Get(poll.ID); edited.Question != "Best snack?" {
+		t.Errorf("Expected the edited question, got %q", edited.Question)
+	}
+	if !strings.Contains(rec.Header().Get("Location"), "failed") {
+		t.Errorf("Expected an empty question to fail, got %q", rec.Header().Get("Location"))
+	}
+
+	adminCall(t, app, http.MethodPost, base+"delete", nil)
+	if _, err := app.store.Get(poll.ID); !errors.Is(err, ErrPollNotFound) {
+		t.Error("Expected the poll deleted")
+	}
+}
+
+// TestAdminCrossOrigin refuses actions posted from another site.
+func TestAdminCrossOrigin(t *testing.T) {
+	app := NewApp()
+	app.adminPassword = "secret"
+	poll := exportedPoll(t, app)
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/polls/"+poll.ID+"/delete", nil)
+	req.Header.Set("Origin", "https://evil.example")
+	req.SetBasicAuth("admin", "secret")
+	rec := httptest.NewRecorder()
+	app.Routes().ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("Expected 403, got %d", rec.Code)
+	}
+	if _, err := app.store.Get(poll.ID); err != nil {
+		t.Error("Cross-origin request deleted the poll")
+	}
+}
@@ -0,0 +1,378 @@
+// api.go - JSON REST API
+// Routes:
+//   GET    /api/polls             list polls
+//   POST   /api/polls             create a poll
+//   POST   /api/polls/import      create polls in bulk (see import.go)
+//   GET    /api/polls/{id}        fetch a poll
+//   PATCH  /api/polls/{id}        edit question or expiry (owner or admin)
+//   DELETE /api/polls/{id}        delete a poll (owner or admin)
+//   POST   /api/polls/{id}/votes  cast or change the caller's vote
+//   DELETE /api/polls/{id}/votes  retract the caller's vote
+//   GET    /api/polls/{id}/export download results (see export.go)
+//   GET    /api/polls/{id}/voters who voted for what in an attributed poll
+//                                 (owner or admin, see attribution.go)
+// Clients can authenticate with an API key (see apikeys.go). Polls that are
+// not public need access (see visibility.go).
+// Errors are always JSON: {"error": {"code": "...", "message": "..."}}.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const maxAPIBodySize = 1 << 20
+
+// Request errors that are not produced by the store
+var (
+	ErrMethodNotAllowed = errors.New("method not allowed")
+	ErrVoterRequired    = errors.New("voter identity required; open the poll page first")
+)
+
+// apiError is the body of every API error response
+type apiError struct {
+	Error apiErrorBody `json:"error"`
+}
+
+type apiErrorBody struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Field   string `json:"field,omitempty"`
+}
+
+// pollPatch is the body of PATCH /api/polls/{id}. Absent fields are left
+// unchanged; null removes an opening time or expiry.
+type pollPatch struct {
+	Question  *string         `json:"question"`
+	OpensAt   json.RawMessage `json:"opens_at"`
+	ExpiresAt json.RawMessage `json:"expires_at"`
+}
+
+// voteRequest is the body of POST /api/polls/{id}/votes. For ranked polls
+// the options are in order of preference.
+type voteRequest struct {
+	Options []string `json:"options"`
+}
+
+// APIPollsHandler serves /api/polls
+func (app *App) APIPollsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		app.APIListHandler(w, r)
+	case http.MethodPost:
+		app.apiCreatePoll(w, r)
+	default:
+		writeErrorJSON(w, ErrMethodNotAllowed)
+	}
+}
+
+// APIPollHandler serves /api/polls/{id} and /api/polls/{id}/votes
+func (app *App) APIPollHandler(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/api/polls/")
+	pollID, sub, _ := strings.Cut(rest, "/")
+
+	switch {
+	case pollID == "":
+		writeAPIError(w, http.StatusNotFound, "not_found", "Not found")
+	case pollID == "import" && sub == "":
+		if r.Method != http.MethodPost {
+			writeErrorJSON(w, ErrMethodNotAllowed)
+			return
+		}
+		app.apiImport(w, r)
+	case sub == "" && r.Method == http.MethodGet:
+		poll, err := app.viewablePoll(r, pollID)
+		if err != nil {
+			writeErrorJSON(w, err)
+			return
+		}
+		app.withViewers(poll)
+		app.withResults(r, poll)
+		writeJSON(w, http.StatusOK, poll)
+	case sub == "" && r.Method == http.MethodPatch:
+		app.apiUpdatePoll(w, r, pollID)
+	case sub == "" && r.Method == http.MethodDelete:
+		if err := app.checkManage(r, pollID); err != nil {
+			writeErrorJSON(w, err)
+			return
+		}
+		if err := app.deletePoll(pollID); err != nil {
+			writeErrorJSON(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case sub == "votes" && r.Method == http.MethodPost:
+		app.apiVote(w, r, pollID)
+	case sub == "votes" && r.Method == http.MethodDelete:
+		app.apiRetract(w, r, pollID)
+	case sub == "export" && r.Method == http.MethodGet:
+		app.apiExport(w, r, pollID)
+	case sub == "voters" && r.Method == http.MethodGet:
+		app.apiVoters(w, r, pollID)
+	case sub == "" || sub == "votes" || sub == "export" || sub == "voters":
+		writeErrorJSON(w, ErrMethodNotAllowed)
+	default:
+		writeAPIError(w, http.StatusNotFound, "not_found", "Not found")
+	}
+}
+
+func (app *App) apiCreatePoll(w http.ResponseWriter, r *http.Request) {
+	var input PollInput
+	if !decodeJSON(w, r, &input) {
+		return
+	}
+
+	poll, err := buildPoll(input)
+	if err != nil {
+		writeErrorJSON(w, err)
+		return
+	}
+	poll.OwnerID = ownerID(r)
+	if err := app.store.Create(poll); err != nil {
+		writeErrorJSON(w, err)
+		return
+	}
+	log.Printf("Created poll via API: %s - %s", poll.ID, poll.Question)
+	app.pollCreated(poll)
+	app.scheduler.Wake()
+
+	w.Header().Set("Location", "/api/polls/"+poll.ID)
+	writeJSON(w, http.StatusCreated, poll)
+}
+
+func (app *App) apiUpdatePoll(w http.ResponseWriter, r *http.Request, pollID string) {
+	if err := app.checkManage(r, pollID); err != nil {
+		writeErrorJSON(w, err)
+		return
+	}
+	var patch pollPatch
+	if !decodeJSON(w, r, &patch) {
+		return
+	}
+
+	opensAt, err := parseTimePatch(patch.OpensAt, "opens_at")
+	if err != nil {
+		writeErrorJSON(w, err)
+		return
+	}
+	expiresAt, err := parseTimePatch(patch.ExpiresAt, "expires_at")
+	if err != nil {
+		writeErrorJSON(w, err)
+		return
+	}
+
+	poll, err := app.store.Update(pollID, func(p *Poll) error {
+		status := p.StatusAt(time.Now())
+		if status == PollClosed && (opensAt != nil || expiresAt != nil) {
+			return ErrPollExpired
+		}
+		if opensAt != nil {
+			if status != PollDraft {
+				return &ValidationError{Field: "opens_at", Message: "The opening time can only change before the poll opens"}
+			}
+			p.OpensAt = *opensAt
+		}
+		if patch.Question != nil {
+			question := strings.TrimSpace(*patch.Question)
+			if question == "" {
+				return &ValidationError{Field: "question", Message: "Question is required"}
+			}
+			p.Question = question
+		}
+		if expiresAt != nil {
+			p.ExpiresAt = *expiresAt
+		}
+		return validateSchedule(p.OpensAt, p.ExpiresAt)
+	})
+	if err != nil {
+		writeErrorJSON(w, err)
+		return
+	}
+	log.Printf("Updated poll via API: %s", pollID)
+	app.scheduler.Wake()
+
+	app.broadcastPoll(poll)
+	writeJSON(w, http.StatusOK, poll)
+}
+
+func (app *App) apiVote(w http.ResponseWriter, r *http.Request, pollID string) {
+	if _, err := app.viewablePoll(r, pollID); err != nil {
+		writeErrorJSON(w, err)
+		return
+	}
+	voterID, voterName, err := app.ballotIdentity(r, pollID)
+	if err != nil {
+		writeErrorJSON(w, err)
+		return
+	}
+
+	var req voteRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	poll, err := app.store.CastBallot(pollID, Ballot{VoterID: voterID, VoterName: voterName, Choices: req.Options})
+	if err != nil {
+		writeErrorJSON(w, err)
+		return
+	}
+	log.Printf("Vote recorded via API for poll %s, options %s", pollID, strings.Join(req.Options, ","))
+	app.notifyVote(poll)
+
+	app.broadcastPoll(poll)
+	writeJSON(w, http.StatusOK, app.resultsFor(r, poll))
+}
+
+func (app *App) apiRetract(w http.ResponseWriter, r *http.Request, pollID string) {
+	if _, err := app.viewablePoll(r, pollID); err != nil {
+		writeErrorJSON(w, err)
+		return
+	}
+	voterID, _, err := app.ballotIdentity(r, pollID)
+	if err != nil {
+		writeErrorJSON(w, err)
+		return
+	}
+
+	poll, err := app.store.RetractBallot(pollID, voterID)
+	if err != nil {
+		writeErrorJSON(w, err)
+		return
+	}
+	log.Printf("Vote retracted via API for poll %s", pollID)
+
+	app.broadcastPoll(poll)
+	writeJSON(w, http.StatusOK, app.resultsFor(r, poll))
+}
+
+// parseTimePatch reads an optional timestamp field of a patch. It returns
+// nil if the field was absent and the zero time if it was null.
+func parseTimePatch(raw json.RawMessage, field string) (*time.Time, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	t := &time.Time{}
+	if string(raw) != "null" {
+		if err := json.Unmarshal(raw, t); err != nil {
+			return nil, &ValidationError{Field: field, Message: field + " must be an RFC 3339 timestamp or null"}
+		}
+	}
+	return t, nil
+}
+
+// decodeJSON reads a JSON request body into v, answering with an error and
+// returning false if it cannot
+func decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAPIBodySize))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON body: "+err.Error())
+		return false
+	}
+	return true
+}
+
+// writeJSON writes v as a JSON response
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeAPIError writes a JSON error body
+func writeAPIError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, apiError{Error: apiErrorBody{Code: code, Message: message}})
+}
+
+// writeErrorJSON maps a store or validation error to a JSON error response
+func writeErrorJSON(w http.ResponseWriter, err error) {
+	status, body := errorBody(err)
+	writeJSON(w, status, apiError{Error: body})
+}
+
+// errorBody describes err for API clients
+func errorBody(err error) (int, apiErrorBody) {
+	status, code := errorStatus(err)
+	body := apiErrorBody{Code: code, Message: err.Error()}
+
+	var verr *ValidationError
+	if errors.As(err, &verr) {
+		body.Field = verr.Field
+	}
+	switch status {
+	case http.StatusInternalServerError:
+		log.Printf("Internal error: %v", err)
+		body.Message = "Internal server error"
+	case http.StatusServiceUnavailable:
+		log.Printf("Storage error: %v", err)
+		body.Message = "Storage unavailable; try again"
+	}
+	return status, body
+}
+
+// errorStatus returns the HTTP status and machine-readable code for err
+func errorStatus(err error) (int, string) {
+	var verr *ValidationError
+	switch {
+	case errors.As(err, &verr):
+		return http.StatusBadRequest, "validation_failed"
+	case errors.Is(err, ErrPollNotFound):
+		return http.StatusNotFound, "poll_not_found"
+	case errors.Is(err, ErrPollExpired):
+		return http.StatusConflict, "poll_closed"
+	case errors.Is(err, ErrPollNotOpen):
+		return http.StatusConflict, "poll_not_open"
+	case errors.Is(err, ErrOptionNotFound):
+		return http.StatusBadRequest, "option_not_found"
+	case errors.Is(err, ErrInvalidBallot):
+		return http.StatusBadRequest, "invalid_ballot"
+	case errors.Is(err, ErrNoBallot):
+		return http.StatusNotFound, "vote_not_found"
+	case errors.Is(err, ErrVoterRequired):
+		return http.StatusForbidden, "voter_required"
+	case errors.Is(err, ErrQuizNotFound):
+		return http.StatusNotFound, "quiz_not_found"
+	case errors.Is(err, ErrResultsHidden):
+		return http.StatusForbidden, "results_hidden"
+	case errors.Is(err, ErrAccountRequired):
+		return http.StatusUnauthorized, "account_required"
+	case errors.Is(err, ErrBallotFinal):
+		return http.StatusConflict, "ballot_final"
+	case errors.Is(err, ErrDuplicateID):
+		return http.StatusConflict, "duplicate_id"
+	case errors.Is(err, ErrConcurrentUpdate):
+		return http.StatusConflict, "conflict"
+	case errors.Is(err, ErrStoreUnavailable):
+		return http.StatusServiceUnavailable, "storage_unavailable"
+	case errors.Is(err, ErrPollLocked):
+		return http.StatusForbidden, "password_required"
+	case errors.Is(err, ErrForbidden), errors.Is(err, ErrGlobalWebhook):
+		return http.StatusForbidden, "forbidden"
+	case errors.Is(err, ErrInvalidLogin):
+		return http.StatusUnauthorized, "invalid_login"
+	case errors.Is(err, ErrInvalidAPIKey):
+		return http.StatusUnauthorized, "invalid_api_key"
+	case errors.Is(err, ErrSignInRequired), errors.Is(err, ErrWebhookSignIn):
+		return http.StatusUnauthorized, "sign_in_required"
+	case errors.Is(err, ErrInsufficientScope):
+		return http.StatusForbidden, "insufficient_scope"
+	case errors.Is(err, ErrAPIKeyNotFound):
+		return http.StatusNotFound, "api_key_not_found"
+	case errors.Is(err, ErrWebhookNotFound):
+		return http.StatusNotFound, "webhook_not_found"
+	case errors.Is(err, ErrMethodNotAllowed):
+		return http.StatusMethodNotAllowed, "method_not_allowed"
+	default:
+		return http.StatusInternalServerError, "internal_error"
+	}
+}
+
+// wantsJSON reports whether the client asked for a JSON response
+func wantsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// apiCall sends a JSON request through the full router
+func apiCall(t *testing.T, app *App, method, path, body string, voterID string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	if voterID != "" {
+		signIn(app, req, voterID)
+	}
+	rec := httptest.NewRecorder()
+	app.Routes().ServeHTTP(rec, req)
+	return rec
+}
+
+// decodeAPIError reads the machine-readable error code
+func decodeAPIError(t *testing.T, rec *httptest.ResponseRecorder) string {
+	t.Helper()
+	var body apiError
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatalf("Expected JSON error body, got %q", rec.Body.String())
+	}
+	return body.Error.Code
+}
+
+// TestAPIPollLifecycle walks a poll through create, get,
+// patch, vote and delete.
+func TestAPIPollLifecycle(t *testing.T) {
+	app := NewApp()
+	owner := registerUser(t, app, "owner")
+
+	rec := accountCall(t, app, owner, http.MethodPost, "/api/polls", `{"question":"Deploy day?","options":["Mon","Thu"]}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var created Poll
+	json.NewDecoder(rec.Body).Decode(&created)
+	if created.ID == "" || len(created.Options) != 2 || created.Type != PollSingle {
+		t.Fatalf("Unexpected poll: %+v", created)
+	}
+	if loc := rec.Header().Get("Location"); loc != "/api/polls/"+created.ID {
+		t.Errorf("Unexpected Location %q", loc)
+	}
+
+	rec = apiCall(t, app, http.MethodGet, "/api/polls/"+created.ID, "", "")
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected 200 on GET, got %d", rec.Code)
+	}
+
+	rec = accountCall(t, app, owner, http.MethodPatch, "/api/polls/"+created.ID, `{"question":"Release day?"}`)
+	var patched Poll
+	json.NewDecoder(rec.Body).Decode(&patched)
+	if rec.Code != http.StatusOK || patched.Question != "Release day?" {
+		t.Errorf("Expected renamed poll, got %d %+v", rec.Code, patched)
+	}
+
+	body := `{"options":["` + created.Options[1].ID + `"]}`
+	rec = apiCall(t, app, http.MethodPost, "/api/polls/"+created.ID+"/votes", body, "bot-1")
+	var voted Poll
+	json.NewDecoder(rec.Body).Decode(&voted)
+	if rec.Code != http.StatusOK || voted.Options[1].Votes != 1 {
+		t.Errorf("Expected recorded vote, got %d %+v", rec.Code, voted)
+	}
+
+	rec = accountCall(t, app, owner, http.MethodDelete, "/api/polls/"+created.ID, "")
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("Expected 204 on delete, got %d", rec.Code)
+	}
+	rec = apiCall(t, app, http.MethodGet, "/api/polls/"+created.ID, "", "")
+	if code := decodeAPIError(t, rec); rec.Code != http.StatusNotFound || code != "poll_not_found" {
+		t.Errorf("Expected poll_not_found after delete, got %d %s", rec.Code, code)
+	}
+}
+
+// TestAPIErrors checks that failures come back as JSON with
+// machine-readable codes.
+func TestAPIErrors(t *testing.T) {
+	app := NewApp()
+	owner := registerUser(t, app, "owner")
+	poll := &Poll{Question: "Q?", Options: []Option{{ID: "a", Text: "A"}, {ID: "b", Text: "B"}}, OwnerID: owner.ID}
+	app.store.Create(poll)
+
+	tests := []struct {
+		name, method, path, body, voter string
+		status                          int
+		code                            string
+	}{
+		{"one option", http.MethodPost, "/api/polls", `{"question":"Q","options":["only"]}`, "", 400, "validation_failed"},
+		{"bad json", http.MethodPost, "/api/polls", `{"question":`, "", 400, "invalid_json"},
+		{"unknown field", http.MethodPost, "/api/polls", `{"title":"Q"}`, "", 400, "invalid_json"},
+		{"not the owner", http.MethodPatch, "/api/polls/" + poll.ID, `{"question":"Mine?"}`, "", 403, "forbidden"},
+		{"no voter", http.MethodPost, "/api/polls/" + poll.ID + "/votes", `{"options":["a"]}`, "", 403, "voter_required"},
+		{"bad option", http.MethodPost, "/api/polls/" + poll.ID + "/votes", `{"options":["z"]}`, "v1", 400, "option_not_found"},
+		{"two options", http.MethodPost, "/api/polls/" + poll.ID + "/votes", `{"options":["a","b"]}`, "v1", 400, "invalid_ballot"},
+		{"nothing to retract", http.MethodDelete, "/api/polls/" + poll.ID + "/votes", "", "v1", 404, "vote_not_found"},
+		{"method", http.MethodPut, "/api/polls/" + poll.ID, "", "", 405, "method_not_allowed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := apiCall(t, app, tt.method, tt.path, tt.body, tt.voter)
+			if rec.Code != tt.status {
+				t.Errorf("Expected %d, got %d: %s", tt.status, rec.Code, rec.Body.String())
+			}
+			if code := decodeAPIError(t, rec); code != tt.code {
+				t.Errorf("Expected code %q, got %q", tt.code, code)
+			}
+		})
+	}
+
+	rec := accountCall(t, app, owner, http.MethodPatch, "/api/polls/"+poll.ID, `{"question":" "}`)
+	if code := decodeAPIError(t, rec); rec.Code != http.StatusBadRequest || code != "validation_failed" {
+		t.Errorf("Expected validation_failed for an empty question, got %d %s", rec.Code, code)
+	}
+}
+
+// TestVoteHandlerJSONErrors ensures the form endpoint answers
+// JSON clients with JSON errors.
+func TestVoteHandlerJSONErrors(t *testing.T) {
+	app := NewApp()
+
+	rec := apiCall(t, app, http.MethodPost, "/vote/missing", "", "v1")
+	if code := decodeAPIError(t, rec); rec.Code != http.StatusNotFound || code != "poll_not_found" {
+		t.Errorf("Expected poll_not_found, got %d %s", rec.Code, code)
+	}
+}
@@ -0,0 +1,398 @@
+// apikeys.go - API keys for programmatic access
+// Signed-in users create keys for bots and integrations at /api/keys. A key
+// acts as the user who created it, limited to the scopes it was given:
+//   polls:read       list, fetch and export polls
+//   polls:write      create, import, edit and delete polls
+//   votes:write      vote and retract votes, through the API or /vote/
+//   webhooks:manage  register and remove webhooks
+// Clients send it as "Authorization: Bearer qpk_...". Keys are stored as
+// SHA-256 hashes; the full key is only shown when it is created. Votes cast
+// with a key count as the user's vote.
+//
+//   GET    /api/keys       list the signed-in user's keys
+//   POST   /api/keys       create a key
+//   DELETE /api/keys/{id}  revoke a key
+//
+// Keys are managed with a session cookie only, so a leaked key cannot mint
+// more. With STORAGE=file, keys are saved to apikeys.json in the data
+// directory; with STORAGE=redis, every node shares them, and a revoked
+// key stops working on all of them at once.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// API key scopes
+const (
+	ScopePollsRead      = "polls:read"
+	ScopePollsWrite     = "polls:write"
+	ScopeVotesWrite     = "votes:write"
+	ScopeWebhooksManage = "webhooks:manage"
+)
+
+const apiKeyPrefix = "qpk_"
+
+// lastUsedResolution limits how often using a key rewrites the keys file
+const lastUsedResolution = time.Minute
+
+// API key errors
+var (
+	ErrInvalidAPIKey     = errors.New("invalid or revoked API key")
+	ErrInsufficientScope = errors.New("API key lacks the scope for this request")
+	ErrAPIKeyNotFound    = errors.New("API key not found")
+	ErrSignInRequired    = errors.New("sign in to manage API keys")
+)
+
+// APIKey is a credential of a user. Hash is the SHA-256 of the secret part
+// of the key.
+type APIKey struct {
+	ID         string    `json:"id"`
+	UserID     string    `json:"user_id"`
+	Name       string    `json:"name"`
+	Scopes     []string  `json:"scopes"`
+	Hash       string    `json:"hash,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at,omitempty"`
+	// Key is the full key, only filled in when it is created
+	Key string `json:"key,omitempty"`
+}
+
+// allows reports whether the key has scope
+func (k *APIKey) allows(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// redacted returns the key without its hash
+func (k *APIKey) redacted() *APIKey {
+	cp := *k
+	cp.Hash = ""
+	cp.Key = ""
+	return &cp
+}
+
+// APIKeys is the registry of API keys
+type APIKeys struct {
+	mu   sync.Mutex
+	keys map[string]*APIKey
+	path string // where keys are saved; empty keeps them in memory
+	// shared keeps the keys in Redis instead, for every node
+	shared *redisDoc
+}
+
+// NewAPIKeys creates an in-memory key registry
+func NewAPIKeys() *APIKeys {
+	return &APIKeys{keys: make(map[string]*APIKey)}
+}
+
+// OpenAPIKeys creates a registry saved to path, loading the keys already
+// there
+func OpenAPIKeys(path string) (*APIKeys, error) {
+	k := NewAPIKeys()
+	k.path = path
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return k, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := k.loadLocked(data); err != nil {
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+	return k, nil
+}
+
+// OpenSharedAPIKeys creates a registry kept in Redis, where every node
+// sees the same keys
+func OpenSharedAPIKeys(client *RedisClient) (*APIKeys, error) {
+	k := NewAPIKeys()
+	k.shared = newRedisDoc(client, "apikeys")
+	if err := k.shared.sync(k.loadLocked); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// loadLocked replaces the keys with saved ones. The caller must hold k.mu.
+func (k *APIKeys) loadLocked(data []byte) error {
+	var keys []*APIKey
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &keys); err != nil {
+			return err
+		}
+	}
+	k.keys = make(map[string]*APIKey, len(keys))
+	for _, key := range keys {
+		k.keys[key.ID] = key
+	}
+	return nil
+}
+
+// Create validates and adds a key for userID. The returned key carries
+// the full key, which is not kept.
+func (k *APIKeys) Create(userID, name string, scopes []string) (*APIKey, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, &ValidationError{Field: "name", Message: "Name is required"}
+	}
+	if len(scopes) == 0 {
+		return nil, &ValidationError{Field: "scopes", Message: "At least one scope is required"}
+	}
+	for _, s := range scopes {
+		switch s {
+		case ScopePollsRead, ScopePollsWrite, ScopeVotesWrite, ScopeWebhooksManage:
+		default:
+			return nil, &ValidationError{Field: "scopes", Message: fmt.Sprintf("Unknown scope %q", s)}
+		}
+	}
+
+	secret := make([]byte, 32)
+	if _, err := randRead(secret); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrEntropy, err)
+	}
+	encoded := hex.EncodeToString(secret)
+	id, err := NewID(KindAPIKey)
+	if err != nil {
+		return nil, err
+	}
+	key := &APIKey{
+		ID:        id,
+		UserID:    userID,
+		Name:      name,
+		Scopes:    scopes,
+		Hash:      hashAPIKeySecret(encoded),
+		CreatedAt: time.Now(),
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if err := k.shared.sync(k.loadLocked); err != nil {
+		return nil, err
+	}
+	k.keys[key.ID] = key
+	if err := k.saveLocked(); err != nil {
+		delete(k.keys, key.ID)
+		return nil, err
+	}
+	created := key.redacted()
+	created.Key = apiKeyPrefix + key.ID + "_" + encoded
+	return created, nil
+}
+
+// Authenticate returns the key matching token and records its use
+func (k *APIKeys) Authenticate(token string, now time.Time) (*APIKey, error) {
+	// The ID contains underscores but the hex secret does not
+	sep := strings.LastIndex(token, "_")
+	if !strings.HasPrefix(token, apiKeyPrefix) || sep < len(apiKeyPrefix) {
+		return nil, ErrInvalidAPIKey
+	}
+	id, secret := token[len(apiKeyPrefix):sep], token[sep+1:]
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	// A key revoked on another node must not keep working here
+	if err := k.shared.sync(k.loadLocked); err != nil {
+		return nil, err
+	}
+	key, exists := k.keys[id]
+	if !exists {
+		return nil, ErrInvalidAPIKey
+	}
+	if subtle.ConstantTimeCompare([]byte(hashAPIKeySecret(secret)), []byte(key.Hash)) != 1 {
+		return nil, ErrInvalidAPIKey
+	}
+	if now.Sub(key.LastUsedAt) >= lastUsedResolution {
+		key.LastUsedAt = now
+		if err := k.saveLocked(); err != nil {
+			log.Printf("Failed to save API key use: %v", err)
+		}
+	}
+	return key.redacted(), nil
+}
+
+// List returns the keys of userID without their hashes, oldest first
+func (k *APIKeys) List(userID string) []*APIKey {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if err := k.shared.sync(k.loadLocked); err != nil {
+		log.Printf("Failed to reload API keys: %v", err)
+	}
+
+	keys := make([]*APIKey, 0)
+	for _, key := range k.keys {
+		if key.UserID == userID {
+			keys = append(keys, key.redacted())
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.Before(keys[j].CreatedAt) })
+	return keys
+}
+
+// Revoke removes a key of userID
+func (k *APIKeys) Revoke(userID, id string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if err := k.shared.sync(k.loadLocked); err != nil {
+		return err
+	}
+	key, exists := k.keys[id]
+	if !exists || key.UserID != userID {
+		return ErrAPIKeyNotFound
+	}
+	delete(k.keys, id)
+	return k.saveLocked()
+}
+
+// saveLocked writes the keys file, or the keys in Redis. The caller must
+// hold k.mu.
+func (k *APIKeys) saveLocked() error {
+	if k.path == "" && k.shared == nil {
+		return nil
+	}
+	keys := make([]*APIKey, 0, len(k.keys))
+	for _, key := range k.keys {
+		keys = append(keys, key)
+	}
+	data, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	if k.shared != nil {
+		return k.shared.save(data)
+	}
+	return writeFileAtomic(k.path, data)
+}
+
+// hashAPIKeySecret hashes the secret part of a key. Keys are random and
+// long, so a fast hash is enough.
+func hashAPIKeySecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// newAPIKeysFromEnv keeps keys next to the polls when they are stored in
+// files or Redis
+func newAPIKeysFromEnv() (*APIKeys, error) {
+	switch strings.ToLower(os.Getenv("STORAGE")) {
+	case "file":
+		return OpenAPIKeys(dataDir() + "/apikeys.json")
+	case "redis":
+		return OpenSharedAPIKeys(redisClientFromEnv())
+	}
+	return NewAPIKeys(), nil
+}
+
+// requiredScope returns the scope an API key needs for r
+func requiredScope(r *http.Request) string {
+	path := r.URL.Path
+	switch {
+	case strings.HasPrefix(path, "/api/webhooks"):
+		return ScopeWebhooksManage
+	case strings.HasPrefix(path, "/vote/") || strings.HasSuffix(strings.TrimSuffix(path, "/"), "/votes"),
+		strings.HasPrefix(path, "/api/quizzes/") && strings.HasSuffix(strings.TrimSuffix(path, "/"), "/players"):
+		return ScopeVotesWrite
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		return ScopePollsRead
+	default:
+		return ScopePollsWrite
+	}
+}
+
+// withAPIKey authenticates requests carrying an API key and checks its
+// scope. The key's user replaces any from cookies, and with it the voter
+// identity (see voterFromRequest). Requests without a key pass through
+// unchanged.
+func (app *App) withAPIKey(next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			next(w, r)
+			return
+		}
+
+		key, err := app.apiKeys.Authenticate(strings.TrimSpace(token), time.Now())
+		if err != nil {
+			writeErrorJSON(w, err)
+			return
+		}
+		user, exists := app.users.Get(key.UserID)
+		if !exists {
+			writeErrorJSON(w, ErrInvalidAPIKey)
+			return
+		}
+		if !key.allows(requiredScope(r)) {
+			writeErrorJSON(w, ErrInsufficientScope)
+			return
+		}
+
+		next(w, r.WithContext(context.WithValue(r.Context(), userContextKey{}, user)))
+	})
+}
+
+// apiKeyRequest is the body of POST /api/keys
+type apiKeyRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+}
+
+// APIKeysHandler serves /api/keys and /api/keys/{id}
+func (app *App) APIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	user := userFromRequest(r)
+	if user == nil {
+		writeErrorJSON(w, ErrSignInRequired)
+		return
+	}
+
+	keyID := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/keys"), "/")
+	switch {
+	case keyID == "" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, app.apiKeys.List(user.ID))
+	case keyID == "" && r.Method == http.MethodPost:
+		var req apiKeyRequest
+		if !decodeJSON(w, r, &req) {
+			return
+		}
+		key, err := app.apiKeys.Create(user.ID, req.Name, req.Scopes)
+		if err != nil {
+			writeErrorJSON(w, err)
+			return
+		}
+		log.Printf("Created API key %s for user %s", key.ID, user.Name)
+
+		// The full key is only ever shown here
+		w.Header().Set("Location", "/api/keys/"+key.ID)
+		writeJSON(w, http.StatusCreated, key)
+	case keyID != "" && !strings.Contains(keyID, "/") && r.Method == http.MethodDelete:
+		if err := app.apiKeys.Revoke(user.ID, keyID); err != nil {
+			writeErrorJSON(w, err)
+			return
+		}
+		log.Printf("Revoked API key %s of user %s", keyID, user.Name)
+		w.WriteHeader(http.StatusNoContent)
+	case keyID == "" || !strings.Contains(keyID, "/"):
+		writeErrorJSON(w, ErrMethodNotAllowed)
+	default:
+		writeAPIError(w, http.StatusNotFound, "not_found", "Not found")
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// keyCall sends a JSON request authenticated with an API key
+func keyCall(t *testing.T, app *App, key, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+key)
+	rec := httptest.NewRecorder()
+	app.Routes().ServeHTTP(rec, req)
+	return rec
+}
+
+// createKey creates an API key through the API, signed in as user
+func createKey(t *testing.T, app *App, user *User, body string) APIKey {
+	t.Helper()
+	rec := accountCall(t, app, user, http.MethodPost, "/api/keys", body)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var key APIKey
+	json.NewDecoder(rec.Body).Decode(&key)
+	return key
+}
+
+// TestAPIKeysStore verifies keys are hashed at rest, record their use and
+// stop working when revoked.
+func TestAPIKeysStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "apikeys.json")
+	keys, err := OpenAPIKeys(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keys.Create("u1", "bot", []string{"polls:delete"}); err == nil {
+		t.Error("Expected an unknown scope to be rejected")
+	}
+	created, err := keys.Create("u1", "bot", []string{ScopePollsRead})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(created.Key, apiKeyPrefix) || created.Hash != "" {
+		t.Fatalf("Expected the full key without its hash, got %+v", created)
+	}
+
+	reopened, err := OpenAPIKeys(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := reopened.keys[created.ID]
+	if saved == nil || saved.Hash == "" || strings.Contains(saved.Hash, created.Key[len(apiKeyPrefix)+len(created.ID)+1:]) {
+		t.Fatalf("Expected only a hash saved, got %+v", saved)
+	}
+
+	now := time.Now()
+	if _, err := reopened.Authenticate(created.Key+"x", now); err != ErrInvalidAPIKey {
+		t.Errorf("Expected a tampered key to fail, got %v", err)
+	}
+	key, err := reopened.Authenticate(created.Key, now)
+	if err != nil || !key.LastUsedAt.Equal(now) {
+		t.Fatalf("Expected the use recorded, got %+v %v", key, err)
+	}
+
+	if err := reopened.Revoke("u2", created.ID); err != ErrAPIKeyNotFound {
+		t.Errorf("Expected another user's revoke to fail, got %v", err)
+	}
+	reopened.Revoke("u1", created.ID)
+	if _, err := reopened.Authenticate(created.Key, now); err != ErrInvalidAPIKey {
+		t.Errorf("Expected a revoked key to fail, got %v", err)
+	}
+}
+
+// TestAPIKeyScopes lets a key act as its user within its scopes only.
+func TestAPIKeyScopes(t *testing.T) {
+	app := NewApp()
+	owner := registerUser(t, app, "owner")
+	reader := createKey(t, app, owner, `{"name":"dashboard","scopes":["polls:read"]}`)
+	writer := createKey(t, app, owner, `{"name":"ci","scopes":["polls:write","votes:write"]}`)
+
+	if rec := keyCall(t, app, reader.Key, http.MethodGet, "/api/polls", ""); rec.Code != http.StatusOK {
+		t.Errorf("Expected a read key to list polls, got %d", rec.Code)
+	}
+	rec := keyCall(t, app, reader.Key, http.MethodPost, "/api/polls", `{"question":"Q?","options":["A","B"]}`)
+	if code := decodeAPIError(t, rec); rec.Code != http.StatusForbidden || code != "insufficient_scope" {
+		t.Errorf("Expected insufficient_scope, got %d %s", rec.Code, code)
+	}
+
+	rec = keyCall(t, app, writer.Key, http.MethodPost, "/api/polls", `{"question":"Q?","options":["A","B"]}`)
+	var poll Poll
+	json.NewDecoder(rec.Body).Decode(&poll)
+	if rec.Code != http.StatusCreated || poll.OwnerID != owner.ID {
+		t.Fatalf("Expected a poll owned by the key's user, got %d %+v", rec.Code, poll)
+	}
+
+	rec = keyCall(t, app, writer.Key, http.MethodPost, "/api/polls/"+poll.ID+"/votes", `{"options":["`+poll.Options[0].ID+`"]}`)
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected the key to vote, got %d: %s", rec.Code, rec.Body.String())
+	}
+	accountCall(t, app, owner, http.MethodPost, "/api/polls/"+poll.ID+"/votes", `{"options":["`+poll.Options[1].ID+`"]}`)
+	if got, _ := app.store.Get(poll.ID); len(got.Ballots) != 1 || got.Ballots[owner.ID].Choices[0] != poll.Options[1].ID {
+		t.Errorf("Expected the key and the browser to share the account's ballot, got %+v", got.Ballots)
+	}
+	if rec := keyCall(t, app, reader.Key, http.MethodPost, "/vote/"+poll.ID, ""); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected a read key not to vote through the form endpoint, got %d", rec.Code)
+	}
+
+	if rec := keyCall(t, app, "qpk_nope_nope", http.MethodGet, "/api/polls", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for an unknown key, got %d", rec.Code)
+	}
+}
+
+// TestAPIKeysHandler manages keys with a session and refuses keys.
+func TestAPIKeysHandler(t *testing.T) {
+	app := NewApp()
+	owner := registerUser(t, app, "owner")
+	key := createKey(t, app, owner, `{"name":"slack","scopes":["votes:write"]}`)
+
+	rec := accountCall(t, app, owner, http.MethodGet, "/api/keys", "")
+	var keys []APIKey
+	json.NewDecoder(rec.Body).Decode(&keys)
+	if len(keys) != 1 || keys[0].Name != "slack" || keys[0].Key != "" || keys[0].Hash != "" {
+		t.Fatalf("Expected the key listed without secrets, got %+v", keys)
+	}
+
+	rec = keyCall(t, app, key.Key, http.MethodPost, "/api/keys", `{"name":"more","scopes":["polls:write"]}`)
+	if code := decodeAPIError(t, rec); rec.Code != http.StatusUnauthorized || code != "sign_in_required" {
+		t.Errorf("Expected a key not to create keys, got %d %s", rec.Code, code)
+	}
+
+	if rec := accountCall(t, app, owner, http.MethodDelete, "/api/keys/"+key.ID, ""); rec.Code != http.StatusNoContent {
+		t.Errorf("Expected 204 on revoke, got %d", rec.Code)
+	}
+	if rec := keyCall(t, app, key.Key, http.MethodGet, "/api/polls", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a revoked key to be refused, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,46 @@
+// approval.go - Multiple-choice and approval voting
+// A multi-select ballot adds one vote to every option it selects, so
+// Option.Votes counts selections while BallotCount counts voters. Shares
+// can therefore be reported either per ballot or per selection.
+
+package main
+
+// IsMultiSelect reports whether one ballot may select several options
+func (p *Poll) IsMultiSelect() bool {
+	return p.Type == PollMultiple || p.Type == PollApproval
+}
+
+// ChoiceLimit returns how many options a single ballot may select
+func (p *Poll) ChoiceLimit() int {
+	switch p.Type {
+	case PollMultiple:
+		return p.MaxChoices
+	case PollApproval:
+		return len(p.Options)
+	default:
+		return 1
+	}
+}
+
+// TotalBallots returns the number of ballots cast. Single and ranked polls
+// count one vote per ballot, so this equals TotalVotes for them.
+func (p *Poll) TotalBallots() int {
+	if p.IsMultiSelect() {
+		return p.BallotCount
+	}
+	return p.TotalVotes()
+}
+
+// BallotPercentage returns the share of ballots that selected an option.
+// For multi-select polls the shares can add up to more than 100; use
+// VotePercentage for the share of all selections.
+func (p *Poll) BallotPercentage(optionID string) float64 {
+	total := p.TotalBallots()
+	if total == 0 {
+		return 0
+	}
+	if i := p.optionIndex(optionID); i >= 0 {
+		return float64(p.Options[i].Votes) / float64(total) * 100
+	}
+	return 0
+}
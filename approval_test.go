@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// TestMultiSelectBallot verifies that a ballot counts once per
+// selected option and once towards the ballot total.
+func TestMultiSelectBallot(t *testing.T) {
+	store := NewStore()
+	poll := &Poll{
+		Question:   "Which days?",
+		Type:       PollMultiple,
+		MaxChoices: 2,
+		Options:    []Option{{ID: "mon", Text: "Mon"}, {ID: "tue", Text: "Tue"}, {ID: "wed", Text: "Wed"}},
+	}
+	store.Create(poll)
+
+	store.CastBallot(poll.ID, Ballot{Choices: []string{"mon", "tue"}})
+	updated, err := store.CastBallot(poll.ID, Ballot{Choices: []string{"mon"}})
+	if err != nil {
+		t.Fatalf("CastBallot failed: %v", err)
+	}
+
+	if updated.TotalBallots() != 2 {
+		t.Errorf("Expected 2 ballots, got %d", updated.TotalBallots())
+	}
+	if updated.TotalVotes() != 3 {
+		t.Errorf("Expected 3 selections, got %d", updated.TotalVotes())
+	}
+
+	// Share of ballots vs share of selections
+	if got := updated.BallotPercentage("mon"); got != 100 {
+		t.Errorf("Expected mon on 100%% of ballots, got %.1f", got)
+	}
+	if got := updated.VotePercentage("tue"); got < 33.3 || got > 33.4 {
+		t.Errorf("Expected tue at 33.3%% of selections, got %.1f", got)
+	}
+}
+
+// TestMultiSelectLimits ensures over-limit, duplicate and unknown
+// selections are rejected without counting anything.
+func TestMultiSelectLimits(t *testing.T) {
+	store := NewStore()
+	poll := &Poll{
+		Question:   "Pick two",
+		Type:       PollMultiple,
+		MaxChoices: 2,
+		Options:    []Option{{ID: "a", Text: "A"}, {ID: "b", Text: "B"}, {ID: "c", Text: "C"}},
+	}
+	store.Create(poll)
+
+	for _, choices := range [][]string{{"a", "b", "c"}, {"a", "a"}, {"a", "missing"}} {
+		if _, err := store.CastBallot(poll.ID, Ballot{Choices: choices}); err == nil {
+			t.Errorf("Expected error for %v", choices)
+		}
+	}
+
+	got, _ := store.Get(poll.ID)
+	if got.TotalVotes() != 0 || got.TotalBallots() != 0 {
+		t.Error("Rejected ballots should not be counted")
+	}
+
+	// Approval polls accept every option
+	approval := &Poll{Question: "All?", Type: PollApproval, Options: poll.Options}
+	store.Create(approval)
+	if _, err := store.CastBallot(approval.ID, Ballot{Choices: []string{"a", "b", "c"}}); err != nil {
+		t.Errorf("Expected approval ballot to be accepted: %v", err)
+	}
+}
+
+// TestMultiSelectVoteHandler checks that several option values
+// in one submission are recorded as one ballot.
+func TestMultiSelectVoteHandler(t *testing.T) {
+	app := NewApp()
+	poll := &Poll{Question: "Days?", Type: PollApproval, Options: []Option{{ID: "a", Text: "A"}, {ID: "b", Text: "B"}}}
+	app.store.Create(poll)
+
+	form := url.Values{"option": {"a", "b"}}
+	req := httptest.NewRequest(http.MethodPost, "/vote/"+poll.ID, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	signIn(app, req, "voter-1")
+	rec := httptest.NewRecorder()
+	app.Routes().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("Expected redirect, got %d: %s", rec.Code, rec.Body.String())
+	}
+	got, _ := app.store.Get(poll.ID)
+	if got.BallotCount != 1 || got.Options[0].Votes != 1 || got.Options[1].Votes != 1 {
+		t.Errorf("Expected one ballot selecting both options, got %+v", got)
+	}
+
+	rec = httptest.NewRecorder()
+	app.PollHandler(rec, httptest.NewRequest(http.MethodGet, "/poll/"+poll.ID, nil))
+	if !strings.Contains(rec.Body.String(), "of selections") {
+		t.Error("Expected selection share on poll page")
+	}
+}
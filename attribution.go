@@ -0,0 +1,227 @@
+// attribution.go - Attributed and anonymous voting
+// By default ballots are keyed by the voter's browser and carry no names.
+// A poll can instead be created as:
+//   attributed  only signed-in users vote, each ballot carries the user's
+//               name, the poll page lists who chose each option and the
+//               owner can fetch who voted for what from
+//               GET /api/polls/{id}/voters
+//   anonymous   ballots are stored without voter, time or any other link
+//               to who cast them; the poll only remembers a hash of each
+//               voter's identity to refuse a second vote, so votes cannot
+//               be changed or retracted
+// The hashes are HMACs keyed with a salt of the poll, derived from a
+// secret key of the store that is kept apart from the polls (see
+// filestore.go), so the stored hashes cannot be matched to voter IDs and
+// differ between polls.
+// The setting is chosen when the poll is created and cannot change.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+)
+
+// voterKeySize is the size of the key the voter salts are derived from
+const voterKeySize = 32
+
+// Attribution says whether ballots carry the voter's identity
+type Attribution string
+
+// Attribution modes
+const (
+	AttributionDefault    Attribution = ""
+	AttributionAttributed Attribution = "attributed"
+	AttributionAnonymous  Attribution = "anonymous"
+)
+
+// Attribution errors
+var (
+	ErrAccountRequired = errors.New("sign in to vote in this poll; votes are shown with your name")
+	ErrBallotFinal     = errors.New("votes in anonymous polls cannot be changed or retracted")
+)
+
+// IsAttributed reports whether ballots carry voter names
+func (p *Poll) IsAttributed() bool {
+	return p.Attribution == AttributionAttributed
+}
+
+// IsAnonymous reports whether ballots are unlinked from voters
+func (p *Poll) IsAnonymous() bool {
+	return p.Attribution == AttributionAnonymous
+}
+
+// parseAttribution validates an attribution submitted by a client
+func parseAttribution(value string) (Attribution, error) {
+	switch Attribution(value) {
+	case AttributionDefault, AttributionAttributed, AttributionAnonymous:
+		return Attribution(value), nil
+	case "default":
+		return AttributionDefault, nil
+	default:
+		return "", fmt.Errorf("unknown attribution %q", value)
+	}
+}
+
+// newVoterKey returns a random key to derive voter salts from
+func newVoterKey() []byte {
+	key := make([]byte, voterKeySize)
+	if _, err := rand.Read(key); err != nil {
+		log.Fatalf("Failed to generate voter key: %v", err)
+	}
+	return key
+}
+
+// voterSalt derives the salt of a poll's voter hashes from a store's key
+func voterSalt(key []byte, pollID string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(pollID))
+	return mac.Sum(nil)
+}
+
+// voterHash is what anonymous polls remember of a voter
+func voterHash(salt []byte, voterID string) string {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write([]byte(voterID))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// HasVoted reports whether the voter has a ballot in the poll
+func (p *Poll) HasVoted(voterID string) bool {
+	if voterID == "" {
+		return false
+	}
+	if p.IsAnonymous() {
+		return p.Voters[voterHash(p.voterSalt, voterID)]
+	}
+	_, voted := p.Ballots[voterID]
+	return voted
+}
+
+// ballotKey applies the poll's attribution to a validated ballot and
+// returns the key to store it under
+func (p *Poll) ballotKey(ballot *Ballot) (string, error) {
+	switch p.Attribution {
+	case AttributionAttributed:
+		if ballot.VoterID == "" || ballot.VoterName == "" {
+			return "", ErrAccountRequired
+		}
+	case AttributionAnonymous:
+		hash := voterHash(p.voterSalt, ballot.VoterID)
+		if ballot.VoterID != "" && p.Voters[hash] {
+			return "", ErrBallotFinal
+		}
+		id, err := NewID(KindBallot)
+		if err != nil {
+			return "", err
+		}
+		if ballot.VoterID != "" {
+			if p.Voters == nil {
+				p.Voters = make(map[string]bool)
+			}
+			p.Voters[hash] = true
+		}
+		*ballot = Ballot{Choices: ballot.Choices}
+		return anonymousBallotPrefix + id, nil
+	default:
+		ballot.VoterName = ""
+	}
+	if ballot.VoterID == "" {
+		id, err := NewID(KindBallot)
+		if err != nil {
+			return "", err
+		}
+		return anonymousBallotPrefix + id, nil
+	}
+	return ballot.VoterID, nil
+}
+
+// updateRoster lists the names of the voters of each option of an
+// attributed poll; ranked ballots count for their first preference
+func (p *Poll) updateRoster() {
+	if !p.IsAttributed() {
+		return
+	}
+	p.Roster = make(map[string][]string)
+	for _, ballot := range p.Ballots.List() {
+		choices := ballot.Choices
+		if p.IsRanked() {
+			choices = choices[:1]
+		}
+		for _, id := range choices {
+			p.Roster[id] = append(p.Roster[id], ballot.VoterName)
+		}
+	}
+}
+
+// ballotIdentity returns the voter ID and name a request votes with in the
+// poll. Attributed polls need a signed-in account.
+func (app *App) ballotIdentity(r *http.Request, pollID string) (string, string, error) {
+	poll, err := app.store.Get(pollID)
+	if errors.Is(err, ErrPollNotFound) {
+		poll = &Poll{ID: pollID}
+	} else if err != nil {
+		return "", "", err
+	}
+	return pollIdentity(r, poll)
+}
+
+// pollIdentity is ballotIdentity for a poll the caller already has
+func pollIdentity(r *http.Request, poll *Poll) (string, string, error) {
+	if poll.IsAttributed() {
+		user := userFromRequest(r)
+		if user == nil {
+			return "", "", ErrAccountRequired
+		}
+		return user.ID, user.Name, nil
+	}
+	voterID := voterFromRequest(r)
+	if voterID == "" {
+		return "", "", ErrVoterRequired
+	}
+	return voterID, "", nil
+}
+
+// RosterEntry is one ballot of an attributed poll
+type RosterEntry struct {
+	Name    string   `json:"name"`
+	Choices []string `json:"choices"`
+	Texts   []string `json:"texts"`
+	CastAt  string   `json:"cast_at"`
+}
+
+// apiVoters serves GET /api/polls/{id}/voters, the ballots of an
+// attributed poll by voter, for its owner and admins
+func (app *App) apiVoters(w http.ResponseWriter, r *http.Request, pollID string) {
+	if err := app.checkManage(r, pollID); err != nil {
+		writeErrorJSON(w, err)
+		return
+	}
+	poll, err := app.store.Get(pollID)
+	if err != nil {
+		writeErrorJSON(w, err)
+		return
+	}
+	if !poll.IsAttributed() {
+		writeErrorJSON(w, &ValidationError{Field: "attribution", Message: "Only attributed polls record who voted"})
+		return
+	}
+
+	roster := make([]RosterEntry, 0, len(poll.Ballots))
+	for _, ballot := range poll.Ballots.List() {
+		texts := make([]string, len(ballot.Choices))
+		for i, id := range ballot.Choices {
+			texts[i] = optionText(poll, id)
+		}
+		roster = append(roster, RosterEntry{Name: ballot.VoterName, Choices: ballot.Choices, Texts: texts, CastAt: exportTime(ballot.CastAt)})
+	}
+	sort.SliceStable(roster, func(i, j int) bool { return roster[i].Name < roster[j].Name })
+	writeJSON(w, http.StatusOK, roster)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestBuildPollAttribution validates the attribution of new polls.
+func TestBuildPollAttribution(t *testing.T) {
+	for _, value := range []string{"", "attributed", "anonymous"} {
+		poll, err := buildPoll(PollInput{Question: "Q?", Options: []string{"A", "B"}, Attribution: value})
+		if err != nil || string(poll.Attribution) != value {
+			t.Errorf("Expected attribution %q, got %+v %v", value, poll, err)
+		}
+	}
+	if _, err := buildPoll(PollInput{Question: "Q?", Options: []string{"A", "B"}, Attribution: "secret"}); err == nil {
+		t.Error("Expected an unknown attribution to be rejected")
+	}
+}
+
+// TestAttributedVoting records who voted and shows it to the owner.
+func TestAttributedVoting(t *testing.T) {
+	app := NewApp()
+	owner := registerUser(t, app, "owner")
+	alice := registerUser(t, app, "alice")
+
+	rec := accountCall(t, app, owner, http.MethodPost, "/api/polls", `{"question":"Lunch?","options":["Pizza","Sushi"],"attribution":"attributed"}`)
+	var poll Poll
+	json.NewDecoder(rec.Body).Decode(&poll)
+	pizza := poll.Options[0].ID
+	votePath := "/api/polls/" + poll.ID + "/votes"
+
+	rec = apiCall(t, app, http.MethodPost, votePath, `{"options":["`+pizza+`"]}`, "v1")
+	if rec.Code != http.StatusUnauthorized || decodeAPIError(t, rec) != "account_required" {
+		t.Fatalf("Expected votes without an account refused, got %d", rec.Code)
+	}
+
+	rec = accountCall(t, app, alice, http.MethodPost, votePath, `{"options":["`+pizza+`"]}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected alice's vote accepted, got %d: %s", rec.Code, rec.Body.String())
+	}
+	json.NewDecoder(rec.Body).Decode(&poll)
+	if names := poll.Roster[pizza]; len(names) != 1 || names[0] != "alice" {
+		t.Errorf("Expected alice on the roster, got %v", poll.Roster)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/poll/"+poll.ID, nil)
+	rec = httptest.NewRecorder()
+	app.Routes().ServeHTTP(rec, req)
+	if !strings.Contains(rec.Body.String(), "alice") {
+		t.Error("Expected the poll page to show voter names")
+	}
+
+	if rec := accountCall(t, app, alice, http.MethodGet, "/api/polls/"+poll.ID+"/voters", ""); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected voters hidden from other users, got %d", rec.Code)
+	}
+	rec = accountCall(t, app, owner, http.MethodGet, "/api/polls/"+poll.ID+"/voters", "")
+	var roster []RosterEntry
+	json.NewDecoder(rec.Body).Decode(&roster)
+	if len(roster) != 1 || roster[0].Name != "alice" || roster[0].Texts[0] != "Pizza" {
+		t.Errorf("Expected alice's ballot for the owner, got %+v", roster)
+	}
+
+	rec = accountCall(t, app, alice, http.MethodDelete, votePath, "")
+	var retracted Poll
+	json.NewDecoder(rec.Body).Decode(&retracted)
+	if rec.Code != http.StatusOK || len(retracted.Roster[pizza]) != 0 {
+		t.Errorf("Expected the retraction to leave the roster, got %d %v", rec.Code, retracted.Roster)
+	}
+}
+
+// TestAnonymousVoting keeps only counts and refuses a second vote.
+func TestAnonymousVoting(t *testing.T) {
+	app := NewApp()
+	owner := registerUser(t, app, "owner")
+	rec := accountCall(t, app, owner, http.MethodPost, "/api/polls", `{"question":"Raise?","options":["Yes","No"],"attribution":"anonymous"}`)
+	var poll Poll
+	json.NewDecoder(rec.Body).Decode(&poll)
+	yes := poll.Options[0].ID
+	votePath := "/api/polls/" + poll.ID + "/votes"
+
+	if rec := apiCall(t, app, http.MethodPost, votePath, `{"options":["`+yes+`"]}`, "v1"); rec.Code != http.StatusOK {
+		t.Fatalf("Expected the vote accepted, got %d", rec.Code)
+	}
+	rec = apiCall(t, app, http.MethodPost, votePath, `{"options":["`+poll.Options[1].ID+`"]}`, "v1")
+	if rec.Code != http.StatusConflict || decodeAPIError(t, rec) != "ballot_final" {
+		t.Errorf("Expected a second vote refused, got %d", rec.Code)
+	}
+	if rec := apiCall(t, app, http.MethodDelete, votePath, "", "v1"); rec.Code != http.StatusConflict {
+		t.Errorf("Expected a retraction refused, got %d", rec.Code)
+	}
+
+	stored, _ := app.store.Get(poll.ID)
+	if stored.Options[0].Votes != 1 || !stored.HasVoted("v1") {
+		t.Fatalf("Expected one counted vote, got %+v", stored.Options)
+	}
+	for key, ballot := range stored.Ballots {
+		if strings.Contains(key, "v1") || ballot.VoterID != "" || !ballot.CastAt.IsZero() {
+			t.Errorf("Expected an unlinked ballot, got %q %+v", key, ballot)
+		}
+	}
+
+	rec = accountCall(t, app, owner, http.MethodGet, "/api/polls/"+poll.ID+"/export?format=jsonl", "")
+	if strings.Contains(rec.Body.String(), "v1") {
+		t.Errorf("Expected no voter in the export, got %s", rec.Body.String())
+	}
+}
+
+// TestVoterHashes salts the voter hashes of every poll differently.
+func TestVoterHashes(t *testing.T) {
+	store := NewStore()
+	var hashes []string
+	for i := 0; i < 2; i++ {
+		poll, _ := buildPoll(PollInput{Question: "Raise?", Options: []string{"Yes", "No"}, Attribution: "anonymous"})
+		store.Create(poll)
+		voted, err := store.CastBallot(poll.ID, Ballot{VoterID: "v1", Choices: []string{poll.Options[0].ID}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for hash := range voted.Voters {
+			hashes = append(hashes, hash)
+		}
+	}
+	plain := sha256.Sum256([]byte("v1"))
+	if len(hashes) != 2 || hashes[0] == hashes[1] || hashes[0] == hex.EncodeToString(plain[:]) {
+		t.Errorf("Expected a differently salted hash per poll, got %v", hashes)
+	}
+}
+
+// TestFileStoreAnonymousBallots keeps voters out of the journal of
+// anonymous polls and still refuses second votes after a restart.
+func TestFileStoreAnonymousBallots(t *testing.T) {
+	dir := t.TempDir()
+	fs, err := OpenFileStore(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	poll, _ := buildPoll(PollInput{Question: "Raise?", Options: []string{"Yes", "No"}, Attribution: "anonymous"})
+	fs.Create(poll)
+	if _, err := fs.CastBallot(poll.ID, Ballot{VoterID: "voter-secret", Choices: []string{poll.Options[0].ID}, CastAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := fs.CastBallot(poll.ID, Ballot{VoterID: "voter-other", Choices: []string{poll.Options[1].ID}}); err != nil {
+		t.Fatal(err)
+	}
+
+	plain := sha256.Sum256([]byte("voter-secret"))
+	ReadJournal(filepath.Join(dir, journalFileName), func(payload []byte) error {
+		var rec journalRecord
+		json.Unmarshal(payload, &rec)
+		if rec.Op == "vote" && (rec.Voter != "" || rec.At != nil || rec.CastAt != nil || rec.Poll != nil || rec.VoterHash == "") {
+			t.Errorf("Expected only a hash and choices, got %s", payload)
+		}
+		if strings.Contains(string(payload), "voter-secret") || strings.Contains(string(payload), hex.EncodeToString(plain[:])) {
+			t.Errorf("Expected the journal to leave out the voter, got %s", payload)
+		}
+		return nil
+	})
+	if info, err := os.Stat(filepath.Join(dir, voterKeyFileName)); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("Expected a private voter key, got %v %v", info, err)
+	}
+
+	// A crash before the snapshot still keeps the voter from voting again
+	fs.journal.Close()
+	fs, err = OpenFileStore(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := fs.Get(poll.ID); got.TotalBallots() != 2 || !got.HasVoted("voter-secret") {
+		t.Errorf("Expected both ballots replayed, got %+v", got)
+	}
+
+	fs.Close()
+	fs, err = OpenFileStore(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	if _, err := fs.CastBallot(poll.ID, Ballot{VoterID: "voter-secret", Choices: []string{poll.Options[1].ID}}); err != ErrBallotFinal {
+		t.Errorf("Expected ErrBallotFinal after reopening, got %v", err)
+	}
+}
@@ -0,0 +1,161 @@
+// ballots.go - Ballot validation, counting and replacement
+// Every ballot is kept in the poll's BallotBox keyed by voter, so a second
+// submission from the same voter replaces the first instead of adding to
+// it; anonymous polls refuse it instead (see attribution.go). Counts on the
+// options are adjusted incrementally; ranked polls also recount their
+// runoff.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// anonymousBallotPrefix marks ballot keys for submissions without a voter
+const anonymousBallotPrefix = "anon-"
+
+// BallotBox holds a poll's ballots keyed by voter ID
+type BallotBox map[string]Ballot
+
+// List returns the ballots ordered by the time they were cast
+func (box BallotBox) List() []Ballot {
+	list := make([]Ballot, 0, len(box))
+	for _, b := range box {
+		list = append(list, b)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CastAt.Before(list[j].CastAt)
+	})
+	return list
+}
+
+// BallotOf returns the ballot cast by a voter, if any
+func (p *Poll) BallotOf(voterID string) (Ballot, bool) {
+	if voterID == "" {
+		return Ballot{}, false
+	}
+	b, ok := p.Ballots[voterID]
+	return b, ok
+}
+
+// addBallot validates a ballot and counts it, replacing any earlier ballot
+// from the same voter
+func (p *Poll) addBallot(ballot Ballot) error {
+	_, _, err := p.castBallot(ballot)
+	return err
+}
+
+// castBallot is addBallot, returning the key the ballot is stored under
+// and the ballot as stored
+func (p *Poll) castBallot(ballot Ballot) (string, Ballot, error) {
+	if err := p.checkOpen(); err != nil {
+		return "", Ballot{}, err
+	}
+	if err := p.validateChoices(ballot.Choices); err != nil {
+		return "", Ballot{}, err
+	}
+	if ballot.CastAt.IsZero() {
+		ballot.CastAt = time.Now()
+	}
+
+	key, err := p.ballotKey(&ballot)
+	if err != nil {
+		return "", Ballot{}, err
+	}
+	p.putBallot(key, ballot)
+	return key, ballot, nil
+}
+
+// putBallot stores a validated ballot under key and counts it, replacing
+// the ballot stored there
+func (p *Poll) putBallot(key string, ballot Ballot) {
+	if old, exists := p.Ballots[key]; exists {
+		p.countBallot(old, -1)
+	}
+	if p.Ballots == nil {
+		p.Ballots = make(BallotBox)
+	}
+	p.Ballots[key] = ballot
+	p.countBallot(ballot, 1)
+	p.recount()
+	p.Version++
+}
+
+// retractBallot removes a voter's ballot and its votes
+func (p *Poll) retractBallot(voterID string) error {
+	if err := p.checkOpen(); err != nil {
+		return err
+	}
+	if p.IsAnonymous() {
+		return ErrBallotFinal
+	}
+	if _, exists := p.BallotOf(voterID); !exists {
+		return ErrNoBallot
+	}
+	p.removeBallot(voterID)
+	return nil
+}
+
+// removeBallot uncounts and removes the ballot stored under key, if any
+func (p *Poll) removeBallot(key string) {
+	old, exists := p.Ballots[key]
+	if !exists {
+		return
+	}
+	delete(p.Ballots, key)
+	p.countBallot(old, -1)
+	p.recount()
+	p.Version++
+}
+
+// validateChoices checks a ballot against the poll type without changing
+// anything
+func (p *Poll) validateChoices(choices []string) error {
+	if len(choices) == 0 {
+		return fmt.Errorf("%w: option is required", ErrInvalidBallot)
+	}
+	if !p.IsRanked() && len(choices) > p.ChoiceLimit() {
+		if p.ChoiceLimit() == 1 {
+			return fmt.Errorf("%w: only one option may be chosen", ErrInvalidBallot)
+		}
+		return fmt.Errorf("%w: at most %d options may be selected", ErrInvalidBallot, p.ChoiceLimit())
+	}
+
+	seen := make(map[string]bool, len(choices))
+	for _, id := range choices {
+		if p.optionIndex(id) < 0 {
+			return ErrOptionNotFound
+		}
+		if seen[id] {
+			return fmt.Errorf("%w: option chosen more than once", ErrInvalidBallot)
+		}
+		seen[id] = true
+	}
+	return nil
+}
+
+// countBallot adds (delta 1) or removes (delta -1) a validated ballot's
+// votes. Ranked ballots count for their first preference only.
+func (p *Poll) countBallot(b Ballot, delta int) {
+	switch {
+	case p.IsRanked():
+		p.Options[p.optionIndex(b.Choices[0])].Votes += delta
+	case p.IsMultiSelect():
+		for _, id := range b.Choices {
+			p.Options[p.optionIndex(id)].Votes += delta
+		}
+		p.BallotCount += delta
+	default:
+		p.Options[p.optionIndex(b.Choices[0])].Votes += delta
+	}
+}
+
+// recount refreshes results derived from the full set of ballots
+func (p *Poll) recount() {
+	if p.IsRanked() {
+		p.Runoff = computeRunoff(p.Options, p.Ballots.List())
+	}
+	p.updateRoster()
+}
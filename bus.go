@@ -0,0 +1,110 @@
+// bus.go - Message bus between nodes
+// Poll events are published to a MessageBus, and every node's Broadcaster
+// consumes them from it, so a vote on one replica reaches the SSE and
+// WebSocket clients of all replicas. LocalBus delivers within the process
+// (one node); RedisBus uses Redis pub/sub. Event IDs are poll versions, so
+// a message delivered twice is dropped as stale by the Broadcaster. That
+// only holds while versions are unique across nodes, so a Redis bus needs
+// the shared store of redisstore.go.
+
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+// BusMessage is an event for one poll as sent between nodes. Instead of an
+// event it may carry a node's viewer count for the poll (Presence) or
+// activity that is not a poll event (Activity).
+type BusMessage struct {
+	PollID   string          `json:"poll_id"`
+	Event    Event           `json:"event"`
+	Presence *PresenceReport `json:"presence,omitempty"`
+	Activity *Activity       `json:"activity,omitempty"`
+}
+
+// MessageBus carries poll events to every node
+type MessageBus interface {
+	// Publish sends a message to all subscribers, including this node
+	Publish(msg BusMessage) error
+	// Subscribe registers fn to receive every published message
+	Subscribe(fn func(BusMessage))
+	Close() error
+}
+
+// newNodeID names this process on the bus. It runs once at startup, where
+// a system without randomness cannot serve anything.
+func newNodeID() string {
+	id, err := NewID(KindNode)
+	if err != nil {
+		log.Fatalf("Failed to generate node ID: %v", err)
+	}
+	return id
+}
+
+// LocalBus delivers messages synchronously to subscribers in the same
+// process
+type LocalBus struct {
+	subscribers []func(BusMessage)
+	mu          sync.RWMutex
+}
+
+// NewLocalBus creates an in-process message bus
+func NewLocalBus() *LocalBus {
+	return &LocalBus{}
+}
+
+// Publish calls every subscriber before returning. They are called
+// without the lock held, so they may publish or subscribe in turn.
+func (b *LocalBus) Publish(msg BusMessage) error {
+	b.mu.RLock()
+	subscribers := b.subscribers
+	b.mu.RUnlock()
+	for _, fn := range subscribers {
+		fn(msg)
+	}
+	return nil
+}
+
+// Subscribe registers fn to receive every published message
+func (b *LocalBus) Subscribe(fn func(BusMessage)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subscribers = append(b.subscribers, fn)
+}
+
+// Close is a no-op
+func (b *LocalBus) Close() error {
+	return nil
+}
+
+// publishEvent sends a poll event through the bus, delivering it locally if
+// the bus is unavailable
+func (app *App) publishEvent(pollID string, ev Event) {
+	if err := app.bus.Publish(BusMessage{PollID: pollID, Event: ev}); err != nil {
+		log.Printf("Failed to publish event %d for poll %s: %v", ev.ID, pollID, err)
+		app.deliverEvent(pollID, ev)
+	}
+}
+
+// newBusFromEnv picks the message bus. BUS=redis connects to REDIS_ADDR
+// (default "localhost:6379"), authenticating with REDIS_PASSWORD if set;
+// anything else keeps events within this process. Nodes on one bus must
+// read the same polls and accept each other's cookies, so BUS=redis needs
+// STORAGE=redis and a SESSION_SECRET.
+func newBusFromEnv() (MessageBus, error) {
+	if os.Getenv("BUS") != "redis" {
+		return NewLocalBus(), nil
+	}
+	if strings.ToLower(os.Getenv("STORAGE")) != "redis" {
+		return nil, errors.New("BUS=redis needs STORAGE=redis, or each node would serve polls of its own")
+	}
+	if os.Getenv("SESSION_SECRET") == "" {
+		return nil, errors.New("BUS=redis needs a SESSION_SECRET shared by every node")
+	}
+	return NewRedisBus(redisAddrFromEnv(), os.Getenv("REDIS_PASSWORD"), redisEventsChannel), nil
+}
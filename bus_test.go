@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestLocalBusFanOut checks that apps sharing a LocalBus see each other's
+// events, and that duplicates are dropped.
+func TestLocalBusFanOut(t *testing.T) {
+	store := NewStore()
+	bus := NewLocalBus()
+	nodeA := NewAppWithBus(store, bus)
+	nodeB := NewAppWithBus(store, bus)
+
+	poll := &Poll{Question: "Q?", Options: []Option{{ID: "a", Text: "A"}, {ID: "b", Text: "B"}}}
+	store.Create(poll)
+	voted, _ := store.CastBallot(poll.ID, Ballot{VoterID: "v1", Choices: []string{"a"}})
+
+	nodeA.broadcastPoll(voted)
+	nodeA.broadcastPoll(voted)
+
+	for name, node := range map[string]*App{"A": nodeA, "B": nodeB} {
+		if events := node.broadcaster.Since(poll.ID, 0); len(events) != 1 || events[0].ID != voted.Version {
+			t.Errorf("Node %s: expected one event %d, got %+v", name, voted.Version, events)
+		}
+	}
+}
+
+// TestBusFromEnv refuses a Redis bus between nodes that do not share
+// their state.
+func TestBusFromEnv(t *testing.T) {
+	t.Setenv("BUS", "redis")
+	t.Setenv("STORAGE", "file")
+	t.Setenv("SESSION_SECRET", "")
+	if _, err := newBusFromEnv(); err == nil {
+		t.Error("Expected BUS=redis refused with file storage")
+	}
+	t.Setenv("STORAGE", "redis")
+	if _, err := newBusFromEnv(); err == nil {
+		t.Error("Expected BUS=redis refused without a session secret")
+	}
+	t.Setenv("SESSION_SECRET", "shared")
+	bus, err := newBusFromEnv()
+	if err != nil {
+		t.Fatalf("Expected a Redis bus, got %v", err)
+	}
+	if _, ok := bus.(*RedisBus); !ok {
+		t.Errorf("Expected a Redis bus, got %T", bus)
+	}
+	bus.Close()
+}
+
+// TestLocalBusReentrant lets a subscriber publish and subscribe while it
+// handles a message.
+func TestLocalBusReentrant(t *testing.T) {
+	bus := NewLocalBus()
+	var got []string
+	bus.Subscribe(func(msg BusMessage) {
+		got = append(got, msg.PollID)
+		if msg.PollID == "first" {
+			bus.Subscribe(func(BusMessage) {})
+			bus.Publish(BusMessage{PollID: "second"})
+		}
+	})
+
+	done := make(chan struct{})
+	go func() {
+		bus.Publish(BusMessage{PollID: "first"})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Publish from a subscriber deadlocked")
+	}
+	if len(got) != 2 || got[1] != "second" {
+		t.Errorf("Expected both messages, got %v", got)
+	}
+}
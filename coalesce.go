@@ -0,0 +1,212 @@
+// coalesce.go - Throttled broadcasts and delta payloads
+// A hot poll can take hundreds of votes per second, and sending the whole
+// poll to every client for each one floods both clients and CPU. The
+// Coalescer sends at most one update per poll per interval: the first vote
+// after a quiet period goes out at once, later ones within the interval are
+// merged and the latest state is sent when it ends. Each update also
+// carries a delta against the previous update, listing only the counts that
+// changed, for clients that ask for ?delta=1.
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// defaultBroadcastInterval is the minimum gap between updates of one poll
+const defaultBroadcastInterval = 250 * time.Millisecond
+
+// PollDelta is an update that only carries what changed since the update
+// with version Base
+type PollDelta struct {
+	Version     uint64         `json:"version"`
+	Base        uint64         `json:"base"`
+	Options     map[string]int `json:"options,omitempty"`
+	BallotCount *int           `json:"ballot_count,omitempty"`
+	Runoff      *RunoffResult  `json:"runoff,omitempty"`
+}
+
+// Coalescer throttles broadcasts per poll
+type Coalescer struct {
+	interval time.Duration
+	send     func(pollID string, ev Event)
+
+	mu    sync.Mutex
+	polls map[string]*coalesceState
+}
+
+// coalesceState is the throttling state of one poll
+type coalesceState struct {
+	mu       sync.Mutex
+	lastSent time.Time
+	last     *Poll // last poll sent, the base for deltas
+	pending  *Poll
+	timer    *time.Timer
+}
+
+// NewCoalescer creates a coalescer that passes events to send. An interval
+// of zero sends every update immediately.
+func NewCoalescer(interval time.Duration, send func(pollID string, ev Event)) *Coalescer {
+	return &Coalescer{interval: interval, send: send, polls: make(map[string]*coalesceState)}
+}
+
+// Submit queues the latest state of a poll for broadcast. Typed events such
+// as "closed" are never delayed.
+func (c *Coalescer) Submit(poll *Poll, eventType string) {
+	st := c.state(poll.ID)
+	st.mu.Lock()
+
+	if eventType == "" && c.interval > 0 && (st.timer != nil || time.Since(st.lastSent) < c.interval) {
+		if st.pending == nil || poll.Version > st.pending.Version {
+			st.pending = broadcastCopy(poll)
+		}
+		if st.timer == nil {
+			wait := c.interval - time.Since(st.lastSent)
+			st.timer = time.AfterFunc(wait, func() { c.flush(poll.ID) })
+		}
+		st.mu.Unlock()
+		return
+	}
+
+	// Anything pending is older than this poll
+	if st.timer != nil {
+		st.timer.Stop()
+		st.timer = nil
+	}
+	st.pending = nil
+	ev := st.event(poll, eventType)
+	st.mu.Unlock()
+	c.send(poll.ID, ev)
+}
+
+// flush sends the pending update of a poll
+func (c *Coalescer) flush(pollID string) {
+	c.mu.Lock()
+	st, exists := c.polls[pollID]
+	c.mu.Unlock()
+	if !exists {
+		// The poll was deleted
+		return
+	}
+
+	st.mu.Lock()
+	poll := st.pending
+	st.pending = nil
+	st.timer = nil
+	if poll == nil {
+		st.mu.Unlock()
+		return
+	}
+	ev := st.event(poll, "")
+	st.mu.Unlock()
+	c.send(pollID, ev)
+}
+
+// Forget drops the state of a deleted poll
+func (c *Coalescer) Forget(pollID string) {
+	c.mu.Lock()
+	st := c.polls[pollID]
+	delete(c.polls, pollID)
+	c.mu.Unlock()
+
+	if st != nil {
+		st.mu.Lock()
+		if st.timer != nil {
+			st.timer.Stop()
+		}
+		st.mu.Unlock()
+	}
+}
+
+func (c *Coalescer) state(pollID string) *coalesceState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st, exists := c.polls[pollID]
+	if !exists {
+		st = &coalesceState{}
+		c.polls[pollID] = st
+	}
+	return st
+}
+
+// event builds the event for poll and records it as sent. The caller must
+// hold st.mu.
+func (st *coalesceState) event(poll *Poll, eventType string) Event {
+	data, _ := json.Marshal(poll)
+	ev := Event{ID: poll.Version, Type: eventType, Data: string(data)}
+	if st.last != nil && eventType == "" {
+		if delta, ok := pollDelta(st.last, poll); ok {
+			encoded, _ := json.Marshal(delta)
+			ev.Base = st.last.Version
+			ev.Delta = string(encoded)
+		}
+	}
+	st.last = broadcastCopy(poll)
+	st.lastSent = time.Now()
+	return ev
+}
+
+// broadcastCopy copies what a broadcast needs from a poll, leaving out the
+// ballots, so later changes by the store cannot alter it
+func broadcastCopy(p *Poll) *Poll {
+	cp := *p
+	cp.Options = make([]Option, len(p.Options))
+	copy(cp.Options, p.Options)
+	cp.Ballots = nil
+	return &cp
+}
+
+// pollDelta describes next relative to prev. It reports false if anything
+// other than the counts changed.
+func pollDelta(prev, next *Poll) (*PollDelta, bool) {
+	if prev.Version >= next.Version || pollShape(prev) != pollShape(next) {
+		return nil, false
+	}
+	if (prev.Runoff == nil) != (next.Runoff == nil) {
+		return nil, false
+	}
+
+	delta := &PollDelta{Version: next.Version, Base: prev.Version, Options: make(map[string]int)}
+	for i, opt := range next.Options {
+		if opt.Votes != prev.Options[i].Votes {
+			delta.Options[opt.ID] = opt.Votes
+		}
+	}
+	if next.BallotCount != prev.BallotCount {
+		count := next.BallotCount
+		delta.BallotCount = &count
+	}
+	if !reflect.DeepEqual(prev.Runoff, next.Runoff) {
+		delta.Runoff = next.Runoff
+	}
+	return delta, true
+}
+
+// pollShape encodes everything about a poll except its counts
+func pollShape(p *Poll) string {
+	shape := *p
+	shape.Options = make([]Option, len(p.Options))
+	for i, opt := range p.Options {
+		shape.Options[i] = Option{ID: opt.ID, Text: opt.Text}
+	}
+	shape.BallotCount = 0
+	shape.Runoff = nil
+	shape.Version = 0
+	data, _ := json.Marshal(&shape)
+	return string(data)
+}
+
+// broadcastIntervalFromEnv reads BROADCAST_INTERVAL (a duration such as
+// "250ms"; "0" sends every update)
+func broadcastIntervalFromEnv() time.Duration {
+	if value := os.Getenv("BROADCAST_INTERVAL"); value != "" {
+		if d, err := time.ParseDuration(value); err == nil && d >= 0 {
+			return d
+		}
+	}
+	return defaultBroadcastInterval
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingSender collects the events a Coalescer sends
+type recordingSender struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (r *recordingSender) send(pollID string, ev Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, ev)
+}
+
+func (r *recordingSender) ids() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var ids []uint64
+	for _, ev := range r.events {
+		ids = append(ids, ev.ID)
+	}
+	return fmt.Sprint(ids)
+}
+
+func versionedPoll(version uint64, votes int) *Poll {
+	return &Poll{ID: "p", Question: "Q?", Version: version, Options: []Option{{ID: "a", Text: "A", Votes: votes}, {ID: "b", Text: "B"}}}
+}
+
+// TestCoalescerThrottles sends the first update at once and only the
+// latest of the following ones.
+func TestCoalescerThrottles(t *testing.T) {
+	rec := &recordingSender{}
+	c := NewCoalescer(50*time.Millisecond, rec.send)
+
+	for v := uint64(1); v <= 5; v++ {
+		c.Submit(versionedPoll(v, int(v)), "")
+	}
+	if got := rec.ids(); got != "[1]" {
+		t.Fatalf("Expected only the first update at once, got %s", got)
+	}
+	waitFor(t, "trailing update", func() bool { return rec.ids() == "[1 5]" })
+}
+
+// TestCoalescerTypedEvents ensures typed events are sent immediately and
+// supersede pending updates.
+func TestCoalescerTypedEvents(t *testing.T) {
+	rec := &recordingSender{}
+	c := NewCoalescer(50*time.Millisecond, rec.send)
+
+	c.Submit(versionedPoll(1, 1), "")
+	c.Submit(versionedPoll(2, 2), "")
+	c.Submit(versionedPoll(3, 2), "closed")
+	if got := rec.ids(); got != "[1 3]" {
+		t.Fatalf("Expected closed event at once, got %s", got)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if got := rec.ids(); got != "[1 3]" {
+		t.Errorf("Pending update sent after closing: %s", got)
+	}
+}
+
+// TestPollDelta checks which changes can be sent as deltas.
+func TestPollDelta(t *testing.T) {
+	prev := versionedPoll(1, 1)
+	next := versionedPoll(2, 4)
+
+	delta, ok := pollDelta(prev, next)
+	if !ok || delta.Base != 1 || delta.Version != 2 || len(delta.Options) != 1 || delta.Options["a"] != 4 {
+		t.Fatalf("Unexpected delta %+v %v", delta, ok)
+	}
+	if delta.BallotCount != nil || delta.Runoff != nil {
+		t.Errorf("Unchanged fields included: %+v", delta)
+	}
+
+	renamed := versionedPoll(3, 4)
+	renamed.Question = "Other?"
+	if _, ok := pollDelta(next, renamed); ok {
+		t.Error("Expected no delta for a changed question")
+	}
+	if _, ok := pollDelta(next, prev); ok {
+		t.Error("Expected no delta against a newer base")
+	}
+}
+
+// TestEventCursorDeltas sends deltas only to clients that asked for them
+// and hold the base version.
+func TestEventCursorDeltas(t *testing.T) {
+	app := NewApp()
+	poll := &Poll{Question: "Q?", Options: []Option{{ID: "a", Text: "A"}, {ID: "b", Text: "B"}}}
+	app.store.Create(poll)
+	app.broadcastPoll(poll)
+	v2, _ := app.store.CastBallot(poll.ID, Ballot{VoterID: "v1", Choices: []string{"a"}})
+	app.broadcastPoll(v2)
+
+	resumed := app.newEventCursor(poll.ID, 1)
+	resumed.deltas = true
+	events := resumed.start()
+	if len(events) != 1 || events[0].Type != "delta" {
+		t.Fatalf("Expected one delta on resume, got %+v", events)
+	}
+	var delta PollDelta
+	json.Unmarshal([]byte(events[0].Data), &delta)
+	if delta.Base != 1 || delta.Options["a"] != 1 {
+		t.Errorf("Unexpected delta %+v", delta)
+	}
+
+	full := app.newEventCursor(poll.ID, 1)
+	if events := full.start(); len(events) != 1 || events[0].Type != "" || events[0].Delta != "" {
+		t.Errorf("Expected full update without deltas, got %+v", events)
+	}
+
+	fresh := app.newEventCursor(poll.ID, 0)
+	fresh.deltas = true
+	if events := fresh.start(); len(events) != 1 || events[0].Type != "" {
+		t.Errorf("Expected a full snapshot for a new client, got %+v", events)
+	}
+}
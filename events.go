@@ -0,0 +1,198 @@
+// events.go - Versioned poll events and replay
+// Every change to a poll bumps its Version, and each broadcast carries the
+// full poll state tagged with that version as its event ID. The broadcaster
+// keeps the most recent events of every poll, so a client reconnecting with
+// Last-Event-ID is sent what it missed, and a subscriber whose channel
+// overflowed catches up instead of silently losing updates.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// eventHistorySize is the number of recent events kept per poll
+const eventHistorySize = 32
+
+// Event is one update in a poll's stream. ID is the poll version whose
+// state Data holds; Type names events other than plain updates, such as
+// "closed". Delta, if set, holds the same update relative to version Base.
+// Events with no ID, such as viewer counts, are not versioned.
+type Event struct {
+	ID    uint64 `json:"id"`
+	Type  string `json:"type,omitempty"`
+	Data  string `json:"data"`
+	Base  uint64 `json:"base,omitempty"`
+	Delta string `json:"delta,omitempty"`
+}
+
+// record appends ev to a poll's history, keeping it bounded. It reports
+// false for events that are not newer than the last one recorded. The
+// caller must hold b.mu.
+func (b *Broadcaster) record(pollID string, ev Event) bool {
+	history := b.history[pollID]
+	if n := len(history); n > 0 && ev.ID <= history[n-1].ID {
+		return false
+	}
+	if len(history) == eventHistorySize {
+		history = append(history[:0], history[1:]...)
+	}
+	b.history[pollID] = append(history, ev)
+	return true
+}
+
+// Since returns the recorded events of a poll newer than afterID, oldest
+// first
+func (b *Broadcaster) Since(pollID string, afterID uint64) []Event {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	var events []Event
+	for _, ev := range b.history[pollID] {
+		if ev.ID > afterID {
+			events = append(events, ev)
+		}
+	}
+	return events
+}
+
+// Forget drops the history and viewer counts of a deleted poll
+func (b *Broadcaster) Forget(pollID string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.history, pollID)
+	delete(b.remote, pollID)
+}
+
+// eventCursor tracks the last event delivered to one client, so that
+// replays, overflowing channels and out-of-order broadcasts never repeat or
+// reorder updates. Clients that accept deltas get them whenever they hold
+// the delta's base version.
+type eventCursor struct {
+	app    *App
+	pollID string
+	lastID uint64
+	deltas bool
+	// results, if set, hides results the client may not see (see
+	// results.go); redacted records that the last event was redacted, and
+	// lastRedacted its data
+	results      *resultsGate
+	redacted     bool
+	lastRedacted string
+}
+
+func (app *App) newEventCursor(pollID string, lastID uint64) *eventCursor {
+	return &eventCursor{app: app, pollID: pollID, lastID: lastID}
+}
+
+// start returns the first events for a client: the ones it missed since
+// lastID, or the current poll state. Call it after subscribing so that
+// nothing newer can slip between the two.
+func (c *eventCursor) start() []Event {
+	poll, err := c.app.store.Get(c.pollID)
+	if err != nil {
+		return nil
+	}
+	// A cursor ahead of the poll comes from before a restart or from
+	// another poll; start over from the current state
+	if c.lastID == 0 || c.lastID > poll.Version {
+		c.lastID = 0
+	}
+
+	var events []Event
+	if c.lastID > 0 {
+		for _, ev := range c.app.broadcaster.Since(c.pollID, c.lastID) {
+			if ev.ID <= poll.Version {
+				events = c.advance(events, ev)
+			}
+		}
+	}
+	if c.lastID == 0 || c.lastID < poll.Version {
+		data, _ := json.Marshal(poll)
+		events = c.redact(events, Event{ID: poll.Version, Data: string(data)})
+		c.lastID = poll.Version
+	}
+	return events
+}
+
+// receive returns ev unless the client already has it. Once the channel is
+// drained, events it could not hold are fetched from history.
+func (c *eventCursor) receive(ev Event, drained bool) []Event {
+	var events []Event
+	if ev.ID == 0 {
+		events = append(events, ev)
+	} else if ev.ID > c.lastID {
+		events = c.advance(events, ev)
+	}
+	if drained {
+		for _, missed := range c.app.broadcaster.Since(c.pollID, c.lastID) {
+			events = c.advance(events, missed)
+		}
+	}
+	return events
+}
+
+// advance moves the cursor to ev and appends it to events in the form the
+// client should receive
+func (c *eventCursor) advance(events []Event, ev Event) []Event {
+	base := c.lastID
+	c.lastID = ev.ID
+	// A delta cannot build on a redacted event
+	if c.deltas && ev.Delta != "" && ev.Base == base && !c.redacted && !c.hidden() {
+		return append(events, Event{ID: ev.ID, Type: "delta", Data: ev.Delta})
+	}
+	ev.Base, ev.Delta = 0, ""
+	return c.redact(events, ev)
+}
+
+// hidden reports whether the client may not see results yet
+func (c *eventCursor) hidden() bool {
+	return c.results != nil && !c.results.visible()
+}
+
+// redact appends ev to events, hiding the results in it if the client may
+// not see them. A redacted event equal to the last one only says that
+// someone voted, so it is left out.
+func (c *eventCursor) redact(events []Event, ev Event) []Event {
+	c.redacted = c.hidden()
+	if !c.redacted {
+		c.lastRedacted = ""
+		return append(events, ev)
+	}
+	ev = redactEvent(ev)
+	if ev.Type == "" && ev.Data == c.lastRedacted {
+		return events
+	}
+	c.lastRedacted = ev.Data
+	return append(events, ev)
+}
+
+// formatSSE encodes events in the text/event-stream format
+func formatSSE(events []Event) string {
+	var sb strings.Builder
+	for _, ev := range events {
+		if ev.Type != "" {
+			fmt.Fprintf(&sb, "event: %s\n", ev.Type)
+		}
+		// Without an id field the client keeps its Last-Event-ID
+		if ev.ID > 0 {
+			fmt.Fprintf(&sb, "id: %d\n", ev.ID)
+		}
+		fmt.Fprintf(&sb, "data: %s\n\n", ev.Data)
+	}
+	return sb.String()
+}
+
+// lastEventID returns the event ID a reconnecting SSE client resumes from,
+// or 0
+func lastEventID(r *http.Request) uint64 {
+	id, err := strconv.ParseUint(strings.TrimSpace(r.Header.Get("Last-Event-ID")), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return id
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestPollVersion checks that every change bumps the version.
+func TestPollVersion(t *testing.T) {
+	store := NewStore()
+	poll := &Poll{Question: "Q?", Options: []Option{{ID: "a", Text: "A"}, {ID: "b", Text: "B"}}}
+	store.Create(poll)
+	if poll.Version != 1 {
+		t.Fatalf("Expected version 1 on create, got %d", poll.Version)
+	}
+
+	voted, _ := store.CastBallot(poll.ID, Ballot{VoterID: "v1", Choices: []string{"a"}})
+	retracted, _ := store.RetractBallot(poll.ID, "v1")
+	updated, _ := store.Update(poll.ID, func(p *Poll) error { p.Question = "Q2?"; return nil })
+	if voted.Version != 2 || retracted.Version != 3 || updated.Version != 4 {
+		t.Errorf("Expected versions 2, 3, 4, got %d, %d, %d", voted.Version, retracted.Version, updated.Version)
+	}
+}
+
+// TestBroadcasterHistory checks that history is bounded and ignores stale
+// events.
+func TestBroadcasterHistory(t *testing.T) {
+	b := NewBroadcaster()
+	for i := 1; i <= eventHistorySize+5; i++ {
+		b.Broadcast("p", uint64(i), fmt.Sprint(i))
+	}
+	b.Broadcast("p", 3, "stale")
+
+	events := b.Since("p", 0)
+	if len(events) != eventHistorySize || events[0].ID != 6 {
+		t.Fatalf("Expected %d events from 6, got %d from %d", eventHistorySize, len(events), events[0].ID)
+	}
+	if last := events[len(events)-1]; last.Data != fmt.Sprint(eventHistorySize+5) {
+		t.Errorf("Stale event replaced the latest one: %+v", last)
+	}
+	if got := b.Since("p", uint64(eventHistorySize+3)); len(got) != 2 {
+		t.Errorf("Expected 2 events after %d, got %d", eventHistorySize+3, len(got))
+	}
+}
+
+// TestEventCursorStart covers fresh clients, resumes and cursors from
+// before a restart.
+func TestEventCursorStart(t *testing.T) {
+	app := NewApp()
+	poll := &Poll{Question: "Q?", Options: []Option{{ID: "a", Text: "A"}, {ID: "b", Text: "B"}}}
+	app.store.Create(poll)
+	for _, voter := range []string{"v1", "v2", "v3"} {
+		p, _ := app.store.CastBallot(poll.ID, Ballot{VoterID: voter, Choices: []string{"a"}})
+		app.broadcastPoll(p)
+	}
+
+	tests := []struct {
+		name   string
+		lastID uint64
+		ids    []uint64
+	}{
+		{"fresh", 0, []uint64{4}},
+		{"resume", 2, []uint64{3, 4}},
+		{"up to date", 4, nil},
+		{"ahead", 99, []uint64{4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ids []uint64
+			for _, ev := range app.newEventCursor(poll.ID, tt.lastID).start() {
+				ids = append(ids, ev.ID)
+			}
+			if fmt.Sprint(ids) != fmt.Sprint(tt.ids) {
+				t.Errorf("Expected events %v, got %v", tt.ids, ids)
+			}
+		})
+	}
+}
+
+// TestEventCursorOverflow ensures a subscriber whose channel filled up
+// still ends on the latest event, in order.
+func TestEventCursorOverflow(t *testing.T) {
+	app := NewApp()
+	ch := app.broadcaster.Subscribe("p")
+	defer app.broadcaster.Unsubscribe("p", ch)
+
+	for i := 1; i <= 15; i++ {
+		app.broadcaster.Broadcast("p", uint64(i), fmt.Sprint(i))
+	}
+
+	cursor := app.newEventCursor("p", 0)
+	var ids []uint64
+	for len(ch) > 0 {
+		ev := <-ch
+		for _, got := range cursor.receive(ev, len(ch) == 0) {
+			ids = append(ids, got.ID)
+		}
+	}
+	for i, id := range ids {
+		if id != uint64(i+1) {
+			t.Fatalf("Expected events 1..15 in order, got %v", ids)
+		}
+	}
+	if len(ids) != 15 {
+		t.Errorf("Expected 15 events, got %v", ids)
+	}
+}
+
+// TestEventsHandlerLastEventID reconnects with Last-Event-ID and expects
+// only the missed events.
+func TestEventsHandlerLastEventID(t *testing.T) {
+	app := NewApp()
+	poll := &Poll{Question: "Q?", Options: []Option{{ID: "a", Text: "A"}, {ID: "b", Text: "B"}}}
+	app.store.Create(poll)
+	for _, voter := range []string{"v1", "v2"} {
+		p, _ := app.store.CastBallot(poll.ID, Ballot{VoterID: voter, Choices: []string{"b"}})
+		app.broadcastPoll(p)
+	}
+	server := httptest.NewServer(app.Routes())
+	defer server.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/events/"+poll.ID, nil)
+	req.Header.Set("Last-Event-ID", "1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	reader := bufio.NewReader(resp.Body)
+	var ids []string
+	for len(ids) < 2 {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		if strings.HasPrefix(line, "id: ") {
+			ids = append(ids, strings.TrimSpace(strings.TrimPrefix(line, "id: ")))
+		}
+	}
+	if ids[0] != "2" || ids[1] != "3" {
+		t.Errorf("Expected replay of events 2 and 3, got %v", ids)
+	}
+}
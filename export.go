@@ -0,0 +1,251 @@
+// export.go - Results export
+// GET /api/polls/{id}/export?format=csv|tsv|jsonl downloads a poll's
+// results. CSV and TSV have three blocks separated by blank lines: the poll
+// details, one row per option with its votes and percentage, and, if the
+// poll recorded ballots, one row per ballot. CSV starts with a byte order
+// mark so spreadsheet apps read it as UTF-8; TSV pastes straight into a
+// spreadsheet. JSON Lines has one object per line, tagged by "record".
+// Only attributed polls name the voter of each ballot: the voter IDs of
+// other polls are the same across polls and would link votes to people.
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Export formats
+const (
+	ExportCSV   = "csv"
+	ExportTSV   = "tsv"
+	ExportJSONL = "jsonl"
+)
+
+// exportContentTypes maps each export format to its content type
+var exportContentTypes = map[string]string{
+	ExportCSV:   "text/csv; charset=utf-8",
+	ExportTSV:   "text/tab-separated-values; charset=utf-8",
+	ExportJSONL: "application/x-ndjson",
+}
+
+// exportPollRecord is the first line of a JSON Lines export
+type exportPollRecord struct {
+	Record      string    `json:"record"`
+	ID          string    `json:"id"`
+	Question    string    `json:"question"`
+	Type        PollType  `json:"type"`
+	Status      string    `json:"status"`
+	CreatedAt   time.Time `json:"created_at"`
+	OpensAt     string    `json:"opens_at,omitempty"`
+	ExpiresAt   string    `json:"expires_at,omitempty"`
+	ClosedAt    string    `json:"closed_at,omitempty"`
+	BallotCount int       `json:"ballot_count"`
+	Winner      string    `json:"winner,omitempty"`
+}
+
+// exportOptionRecord is an option line of a JSON Lines export
+type exportOptionRecord struct {
+	Record  string  `json:"record"`
+	ID      string  `json:"id"`
+	Text    string  `json:"text"`
+	Votes   int     `json:"votes"`
+	Percent float64 `json:"percent"`
+}
+
+// exportBallotRecord is a ballot line of a JSON Lines export
+type exportBallotRecord struct {
+	Record    string    `json:"record"`
+	VoterID   string    `json:"voter_id,omitempty"`
+	VoterName string    `json:"voter_name,omitempty"`
+	Choices   []string  `json:"choices"`
+	CastAt    time.Time `json:"cast_at"`
+}
+
+// apiExport serves GET /api/polls/{id}/export
+func (app *App) apiExport(w http.ResponseWriter, r *http.Request, pollID string) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = ExportCSV
+	}
+	contentType, ok := exportContentTypes[format]
+	if !ok {
+		writeErrorJSON(w, &ValidationError{Field: "format", Message: "Format must be csv, tsv or jsonl"})
+		return
+	}
+
+	poll, err := app.viewablePoll(r, pollID)
+	if err != nil {
+		writeErrorJSON(w, err)
+		return
+	}
+	if !app.resultsVisible(r, poll) {
+		writeErrorJSON(w, ErrResultsHidden)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="poll-%s.%s"`, poll.ID, format))
+	switch format {
+	case ExportJSONL:
+		writeExportJSONL(w, poll)
+	case ExportTSV:
+		writeExportTable(w, poll, '\t')
+	default:
+		io.WriteString(w, "\ufeff")
+		writeExportTable(w, poll, ',')
+	}
+}
+
+// writeExportTable writes the CSV or TSV export of poll
+func writeExportTable(out io.Writer, poll *Poll, comma rune) error {
+	w := csv.NewWriter(out)
+	w.Comma = comma
+
+	details := [][]string{
+		{"Poll", poll.ID},
+		{"Question", cell(poll.Question)},
+		{"Type", string(pollTypeOrDefault(poll.Type))},
+		{"Status", string(poll.StatusAt(time.Now()))},
+		{"Created", exportTime(poll.CreatedAt)},
+		{"Opens", exportTime(poll.OpensAt)},
+		{"Expires", exportTime(poll.ExpiresAt)},
+		{"Closed", exportTime(closedAt(poll))},
+		{"Ballots", strconv.Itoa(poll.TotalBallots())},
+	}
+	if winner := runoffWinner(poll); winner != "" {
+		details = append(details, []string{"Winner", cell(winner)})
+	}
+	w.WriteAll(details)
+
+	w.Write(nil)
+	w.Write([]string{"Option", "Votes", "Percent"})
+	for _, opt := range poll.Options {
+		w.Write([]string{cell(opt.Text), strconv.Itoa(opt.Votes), formatPercent(poll.VotePercentage(opt.ID))})
+	}
+
+	if len(poll.Ballots) > 0 {
+		w.Write(nil)
+		w.Write([]string{"Ballot", "Voter", "Choices", "Cast at"})
+		for i, ballot := range poll.Ballots.List() {
+			texts := make([]string, len(ballot.Choices))
+			for j, id := range ballot.Choices {
+				texts[j] = optionText(poll, id)
+			}
+			_, voter := exportVoter(poll, ballot)
+			w.Write([]string{strconv.Itoa(i + 1), cell(voter), cell(strings.Join(texts, "; ")), exportTime(ballot.CastAt)})
+		}
+	}
+
+	w.Flush()
+	return w.Error()
+}
+
+// writeExportJSONL writes the JSON Lines export of poll
+func writeExportJSONL(out io.Writer, poll *Poll) error {
+	enc := json.NewEncoder(out)
+	err := enc.Encode(exportPollRecord{
+		Record:      "poll",
+		ID:          poll.ID,
+		Question:    poll.Question,
+		Type:        pollTypeOrDefault(poll.Type),
+		Status:      string(poll.StatusAt(time.Now())),
+		CreatedAt:   poll.CreatedAt,
+		OpensAt:     exportTime(poll.OpensAt),
+		ExpiresAt:   exportTime(poll.ExpiresAt),
+		ClosedAt:    exportTime(closedAt(poll)),
+		BallotCount: poll.TotalBallots(),
+		Winner:      runoffWinner(poll),
+	})
+	if err != nil {
+		return err
+	}
+	for _, opt := range poll.Options {
+		rec := exportOptionRecord{Record: "option", ID: opt.ID, Text: opt.Text, Votes: opt.Votes, Percent: roundPercent(poll.VotePercentage(opt.ID))}
+		if err := enc.Encode(rec); err != nil {
+			return err
+		}
+	}
+	for _, ballot := range poll.Ballots.List() {
+		voterID, voterName := exportVoter(poll, ballot)
+		rec := exportBallotRecord{Record: "ballot", VoterID: voterID, VoterName: voterName, Choices: ballot.Choices, CastAt: ballot.CastAt}
+		if err := enc.Encode(rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exportVoter returns the voter ID and name an export shows for a ballot,
+// which are empty unless the poll is attributed
+func exportVoter(poll *Poll, ballot Ballot) (string, string) {
+	if !poll.IsAttributed() {
+		return "", ""
+	}
+	return ballot.VoterID, ballot.VoterName
+}
+
+// pollTypeOrDefault names the type of polls created before types existed
+func pollTypeOrDefault(t PollType) PollType {
+	if t == "" {
+		return PollSingle
+	}
+	return t
+}
+
+// closedAt returns when a poll closed, or the zero time if it is open
+func closedAt(poll *Poll) time.Time {
+	if poll.Final != nil {
+		return poll.Final.ClosedAt
+	}
+	return time.Time{}
+}
+
+// runoffWinner returns the text of a ranked poll's winning option
+func runoffWinner(poll *Poll) string {
+	if poll.Runoff == nil || poll.Runoff.Winner == "" {
+		return ""
+	}
+	return optionText(poll, poll.Runoff.Winner)
+}
+
+// optionText returns the text of an option, or its ID if it is unknown
+func optionText(poll *Poll, optionID string) string {
+	if i := poll.optionIndex(optionID); i >= 0 {
+		return poll.Options[i].Text
+	}
+	return optionID
+}
+
+// exportTime formats a timestamp, leaving unset ones empty
+func exportTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// roundPercent rounds a percentage to one decimal place
+func roundPercent(p float64) float64 {
+	value, _ := strconv.ParseFloat(formatPercent(p), 64)
+	return value
+}
+
+func formatPercent(p float64) string {
+	return strconv.FormatFloat(p, 'f', 1, 64)
+}
+
+// cell keeps user text from being read as a formula when the export is
+// opened in a spreadsheet
+func cell(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
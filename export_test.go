@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// exportedPoll creates a poll with two ballots
+func exportedPoll(t *testing.T, app *App) *Poll {
+	t.Helper()
+	poll := &Poll{Question: "=Best snack?", Options: []Option{{ID: "a", Text: "Chips"}, {ID: "b", Text: "Fruit"}}}
+	app.store.Create(poll)
+	app.store.CastBallot(poll.ID, Ballot{VoterID: "v1", Choices: []string{"a"}})
+	app.store.CastBallot(poll.ID, Ballot{VoterID: "v2", Choices: []string{"a"}})
+	return poll
+}
+
+// TestExportCSV writes the details, options and ballots blocks.
+func TestExportCSV(t *testing.T) {
+	app := NewApp()
+	poll := exportedPoll(t, app)
+
+	rec := apiCall(t, app, http.MethodGet, "/api/polls/"+poll.ID+"/export", "", "")
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/csv") {
+		t.Fatalf("Expected CSV, got %d %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(rec.Header().Get("Content-Disposition"), "poll-"+poll.ID+".csv") {
+		t.Errorf("Unexpected Content-Disposition %q", rec.Header().Get("Content-Disposition"))
+	}
+
+	body := strings.TrimPrefix(rec.Body.String(), "\ufeff")
+	r := csv.NewReader(strings.NewReader(body))
+	r.FieldsPerRecord = -1
+	rows, err := r.ReadAll()
+	if err != nil {
+		t.Fatalf("Invalid CSV: %v", err)
+	}
+	find := func(first string) []string {
+		for _, row := range rows {
+			if row[0] == first {
+				return row
+			}
+		}
+		t.Fatalf("No row starting with %q in %q", first, rows)
+		return nil
+	}
+
+	if row := find("Question"); row[1] != "'=Best snack?" {
+		t.Errorf("Expected the question escaped against formulas, got %q", row[1])
+	}
+	if row := find("Chips"); row[1] != "2" || row[2] != "100.0" {
+		t.Errorf("Unexpected option row %q", row)
+	}
+	if row := find("2"); row[1] != "" || row[2] != "Chips" {
+		t.Errorf("Expected the ballot row without its voter, got %q", row)
+	}
+}
+
+// TestExportJSONL writes one record per line.
+func TestExportJSONL(t *testing.T) {
+	app := NewApp()
+	poll := exportedPoll(t, app)
+
+	rec := apiCall(t, app, http.MethodGet, "/api/polls/"+poll.ID+"/export?format=jsonl", "", "")
+	var kinds []string
+	scanner := bufio.NewScanner(rec.Body)
+	for scanner.Scan() {
+		var line struct {
+			Record  string
+			Percent float64
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("Invalid line %q: %v", scanner.Text(), err)
+		}
+		kinds = append(kinds, line.Record)
+	}
+	if got := strings.Join(kinds, ","); got != "poll,option,option,ballot,ballot" {
+		t.Errorf("Unexpected records %s", got)
+	}
+}
+
+// TestExportVoters names voters only in attributed polls.
+func TestExportVoters(t *testing.T) {
+	app := NewApp()
+	poll := exportedPoll(t, app)
+	attributed := &Poll{Question: "Q?", Attribution: AttributionAttributed, Options: []Option{{ID: "a", Text: "A"}, {ID: "b", Text: "B"}}}
+	app.store.Create(attributed)
+	app.store.CastBallot(attributed.ID, Ballot{VoterID: "user_1", VoterName: "ada", Choices: []string{"a"}})
+
+	rec := apiCall(t, app, http.MethodGet, "/api/polls/"+poll.ID+"/export?format=jsonl", "", "")
+	if body := rec.Body.String(); strings.Contains(body, "voter_id") {
+		t.Errorf("Expected no voter IDs in a default poll's export, got %s", body)
+	}
+	rec = apiCall(t, app, http.MethodGet, "/api/polls/"+attributed.ID+"/export?format=jsonl", "", "")
+	if body := rec.Body.String(); !strings.Contains(body, `"voter_name":"ada"`) {
+		t.Errorf("Expected voter names in an attributed poll's export, got %s", body)
+	}
+}
+
+// TestExportErrors rejects unknown formats and polls.
+func TestExportErrors(t *testing.T) {
+	app := NewApp()
+	poll := exportedPoll(t, app)
+
+	if code := decodeAPIError(t, apiCall(t, app, http.MethodGet, "/api/polls/"+poll.ID+"/export?format=xlsx", "", "")); code != "validation_failed" {
+		t.Errorf("Expected validation_failed, got %q", code)
+	}
+	if code := decodeAPIError(t, apiCall(t, app, http.MethodGet, "/api/polls/missing/export", "", "")); code != "poll_not_found" {
+		t.Errorf("Expected poll_not_found, got %q", code)
+	}
+	if code := decodeAPIError(t, apiCall(t, app, http.MethodPost, "/api/polls/"+poll.ID+"/export", "", "")); code != "method_not_allowed" {
+		t.Errorf("Expected method_not_allowed, got %q", code)
+	}
+}
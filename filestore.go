@@ -0,0 +1,505 @@
+// filestore.go - File-backed poll repository
+// Polls live in memory (via Store). Every change is first written to the
+// write-ahead journal (see journal.go) and only then applied in memory, so
+// an acknowledged vote is never lost. Creations and updates journal the
+// whole poll; ballots and retractions only journal the ballot, so the
+// journal grows with the number of votes. A periodic snapshot captures the
+// full state; the journal segment it covers is archived next to it and kept
+// as an audit trail.
+//
+// The key that salts the voter hashes of anonymous polls lives in its own
+// file, voter.key, so the snapshot and journal do not show whose hash is
+// whose. Journal records of anonymous ballots carry the new hash and the
+// choices, but no voter, no time and none of the poll's other hashes.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	snapshotFileName        = "snapshot.json"
+	journalFileName         = "polls.wal"
+	voterKeyFileName        = "voter.key"
+	defaultSnapshotInterval = 5 * time.Minute
+)
+
+// journalRecord is the payload of one journal entry. Creations and updates
+// hold the state of the poll afterwards in Poll. Votes hold the ballot and
+// the key it is stored under (Key, when it is not the voter), plus the
+// voter's hash for anonymous polls; retractions hold the voter. Records are
+// replayed in order, once, after the snapshot they follow.
+type journalRecord struct {
+	Seq       uint64      `json:"seq"`
+	Op        string      `json:"op"`
+	ID        string      `json:"id"`
+	Key       string      `json:"key,omitempty"`
+	Voter     string      `json:"voter,omitempty"`
+	VoterName string      `json:"voter_name,omitempty"`
+	VoterHash string      `json:"voter_hash,omitempty"`
+	Choices   []string    `json:"choices,omitempty"`
+	CastAt    *time.Time  `json:"cast_at,omitempty"`
+	Poll      *storedPoll `json:"poll,omitempty"`
+	At        *time.Time  `json:"at,omitempty"`
+
+	timeless bool // leave At out, for anonymous ballots
+}
+
+// snapshotFile is the on-disk snapshot format
+type snapshotFile struct {
+	Seq   uint64        `json:"seq"`
+	Polls []*storedPoll `json:"polls"`
+}
+
+// storedPoll is the persisted form of a poll. It adds the fields that are
+// kept out of the public JSON.
+type storedPoll struct {
+	*Poll
+	Ballots      BallotBox       `json:"ballots,omitempty"`
+	PasswordHash string          `json:"password_hash,omitempty"`
+	Voters       map[string]bool `json:"voters,omitempty"`
+	Answers      []string        `json:"answers,omitempty"`
+}
+
+func toStored(p *Poll) *storedPoll {
+	return &storedPoll{Poll: p, Ballots: p.Ballots, PasswordHash: p.PasswordHash, Voters: p.Voters, Answers: p.Answers}
+}
+
+func (sp *storedPoll) poll() *Poll {
+	p := sp.Poll
+	p.Ballots = sp.Ballots
+	p.PasswordHash = sp.PasswordHash
+	p.Voters = sp.Voters
+	p.Answers = sp.Answers
+	return p
+}
+
+// FileStore is a PollRepository that persists polls to a directory
+type FileStore struct {
+	mem     *Store
+	dir     string
+	journal *Journal
+	seq     uint64     // sequence number of the last journaled record
+	snapSeq uint64     // sequence number covered by the last snapshot
+	mu      sync.Mutex // serializes mutations so the journal order matches memory
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// OpenFileStore loads the snapshot and replays the journal from dir
+// (creating it if needed) and starts a background snapshot every interval.
+// An interval of zero disables periodic snapshots; one is still taken on
+// Close.
+func OpenFileStore(dir string, interval time.Duration) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	fs := &FileStore{
+		mem:  NewStore(),
+		dir:  dir,
+		done: make(chan struct{}),
+	}
+	key, err := loadVoterKey(filepath.Join(dir, voterKeyFileName))
+	if err != nil {
+		return nil, err
+	}
+	fs.mem.voterKey = key
+	if err := fs.loadSnapshot(); err != nil {
+		return nil, err
+	}
+
+	replayed := 0
+	journal, err := OpenJournal(filepath.Join(dir, journalFileName), func(payload []byte) error {
+		var rec journalRecord
+		if err := json.Unmarshal(payload, &rec); err != nil {
+			return fmt.Errorf("decoding journal record: %w", err)
+		}
+		if fs.apply(rec) {
+			replayed++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	fs.journal = journal
+	log.Printf("Loaded %d polls (%d journal records replayed)", len(fs.mem.List()), replayed)
+
+	if interval > 0 {
+		fs.wg.Add(1)
+		go fs.snapshotLoop(interval)
+	}
+	return fs, nil
+}
+
+// Create journals a new poll and then adds it to the store
+func (fs *FileStore) Create(poll *Poll) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if err := preparePoll(poll, fs.mem.taken); err != nil {
+		return err
+	}
+	stored := copyPoll(poll)
+	if err := fs.write(journalRecord{Op: "create", ID: poll.ID, Poll: toStored(stored)}); err != nil {
+		return err
+	}
+	fs.mem.restore(stored)
+	return nil
+}
+
+// Get retrieves a poll by ID
+func (fs *FileStore) Get(id string) (*Poll, error) {
+	return fs.mem.Get(id)
+}
+
+// GetByShareCode retrieves a poll by its share code
+func (fs *FileStore) GetByShareCode(code string) (*Poll, error) {
+	return fs.mem.GetByShareCode(code)
+}
+
+// Vote journals a vote and then applies it
+func (fs *FileStore) Vote(pollID, optionID string) (*Poll, error) {
+	return fs.CastBallot(pollID, Ballot{Choices: []string{optionID}})
+}
+
+// CastBallot journals a ballot and then applies it
+func (fs *FileStore) CastBallot(pollID string, ballot Ballot) (*Poll, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	poll, err := fs.mem.Get(pollID)
+	if err != nil {
+		return nil, err
+	}
+	var hash string
+	if poll.IsAnonymous() && ballot.VoterID != "" {
+		hash = voterHash(poll.voterSalt, ballot.VoterID)
+	}
+	key, stored, err := poll.castBallot(ballot)
+	if err != nil {
+		return nil, err
+	}
+	rec := journalRecord{Op: "vote", ID: pollID, Voter: stored.VoterID, VoterName: stored.VoterName, VoterHash: hash, Choices: stored.Choices, timeless: poll.IsAnonymous()}
+	if key != stored.VoterID {
+		rec.Key = key
+	}
+	if !stored.CastAt.IsZero() {
+		rec.CastAt = &stored.CastAt
+	}
+	if err := fs.write(rec); err != nil {
+		return nil, err
+	}
+	fs.mem.restore(poll)
+	return copyPoll(poll), nil
+}
+
+// RetractBallot journals a retraction and then applies it
+func (fs *FileStore) RetractBallot(pollID, voterID string) (*Poll, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	poll, err := fs.mem.Get(pollID)
+	if err != nil {
+		return nil, err
+	}
+	if err := poll.retractBallot(voterID); err != nil {
+		return nil, err
+	}
+	if err := fs.write(journalRecord{Op: "retract", ID: pollID, Voter: voterID}); err != nil {
+		return nil, err
+	}
+	fs.mem.restore(poll)
+	return copyPoll(poll), nil
+}
+
+// Update journals the result of applying fn to a poll and then stores it
+func (fs *FileStore) Update(id string, fn func(*Poll) error) (*Poll, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	poll, err := fs.mem.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := fn(poll); err != nil {
+		return nil, err
+	}
+	poll.ID = id
+	poll.Version++
+	if err := fs.write(journalRecord{Op: "update", ID: id, Poll: toStored(poll)}); err != nil {
+		return nil, err
+	}
+	fs.mem.restore(poll)
+	return copyPoll(poll), nil
+}
+
+// List returns all polls sorted by creation date (newest first)
+func (fs *FileStore) List() []*Poll {
+	return fs.mem.List()
+}
+
+// Delete journals a deletion and then removes the poll
+func (fs *FileStore) Delete(id string) bool {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if _, err := fs.mem.Get(id); err != nil {
+		return false
+	}
+	if err := fs.write(journalRecord{Op: "delete", ID: id}); err != nil {
+		log.Printf("Failed to journal deletion of poll %s: %v", id, err)
+		return false
+	}
+	return fs.mem.Delete(id)
+}
+
+// Snapshot writes the full state to disk and archives the journal segment
+// it covers
+func (fs *FileStore) Snapshot() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.snapshot()
+}
+
+// Close stops the snapshot loop, takes a final snapshot and closes the
+// journal
+func (fs *FileStore) Close() error {
+	close(fs.done)
+	fs.wg.Wait()
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	err := fs.snapshot()
+	if cerr := fs.journal.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (fs *FileStore) snapshotLoop(interval time.Duration) {
+	defer fs.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := fs.Snapshot(); err != nil {
+				log.Printf("Snapshot failed: %v", err)
+			}
+		case <-fs.done:
+			return
+		}
+	}
+}
+
+// write assigns the next sequence number and appends rec to the journal.
+// Callers must hold fs.mu.
+func (fs *FileStore) write(rec journalRecord) error {
+	rec.Seq = fs.seq + 1
+	if !rec.timeless {
+		now := time.Now()
+		rec.At = &now
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if err := fs.journal.Append(data); err != nil {
+		return err
+	}
+	fs.seq = rec.Seq
+	return nil
+}
+
+// snapshot replaces the snapshot file atomically and rotates the journal
+// into an archive segment. Callers must hold fs.mu.
+func (fs *FileStore) snapshot() error {
+	if fs.seq == fs.snapSeq && fs.journal.Size() == 0 {
+		return nil
+	}
+
+	polls := fs.mem.List()
+	stored := make([]*storedPoll, len(polls))
+	for i, p := range polls {
+		stored[i] = toStored(p)
+	}
+	data, err := json.Marshal(snapshotFile{Seq: fs.seq, Polls: stored})
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(fs.dir, snapshotFileName), data); err != nil {
+		return err
+	}
+	fs.snapSeq = fs.seq
+
+	if fs.journal.Size() == 0 {
+		return nil
+	}
+	archive := filepath.Join(fs.dir, fmt.Sprintf("polls-%020d.wal", fs.seq))
+	return fs.journal.Rotate(archive)
+}
+
+// loadSnapshot restores the state captured by the last snapshot, if any
+func (fs *FileStore) loadSnapshot() error {
+	data, err := os.ReadFile(filepath.Join(fs.dir, snapshotFileName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var snap snapshotFile
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return fmt.Errorf("reading snapshot: %w", err)
+	}
+	for _, sp := range snap.Polls {
+		fs.mem.restore(sp.poll())
+	}
+	fs.seq = snap.Seq
+	fs.snapSeq = snap.Seq
+	return nil
+}
+
+// apply replays a single journal record against the in-memory store.
+// Records already covered by the snapshot are skipped.
+func (fs *FileStore) apply(rec journalRecord) bool {
+	if rec.Seq <= fs.snapSeq {
+		return false
+	}
+
+	switch {
+	case rec.Op == "delete":
+		fs.mem.Delete(rec.ID)
+	case rec.Poll != nil:
+		// creations and updates
+		fs.mem.restore(rec.Poll.poll())
+	case rec.Op == "vote" || rec.Op == "retract":
+		poll, err := fs.mem.Get(rec.ID)
+		if err != nil {
+			break
+		}
+		if rec.Op == "retract" {
+			poll.removeBallot(rec.Voter)
+		} else {
+			fs.replayBallot(poll, rec)
+		}
+		fs.mem.restore(poll)
+	}
+	fs.seq = rec.Seq
+	return true
+}
+
+// replayBallot stores the ballot of a vote record in poll as it was
+// stored when the vote was cast
+func (fs *FileStore) replayBallot(poll *Poll, rec journalRecord) {
+	if rec.VoterHash != "" {
+		if poll.Voters == nil {
+			poll.Voters = make(map[string]bool)
+		}
+		poll.Voters[rec.VoterHash] = true
+	}
+	key := rec.Key
+	if key == "" {
+		key = rec.Voter
+	}
+	ballot := Ballot{VoterID: rec.Voter, VoterName: rec.VoterName, Choices: rec.Choices}
+	if rec.CastAt != nil {
+		ballot.CastAt = *rec.CastAt
+	}
+	poll.putBallot(key, ballot)
+}
+
+// loadVoterKey reads the key voter salts are derived from, creating it the
+// first time. Only the owner may read it.
+func loadVoterKey(path string) ([]byte, error) {
+	key, err := os.ReadFile(path)
+	if err == nil {
+		if len(key) != voterKeySize {
+			return nil, fmt.Errorf("%s: expected a %d-byte key", path, voterKeySize)
+		}
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	key = newVoterKey()
+	if err := writeFileAtomic(path, key); err != nil {
+		return nil, err
+	}
+	return key, os.Chmod(path, 0o600)
+}
+
+// writeFileAtomic writes data to a temporary file, fsyncs it and renames
+// it over path
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// printAuditTrail writes one line per journal record found in the archived
+// and active journal segments of dir, oldest first
+func printAuditTrail(w io.Writer, dir string) error {
+	segments, err := filepath.Glob(filepath.Join(dir, "polls-*.wal"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(segments)
+	segments = append(segments, filepath.Join(dir, journalFileName))
+
+	for _, path := range segments {
+		_, err := ReadJournal(path, func(payload []byte) error {
+			var rec journalRecord
+			if err := json.Unmarshal(payload, &rec); err != nil {
+				return err
+			}
+			at := "-"
+			if rec.At != nil {
+				at = rec.At.Format(time.RFC3339Nano)
+			}
+			line := fmt.Sprintf("%d\t%s\t%s\t%s", rec.Seq, at, rec.Op, rec.ID)
+			if rec.Voter != "" {
+				line += "\tvoter=" + rec.Voter
+			}
+			if len(rec.Choices) > 0 {
+				line += "\t" + strings.Join(rec.Choices, ">")
+			}
+			_, err := fmt.Fprintln(w, line)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestFileStoreReopen verifies that polls, votes and deletions
+// survive closing and reopening the store.
+func TestFileStoreReopen(t *testing.T) {
+	dir := t.TempDir()
+
+	fs, err := OpenFileStore(dir, 0)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	keep := &Poll{Question: "Keep?", Options: []Option{{ID: "a", Text: "A"}, {ID: "b", Text: "B"}}}
+	drop := &Poll{Question: "Drop?", Options: []Option{{ID: "a", Text: "A"}}}
+	fs.Create(keep)
+	fs.Create(drop)
+	fs.Vote(keep.ID, "b")
+	fs.Vote(keep.ID, "b")
+	fs.Delete(drop.ID)
+
+	if err := fs.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	reopened, err := OpenFileStore(dir, 0)
+	if err != nil {
+		t.Fatalf("Reopen failed: %v", err)
+	}
+	defer reopened.Close()
+
+	got, err := reopened.Get(keep.ID)
+	if err != nil {
+		t.Fatal("Expected poll to survive restart")
+	}
+	if got.Options[1].Votes != 2 {
+		t.Errorf("Expected 2 votes, got %d", got.Options[1].Votes)
+	}
+	if !got.CreatedAt.Equal(keep.CreatedAt) {
+		t.Error("Expected CreatedAt to be preserved")
+	}
+
+	// Deleted poll should stay deleted
+	if _, err := reopened.Get(drop.ID); !errors.Is(err, ErrPollNotFound) {
+		t.Error("Deleted poll came back after restart")
+	}
+}
+
+// TestFileStoreReplayWithoutSnapshot ensures state is rebuilt
+// from the log alone when the process dies before a snapshot.
+func TestFileStoreReplayWithoutSnapshot(t *testing.T) {
+	dir := t.TempDir()
+
+	fs, err := OpenFileStore(dir, 0)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	poll := &Poll{Question: "Crash?", Options: []Option{{ID: "a", Text: "A"}}}
+	fs.Create(poll)
+	fs.Vote(poll.ID, "a")
+
+	// Simulate a crash: close the journal without snapshotting
+	fs.journal.Close()
+
+	reopened, err := OpenFileStore(dir, 0)
+	if err != nil {
+		t.Fatalf("Reopen failed: %v", err)
+	}
+	defer reopened.Close()
+
+	got, err := reopened.Get(poll.ID)
+	if err != nil || got.Options[0].Votes != 1 {
+		t.Errorf("Expected poll with 1 vote after replay, got %+v", got)
+	}
+}
+
+// TestFileStoreJournalsBallots journals votes and retractions on their own
+// and replays them to the same state.
+func TestFileStoreJournalsBallots(t *testing.T) {
+	dir := t.TempDir()
+	fs, err := OpenFileStore(dir, 0)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	poll := &Poll{Question: "Rank?", Type: PollRanked, Options: []Option{{ID: "a", Text: "A"}, {ID: "b", Text: "B"}}}
+	fs.Create(poll)
+	fs.CastBallot(poll.ID, Ballot{VoterID: "v1", Choices: []string{"b", "a"}})
+	fs.CastBallot(poll.ID, Ballot{VoterID: "v2", Choices: []string{"a"}})
+	fs.CastBallot(poll.ID, Ballot{Choices: []string{"a", "b"}})
+	fs.RetractBallot(poll.ID, "v2")
+	want, _ := fs.Get(poll.ID)
+	fs.journal.Close()
+
+	journal, _ := os.ReadFile(filepath.Join(dir, journalFileName))
+	if n := strings.Count(string(journal), `"poll":`); n != 1 {
+		t.Errorf("Expected only the creation to journal the poll, got %d", n)
+	}
+
+	reopened, err := OpenFileStore(dir, 0)
+	if err != nil {
+		t.Fatalf("Reopen failed: %v", err)
+	}
+	defer reopened.Close()
+	got, _ := reopened.Get(poll.ID)
+	if got.Version != want.Version || len(got.Ballots) != 2 || got.Options[0].Votes != want.Options[0].Votes || got.Options[1].Votes != want.Options[1].Votes {
+		t.Errorf("Expected %+v after replay, got %+v", want, got)
+	}
+	if ballot, _ := got.BallotOf("v1"); ballot.CastAt.IsZero() || ballot.Choices[0] != "b" {
+		t.Errorf("Expected v1's ballot replayed, got %+v", ballot)
+	}
+}
+
+// TestFileStoreSnapshotArchivesJournal checks that a snapshot
+// starts a fresh journal and keeps the old segment for auditing.
+func TestFileStoreSnapshotArchivesJournal(t *testing.T) {
+	dir := t.TempDir()
+
+	fs, err := OpenFileStore(dir, 0)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer fs.Close()
+
+	fs.Create(&Poll{Question: "Snap?", Options: []Option{{ID: "a", Text: "A"}}})
+	if err := fs.Snapshot(); err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+
+	info, err := os.Stat(filepath.Join(dir, journalFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 0 {
+		t.Errorf("Expected empty journal after snapshot, got %d bytes", info.Size())
+	}
+
+	archives, _ := filepath.Glob(filepath.Join(dir, "polls-*.wal"))
+	if len(archives) != 1 {
+		t.Errorf("Expected 1 archived segment, got %d", len(archives))
+	}
+
+	// The audit trail should still list the create
+	var out strings.Builder
+	if err := printAuditTrail(&out, dir); err != nil {
+		t.Fatalf("Audit failed: %v", err)
+	}
+	if !strings.Contains(out.String(), "\tcreate\t") {
+		t.Errorf("Expected create in audit trail, got %q", out.String())
+	}
+}
+
+// TestFileStoreTornTail ensures a half-written record at the end
+// of the journal is dropped and earlier records are kept.
+func TestFileStoreTornTail(t *testing.T) {
+	dir := t.TempDir()
+
+	fs, err := OpenFileStore(dir, 0)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	poll := &Poll{Question: "Torn?", Options: []Option{{ID: "a", Text: "A"}}}
+	fs.Create(poll)
+	fs.Vote(poll.ID, "a")
+	fs.journal.Close()
+
+	// Append garbage that looks like the start of another record
+	f, err := os.OpenFile(filepath.Join(dir, journalFileName), os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0x20, 0, 0, 0, 1, 2})
+	f.Close()
+
+	reopened, err := OpenFileStore(dir, 0)
+	if err != nil {
+		t.Fatalf("Reopen failed: %v", err)
+	}
+	got, _ := reopened.Get(poll.ID)
+	if got == nil || got.Options[0].Votes != 1 {
+		t.Fatalf("Expected poll with 1 vote, got %+v", got)
+	}
+
+	// New writes must land on a clean record boundary
+	reopened.Vote(poll.ID, "a")
+	reopened.journal.Close()
+
+	again, err := OpenFileStore(dir, 0)
+	if err != nil {
+		t.Fatalf("Second reopen failed: %v", err)
+	}
+	defer again.Close()
+	got, _ = again.Get(poll.ID)
+	if got == nil || got.Options[0].Votes != 2 {
+		t.Errorf("Expected 2 votes after second replay, got %+v", got)
+	}
+}
+
+// TestFileStoreKeepsBallots ensures ranked ballots, which are
+// not part of the public JSON, are persisted.
+func TestFileStoreKeepsBallots(t *testing.T) {
+	dir := t.TempDir()
+
+	fs, err := OpenFileStore(dir, 0)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	poll := &Poll{Question: "Rank?", Type: PollRanked, Options: []Option{{ID: "a", Text: "A"}, {ID: "b", Text: "B"}}}
+	fs.Create(poll)
+	fs.CastBallot(poll.ID, Ballot{Choices: []string{"b", "a"}})
+	fs.Close()
+
+	reopened, err := OpenFileStore(dir, 0)
+	if err != nil {
+		t.Fatalf("Reopen failed: %v", err)
+	}
+	defer reopened.Close()
+
+	got, _ := reopened.Get(poll.ID)
+	if got == nil || len(got.Ballots) != 1 || got.Ballots.List()[0].Choices[0] != "b" {
+		t.Errorf("Expected stored ballot after restart, got %+v", got)
+	}
+}
@@ -0,0 +1,115 @@
+// heartbeat.go - Keeping live connections alive and reaping dead ones
+// Idle streams get a comment line every sseHeartbeatInterval so proxies and
+// load balancers do not cut them, and every write has a deadline so a
+// client that stopped reading cannot hold a handler forever. A subscriber
+// whose channel stays full for longer than subscriberStallTimeout is
+// evicted by the broadcaster; its stream ends and the client reconnects
+// with Last-Event-ID. Reaped connections are counted in /api/stats.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// sseHeartbeatInterval is a variable so tests can shorten it
+var sseHeartbeatInterval = 15 * time.Second
+
+const (
+	sseRetryInterval       = 3 * time.Second
+	sseWriteTimeout        = 10 * time.Second
+	subscriberStallTimeout = 30 * time.Second
+)
+
+// subscriber is the broadcaster's view of one subscription
+type subscriber struct {
+	// fullSince is when a broadcast first found the channel full, or zero
+	fullSince time.Time
+}
+
+// BroadcasterStats describes live connections
+type BroadcasterStats struct {
+	Polls       int    `json:"polls"`
+	Subscribers int    `json:"subscribers"`
+	Reaped      uint64 `json:"reaped"`
+}
+
+// Stats returns the current connection counts
+func (b *Broadcaster) Stats() BroadcasterStats {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	stats := BroadcasterStats{Reaped: atomic.LoadUint64(&b.reaped)}
+	for _, subs := range b.subscribers {
+		if len(subs) > 0 {
+			stats.Polls++
+			stats.Subscribers += len(subs)
+		}
+	}
+	return stats
+}
+
+// countReaped records a connection dropped because it stopped accepting
+// writes
+func (b *Broadcaster) countReaped() {
+	atomic.AddUint64(&b.reaped, 1)
+}
+
+// stalled updates a subscriber whose channel is full and reports whether
+// it has been full for too long. The caller must hold b.mu.
+func (sub *subscriber) stalled(now time.Time) bool {
+	if sub.fullSince.IsZero() {
+		sub.fullSince = now
+		return false
+	}
+	return now.Sub(sub.fullSince) > subscriberStallTimeout
+}
+
+// sseConn writes events to one SSE client
+type sseConn struct {
+	w  http.ResponseWriter
+	rc *http.ResponseController
+}
+
+func newSSEConn(w http.ResponseWriter) *sseConn {
+	return &sseConn{w: w, rc: http.NewResponseController(w)}
+}
+
+// send writes s and flushes it, giving up after sseWriteTimeout
+func (c *sseConn) send(s string) error {
+	// Not every ResponseWriter supports deadlines; writes there simply
+	// have none
+	c.rc.SetWriteDeadline(time.Now().Add(sseWriteTimeout))
+	if _, err := fmt.Fprint(c.w, s); err != nil {
+		return err
+	}
+	return c.rc.Flush()
+}
+
+// sendEvents writes events in the text/event-stream format
+func (c *sseConn) sendEvents(events []Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+	return c.send(formatSSE(events))
+}
+
+// StatsHandler reports live connection counts as JSON
+func (app *App) StatsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeErrorJSON(w, ErrMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, app.broadcaster.Stats())
+}
+
+// reapConnection counts and logs a live connection dropped after a failed
+// write
+func (app *App) reapConnection(kind, pollID string, err error) {
+	app.broadcaster.countReaped()
+	log.Printf("Reaped %s connection for poll %s: %v", kind, pollID, err)
+}
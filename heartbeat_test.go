@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestBroadcasterEvictsStalledSubscriber ensures a subscriber whose channel
+// stays full is dropped and counted.
+func TestBroadcasterEvictsStalledSubscriber(t *testing.T) {
+	b := NewBroadcaster()
+	ch := b.Subscribe("p")
+	for i := 1; i <= cap(ch)+1; i++ {
+		b.Broadcast("p", uint64(i), "x")
+	}
+	if stats := b.Stats(); stats.Subscribers != 1 || stats.Reaped != 0 {
+		t.Fatalf("Lagging subscriber evicted too early: %+v", stats)
+	}
+
+	b.mu.Lock()
+	b.subscribers["p"][ch].fullSince = time.Now().Add(-subscriberStallTimeout - time.Second)
+	b.mu.Unlock()
+	b.Broadcast("p", uint64(cap(ch)+2), "x")
+
+	for range ch {
+		// Drain until the broadcaster closes the channel
+	}
+	if stats := b.Stats(); stats.Subscribers != 0 || stats.Reaped != 1 {
+		t.Errorf("Expected stalled subscriber reaped, got %+v", stats)
+	}
+	b.Unsubscribe("p", ch) // must not close the channel twice
+}
+
+// TestEventsHandlerRetryAndHeartbeat reads the retry hint and a heartbeat
+// from an idle stream.
+func TestEventsHandlerRetryAndHeartbeat(t *testing.T) {
+	defer func(d time.Duration) { sseHeartbeatInterval = d }(sseHeartbeatInterval)
+	sseHeartbeatInterval = 20 * time.Millisecond
+
+	app := NewApp()
+	poll := &Poll{Question: "Q?", Options: []Option{{ID: "a", Text: "A"}, {ID: "b", Text: "B"}}}
+	app.store.Create(poll)
+	server := httptest.NewServer(app.Routes())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/events/" + poll.ID)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	reader := bufio.NewReader(resp.Body)
+	first, _ := reader.ReadString('\n')
+	if first != "retry: 3000\n" {
+		t.Errorf("Expected retry hint first, got %q", first)
+	}
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Stream ended before a heartbeat: %v", err)
+		}
+		if strings.HasPrefix(line, ": heartbeat") {
+			break
+		}
+	}
+}
+
+// TestStatsHandler checks the connection counts endpoint.
+func TestStatsHandler(t *testing.T) {
+	app := NewApp()
+	ch := app.broadcaster.Subscribe("p")
+	defer app.broadcaster.Unsubscribe("p", ch)
+
+	rec := apiCall(t, app, http.MethodGet, "/api/stats", "", "")
+	var stats BroadcasterStats
+	json.NewDecoder(rec.Body).Decode(&stats)
+	if rec.Code != http.StatusOK || stats.Polls != 1 || stats.Subscribers != 1 {
+		t.Errorf("Unexpected stats %d %+v", rec.Code, stats)
+	}
+}
@@ -0,0 +1,134 @@
+// ids.go - Identifiers
+// IDs are 120 random bits in lowercase base32, after a prefix naming what
+// they identify, e.g. "poll_3k7x...": long enough that collisions are not a
+// concern at any number of polls, URL-safe, and recognizable in logs.
+// Stores still refuse an ID that is already taken. IDs made before this
+// scheme (8 hex characters) keep working.
+//
+// Polls also get a short share code, 12 characters from an alphabet
+// without look-alike characters, that /s/{code} redirects to the poll.
+// Codes are case-insensitive and may be written with dashes. They also
+// lead to unlisted polls, so they carry about 59 random bits: too many to
+// find one by guessing.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// IDKind says what an ID identifies; it is the ID's prefix
+type IDKind string
+
+// ID kinds
+const (
+	KindPoll     IDKind = "poll"
+	KindOption   IDKind = "opt"
+	KindBallot   IDKind = "ballot"
+	KindUser     IDKind = "user"
+	KindVoter    IDKind = "voter"
+	KindAPIKey   IDKind = "key"
+	KindWebhook  IDKind = "hook"
+	KindDelivery IDKind = "dlv"
+	KindNode     IDKind = "node"
+	KindQuiz     IDKind = "quiz"
+)
+
+const (
+	idRandomBytes   = 15
+	shareCodeLength = 12
+	// shareCodeAlphabet leaves out 0, 1, I, L and O
+	shareCodeAlphabet = "23456789ABCDEFGHJKMNPQRSTUVWXYZ"
+	// idAttempts bounds the retries when a new ID is taken
+	idAttempts = 5
+)
+
+// ID errors
+var (
+	ErrEntropy     = errors.New("not enough randomness to generate an ID")
+	ErrDuplicateID = errors.New("ID is already in use")
+)
+
+var idEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// randRead fills b with random bytes; tests replace it to simulate failures
+var randRead = rand.Read
+
+// NewID returns a new random ID of the given kind
+func NewID(kind IDKind) (string, error) {
+	b := make([]byte, idRandomBytes)
+	if _, err := randRead(b); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrEntropy, err)
+	}
+	return string(kind) + "_" + strings.ToLower(idEncoding.EncodeToString(b)), nil
+}
+
+// uniqueID returns a new ID of the given kind that taken rejects
+func uniqueID(kind IDKind, taken func(string) bool) (string, error) {
+	for i := 0; i < idAttempts; i++ {
+		id, err := NewID(kind)
+		if err != nil {
+			return "", err
+		}
+		if !taken(id) {
+			return id, nil
+		}
+	}
+	return "", ErrDuplicateID
+}
+
+// newShareCode returns a random share code
+func newShareCode() (string, error) {
+	b := make([]byte, shareCodeLength)
+	if _, err := randRead(b); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrEntropy, err)
+	}
+	code := make([]byte, shareCodeLength)
+	for i, c := range b {
+		// 256 is not a multiple of the alphabet size, so some characters
+		// are slightly likelier; that costs well under a bit of entropy
+		code[i] = shareCodeAlphabet[int(c)%len(shareCodeAlphabet)]
+	}
+	return string(code), nil
+}
+
+// uniqueShareCode returns a new share code that taken rejects
+func uniqueShareCode(taken func(string) bool) (string, error) {
+	for i := 0; i < idAttempts; i++ {
+		code, err := newShareCode()
+		if err != nil {
+			return "", err
+		}
+		if !taken(code) {
+			return code, nil
+		}
+	}
+	return "", ErrDuplicateID
+}
+
+// normalizeShareCode turns a share code as typed by a person into its
+// stored form
+func normalizeShareCode(code string) string {
+	return strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+}
+
+// ShareHandler redirects /s/{code} to the poll with that share code
+func (app *App) ShareHandler(w http.ResponseWriter, r *http.Request) {
+	code := normalizeShareCode(strings.TrimPrefix(r.URL.Path, "/s/"))
+	poll, err := app.store.GetByShareCode(code)
+	if errors.Is(err, ErrPollNotFound) {
+		http.Error(w, "Poll not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		status, body := errorBody(err)
+		http.Error(w, body.Message, status)
+		return
+	}
+	http.Redirect(w, r, "/poll/"+poll.ID, http.StatusFound)
+}
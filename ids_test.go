@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// failingRand simulates a system without randomness until the test ends
+func failingRand(t *testing.T) {
+	t.Helper()
+	randRead = func([]byte) (int, error) { return 0, errors.New("no entropy") }
+	t.Cleanup(func() { randRead = randReadDefault })
+}
+
+var randReadDefault = randRead
+
+// TestNewIDEntropy reports a failing random source instead of returning a
+// predictable ID.
+func TestNewIDEntropy(t *testing.T) {
+	failingRand(t)
+	if _, err := NewID(KindPoll); !errors.Is(err, ErrEntropy) {
+		t.Errorf("Expected ErrEntropy, got %v", err)
+	}
+	if err := NewStore().Create(&Poll{Question: "Q?"}); !errors.Is(err, ErrEntropy) {
+		t.Errorf("Expected creating a poll to fail, got %v", err)
+	}
+}
+
+// TestEntropyOnRequests serves pages and drops webhook deliveries instead
+// of failing when there is no randomness.
+func TestEntropyOnRequests(t *testing.T) {
+	app := NewApp()
+	failingRand(t)
+
+	rec := httptest.NewRecorder()
+	app.Routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusOK || len(rec.Result().Cookies()) != 0 {
+		t.Errorf("Expected the page without a voter cookie, got %d %v", rec.Code, rec.Result().Cookies())
+	}
+	if _, err := newDelivery(&Webhook{ID: "hook_a"}, WebhookClosed, &Poll{ID: "p1"}); !errors.Is(err, ErrEntropy) {
+		t.Errorf("Expected ErrEntropy for a delivery, got %v", err)
+	}
+}
+
+// TestStoreCreateDuplicate refuses to overwrite a poll with the same ID.
+func TestStoreCreateDuplicate(t *testing.T) {
+	store := NewStore()
+	store.Create(&Poll{ID: "poll_a", Question: "First"})
+	if err := store.Create(&Poll{ID: "poll_a", Question: "Second"}); !errors.Is(err, ErrDuplicateID) {
+		t.Fatalf("Expected ErrDuplicateID, got %v", err)
+	}
+	if poll, _ := store.Get("poll_a"); poll.Question != "First" {
+		t.Errorf("Expected the first poll kept, got %q", poll.Question)
+	}
+
+	// A generator that keeps hitting taken IDs gives up
+	if _, err := uniqueID(KindPoll, func(string) bool { return true }); !errors.Is(err, ErrDuplicateID) {
+		t.Errorf("Expected ErrDuplicateID after repeated collisions, got %v", err)
+	}
+}
+
+// TestShareCodes resolves share codes as people type them.
+func TestShareCodes(t *testing.T) {
+	app := NewApp()
+	poll := &Poll{Question: "Q?", Options: []Option{{ID: "a", Text: "A"}, {ID: "b", Text: "B"}}}
+	app.store.Create(poll)
+	if len(poll.ShareCode) != shareCodeLength || strings.ContainsAny(poll.ShareCode, "01ILO") {
+		t.Fatalf("Unexpected share code %q", poll.ShareCode)
+	}
+
+	typed := strings.ToLower(poll.ShareCode[:4] + "-" + poll.ShareCode[4:])
+	rec := httptest.NewRecorder()
+	app.Routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/s/"+typed, nil))
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != "/poll/"+poll.ID {
+		t.Errorf("Expected a redirect to the poll, got %d %q", rec.Code, rec.Header().Get("Location"))
+	}
+
+	app.store.Delete(poll.ID)
+	rec = httptest.NewRecorder()
+	app.Routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/s/"+poll.ShareCode, nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a deleted poll's code, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,315 @@
+// import.go - Bulk import of polls
+// POST /api/polls/import creates many polls at once from a JSON array of
+// poll definitions (the body of POST /api/polls) or from CSV with a header
+// row:
+//   question,options,type,max_choices,opens_at,expires_at
+// Options go in one column separated by "|", or in columns named option1,
+// option2 and so on. Only question and options are required; times are RFC
+// 3339. Each row is checked with the same rules as the create form, valid
+// rows are created and invalid ones reported by row, so a file can be fixed
+// and imported again. ?dry_run=1 only checks.
+//
+// "app import [-url URL] [-dry-run] FILE" sends a file to a running
+// server and prints the report.
+
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxImportSize limits the size of an import file
+const maxImportSize = 8 << 20
+
+// Import formats
+const (
+	ImportJSON = "json"
+	ImportCSV  = "csv"
+)
+
+// importRow is one poll definition read from an import file. Row is the
+// position in a JSON array or the line in a CSV file.
+type importRow struct {
+	Row   int
+	Input PollInput
+	Err   error
+}
+
+// ImportResult reports what became of one row
+type ImportResult struct {
+	Row      int           `json:"row"`
+	Question string        `json:"question,omitempty"`
+	ID       string        `json:"id,omitempty"`
+	Error    *apiErrorBody `json:"error,omitempty"`
+}
+
+// ImportReport is the response to an import
+type ImportReport struct {
+	Created int            `json:"created"`
+	Failed  int            `json:"failed"`
+	DryRun  bool           `json:"dry_run,omitempty"`
+	Results []ImportResult `json:"results"`
+}
+
+// parseImport reads the poll definitions of an import file. It fails only
+// if the file as a whole cannot be read; problems with single rows are
+// left in their Err.
+func parseImport(r io.Reader, format string) ([]importRow, error) {
+	switch format {
+	case ImportJSON:
+		return parseImportJSON(r)
+	case ImportCSV:
+		return parseImportCSV(r)
+	default:
+		return nil, &ValidationError{Field: "format", Message: "Format must be json or csv"}
+	}
+}
+
+func parseImportJSON(r io.Reader) ([]importRow, error) {
+	var items []json.RawMessage
+	if err := json.NewDecoder(r).Decode(&items); err != nil {
+		return nil, &ValidationError{Field: "body", Message: "Expected a JSON array of polls: " + err.Error()}
+	}
+
+	rows := make([]importRow, len(items))
+	for i, item := range items {
+		rows[i].Row = i + 1
+		dec := json.NewDecoder(bytes.NewReader(item))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&rows[i].Input); err != nil {
+			rows[i].Err = &ValidationError{Message: "Invalid poll: " + err.Error()}
+		}
+	}
+	return rows, nil
+}
+
+func parseImportCSV(r io.Reader) ([]importRow, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+
+	header, err := cr.Read()
+	if err != nil {
+		return nil, &ValidationError{Field: "body", Message: "Expected a CSV header row: " + err.Error()}
+	}
+	columns := make(map[string]int)
+	var optionColumns []int
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		columns[name] = i
+		if strings.HasPrefix(name, "option") && name != "options" {
+			optionColumns = append(optionColumns, i)
+		}
+	}
+	if _, ok := columns["question"]; !ok {
+		return nil, &ValidationError{Field: "body", Message: "CSV header needs a question column"}
+	}
+
+	var rows []importRow
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, &ValidationError{Field: "body", Message: "Invalid CSV: " + err.Error()}
+		}
+		line, _ := cr.FieldPos(0)
+		get := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+
+		row := importRow{Row: line, Input: PollInput{Question: get("question"), Type: get("type")}}
+		if options := get("options"); options != "" {
+			row.Input.Options = strings.Split(options, "|")
+		}
+		for _, i := range optionColumns {
+			if i < len(record) {
+				row.Input.Options = append(row.Input.Options, record[i])
+			}
+		}
+		row.Err = parseImportFields(&row.Input, get)
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// parseImportFields reads the CSV columns that are not plain text
+func parseImportFields(in *PollInput, get func(string) string) error {
+	if value := get("max_choices"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return &ValidationError{Field: "max_choices", Message: "Max choices must be a number"}
+		}
+		in.MaxChoices = n
+	}
+	for _, field := range []struct {
+		name string
+		dest *time.Time
+	}{{"opens_at", &in.OpensAt}, {"expires_at", &in.ExpiresAt}} {
+		if value := get(field.name); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return &ValidationError{Field: field.name, Message: field.name + " must be an RFC 3339 timestamp"}
+			}
+			*field.dest = t
+		}
+	}
+	return nil
+}
+
+// importPolls validates every row and, unless dryRun is set, creates the
+// valid ones, owned by ownerID
+func (app *App) importPolls(rows []importRow, dryRun bool, ownerID string) ImportReport {
+	report := ImportReport{DryRun: dryRun, Results: make([]ImportResult, 0, len(rows))}
+	for _, row := range rows {
+		result := ImportResult{Row: row.Row, Question: strings.TrimSpace(row.Input.Question)}
+		err := row.Err
+		var poll *Poll
+		if err == nil {
+			poll, err = buildPoll(row.Input)
+		}
+		if err == nil {
+			poll.OwnerID = ownerID
+		}
+		if err == nil && !dryRun {
+			err = app.store.Create(poll)
+		}
+		if err != nil {
+			_, body := errorBody(err)
+			result.Error = &body
+			report.Failed++
+		} else {
+			if !dryRun {
+				result.ID = poll.ID
+				app.pollCreated(poll)
+			}
+			report.Created++
+		}
+		report.Results = append(report.Results, result)
+	}
+	if report.Created > 0 && !dryRun {
+		log.Printf("Imported %d polls (%d rows failed)", report.Created, report.Failed)
+		app.scheduler.Wake()
+	}
+	return report
+}
+
+// importFormat picks the format of an import from ?format= or the
+// Content-Type
+func importFormat(r *http.Request) string {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return format
+	}
+	if strings.Contains(r.Header.Get("Content-Type"), "csv") {
+		return ImportCSV
+	}
+	return ImportJSON
+}
+
+// apiImport serves POST /api/polls/import
+func (app *App) apiImport(w http.ResponseWriter, r *http.Request) {
+	rows, err := parseImport(http.MaxBytesReader(w, r.Body, maxImportSize), importFormat(r))
+	if err != nil {
+		writeErrorJSON(w, err)
+		return
+	}
+	dryRun := r.URL.Query().Get("dry_run") == "1"
+	writeJSON(w, http.StatusOK, app.importPolls(rows, dryRun, ownerID(r)))
+}
+
+// runImportCommand implements "app import": it posts a file to a running
+// server and prints the report. It fails if any row was rejected. With
+// -key the polls are owned by the API key's user.
+func runImportCommand(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	server := flags.String("url", "http://localhost:8080", "address of the QuickPoll server")
+	dryRun := flags.Bool("dry-run", false, "check the file without creating polls")
+	apiKey := flags.String("key", os.Getenv("QUICKPOLL_API_KEY"), "API key with the polls:write scope; the polls are owned by its user")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("usage: app import [-url URL] [-key KEY] [-dry-run] FILE")
+	}
+	path := flags.Arg(0)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	contentType := "application/json"
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		contentType = "text/csv"
+	}
+	endpoint := strings.TrimSuffix(*server, "/") + "/api/polls/import"
+	if *dryRun {
+		endpoint += "?dry_run=1"
+	}
+
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if *apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+*apiKey)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var apiErr apiError
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		return fmt.Errorf("import failed: %s %s", resp.Status, apiErr.Error.Message)
+	}
+
+	var report ImportReport
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		return err
+	}
+	printImportReport(out, report)
+	if report.Failed > 0 {
+		return fmt.Errorf("%d of %d rows failed", report.Failed, len(report.Results))
+	}
+	return nil
+}
+
+// printImportReport writes one line per row and a summary
+func printImportReport(out io.Writer, report ImportReport) {
+	for _, result := range report.Results {
+		switch {
+		case result.Error != nil && result.Error.Field != "":
+			fmt.Fprintf(out, "row %d: %s: %s\n", result.Row, result.Error.Field, result.Error.Message)
+		case result.Error != nil:
+			fmt.Fprintf(out, "row %d: %s\n", result.Row, result.Error.Message)
+		case report.DryRun:
+			fmt.Fprintf(out, "row %d: ok %q\n", result.Row, result.Question)
+		default:
+			fmt.Fprintf(out, "row %d: created %s %q\n", result.Row, result.ID, result.Question)
+		}
+	}
+	verb := "created"
+	if report.DryRun {
+		verb = "valid"
+	}
+	fmt.Fprintf(out, "%d %s, %d failed\n", report.Created, verb, report.Failed)
+}
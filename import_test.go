@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// importCall posts an import file and decodes the report
+func importCall(t *testing.T, app *App, query, contentType, body string) ImportReport {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/api/polls/import"+query, strings.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	rec := httptest.NewRecorder()
+	app.Routes().ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	var report ImportReport
+	json.NewDecoder(rec.Body).Decode(&report)
+	return report
+}
+
+// TestImportCSV creates the valid rows and reports the others by line.
+func TestImportCSV(t *testing.T) {
+	app := NewApp()
+	csv := "question,options,type,max_choices,expires_at\n" +
+		"Retro format?,Start/Stop/Continue|Sailboat|4Ls,,,2030-01-01T10:00:00Z\n" +
+		",A|B,,,\n" +
+		"Pick two,A|B|C,multiple,2,\n" +
+		"Only one,A,,,\n" +
+		"Bad expiry,A|B,,,tomorrow\n"
+
+	report := importCall(t, app, "", "text/csv", csv)
+	if report.Created != 2 || report.Failed != 3 {
+		t.Fatalf("Expected 2 created and 3 failed, got %+v", report)
+	}
+
+	failed := map[int]string{}
+	for _, result := range report.Results {
+		if result.Error != nil {
+			failed[result.Row] = result.Error.Field
+		}
+	}
+	if failed[3] != "question" || failed[5] != "options" || failed[6] != "expires_at" {
+		t.Errorf("Unexpected failures by line: %v", failed)
+	}
+
+	poll, err := app.store.Get(report.Results[0].ID)
+	if err != nil || len(poll.Options) != 3 || poll.ExpiresAt.IsZero() {
+		t.Errorf("Unexpected imported poll %+v", poll)
+	}
+	if multi, _ := app.store.Get(report.Results[2].ID); multi == nil || multi.MaxChoices != 2 {
+		t.Errorf("Expected max choices from the CSV, got %+v", multi)
+	}
+}
+
+// TestImportJSON accepts option columns, rejects unknown fields and
+// creates nothing on a dry run.
+func TestImportJSON(t *testing.T) {
+	app := NewApp()
+	body := `[
+		{"question": "Lunch?", "options": ["Pizza", "Sushi"]},
+		{"question": "Typo", "option": ["A", "B"]},
+		{"question": "Ranked", "options": ["A", "B"], "type": "ranked"}
+	]`
+
+	report := importCall(t, app, "?dry_run=1", "application/json", body)
+	if !report.DryRun || report.Created != 2 || report.Failed != 1 || report.Results[1].Error == nil {
+		t.Fatalf("Unexpected dry run report %+v", report)
+	}
+	if report.Results[0].ID != "" || len(app.store.List()) != 0 {
+		t.Fatal("Dry run created polls")
+	}
+
+	report = importCall(t, app, "", "application/json", body)
+	if report.Created != 2 || len(app.store.List()) != 2 {
+		t.Errorf("Expected 2 polls created, got %+v", report)
+	}
+
+	rec := apiCall(t, app, http.MethodPost, "/api/polls/import", `{"question": "not an array"}`, "")
+	if code := decodeAPIError(t, rec); code != "validation_failed" {
+		t.Errorf("Expected validation_failed for a non-array body, got %q", code)
+	}
+}
+
+// TestImportCommand posts a file to a server and prints the report.
+func TestImportCommand(t *testing.T) {
+	app := NewApp()
+	server := httptest.NewServer(app.Routes())
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "polls.csv")
+	os.WriteFile(path, []byte("question,option1,option2\nSprint goal met?,Yes,No\nEmpty,,\n"), 0o644)
+
+	var out strings.Builder
+	err := runImportCommand([]string{"-url", server.URL, path}, &out)
+	if err == nil || !strings.Contains(err.Error(), "1 of 2 rows failed") {
+		t.Errorf("Expected a failure summary, got %v", err)
+	}
+	for _, want := range []string{`row 2: created`, `row 3: options: At least 2 options are required`, "1 created, 1 failed"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Expected %q in output:\n%s", want, out.String())
+		}
+	}
+	if len(app.store.List()) != 1 {
+		t.Errorf("Expected one poll on the server, got %d", len(app.store.List()))
+	}
+}
+
+// TestImportCommandKey owns imported polls by the API key's user.
+func TestImportCommandKey(t *testing.T) {
+	app := NewApp()
+	server := httptest.NewServer(app.Routes())
+	defer server.Close()
+	user := registerUser(t, app, "ada")
+	key, err := app.apiKeys.Create(user.ID, "import", []string{ScopePollsWrite})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "polls.csv")
+	os.WriteFile(path, []byte("question,option1,option2\nSprint goal met?,Yes,No\n"), 0o644)
+	var out strings.Builder
+	if err := runImportCommand([]string{"-url", server.URL, "-key", key.Key, path}, &out); err != nil {
+		t.Fatalf("Import failed: %v\n%s", err, out.String())
+	}
+	if polls := app.store.List(); len(polls) != 1 || polls[0].OwnerID != user.ID {
+		t.Errorf("Expected the poll owned by the key's user, got %+v", polls)
+	}
+
+	err = runImportCommand([]string{"-url", server.URL, "-key", "qpk_wrong", path}, &out)
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("Expected an unknown key refused, got %v", err)
+	}
+}
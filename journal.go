@@ -0,0 +1,205 @@
+// journal.go - Write-ahead journal
+// Each record is framed as a 4-byte little-endian payload length, a 4-byte
+// CRC-32C of the payload, and the payload itself. Appends are fsync'd
+// before they return, and a torn or corrupt tail left by a crash is cut off
+// when the journal is reopened.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"sync"
+)
+
+const (
+	journalHeaderSize = 8
+	maxJournalRecord  = 64 << 20 // anything larger is treated as corruption
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// errTornRecord marks a record that is incomplete or fails its checksum
+var errTornRecord = errors.New("torn or corrupt journal record")
+
+// Journal is an append-only file of length-prefixed, checksummed records
+type Journal struct {
+	path string
+	file *os.File
+	size int64
+	// failed is set when a record that was refused could not be removed
+	// again; appending after it would let it be replayed
+	failed error
+	mu     sync.Mutex
+}
+
+// OpenJournal replays every intact record in path through replay, truncates
+// anything after the last intact record and opens the file for appending.
+func OpenJournal(path string, replay func(payload []byte) error) (*Journal, error) {
+	valid, err := ReadJournal(path, replay)
+	if err != nil && !errors.Is(err, errTornRecord) {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if info.Size() > valid {
+		log.Printf("Truncating %d bytes of torn journal tail in %s", info.Size()-valid, path)
+		if err := f.Truncate(valid); err != nil {
+			f.Close()
+			return nil, err
+		}
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	if _, err := f.Seek(valid, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &Journal{path: path, file: f, size: valid}, nil
+}
+
+// ReadJournal calls fn for each intact record in path and returns the byte
+// offset just past the last one. It returns errTornRecord (wrapped) when it
+// stops early because of a damaged record. A missing file reads as empty.
+func ReadJournal(path string, fn func(payload []byte) error) (int64, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var offset int64
+	header := make([]byte, journalHeaderSize)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF {
+				return offset, nil
+			}
+			return offset, fmt.Errorf("%w at offset %d: short header", errTornRecord, offset)
+		}
+
+		length := binary.LittleEndian.Uint32(header[0:4])
+		sum := binary.LittleEndian.Uint32(header[4:8])
+		if length > maxJournalRecord {
+			return offset, fmt.Errorf("%w at offset %d: length %d", errTornRecord, offset, length)
+		}
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return offset, fmt.Errorf("%w at offset %d: short payload", errTornRecord, offset)
+		}
+		if crc32.Checksum(payload, crcTable) != sum {
+			return offset, fmt.Errorf("%w at offset %d: checksum mismatch", errTornRecord, offset)
+		}
+
+		if err := fn(payload); err != nil {
+			return offset, err
+		}
+		offset += journalHeaderSize + int64(length)
+	}
+}
+
+// Append writes one record and fsyncs it before returning
+func (j *Journal) Append(payload []byte) error {
+	if len(payload) > maxJournalRecord {
+		return fmt.Errorf("journal record too large (%d bytes)", len(payload))
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.failed != nil {
+		return fmt.Errorf("journal unusable: %w", j.failed)
+	}
+
+	buf := make([]byte, journalHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(buf[4:8], crc32.Checksum(payload, crcTable))
+	copy(buf[journalHeaderSize:], payload)
+
+	if _, err := j.file.Write(buf); err != nil {
+		// Drop the partial write so the next append starts on a boundary
+		j.dropTailLocked()
+		return err
+	}
+	if err := j.file.Sync(); err != nil {
+		// The caller treats the record as not written, so it must not be
+		// replayed on the next start either
+		j.dropTailLocked()
+		return err
+	}
+	j.size += int64(len(buf))
+	return nil
+}
+
+// dropTailLocked cuts the file back to its intact records. If that fails,
+// the journal refuses further appends. The caller must hold j.mu.
+func (j *Journal) dropTailLocked() {
+	err := j.file.Truncate(j.size)
+	if err == nil {
+		_, err = j.file.Seek(j.size, io.SeekStart)
+	}
+	if err == nil {
+		err = j.file.Sync()
+	}
+	if err != nil {
+		log.Printf("Failed to drop a refused record from %s: %v", j.path, err)
+		j.failed = err
+	}
+}
+
+// Size returns the number of bytes of intact records in the journal
+func (j *Journal) Size() int64 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.size
+}
+
+// Rotate moves the current journal to archivePath and starts a new, empty
+// journal at the original path
+func (j *Journal) Rotate(archivePath string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if err := os.Rename(j.path, archivePath); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(j.path, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0o644)
+	if err != nil {
+		// Keep appending to the old file under its archived name
+		return err
+	}
+	old := j.file
+	j.file = f
+	j.size = 0
+	// A refused record left behind is archived, not replayed
+	j.failed = nil
+	return old.Close()
+}
+
+// Close closes the journal file
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.file.Close()
+}
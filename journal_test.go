@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestJournalAppendAndReplay verifies that appended records
+// are read back in order.
+func TestJournalAppendAndReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.wal")
+
+	j, err := OpenJournal(path, func([]byte) error { return nil })
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	for _, rec := range []string{"one", "two", "three"} {
+		if err := j.Append([]byte(rec)); err != nil {
+			t.Fatalf("Append failed: %v", err)
+		}
+	}
+	j.Close()
+
+	var got []string
+	if _, err := ReadJournal(path, func(p []byte) error {
+		got = append(got, string(p))
+		return nil
+	}); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+
+	if len(got) != 3 || got[0] != "one" || got[2] != "three" {
+		t.Errorf("Unexpected records: %v", got)
+	}
+}
+
+// TestJournalChecksumMismatch ensures a record with a bad
+// checksum is truncated along with everything after it.
+func TestJournalChecksumMismatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.wal")
+
+	j, _ := OpenJournal(path, func([]byte) error { return nil })
+	j.Append([]byte("good"))
+	j.Append([]byte("flipped"))
+	j.Close()
+
+	// Corrupt one byte of the second payload
+	data, _ := os.ReadFile(path)
+	data[len(data)-1] ^= 0xff
+	os.WriteFile(path, data, 0o644)
+
+	var got [][]byte
+	j, err := OpenJournal(path, func(p []byte) error {
+		got = append(got, p)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Reopen failed: %v", err)
+	}
+	defer j.Close()
+
+	if len(got) != 1 || !bytes.Equal(got[0], []byte("good")) {
+		t.Errorf("Expected only the good record, got %q", got)
+	}
+
+	// The damaged record should be gone from disk
+	info, _ := os.Stat(path)
+	if info.Size() != int64(journalHeaderSize+len("good")) {
+		t.Errorf("Expected truncated journal, got %d bytes", info.Size())
+	}
+}
+
+// TestJournalDropsRefusedRecord checks that a record whose fsync failed is
+// not replayed, and that a journal unable to drop it refuses appends.
+func TestJournalDropsRefusedRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.wal")
+
+	j, _ := OpenJournal(path, func([]byte) error { return nil })
+	j.Append([]byte("kept"))
+	// Stands in for a record written before its fsync failed
+	lost := make([]byte, journalHeaderSize+4)
+	binary.LittleEndian.PutUint32(lost[0:4], 4)
+	binary.LittleEndian.PutUint32(lost[4:8], crc32.Checksum([]byte("lost"), crcTable))
+	copy(lost[journalHeaderSize:], "lost")
+	j.file.Write(lost)
+	j.mu.Lock()
+	j.dropTailLocked()
+	j.mu.Unlock()
+	if err := j.Append([]byte("next")); err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+	j.Close()
+
+	var got []string
+	ReadJournal(path, func(p []byte) error {
+		got = append(got, string(p))
+		return nil
+	})
+	if len(got) != 2 || got[0] != "kept" || got[1] != "next" {
+		t.Errorf("Expected the refused record gone, got %q", got)
+	}
+
+	j, _ = OpenJournal(path, func([]byte) error { return nil })
+	j.file.Close()
+	j.mu.Lock()
+	j.dropTailLocked()
+	j.mu.Unlock()
+	if err := j.Append([]byte("after")); err == nil {
+		t.Error("Expected appends refused once a record could not be dropped")
+	}
+}
@@ -6,16 +6,22 @@
 package main
 
 import (
-	"crypto/rand"
-	"encoding/hex"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
+	"io"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
@@ -23,13 +29,65 @@ import (
 // MODELS
 // ============================================================================
 
+// PollType selects how ballots are cast and counted
+type PollType string
+
+const (
+	// PollSingle polls take one option per ballot (the default)
+	PollSingle PollType = "single"
+	// PollRanked polls take an ordered ballot and are counted by
+	// instant runoff (see ranked.go)
+	PollRanked PollType = "ranked"
+	// PollMultiple polls let each ballot select up to MaxChoices options
+	PollMultiple PollType = "multiple"
+	// PollApproval polls let each ballot select any number of options
+	PollApproval PollType = "approval"
+)
+
 // Poll represents a voting poll with multiple options
 type Poll struct {
-	ID        string    `json:"id"`
-	Question  string    `json:"question"`
-	Options   []Option  `json:"options"`
-	CreatedAt time.Time `json:"created_at"`
-	ExpiresAt time.Time `json:"expires_at,omitempty"`
+	ID          string        `json:"id"`
+	Question    string        `json:"question"`
+	Type        PollType      `json:"type,omitempty"`
+	MaxChoices  int           `json:"max_choices,omitempty"`
+	Options     []Option      `json:"options"`
+	Ballots     BallotBox     `json:"-"`
+	BallotCount int           `json:"ballot_count,omitempty"`
+	Runoff      *RunoffResult `json:"runoff,omitempty"`
+	Version     uint64        `json:"version"`
+	Status      PollStatus    `json:"status"`
+	Final       *PollResult   `json:"final,omitempty"`
+	CreatedAt   time.Time     `json:"created_at"`
+	OpensAt     time.Time     `json:"opens_at,omitempty"`
+	ExpiresAt   time.Time     `json:"expires_at,omitempty"`
+	OwnerID     string        `json:"owner_id,omitempty"`
+	ShareCode   string        `json:"share_code,omitempty"`
+	Visibility  Visibility    `json:"visibility,omitempty"`
+	Members     []string      `json:"members,omitempty"`
+	Attribution Attribution   `json:"attribution,omitempty"`
+	// ResultsVisibility says who sees the counts (see results.go)
+	ResultsVisibility ResultsVisibility `json:"results_visibility,omitempty"`
+	// ResultsHidden is set on copies whose results were removed
+	ResultsHidden bool `json:"results_hidden,omitempty"`
+	// QuizID is the quiz the poll is a question of (see quiz.go)
+	QuizID string `json:"quiz_id,omitempty"`
+	// Answers holds the IDs of the correct options, kept secret until the
+	// poll closes
+	Answers []string `json:"-"`
+	// Roster lists voter names by option for attributed polls (see
+	// attribution.go)
+	Roster map[string][]string `json:"roster,omitempty"`
+	// Voters holds hashes of who voted in anonymous polls
+	Voters map[string]bool `json:"-"`
+	// voterSalt keys the hashes in Voters; the store sets it
+	voterSalt []byte
+	// PasswordHash protects polls with VisibilityPassword (see
+	// visibility.go)
+	PasswordHash string `json:"-"`
+	// OwnerName is filled in when a poll is displayed (see accounts.go)
+	OwnerName string `json:"owner_name,omitempty"`
+	// Viewers is filled in when a poll is sent to clients (see presence.go)
+	Viewers int `json:"viewers,omitempty"`
 }
 
 // Option represents a single voting option
@@ -39,6 +97,20 @@ type Option struct {
 	Votes int    `json:"votes"`
 }
 
+// Ballot is a single submission. Choices holds option IDs; for ranked
+// polls they are in order of preference.
+type Ballot struct {
+	VoterID   string    `json:"voter_id,omitempty"`
+	VoterName string    `json:"voter_name,omitempty"`
+	Choices   []string  `json:"choices"`
+	CastAt    time.Time `json:"cast_at"`
+}
+
+// IsRanked reports whether the poll is counted by instant runoff
+func (p *Poll) IsRanked() bool {
+	return p.Type == PollRanked
+}
+
 // TotalVotes returns the total number of votes in a poll
 func (p *Poll) TotalVotes() int {
 	total := 0
@@ -62,77 +134,198 @@ func (p *Poll) VotePercentage(optionID string) float64 {
 	return 0
 }
 
+// Errors returned by PollRepository implementations
+var (
+	ErrPollNotFound   = errors.New("poll not found")
+	ErrPollExpired    = errors.New("poll has expired")
+	ErrOptionNotFound = errors.New("option not found")
+	ErrInvalidBallot  = errors.New("invalid ballot")
+	ErrNoBallot       = errors.New("no vote to retract")
+)
+
+// ValidationError reports poll input that breaks the creation rules
+type ValidationError struct {
+	Field   string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Message
+}
+
 // IsExpired checks if the poll has expired
 func (p *Poll) IsExpired() bool {
-	if p.ExpiresAt.IsZero() {
-		return false
+	return p.StatusAt(time.Now()) == PollClosed
+}
+
+// optionIndex returns the index of an option, or -1 if it does not exist
+func (p *Poll) optionIndex(optionID string) int {
+	for i := range p.Options {
+		if p.Options[i].ID == optionID {
+			return i
+		}
 	}
-	return time.Now().After(p.ExpiresAt)
+	return -1
 }
 
 // ============================================================================
 // STORAGE (In-Memory with Thread Safety)
 // ============================================================================
 
+// PollRepository is the storage surface the handlers depend on. The
+// in-memory Store and the file-backed FileStore both implement it, and
+// the backend is chosen at startup (see newRepositoryFromEnv).
+type PollRepository interface {
+	Create(poll *Poll) error
+	Get(id string) (*Poll, error)
+	Vote(pollID, optionID string) (*Poll, error)
+	CastBallot(pollID string, ballot Ballot) (*Poll, error)
+	RetractBallot(pollID, voterID string) (*Poll, error)
+	Update(id string, fn func(*Poll) error) (*Poll, error)
+	List() []*Poll
+	Delete(id string) bool
+	GetByShareCode(code string) (*Poll, error)
+}
+
 // Store handles thread-safe poll storage
 type Store struct {
 	polls map[string]*Poll
-	mu    sync.RWMutex
+	codes map[string]string // share code to poll ID
+	// voterKey derives the voter salt of each poll (see attribution.go)
+	voterKey []byte
+	mu       sync.RWMutex
 }
 
 // NewStore creates a new poll store
 func NewStore() *Store {
 	return &Store{
-		polls: make(map[string]*Poll),
+		polls:    make(map[string]*Poll),
+		codes:    make(map[string]string),
+		voterKey: newVoterKey(),
 	}
 }
 
-// Create adds a new poll to the store
+// Create adds a new poll to the store. It fails with ErrDuplicateID if the
+// poll's ID is already taken.
 func (s *Store) Create(poll *Poll) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if err := preparePoll(poll, s.takenLocked); err != nil {
+		return err
+	}
+	poll.voterSalt = voterSalt(s.voterKey, poll.ID)
+	s.polls[poll.ID] = poll
+	s.codes[poll.ShareCode] = poll.ID
+	return nil
+}
+
+// takenLocked reports whether a poll ID or share code is in use. The
+// caller must hold s.mu.
+func (s *Store) takenLocked(id string) bool {
+	_, poll := s.polls[id]
+	_, code := s.codes[id]
+	return poll || code
+}
+
+// taken reports whether a poll ID or share code is in use
+func (s *Store) taken(id string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.takenLocked(id)
+}
+
+// preparePoll assigns the ID, share code, creation time and first version
+// of a new poll. taken reports IDs and share codes already in use.
+func preparePoll(poll *Poll, taken func(string) bool) error {
 	if poll.ID == "" {
-		poll.ID = generateID()
+		id, err := uniqueID(KindPoll, taken)
+		if err != nil {
+			return err
+		}
+		poll.ID = id
+	} else if taken(poll.ID) {
+		return ErrDuplicateID
 	}
+	code, err := uniqueShareCode(taken)
+	if err != nil {
+		return err
+	}
+	poll.ShareCode = code
 	poll.CreatedAt = time.Now()
-	s.polls[poll.ID] = poll
+	poll.Version = 1
+	poll.Status = poll.StatusAt(poll.CreatedAt)
 	return nil
 }
 
 // Get retrieves a poll by ID
-func (s *Store) Get(id string) (*Poll, bool) {
+func (s *Store) Get(id string) (*Poll, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
 	poll, exists := s.polls[id]
 	if !exists {
-		return nil, false
+		return nil, ErrPollNotFound
 	}
-	return copyPoll(poll), true
+	return copyPoll(poll), nil
 }
 
 // Vote adds a vote to an option
 func (s *Store) Vote(pollID, optionID string) (*Poll, error) {
+	return s.CastBallot(pollID, Ballot{Choices: []string{optionID}})
+}
+
+// CastBallot records a ballot for a poll
+func (s *Store) CastBallot(pollID string, ballot Ballot) (*Poll, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	poll, exists := s.polls[pollID]
 	if !exists {
-		return nil, fmt.Errorf("poll not found")
+		return nil, ErrPollNotFound
 	}
 
-	if poll.IsExpired() {
-		return nil, fmt.Errorf("poll has expired")
+	if err := poll.addBallot(ballot); err != nil {
+		return nil, err
 	}
+	return copyPoll(poll), nil
+}
 
-	for i := range poll.Options {
-		if poll.Options[i].ID == optionID {
-			poll.Options[i].Votes++
-			return copyPoll(poll), nil
-		}
+// RetractBallot removes a voter's ballot from a poll
+func (s *Store) RetractBallot(pollID, voterID string) (*Poll, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	poll, exists := s.polls[pollID]
+	if !exists {
+		return nil, ErrPollNotFound
+	}
+
+	if err := poll.retractBallot(voterID); err != nil {
+		return nil, err
+	}
+	return copyPoll(poll), nil
+}
+
+// Update applies fn to a copy of a poll and stores the result if fn
+// succeeds
+func (s *Store) Update(id string, fn func(*Poll) error) (*Poll, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	poll, exists := s.polls[id]
+	if !exists {
+		return nil, ErrPollNotFound
+	}
+
+	updated := copyPoll(poll)
+	if err := fn(updated); err != nil {
+		return nil, err
 	}
-	return nil, fmt.Errorf("option not found")
+	updated.ID = poll.ID
+	updated.Version = poll.Version + 1
+	s.polls[id] = updated
+	return copyPoll(updated), nil
 }
 
 // List returns all polls sorted by creation date (newest first)
@@ -157,24 +350,56 @@ func (s *Store) Delete(id string) bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if _, exists := s.polls[id]; exists {
+	if poll, exists := s.polls[id]; exists {
 		delete(s.polls, id)
+		delete(s.codes, poll.ShareCode)
 		return true
 	}
 	return false
 }
 
-// copyPoll creates a deep copy of a poll
+// GetByShareCode retrieves a poll by its share code
+func (s *Store) GetByShareCode(code string) (*Poll, error) {
+	s.mu.RLock()
+	id, exists := s.codes[code]
+	s.mu.RUnlock()
+	if !exists || code == "" {
+		return nil, ErrPollNotFound
+	}
+	return s.Get(id)
+}
+
+// restore puts a poll into the store exactly as given, keeping its ID and
+// timestamps. It is used when rebuilding state from disk.
+func (s *Store) restore(poll *Poll) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	poll.voterSalt = voterSalt(s.voterKey, poll.ID)
+	s.polls[poll.ID] = poll
+	if poll.ShareCode != "" {
+		s.codes[poll.ShareCode] = poll.ID
+	}
+}
+
+// copyPoll creates a deep copy of a poll. Stored ballots and runoff results
+// are never modified in place, so their contents are shared.
 func copyPoll(p *Poll) *Poll {
-	options := make([]Option, len(p.Options))
-	copy(options, p.Options)
-	return &Poll{
-		ID:        p.ID,
-		Question:  p.Question,
-		Options:   options,
-		CreatedAt: p.CreatedAt,
-		ExpiresAt: p.ExpiresAt,
+	cp := *p
+	cp.Options = make([]Option, len(p.Options))
+	copy(cp.Options, p.Options)
+	if p.Ballots != nil {
+		cp.Ballots = make(BallotBox, len(p.Ballots))
+		for k, b := range p.Ballots {
+			cp.Ballots[k] = b
+		}
 	}
+	if p.Voters != nil {
+		cp.Voters = make(map[string]bool, len(p.Voters))
+		for k, v := range p.Voters {
+			cp.Voters[k] = v
+		}
+	}
+	return &cp
 }
 
 // ============================================================================
@@ -183,58 +408,99 @@ func copyPoll(p *Poll) *Poll {
 
 // Broadcaster manages SSE connections for real-time updates
 type Broadcaster struct {
-	subscribers map[string]map[chan string]bool
+	subscribers map[string]map[chan Event]*subscriber
+	history     map[string][]Event
+	reaped      uint64
 	mu          sync.RWMutex
+
+	// Viewer counts (see presence.go)
+	remote          map[string]map[string]remoteViewers
+	presencePending map[string]bool
+	onPresence      func(pollID string, local int)
 }
 
 // NewBroadcaster creates a new SSE broadcaster
 func NewBroadcaster() *Broadcaster {
 	return &Broadcaster{
-		subscribers: make(map[string]map[chan string]bool),
+		subscribers: make(map[string]map[chan Event]*subscriber),
+		history:     make(map[string][]Event),
+
+		remote:          make(map[string]map[string]remoteViewers),
+		presencePending: make(map[string]bool),
 	}
 }
 
 // Subscribe creates a new subscription for a poll
-func (b *Broadcaster) Subscribe(pollID string) chan string {
+func (b *Broadcaster) Subscribe(pollID string) chan Event {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
-	ch := make(chan string, 10)
+	ch := make(chan Event, 10)
 	if b.subscribers[pollID] == nil {
-		b.subscribers[pollID] = make(map[chan string]bool)
+		b.subscribers[pollID] = make(map[chan Event]*subscriber)
 	}
-	b.subscribers[pollID][ch] = true
+	b.subscribers[pollID][ch] = &subscriber{}
+	b.presenceChanged(pollID, true)
 
 	log.Printf("New subscriber for poll %s (total: %d)", pollID, len(b.subscribers[pollID]))
 	return ch
 }
 
-// Unsubscribe removes a subscription
-func (b *Broadcaster) Unsubscribe(pollID string, ch chan string) {
+// Unsubscribe removes a subscription. It is a no-op for subscriptions the
+// broadcaster already evicted.
+func (b *Broadcaster) Unsubscribe(pollID string, ch chan Event) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
-	if subs, exists := b.subscribers[pollID]; exists {
+	subs := b.subscribers[pollID]
+	if _, exists := subs[ch]; exists {
 		delete(subs, ch)
 		close(ch)
+		b.presenceChanged(pollID, true)
 		log.Printf("Unsubscribed from poll %s (remaining: %d)", pollID, len(subs))
 	}
 }
 
-// Broadcast sends data to all subscribers of a poll
-func (b *Broadcaster) Broadcast(pollID string, data string) {
-	b.mu.RLock()
-	defer b.mu.RUnlock()
+// Broadcast records version id of a poll and sends it to all subscribers.
+// Versions older than the latest one recorded are stale and dropped.
+func (b *Broadcaster) Broadcast(pollID string, id uint64, data string) {
+	b.BroadcastEvent(pollID, Event{ID: id, Data: data})
+}
+
+// BroadcastEvent is Broadcast for events with a type. It reports false for
+// stale events.
+func (b *Broadcaster) BroadcastEvent(pollID string, ev Event) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
 
-	if subs, exists := b.subscribers[pollID]; exists {
-		for ch := range subs {
-			select {
-			case ch <- data:
-			default:
-				// Channel is full, skip
+	id := ev.ID
+	if !b.record(pollID, ev) {
+		return false
+	}
+
+	now := time.Now()
+	subs := b.subscribers[pollID]
+	for ch, sub := range subs {
+		select {
+		case ch <- ev:
+			sub.fullSince = time.Time{}
+		default:
+			if sub.stalled(now) {
+				// Closing the channel ends the stream; the client
+				// reconnects and resumes from Last-Event-ID
+				delete(subs, ch)
+				close(ch)
+				b.countReaped()
+				b.presenceChanged(pollID, true)
+				log.Printf("Evicted stalled subscriber for poll %s (remaining: %d)", pollID, len(subs))
+				continue
 			}
+			// The subscriber catches up from history once it has drained
+			// its channel
+			log.Printf("Subscriber for poll %s is lagging; it will resync from event %d", pollID, id)
 		}
 	}
+	return true
 }
 
 // ============================================================================
@@ -243,16 +509,99 @@ func (b *Broadcaster) Broadcast(pollID string, data string) {
 
 // App holds application dependencies
 type App struct {
-	store       *Store
-	broadcaster *Broadcaster
+	store         PollRepository
+	broadcaster   *Broadcaster
+	voters        *VoterSigner
+	scheduler     *Scheduler
+	bus           MessageBus
+	coalescer     *Coalescer
+	activity      *ActivityFeed
+	webhooks      *Webhooks
+	users         *Users
+	apiKeys       *APIKeys
+	quizzes       *Quizzes
+	sessions      *VoterSigner
+	node          string          // identifies this node on the bus
+	adminPassword string          // enables /admin when set
+	adminUsers    map[string]bool // accounts that may manage every poll
 }
 
-// NewApp creates a new application instance
+// NewApp creates a new application instance backed by in-memory storage
 func NewApp() *App {
-	return &App{
-		store:       NewStore(),
-		broadcaster: NewBroadcaster(),
+	return NewAppWithRepository(NewStore())
+}
+
+// NewAppWithRepository creates a new application instance using the given
+// poll repository
+func NewAppWithRepository(repo PollRepository) *App {
+	return NewAppWithBus(repo, NewLocalBus())
+}
+
+// NewAppWithBus creates a new application instance that shares poll events
+// with other nodes through bus
+func NewAppWithBus(repo PollRepository, bus MessageBus) *App {
+	app := &App{
+		store:         repo,
+		broadcaster:   NewBroadcaster(),
+		activity:      NewActivityFeed(),
+		webhooks:      NewWebhooks(),
+		voters:        NewVoterSigner(sessionSecret()),
+		users:         NewUsers(),
+		apiKeys:       NewAPIKeys(),
+		quizzes:       NewQuizzes(),
+		sessions:      NewVoterSigner(sessionSecret()),
+		bus:           bus,
+		node:          newNodeID(),
+		adminPassword: adminPasswordFromEnv(),
+		adminUsers:    adminUsersFromEnv(),
 	}
+	app.scheduler = NewScheduler(app)
+	app.coalescer = NewCoalescer(0, app.publishEvent)
+	app.broadcaster.onPresence = app.publishPresence
+	bus.Subscribe(func(msg BusMessage) {
+		if msg.Presence != nil {
+			app.receivePresence(msg.PollID, msg.Presence)
+			return
+		}
+		if msg.Activity != nil {
+			app.activity.Publish(*msg.Activity)
+			return
+		}
+		app.deliverEvent(msg.PollID, msg.Event)
+	})
+	return app
+}
+
+// Routes registers all handlers on a new mux
+func (app *App) Routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", app.IndexHandler)
+	mux.HandleFunc("/create", app.CreateHandler)
+	mux.HandleFunc("/poll/", app.PollHandler)
+	mux.HandleFunc("/s/", app.ShareHandler)
+	mux.Handle("/vote/", app.withAPIKey(app.VoteHandler))
+	mux.HandleFunc("/events", app.ActivityHandler)
+	mux.HandleFunc("/events/", app.EventsHandler)
+	mux.HandleFunc("/ws", app.ActivityWebSocketHandler)
+	mux.HandleFunc("/ws/", app.WebSocketHandler)
+	mux.Handle("/api/polls", app.withAPIKey(app.APIPollsHandler))
+	mux.Handle("/api/polls/", app.withAPIKey(app.APIPollHandler))
+	mux.Handle("/api/webhooks", app.withAPIKey(app.APIWebhooksHandler))
+	mux.Handle("/api/webhooks/", app.withAPIKey(app.APIWebhooksHandler))
+	mux.Handle("/api/stats", app.withAPIKey(app.StatsHandler))
+	mux.Handle("/api/quizzes", app.withAPIKey(app.APIQuizzesHandler))
+	mux.Handle("/api/quizzes/", app.withAPIKey(app.APIQuizzesHandler))
+	mux.HandleFunc("/quiz/", app.QuizHandler)
+	mux.HandleFunc("/api/keys", app.APIKeysHandler)
+	mux.HandleFunc("/api/keys/", app.APIKeysHandler)
+	mux.HandleFunc("/admin", app.AdminHandler)
+	mux.HandleFunc("/admin/", app.AdminHandler)
+	mux.HandleFunc("/register", app.RegisterHandler)
+	mux.HandleFunc("/login", app.LoginHandler)
+	mux.HandleFunc("/logout", app.LogoutHandler)
+	mux.HandleFunc("/my", app.MyPollsHandler)
+	mux.HandleFunc("/my/", app.MyPollsHandler)
+	return app.withVoter(app.withUser(mux))
 }
 
 // IndexHandler displays the home page with all polls
@@ -262,10 +611,14 @@ func (app *App) IndexHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	polls := app.store.List()
+	polls := app.listPolls(r)
+	app.withViewers(polls...)
+	app.withOwners(polls...)
+	app.withResults(r, polls...)
 	tmpl := template.Must(template.New("index").Parse(indexTemplate))
 	tmpl.Execute(w, map[string]interface{}{
 		"Polls": polls,
+		"User":  userFromRequest(r),
 	})
 }
 
@@ -287,44 +640,57 @@ func (app *App) CreateHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	question := strings.TrimSpace(r.FormValue("question"))
-	optionsRaw := r.FormValue("options")
-
-	if question == "" || optionsRaw == "" {
-		http.Error(w, "Question and options are required", http.StatusBadRequest)
-		return
+	input := PollInput{
+		Question:          r.FormValue("question"),
+		Options:           strings.Split(r.FormValue("options"), "\n"),
+		Type:              r.FormValue("type"),
+		Visibility:        r.FormValue("visibility"),
+		Password:          r.FormValue("password"),
+		Members:           parseMembers(r.FormValue("members")),
+		Attribution:       r.FormValue("attribution"),
+		ResultsVisibility: r.FormValue("results_visibility"),
+		Correct:           parseCorrect(r.FormValue("correct")),
 	}
 
-	optionTexts := strings.Split(optionsRaw, "\n")
-	var options []Option
-	for _, text := range optionTexts {
-		text = strings.TrimSpace(text)
-		if text != "" {
-			options = append(options, Option{
-				ID:   generateID(),
-				Text: text,
-			})
+	if input.Type == string(PollMultiple) {
+		maxChoices, err := strconv.Atoi(r.FormValue("max_choices"))
+		if err != nil {
+			http.Error(w, "Max choices must be a positive number", http.StatusBadRequest)
+			return
 		}
+		input.MaxChoices = maxChoices
 	}
 
-	if len(options) < 2 {
-		http.Error(w, "At least 2 options are required", http.StatusBadRequest)
-		return
-	}
-
-	poll := &Poll{
-		Question: question,
-		Options:  options,
+	if opensIn := r.FormValue("opens_in"); opensIn != "" {
+		if minutes, err := time.ParseDuration(opensIn + "m"); err == nil {
+			input.OpensAt = time.Now().Add(minutes)
+		}
 	}
 
 	if expiry := r.FormValue("expiry"); expiry != "" {
 		if hours, err := time.ParseDuration(expiry + "h"); err == nil {
-			poll.ExpiresAt = time.Now().Add(hours)
+			input.ExpiresAt = time.Now().Add(hours)
+			if !input.OpensAt.IsZero() {
+				// The duration counts from the opening time
+				input.ExpiresAt = input.OpensAt.Add(hours)
+			}
 		}
 	}
 
-	app.store.Create(poll)
+	poll, err := buildPoll(input)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	poll.OwnerID = ownerID(r)
+
+	if err := app.store.Create(poll); err != nil {
+		http.Error(w, "Failed to save poll", http.StatusInternalServerError)
+		return
+	}
 	log.Printf("Created poll: %s - %s", poll.ID, poll.Question)
+	app.pollCreated(poll)
+	app.scheduler.Wake()
 
 	http.Redirect(w, r, "/poll/"+poll.ID, http.StatusSeeOther)
 }
@@ -332,63 +698,212 @@ func (app *App) CreateHandler(w http.ResponseWriter, r *http.Request) {
 // PollHandler displays a single poll
 func (app *App) PollHandler(w http.ResponseWriter, r *http.Request) {
 	pollID := strings.TrimPrefix(r.URL.Path, "/poll/")
-	poll, exists := app.store.Get(pollID)
-	if !exists {
+	poll, err := app.store.Get(pollID)
+	if err == nil && poll.Visibility == VisibilityPassword && r.Method == http.MethodPost {
+		app.unlock(w, r, poll)
+		return
+	}
+	if err == nil {
+		switch err = app.checkView(r, poll); err {
+		case ErrPollLocked:
+			w.WriteHeader(http.StatusForbidden)
+			renderUnlockForm(w, poll, "")
+			return
+		}
+	}
+	if errors.Is(err, ErrPollNotFound) {
 		http.Error(w, "Poll not found", http.StatusNotFound)
 		return
 	}
+	if err != nil {
+		status, body := errorBody(err)
+		http.Error(w, body.Message, status)
+		return
+	}
 
+	voterID, _, _ := pollIdentity(r, poll)
+	app.withResults(r, poll)
 	funcMap := template.FuncMap{
 		"percentage": func(optID string) float64 {
+			return poll.BallotPercentage(optID)
+		},
+		"selectionShare": func(optID string) float64 {
 			return poll.VotePercentage(optID)
 		},
+		"ranks": func() []int {
+			ranks := make([]int, len(poll.Options))
+			for i := range ranks {
+				ranks[i] = i + 1
+			}
+			return ranks
+		},
+		"optionText": func(optID string) string {
+			if i := poll.optionIndex(optID); i >= 0 {
+				return poll.Options[i].Text
+			}
+			return ""
+		},
+		"myChoice": func(optID string) bool {
+			ballot, _ := poll.BallotOf(voterID)
+			for _, id := range ballot.Choices {
+				if id == optID {
+					return true
+				}
+			}
+			return false
+		},
+		"myRank": func(optID string) int {
+			ballot, _ := poll.BallotOf(voterID)
+			for i, id := range ballot.Choices {
+				if id == optID {
+					return i + 1
+				}
+			}
+			return 0
+		},
+		"status": func() PollStatus {
+			return poll.StatusAt(time.Now())
+		},
+		"hasVoted": func() bool {
+			return poll.HasVoted(voterID)
+		},
+		"isCorrect": func(optID string) bool {
+			if poll.Final == nil {
+				return false
+			}
+			for _, id := range poll.Final.Correct {
+				if id == optID {
+					return true
+				}
+			}
+			return false
+		},
+		"voterNames": func(optID string) string {
+			return strings.Join(poll.Roster[optID], ", ")
+		},
+		"roundCount": func(round RunoffRound, optID string) string {
+			if count, ok := round.Counts[optID]; ok {
+				return strconv.Itoa(count)
+			}
+			return "–"
+		},
 	}
 
-	tmpl := template.Must(template.New("poll").Funcs(funcMap).Parse(pollTemplate))
+	tmpl := template.Must(template.New("poll").Funcs(funcMap).Parse(pollTemplate + runoffTemplate))
+	app.withViewers(poll)
 	tmpl.Execute(w, poll)
 }
 
-// VoteHandler handles voting
+// VoteHandler handles voting. POST casts (or changes) the caller's vote and
+// DELETE retracts it. Clients that accept JSON get JSON errors.
 func (app *App) VoteHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		voteError(w, r, ErrMethodNotAllowed)
 		return
 	}
 
 	pollID := strings.TrimPrefix(r.URL.Path, "/vote/")
-	optionID := r.FormValue("option")
+	if _, err := app.viewablePoll(r, pollID); err != nil {
+		voteError(w, r, err)
+		return
+	}
+	voterID, voterName, err := app.ballotIdentity(r, pollID)
+	if err != nil {
+		voteError(w, r, err)
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		poll, err := app.store.RetractBallot(pollID, voterID)
+		if err != nil {
+			voteError(w, r, err)
+			return
+		}
+		log.Printf("Vote retracted for poll %s", pollID)
+		app.publishVote(w, r, poll)
+		return
+	}
 
-	if optionID == "" {
-		http.Error(w, "Option is required", http.StatusBadRequest)
+	if err := r.ParseMultipartForm(1 << 20); err != nil && err != http.ErrNotMultipart {
+		voteError(w, r, fmt.Errorf("%w: invalid form data", ErrInvalidBallot))
 		return
 	}
 
-	poll, err := app.store.Vote(pollID, optionID)
+	var choices []string
+	if current, err := app.store.Get(pollID); err == nil && current.IsRanked() {
+		ranking, err := rankingFromForm(r, current)
+		if err != nil {
+			voteError(w, r, fmt.Errorf("%w: %v", ErrInvalidBallot, err))
+			return
+		}
+		choices = ranking
+	} else {
+		for _, optionID := range r.Form["option"] {
+			if optionID != "" {
+				choices = append(choices, optionID)
+			}
+		}
+	}
+
+	poll, err := app.store.CastBallot(pollID, Ballot{VoterID: voterID, VoterName: voterName, Choices: choices})
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		voteError(w, r, err)
 		return
 	}
 
-	log.Printf("Vote recorded for poll %s, option %s", pollID, optionID)
+	log.Printf("Vote recorded for poll %s, options %s", pollID, strings.Join(choices, ","))
+	app.notifyVote(poll)
+	app.publishVote(w, r, poll)
+}
 
-	data, _ := json.Marshal(poll)
-	app.broadcaster.Broadcast(pollID, string(data))
+// publishVote broadcasts the updated poll and answers the voter with JSON
+// or a redirect back to the poll page
+func (app *App) publishVote(w http.ResponseWriter, r *http.Request, poll *Poll) {
+	app.broadcastPoll(poll)
 
-	if r.Header.Get("Accept") == "application/json" {
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(poll)
+	if wantsJSON(r) {
+		writeJSON(w, http.StatusOK, app.resultsFor(r, poll))
 		return
 	}
 
-	http.Redirect(w, r, "/poll/"+pollID, http.StatusSeeOther)
+	http.Redirect(w, r, "/poll/"+poll.ID, http.StatusSeeOther)
+}
+
+// broadcastPoll sends the current state of a poll to its subscribers
+func (app *App) broadcastPoll(poll *Poll) {
+	app.broadcastPollEvent(poll, "")
+}
+
+// broadcastPollEvent sends the current state of a poll as an event of the
+// given type
+func (app *App) broadcastPollEvent(poll *Poll, eventType string) {
+	app.coalescer.Submit(poll, eventType)
+}
+
+// SetBroadcastInterval limits updates of each poll to one per interval;
+// zero sends every update
+func (app *App) SetBroadcastInterval(interval time.Duration) {
+	app.coalescer = NewCoalescer(interval, app.publishEvent)
+}
+
+// voteError answers a failed vote as JSON for clients that accept it and
+// as plain text otherwise
+func voteError(w http.ResponseWriter, r *http.Request, err error) {
+	if wantsJSON(r) {
+		writeErrorJSON(w, err)
+		return
+	}
+	status, body := errorBody(err)
+	http.Error(w, body.Message, status)
 }
 
 // EventsHandler handles SSE connections for real-time updates
 func (app *App) EventsHandler(w http.ResponseWriter, r *http.Request) {
 	pollID := strings.TrimPrefix(r.URL.Path, "/events/")
 
-	if _, exists := app.store.Get(pollID); !exists {
-		http.Error(w, "Poll not found", http.StatusNotFound)
+	if _, err := app.viewablePoll(r, pollID); err != nil {
+		status, body := errorBody(err)
+		http.Error(w, body.Message, status)
 		return
 	}
 
@@ -397,34 +912,53 @@ func (app *App) EventsHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Connection", "keep-alive")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 
+	if _, ok := w.(http.Flusher); !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
 	ch := app.broadcaster.Subscribe(pollID)
 	defer app.broadcaster.Unsubscribe(pollID, ch)
 
-	flusher, ok := w.(http.Flusher)
-	if !ok {
-		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+	conn := newSSEConn(w)
+	cursor := app.newEventCursor(pollID, lastEventID(r))
+	cursor.deltas = r.URL.Query().Get("delta") == "1"
+	cursor.results = app.newResultsGate(r, pollID)
+	retry := fmt.Sprintf("retry: %d\n\n", sseRetryInterval.Milliseconds())
+	events := append(cursor.start(), presenceEvent(app.broadcaster.Viewers(pollID)))
+	if err := conn.send(retry + formatSSE(events)); err != nil {
+		app.reapConnection("SSE", pollID, err)
 		return
 	}
 
-	poll, _ := app.store.Get(pollID)
-	data, _ := json.Marshal(poll)
-	fmt.Fprintf(w, "data: %s\n\n", data)
-	flusher.Flush()
+	heartbeat := time.NewTicker(sseHeartbeatInterval)
+	defer heartbeat.Stop()
 
 	for {
+		var err error
 		select {
-		case msg := <-ch:
-			fmt.Fprintf(w, "data: %s\n\n", msg)
-			flusher.Flush()
+		case ev, ok := <-ch:
+			if !ok {
+				return
+			}
+			err = conn.sendEvents(cursor.receive(ev, len(ch) == 0))
+		case <-heartbeat.C:
+			err = conn.send(": heartbeat\n\n")
 		case <-r.Context().Done():
 			return
 		}
+		if err != nil {
+			app.reapConnection("SSE", pollID, err)
+			return
+		}
 	}
 }
 
-// APIListHandler returns all polls as JSON
+// APIListHandler returns the polls listed for the caller as JSON
 func (app *App) APIListHandler(w http.ResponseWriter, r *http.Request) {
-	polls := app.store.List()
+	polls := app.listPolls(r)
+	app.withViewers(polls...)
+	app.withResults(r, polls...)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(polls)
 }
@@ -433,10 +967,104 @@ func (app *App) APIListHandler(w http.ResponseWriter, r *http.Request) {
 // UTILITIES
 // ============================================================================
 
-func generateID() string {
-	bytes := make([]byte, 4)
-	rand.Read(bytes)
-	return hex.EncodeToString(bytes)
+// PollInput is a poll definition as submitted by a client, before
+// validation
+type PollInput struct {
+	Question   string    `json:"question"`
+	Options    []string  `json:"options"`
+	Type       string    `json:"type,omitempty"`
+	MaxChoices int       `json:"max_choices,omitempty"`
+	OpensAt    time.Time `json:"opens_at,omitempty"`
+	ExpiresAt  time.Time `json:"expires_at,omitempty"`
+	Visibility string    `json:"visibility,omitempty"`
+	Password   string    `json:"password,omitempty"`
+	Members    []string  `json:"members,omitempty"`
+	// Attribution is "attributed", "anonymous" or empty (see
+	// attribution.go)
+	Attribution string `json:"attribution,omitempty"`
+	// ResultsVisibility is "always" (or empty), "after_vote",
+	// "after_close" or "owner" (see results.go)
+	ResultsVisibility string `json:"results_visibility,omitempty"`
+	// Correct lists the texts of the correct options, for quizzes
+	Correct []string `json:"correct,omitempty"`
+}
+
+// buildPoll validates a poll definition and turns it into a new Poll.
+// Blank options are dropped; a poll needs a question and at least two
+// options.
+func buildPoll(in PollInput) (*Poll, error) {
+	question := strings.TrimSpace(in.Question)
+	if question == "" {
+		return nil, &ValidationError{Field: "question", Message: "Question is required"}
+	}
+
+	var options []Option
+	for _, text := range in.Options {
+		text = strings.TrimSpace(text)
+		if text != "" {
+			id, err := NewID(KindOption)
+			if err != nil {
+				return nil, err
+			}
+			options = append(options, Option{
+				ID:   id,
+				Text: text,
+			})
+		}
+	}
+	if len(options) < 2 {
+		return nil, &ValidationError{Field: "options", Message: "At least 2 options are required"}
+	}
+
+	pollType, err := parsePollType(in.Type)
+	if err != nil {
+		return nil, &ValidationError{Field: "type", Message: err.Error()}
+	}
+
+	if err := validateSchedule(in.OpensAt, in.ExpiresAt); err != nil {
+		return nil, err
+	}
+
+	poll := &Poll{
+		Question:  question,
+		Type:      pollType,
+		Options:   options,
+		OpensAt:   in.OpensAt,
+		ExpiresAt: in.ExpiresAt,
+	}
+
+	if pollType == PollMultiple {
+		if in.MaxChoices < 1 {
+			return nil, &ValidationError{Field: "max_choices", Message: "Max choices must be a positive number"}
+		}
+		poll.MaxChoices = in.MaxChoices
+	}
+	if err := applyVisibility(poll, in); err != nil {
+		return nil, err
+	}
+	if poll.Attribution, err = parseAttribution(in.Attribution); err != nil {
+		return nil, &ValidationError{Field: "attribution", Message: err.Error()}
+	}
+	if poll.ResultsVisibility, err = parseResultsVisibility(in.ResultsVisibility); err != nil {
+		return nil, &ValidationError{Field: "results_visibility", Message: err.Error()}
+	}
+	if poll.Answers, err = parseAnswers(poll, in.Correct); err != nil {
+		return nil, err
+	}
+	return poll, nil
+}
+
+// parsePollType validates a poll type submitted by a client; empty means
+// single choice
+func parsePollType(value string) (PollType, error) {
+	switch PollType(value) {
+	case "", PollSingle:
+		return PollSingle, nil
+	case PollRanked, PollMultiple, PollApproval:
+		return PollType(value), nil
+	default:
+		return "", fmt.Errorf("unknown poll type %q", value)
+	}
 }
 
 // ============================================================================
@@ -465,6 +1093,11 @@ const indexTemplate = baseStyle + `
                 🗳️ QuickPoll
             </h1>
             <p class="text-gray-600 text-lg">Create instant polls with real-time results</p>
+            <p class="text-sm text-gray-500 mt-4">
+                {{if .User}}Signed in as {{.User.Name}} · <a href="/my" class="text-indigo-600 hover:text-indigo-800">My polls</a> ·
+                <form method="POST" action="/logout" class="inline"><button class="text-indigo-600 hover:text-indigo-800">Sign out</button></form>
+                {{else}}<a href="/login" class="text-indigo-600 hover:text-indigo-800">Sign in</a> or <a href="/register" class="text-indigo-600 hover:text-indigo-800">register</a> to manage your polls{{end}}
+            </p>
         </header>
 
         <div class="text-center mb-8">
@@ -478,19 +1111,24 @@ const indexTemplate = baseStyle + `
 
         <div class="space-y-4">
             {{if .Polls}}
-                <h2 class="text-2xl font-semibold text-gray-800 mb-4">Recent Polls</h2>
+                <h2 class="text-2xl font-semibold text-gray-800 mb-4" id="poll-list">Recent Polls</h2>
                 {{range .Polls}}
-                <a href="/poll/{{.ID}}" class="block bg-white rounded-xl shadow-md hover:shadow-lg transition-shadow duration-200 p-6 border border-gray-100">
+                <a href="/poll/{{.ID}}" data-poll-id="{{.ID}}" class="block bg-white rounded-xl shadow-md hover:shadow-lg transition-shadow duration-200 p-6 border border-gray-100">
                     <div class="flex justify-between items-start">
                         <div class="flex-1">
                             <h3 class="text-xl font-semibold text-gray-800 mb-2">{{.Question}}</h3>
                             <div class="flex items-center text-sm text-gray-500 space-x-4">
-                                <span>{{.TotalVotes}} votes</span>
+                                <span class="poll-votes">{{if .ResultsHidden}}Results hidden{{else}}{{.TotalBallots}} votes{{end}}</span>
+                                {{if .Viewers}}<span>{{.Viewers}} watching</span>{{end}}
                                 <span>{{len .Options}} options</span>
+                                {{if .IsRanked}}<span>Ranked choice</span>{{end}}
+                                {{if .IsMultiSelect}}<span>Select up to {{.ChoiceLimit}}</span>{{end}}
+                                {{if .OwnerName}}<span>by {{.OwnerName}}</span>{{end}}
+                                {{if not .IsPublic}}<span>🔒 {{.Visibility}}</span>{{end}}
                             </div>
                         </div>
-                        <span class="inline-flex items-center px-3 py-1 rounded-full text-xs font-medium {{if .IsExpired}}bg-red-100 text-red-800{{else}}bg-green-100 text-green-800{{end}}">
-                            {{if .IsExpired}}Expired{{else}}Active{{end}}
+                        <span class="poll-status inline-flex items-center px-3 py-1 rounded-full text-xs font-medium {{if .IsExpired}}bg-red-100 text-red-800{{else if .IsDraft}}bg-yellow-100 text-yellow-800{{else}}bg-green-100 text-green-800{{end}}">
+                            {{if .IsExpired}}Closed{{else if .IsDraft}}Scheduled{{else}}Active{{end}}
                         </span>
                     </div>
                 </a>
@@ -503,6 +1141,68 @@ const indexTemplate = baseStyle + `
             {{end}}
         </div>
     </div>
+
+    <script>
+        // Keep the list current from the activity stream
+        var statusBadges = {
+            draft: ['Scheduled', 'bg-yellow-100 text-yellow-800'],
+            open: ['Active', 'bg-green-100 text-green-800'],
+            closed: ['Closed', 'bg-red-100 text-red-800']
+        };
+
+        function pollCard(id) {
+            return document.querySelector('[data-poll-id="' + id + '"]');
+        }
+
+        function updateCard(card, poll) {
+            var multi = poll.type === 'multiple' || poll.type === 'approval';
+            var total = poll.options.reduce(function(sum, opt) { return sum + opt.votes; }, 0);
+            card.querySelector('.poll-votes').textContent = poll.results_hidden ? 'Results hidden' : (multi ? (poll.ballot_count || 0) : total) + ' votes';
+            var badge = statusBadges[poll.status];
+            if (badge) {
+                var el = card.querySelector('.poll-status');
+                el.textContent = badge[0];
+                el.className = 'poll-status inline-flex items-center px-3 py-1 rounded-full text-xs font-medium ' + badge[1];
+            }
+        }
+
+        function newCard(poll) {
+            var card = document.createElement('a');
+            card.href = '/poll/' + poll.id;
+            card.dataset.pollId = poll.id;
+            card.className = 'block bg-white rounded-xl shadow-md hover:shadow-lg transition-shadow duration-200 p-6 border border-gray-100';
+            card.innerHTML = '<div class="flex justify-between items-start"><div class="flex-1">' +
+                '<h3 class="text-xl font-semibold text-gray-800 mb-2"></h3>' +
+                '<div class="flex items-center text-sm text-gray-500 space-x-4">' +
+                '<span class="poll-votes"></span><span>' + poll.options.length + ' options</span></div></div>' +
+                '<span class="poll-status"></span></div>';
+            card.querySelector('h3').textContent = poll.question;
+            updateCard(card, poll);
+            return card;
+        }
+
+        var activity = new EventSource('/events');
+        activity.addEventListener('created', function(event) {
+            var poll = JSON.parse(event.data).poll;
+            var heading = document.getElementById('poll-list');
+            if (!heading) {
+                location.reload();
+                return;
+            }
+            heading.after(newCard(poll));
+        });
+        ['votes', 'closed'].forEach(function(type) {
+            activity.addEventListener(type, function(event) {
+                var a = JSON.parse(event.data);
+                var card = pollCard(a.poll_id);
+                if (card) updateCard(card, a.poll);
+            });
+        });
+        activity.addEventListener('deleted', function(event) {
+            var card = pollCard(JSON.parse(event.data).poll_id);
+            if (card) card.remove();
+        });
+    </script>
 ` + baseEnd
 
 const createTemplate = baseStyle + `
@@ -533,6 +1233,50 @@ const createTemplate = baseStyle + `
                         placeholder="Option 1&#10;Option 2&#10;Option 3"></textarea>
                 </div>
 
+                <div>
+                    <label for="correct" class="block text-sm font-medium text-gray-700 mb-2">
+                        Correct answers (quiz questions only, one per line)
+                    </label>
+                    <textarea id="correct" name="correct" rows="2"
+                        class="w-full px-4 py-3 border border-gray-300 rounded-xl focus:ring-2 focus:ring-indigo-500 focus:border-indigo-500"
+                        placeholder="Option 2"></textarea>
+                    <p class="mt-1 text-xs text-gray-500">Leave empty for an ordinary poll. Correct answers are revealed when voting closes.</p>
+                </div>
+
+                <div>
+                    <label for="type" class="block text-sm font-medium text-gray-700 mb-2">
+                        Voting method
+                    </label>
+                    <select id="type" name="type"
+                        class="w-full px-4 py-3 border border-gray-300 rounded-xl focus:ring-2 focus:ring-indigo-500 focus:border-indigo-500">
+                        <option value="single">Single choice</option>
+                        <option value="ranked">Ranked choice (instant runoff)</option>
+                        <option value="multiple">Multiple choice (select up to N)</option>
+                        <option value="approval">Approval (select all that apply)</option>
+                    </select>
+                </div>
+
+                <div id="max-choices-field" class="hidden">
+                    <label for="max_choices" class="block text-sm font-medium text-gray-700 mb-2">
+                        Maximum selections per voter
+                    </label>
+                    <input type="number" id="max_choices" name="max_choices" min="1" value="2"
+                        class="w-full px-4 py-3 border border-gray-300 rounded-xl focus:ring-2 focus:ring-indigo-500 focus:border-indigo-500">
+                </div>
+
+                <div>
+                    <label for="opens_in" class="block text-sm font-medium text-gray-700 mb-2">
+                        Opens
+                    </label>
+                    <select id="opens_in" name="opens_in"
+                        class="w-full px-4 py-3 border border-gray-300 rounded-xl focus:ring-2 focus:ring-indigo-500 focus:border-indigo-500">
+                        <option value="">Now</option>
+                        <option value="5">In 5 minutes</option>
+                        <option value="15">In 15 minutes</option>
+                        <option value="60">In 1 hour</option>
+                    </select>
+                </div>
+
                 <div>
                     <label for="expiry" class="block text-sm font-medium text-gray-700 mb-2">
                         Expires in (optional)
@@ -546,6 +1290,60 @@ const createTemplate = baseStyle + `
                     </select>
                 </div>
 
+                <div>
+                    <label for="visibility" class="block text-sm font-medium text-gray-700 mb-2">
+                        Who can see it
+                    </label>
+                    <select id="visibility" name="visibility"
+                        class="w-full px-4 py-3 border border-gray-300 rounded-xl focus:ring-2 focus:ring-indigo-500 focus:border-indigo-500">
+                        <option value="public">Everyone (listed on the home page)</option>
+                        <option value="unlisted">Anyone with the link</option>
+                        <option value="private">Only the members I name</option>
+                        <option value="password">Anyone with a password</option>
+                    </select>
+                </div>
+
+                <div>
+                    <label for="attribution" class="block text-sm font-medium text-gray-700 mb-2">
+                        Ballots
+                    </label>
+                    <select id="attribution" name="attribution"
+                        class="w-full px-4 py-3 border border-gray-300 rounded-xl focus:ring-2 focus:ring-indigo-500 focus:border-indigo-500">
+                        <option value="">Standard (voters can change their vote)</option>
+                        <option value="attributed">Attributed (signed-in voters, names shown)</option>
+                        <option value="anonymous">Strictly anonymous (only counts are kept)</option>
+                    </select>
+                </div>
+
+                <div>
+                    <label for="results_visibility" class="block text-sm font-medium text-gray-700 mb-2">
+                        Who sees the results
+                    </label>
+                    <select id="results_visibility" name="results_visibility"
+                        class="w-full px-4 py-3 border border-gray-300 rounded-xl focus:ring-2 focus:ring-indigo-500 focus:border-indigo-500">
+                        <option value="always">Everyone, live</option>
+                        <option value="after_vote">Voters, once they have voted</option>
+                        <option value="after_close">Everyone, once voting closes</option>
+                        <option value="owner">Only me</option>
+                    </select>
+                </div>
+
+                <div id="members-field" class="hidden">
+                    <label for="members" class="block text-sm font-medium text-gray-700 mb-2">
+                        Members (user names, separated by commas)
+                    </label>
+                    <input type="text" id="members" name="members"
+                        class="w-full px-4 py-3 border border-gray-300 rounded-xl focus:ring-2 focus:ring-indigo-500 focus:border-indigo-500">
+                </div>
+
+                <div id="password-field" class="hidden">
+                    <label for="password" class="block text-sm font-medium text-gray-700 mb-2">
+                        Poll password
+                    </label>
+                    <input type="password" id="password" name="password" autocomplete="new-password"
+                        class="w-full px-4 py-3 border border-gray-300 rounded-xl focus:ring-2 focus:ring-indigo-500 focus:border-indigo-500">
+                </div>
+
                 <button type="submit"
                     class="w-full py-3 px-6 bg-gradient-to-r from-indigo-600 to-purple-600 text-white font-semibold rounded-xl shadow-lg hover:shadow-xl transform hover:-translate-y-0.5 transition-all duration-200">
                     Create Poll
@@ -553,6 +1351,18 @@ const createTemplate = baseStyle + `
             </form>
         </div>
     </div>
+
+    <script>
+        var typeSelect = document.getElementById('type');
+        typeSelect.addEventListener('change', function() {
+            document.getElementById('max-choices-field').classList.toggle('hidden', typeSelect.value !== 'multiple');
+        });
+        var visibilitySelect = document.getElementById('visibility');
+        visibilitySelect.addEventListener('change', function() {
+            document.getElementById('members-field').classList.toggle('hidden', visibilitySelect.value !== 'private');
+            document.getElementById('password-field').classList.toggle('hidden', visibilitySelect.value !== 'password');
+        });
+    </script>
 ` + baseEnd
 
 const pollTemplate = baseStyle + `
@@ -563,46 +1373,116 @@ const pollTemplate = baseStyle + `
 
         <div class="bg-white rounded-2xl shadow-xl p-8">
             <div class="flex items-start justify-between mb-6">
-                <h1 class="text-2xl font-bold text-gray-800">{{.Question}}</h1>
+                <h1 id="question" class="text-2xl font-bold text-gray-800">{{.Question}}</h1>
                 <span id="live-indicator" class="inline-flex items-center px-3 py-1 rounded-full text-xs font-medium bg-green-100 text-green-800">
                     <span class="w-2 h-2 bg-green-500 rounded-full mr-2 animate-pulse"></span>
                     Live
                 </span>
             </div>
 
-            <p class="text-gray-500 mb-6" id="total-votes">Total votes: {{.TotalVotes}}</p>
+            <p class="text-gray-500 mb-6"><span id="viewers">{{.Viewers}} watching</span> · <span id="total-votes">{{if .ResultsHidden}}results hidden{{else}}{{.TotalBallots}} voted{{end}}</span>{{if .ShareCode}} · Share code <a href="/s/{{.ShareCode}}" class="font-mono text-indigo-600">{{.ShareCode}}</a>{{end}}</p>
+
+            {{if .IsDraft}}
+            <p class="mb-4 px-4 py-3 rounded-xl bg-yellow-50 text-yellow-800 text-sm">Voting opens at {{.OpensAt.Format "Jan 2, 15:04 MST"}}.</p>
+            {{else if .IsExpired}}
+            <p class="mb-4 px-4 py-3 rounded-xl bg-red-50 text-red-800 text-sm">Voting has closed. These are the final results.</p>
+            {{end}}
+
+            {{if .QuizID}}
+            <p class="mb-4 px-4 py-3 rounded-xl bg-amber-50 text-amber-800 text-sm">This is a quiz question. <a href="/quiz/{{.QuizID}}" class="font-medium underline">See the leaderboard</a></p>
+            {{end}}
+
+            {{if .ResultsHidden}}
+            <p class="mb-4 px-4 py-3 rounded-xl bg-gray-50 text-gray-700 text-sm">{{if eq .ResultsVisibility "after_vote"}}Results are shown once you have voted.{{else if eq .ResultsVisibility "after_close"}}Results are shown when voting closes.{{else}}Only the poll's owner can see the results.{{end}}</p>
+            {{end}}
+
+            {{if .IsAttributed}}
+            <p class="mb-4 px-4 py-3 rounded-xl bg-indigo-50 text-indigo-800 text-sm">Votes in this poll are shown with the voter's name. Sign in to vote.</p>
+            {{else if .IsAnonymous}}
+            <p class="mb-4 px-4 py-3 rounded-xl bg-indigo-50 text-indigo-800 text-sm">This poll is anonymous: only counts are kept, so a vote cannot be changed once cast.</p>
+            {{end}}
+
+            {{if .IsRanked}}
+            <p class="text-sm text-gray-500 mb-4">Rank as many options as you like, 1 being your favourite.</p>
+            {{else if eq .Type "approval"}}
+            <p class="text-sm text-gray-500 mb-4">Select all that apply.</p>
+            {{else if .IsMultiSelect}}
+            <p class="text-sm text-gray-500 mb-4">Select up to {{.ChoiceLimit}}.</p>
+            {{end}}
 
             <form id="vote-form" method="POST" action="/vote/{{.ID}}" class="space-y-4">
                 <div id="options-container" class="space-y-3">
                     {{range .Options}}
+                    {{if $.IsRanked}}
+                    <div class="option-item relative" data-option-id="{{.ID}}">
+                        <div class="block p-4 border-2 border-gray-200 rounded-xl {{if not $.IsOpen}}opacity-50{{end}}">
+                            <div class="flex justify-between items-center mb-2">
+                                <span class="font-medium text-gray-800">{{.Text}}{{if isCorrect .ID}} <span class="correct-answer text-green-700">✓ correct</span>{{end}}</span>
+                                {{$mine := myRank .ID}}
+                                <select name="rank-{{.ID}}" class="rank-select px-2 py-1 border border-gray-300 rounded-lg text-sm" {{if not $.IsOpen}}disabled{{end}}>
+                                    <option value="">–</option>
+                                    {{range ranks}}<option value="{{.}}" {{if eq . $mine}}selected{{end}}>{{.}}</option>{{end}}
+                                </select>
+                            </div>
+                            {{if not $.ResultsHidden}}
+                            <div class="h-2 bg-gray-200 rounded-full overflow-hidden">
+                                <div class="vote-bar h-full bg-gradient-to-r from-indigo-500 to-purple-500 rounded-full" 
+                                     style="width: {{printf "%.1f" (percentage .ID)}}%"></div>
+                            </div>
+                            <div class="flex justify-between mt-1">
+                                <span class="vote-count text-xs text-gray-500">{{.Votes}} first choices</span>
+                                <span class="vote-percentage text-xs text-gray-500">{{printf "%.1f" (percentage .ID)}}%</span>
+                            </div>
+                            {{end}}
+                            {{if and $.IsAttributed (not $.ResultsHidden)}}<p class="voter-names mt-1 text-xs text-gray-500">{{voterNames .ID}}</p>{{end}}
+                        </div>
+                    </div>
+                    {{else}}
                     <div class="option-item relative" data-option-id="{{.ID}}">
-                        <input type="radio" id="opt-{{.ID}}" name="option" value="{{.ID}}" 
-                            class="sr-only peer" {{if $.IsExpired}}disabled{{end}}>
+                        <input type="{{if $.IsMultiSelect}}checkbox{{else}}radio{{end}}" id="opt-{{.ID}}" name="option" value="{{.ID}}" 
+                            class="sr-only peer" {{if myChoice .ID}}checked{{end}} {{if not $.IsOpen}}disabled{{end}}>
                         <label for="opt-{{.ID}}" 
                             class="block p-4 border-2 border-gray-200 rounded-xl cursor-pointer 
                                    peer-checked:border-indigo-500 peer-checked:bg-indigo-50 
-                                   hover:border-gray-300 transition-colors {{if $.IsExpired}}opacity-50 cursor-not-allowed{{end}}">
+                                   hover:border-gray-300 transition-colors {{if not $.IsOpen}}opacity-50 cursor-not-allowed{{end}}">
                             <div class="flex justify-between items-center mb-2">
-                                <span class="font-medium text-gray-800">{{.Text}}</span>
-                                <span class="vote-count text-sm text-gray-500">{{.Votes}} votes</span>
+                                <span class="font-medium text-gray-800">{{.Text}}{{if isCorrect .ID}} <span class="correct-answer text-green-700">✓ correct</span>{{end}}</span>
+                                {{if not $.ResultsHidden}}<span class="vote-count text-sm text-gray-500">{{.Votes}} votes</span>{{end}}
                             </div>
+                            {{if not $.ResultsHidden}}
                             <div class="h-2 bg-gray-200 rounded-full overflow-hidden">
                                 <div class="vote-bar h-full bg-gradient-to-r from-indigo-500 to-purple-500 rounded-full" 
                                      style="width: {{printf "%.1f" (percentage .ID)}}%"></div>
                             </div>
                             <div class="text-right mt-1">
-                                <span class="vote-percentage text-xs text-gray-500">{{printf "%.1f" (percentage .ID)}}%</span>
+                                <span class="vote-percentage text-xs text-gray-500">{{printf "%.1f" (percentage .ID)}}%{{if $.IsMultiSelect}} of voters{{end}}</span>
+                                {{if $.IsMultiSelect}}
+                                <span class="selection-percentage text-xs text-gray-400">· {{printf "%.1f" (selectionShare .ID)}}% of selections</span>
+                                {{end}}
                             </div>
+                            {{end}}
+                            {{if and $.IsAttributed (not $.ResultsHidden)}}<p class="voter-names mt-1 text-xs text-gray-500">{{voterNames .ID}}</p>{{end}}
                         </label>
                     </div>
                     {{end}}
+                    {{end}}
                 </div>
 
-                {{if not .IsExpired}}
+                {{if and .IsOpen .IsAnonymous hasVoted}}
+                <div class="text-center py-4 bg-green-50 rounded-xl">
+                    <span class="text-green-700 font-medium">Your vote has been counted</span>
+                </div>
+                {{else if .IsOpen}}
                 <button type="submit" id="vote-btn"
                     class="w-full py-3 px-6 bg-gradient-to-r from-indigo-600 to-purple-600 text-white font-semibold rounded-xl shadow-lg hover:shadow-xl transform hover:-translate-y-0.5 transition-all duration-200">
-                    Vote
+                    {{if hasVoted}}Change vote{{else}}Vote{{end}}
+                </button>
+                {{if not .IsAnonymous}}
+                <button type="button" id="retract-btn" onclick="retractVote()"
+                    class="w-full py-2 px-6 text-sm text-gray-500 hover:text-red-600 transition-colors {{if not hasVoted}}hidden{{end}}">
+                    Retract my vote
                 </button>
+                {{end}}
                 {{else}}
                 <div class="text-center py-4 bg-red-50 rounded-xl">
                     <span class="text-red-600 font-medium">This poll has expired</span>
@@ -610,6 +1490,12 @@ const pollTemplate = baseStyle + `
                 {{end}}
             </form>
 
+            {{if and .IsRanked (not .ResultsHidden)}}
+            <div id="runoff" class="mt-8 pt-6 border-t border-gray-200">
+                {{template "runoff" .}}
+            </div>
+            {{end}}
+
             <div class="mt-8 pt-6 border-t border-gray-200">
                 <p class="text-sm text-gray-500 mb-2">Share this poll:</p>
                 <div class="flex items-center space-x-2">
@@ -620,6 +1506,12 @@ const pollTemplate = baseStyle + `
                         Copy
                     </button>
                 </div>
+                <p class="text-sm text-gray-500 mt-4">
+                    Download results:
+                    <a href="/api/polls/{{.ID}}/export?format=csv" class="text-indigo-600 hover:text-indigo-800">CSV</a> ·
+                    <a href="/api/polls/{{.ID}}/export?format=tsv" class="text-indigo-600 hover:text-indigo-800">TSV</a> ·
+                    <a href="/api/polls/{{.ID}}/export?format=jsonl" class="text-indigo-600 hover:text-indigo-800">JSON Lines</a>
+                </p>
             </div>
         </div>
     </div>
@@ -635,39 +1527,211 @@ const pollTemplate = baseStyle + `
         }
 
         var pollId = '{{.ID}}';
-        var evtSource = new EventSource('/events/' + pollId);
+        var evtSource = null;
+        var socket = null;
+
+        // Prefer SSE, but fall back to a WebSocket when the first update
+        // does not arrive (some proxies buffer event streams)
+        function connectSSE() {
+            var received = false;
+            evtSource = new EventSource('/events/' + pollId + '?delta=1');
+            evtSource.onmessage = function(event) {
+                received = true;
+                updatePollUI(JSON.parse(event.data));
+            };
+            evtSource.addEventListener('delta', function(event) {
+                received = true;
+                applyDelta(JSON.parse(event.data));
+            });
+            evtSource.addEventListener('closed', function(event) {
+                received = true;
+                updatePollUI(JSON.parse(event.data));
+            });
+            evtSource.addEventListener('presence', function(event) {
+                updateViewers(JSON.parse(event.data));
+            });
+            evtSource.onerror = function(err) {
+                console.error('SSE error:', err);
+            };
+            setTimeout(function() {
+                if (!received) {
+                    evtSource.close();
+                    connectWebSocket();
+                }
+            }, 5000);
+        }
 
-        evtSource.onmessage = function(event) {
-            var poll = JSON.parse(event.data);
+        function connectWebSocket() {
+            var scheme = location.protocol === 'https:' ? 'wss://' : 'ws://';
+            socket = new WebSocket(scheme + location.host + '/ws/' + pollId);
+            socket.onmessage = function(event) {
+                var msg = JSON.parse(event.data);
+                if (msg.error) {
+                    console.error('WebSocket error:', msg.error.message);
+                    return;
+                }
+                if (!msg.id) {
+                    updateViewers(msg);
+                    return;
+                }
+                updatePollUI(msg);
+            };
+            socket.onclose = function() {
+                setTimeout(connectWebSocket, 3000);
+            };
+        }
+
+        if (new URLSearchParams(location.search).get('transport') === 'ws') {
+            connectWebSocket();
+        } else {
+            connectSSE();
+        }
+
+        var shownVersion = 0;
+        var currentPoll = null;
+        var pageStatus = '{{status}}';
+        var resultsHidden = {{.ResultsHidden}};
+
+        // applyDelta updates the last poll received with changed counts only
+        function applyDelta(delta) {
+            if (delta.version <= shownVersion) return;
+            if (!currentPoll || delta.base !== currentPoll.version) {
+                // The update this delta builds on was missed; start over
+                // from a full snapshot
+                evtSource.close();
+                connectSSE();
+                return;
+            }
+            var poll = JSON.parse(JSON.stringify(currentPoll));
+            poll.version = delta.version;
+            poll.options.forEach(function(opt) {
+                if (delta.options && opt.id in delta.options) {
+                    opt.votes = delta.options[opt.id];
+                }
+            });
+            if (delta.ballot_count !== undefined) poll.ballot_count = delta.ballot_count;
+            if (delta.runoff) poll.runoff = delta.runoff;
             updatePollUI(poll);
-        };
+        }
 
-        evtSource.onerror = function(err) {
-            console.error('SSE error:', err);
-        };
+        function updateViewers(presence) {
+            document.getElementById('viewers').textContent = presence.viewers + ' watching';
+        }
 
         function updatePollUI(poll) {
+            // Vote responses and stream events can arrive in either order
+            if (poll.version < shownVersion) return;
+            shownVersion = poll.version;
+            currentPoll = poll;
+            // Opening and closing change the form, and so does revealing
+            // hidden results, so render the page again
+            if ((poll.status && poll.status !== pageStatus) || (resultsHidden && !poll.results_hidden)) {
+                location.reload();
+                return;
+            }
+            document.getElementById('question').textContent = poll.question;
+            if (poll.results_hidden) return;
             var total = poll.options.reduce(function(sum, opt) { return sum + opt.votes; }, 0);
-            document.getElementById('total-votes').textContent = 'Total votes: ' + total;
+            var multi = poll.type === 'multiple' || poll.type === 'approval';
+            var ballots = multi ? (poll.ballot_count || 0) : total;
+            var unit = poll.type === 'ranked' ? ' first choices' : ' votes';
+            document.getElementById('total-votes').textContent = ballots + ' voted';
 
             poll.options.forEach(function(opt) {
                 var container = document.querySelector('[data-option-id="' + opt.id + '"]');
                 if (container) {
-                    var percentage = total > 0 ? (opt.votes / total * 100) : 0;
-                    container.querySelector('.vote-count').textContent = opt.votes + ' votes';
+                    var percentage = ballots > 0 ? (opt.votes / ballots * 100) : 0;
+                    container.querySelector('.vote-count').textContent = opt.votes + unit;
                     container.querySelector('.vote-bar').style.width = percentage + '%';
-                    container.querySelector('.vote-percentage').textContent = percentage.toFixed(1) + '%';
+                    container.querySelector('.vote-percentage').textContent = percentage.toFixed(1) + '%' + (multi ? ' of voters' : '');
+                    if (multi) {
+                        var share = total > 0 ? (opt.votes / total * 100) : 0;
+                        container.querySelector('.selection-percentage').textContent = '· ' + share.toFixed(1) + '% of selections';
+                    }
+                    var names = container.querySelector('.voter-names');
+                    if (names) {
+                        names.textContent = ((poll.roster || {})[opt.id] || []).join(', ');
+                    }
                 }
             });
+
+            if (poll.type === 'ranked') {
+                renderRunoff(poll);
+            }
         }
 
+        function renderRunoff(poll) {
+            var target = document.getElementById('runoff');
+            var runoff = poll.runoff;
+            if (!target || !runoff || !runoff.rounds || runoff.rounds.length === 0) return;
+
+            var names = {};
+            poll.options.forEach(function(opt) { names[opt.id] = opt.text; });
+
+            var table = document.createElement('table');
+            table.className = 'w-full text-sm';
+            var head = table.insertRow();
+            head.className = 'text-left text-gray-500';
+            addCell(head, 'Option', 'th', 'py-1');
+            runoff.rounds.forEach(function(round) { addCell(head, 'Round ' + round.number, 'th', 'py-1 text-right'); });
+
+            poll.options.forEach(function(opt) {
+                var row = table.insertRow();
+                addCell(row, opt.text, 'td', 'py-1 text-gray-800');
+                runoff.rounds.forEach(function(round) {
+                    var count = round.counts[opt.id];
+                    var cls = 'py-1 text-right ' + (round.eliminated === opt.id ? 'text-red-500 line-through' : 'text-gray-700');
+                    addCell(row, count === undefined ? '–' : String(count), 'td', cls);
+                });
+            });
+
+            var exhausted = table.insertRow();
+            addCell(exhausted, 'Exhausted', 'td', 'py-1 text-gray-400');
+            runoff.rounds.forEach(function(round) { addCell(exhausted, String(round.exhausted), 'td', 'py-1 text-right text-gray-400'); });
+
+            var summary = document.createElement('p');
+            summary.className = 'mt-4 font-medium text-gray-800';
+            if (runoff.winner) {
+                summary.textContent = 'Winner: ' + names[runoff.winner];
+            } else if (runoff.tied) {
+                summary.textContent = 'Tie between ' + runoff.tied.map(function(id) { return names[id]; }).join(', ');
+            }
+
+            var heading = document.createElement('h2');
+            heading.className = 'text-lg font-semibold text-gray-800 mb-4';
+            heading.textContent = 'Instant-runoff rounds';
+
+            target.replaceChildren(heading, table, summary);
+        }
+
+        function addCell(row, text, tag, cls) {
+            var cell = document.createElement(tag);
+            cell.className = cls;
+            cell.textContent = text;
+            row.appendChild(cell);
+        }
+
+        var choiceLimit = {{.ChoiceLimit}};
+        document.querySelectorAll('input[type=checkbox][name=option]').forEach(function(box) {
+            box.addEventListener('change', function() {
+                var checked = document.querySelectorAll('input[type=checkbox][name=option]:checked').length;
+                if (checked > choiceLimit) {
+                    box.checked = false;
+                    alert('You can select up to ' + choiceLimit + ' options');
+                }
+            });
+        });
+
         document.getElementById('vote-form').addEventListener('submit', function(e) {
             e.preventDefault();
             
             var formData = new FormData(this);
             var selectedOption = formData.get('option');
+            var ranked = Array.prototype.some.call(document.querySelectorAll('.rank-select'), function(sel) {
+                return sel.value !== '';
+            });
             
-            if (!selectedOption) {
+            if (!selectedOption && !ranked) {
                 alert('Please select an option');
                 return;
             }
@@ -683,63 +1747,255 @@ const pollTemplate = baseStyle + `
             })
             .then(function(response) {
                 if (response.ok) return response.json();
-                throw new Error('Vote failed');
+                return response.json().then(function(body) {
+                    throw new Error(body.error ? body.error.message : 'Vote failed');
+                });
             })
             .then(function(poll) {
                 updatePollUI(poll);
-                btn.textContent = 'Voted! ✓';
-                btn.className = btn.className.replace('from-indigo-600', 'from-green-500').replace('to-purple-600', 'to-green-600');
+                if (poll.attribution === 'anonymous') {
+                    btn.textContent = 'Your vote has been counted ✓';
+                    return;
+                }
+                btn.disabled = false;
+                btn.textContent = 'Voted! ✓ Change vote';
+                document.getElementById('retract-btn').classList.remove('hidden');
             })
             .catch(function(err) {
                 console.error('Error:', err);
                 btn.disabled = false;
                 btn.textContent = 'Vote';
-                alert('Failed to submit vote');
+                alert('Failed to submit vote: ' + err.message);
             });
         });
 
+        function retractVote() {
+            fetch('/vote/' + pollId, {
+                method: 'DELETE',
+                headers: { 'Accept': 'application/json' }
+            })
+            .then(function(response) {
+                if (response.ok) return response.json();
+                throw new Error('Retract failed');
+            })
+            .then(function(poll) {
+                updatePollUI(poll);
+                document.getElementById('vote-form').reset();
+                document.querySelectorAll('#vote-form input, #vote-form select').forEach(function(el) {
+                    el.checked = false;
+                    if (el.tagName === 'SELECT') el.value = '';
+                });
+                document.getElementById('vote-btn').textContent = 'Vote';
+                document.getElementById('retract-btn').classList.add('hidden');
+            })
+            .catch(function(err) {
+                console.error('Error:', err);
+                alert('Failed to retract vote');
+            });
+        }
+
         window.addEventListener('beforeunload', function() {
-            evtSource.close();
+            if (evtSource) evtSource.close();
+            if (socket) {
+                socket.onclose = null;
+                socket.close();
+            }
         });
     </script>
 ` + baseEnd
 
+const runoffTemplate = `{{define "runoff"}}
+                <h2 class="text-lg font-semibold text-gray-800 mb-4">Instant-runoff rounds</h2>
+                {{with .Runoff}}{{if .Rounds}}
+                <table class="w-full text-sm">
+                    <tr class="text-left text-gray-500">
+                        <th class="py-1">Option</th>
+                        {{range .Rounds}}<th class="py-1 text-right">Round {{.Number}}</th>{{end}}
+                    </tr>
+                    {{range $opt := $.Options}}
+                    <tr>
+                        <td class="py-1 text-gray-800">{{$opt.Text}}</td>
+                        {{range $.Runoff.Rounds}}
+                        <td class="py-1 text-right {{if eq .Eliminated $opt.ID}}text-red-500 line-through{{else}}text-gray-700{{end}}">{{roundCount . $opt.ID}}</td>
+                        {{end}}
+                    </tr>
+                    {{end}}
+                    <tr>
+                        <td class="py-1 text-gray-400">Exhausted</td>
+                        {{range .Rounds}}<td class="py-1 text-right text-gray-400">{{.Exhausted}}</td>{{end}}
+                    </tr>
+                </table>
+                <p class="mt-4 font-medium text-gray-800">
+                    {{if .Winner}}Winner: {{optionText .Winner}}{{else if .Tied}}Tie between {{range $i, $id := .Tied}}{{if $i}}, {{end}}{{optionText $id}}{{end}}{{end}}
+                </p>
+                {{end}}{{else}}
+                <p class="text-gray-500">No ballots yet.</p>
+                {{end}}
+{{end}}`
+
 // ============================================================================
 // MAIN ENTRY POINT
 // ============================================================================
 
 func main() {
-	app := NewApp()
-
-	// Add sample polls
-	app.store.Create(&Poll{
-		Question: "What's your favorite programming language?",
-		Options: []Option{
-			{ID: generateID(), Text: "Go", Votes: 42},
-			{ID: generateID(), Text: "Python", Votes: 38},
-			{ID: generateID(), Text: "Rust", Votes: 25},
-			{ID: generateID(), Text: "TypeScript", Votes: 31},
-		},
-	})
+	// "app audit" prints the vote journal of the file backend and exits
+	if len(os.Args) > 1 && os.Args[1] == "audit" {
+		if err := printAuditTrail(os.Stdout, dataDir()); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	// "app import FILE" sends poll definitions to a running server
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		if err := runImportCommand(os.Args[2:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
-	app.store.Create(&Poll{
-		Question: "Best time for team meetings?",
-		Options: []Option{
-			{ID: generateID(), Text: "Morning (9-11 AM)", Votes: 15},
-			{ID: generateID(), Text: "Afternoon (2-4 PM)", Votes: 22},
-			{ID: generateID(), Text: "Late afternoon (4-6 PM)", Votes: 8},
-		},
-	})
+	repo, err := newRepositoryFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to open storage: %v", err)
+	}
+	bus, err := newBusFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to start the message bus: %v", err)
+	}
+	app := NewAppWithBus(repo, bus)
+	app.SetBroadcastInterval(broadcastIntervalFromEnv())
+	if app.webhooks, err = newWebhooksFromEnv(); err != nil {
+		log.Fatalf("Failed to load webhooks: %v", err)
+	}
+	if app.users, err = newUsersFromEnv(); err != nil {
+		log.Fatalf("Failed to load accounts: %v", err)
+	}
+	if app.apiKeys, err = newAPIKeysFromEnv(); err != nil {
+		log.Fatalf("Failed to load API keys: %v", err)
+	}
+	if app.quizzes, err = newQuizzesFromEnv(); err != nil {
+		log.Fatalf("Failed to load quizzes: %v", err)
+	}
 
-	// Setup routes
-	http.HandleFunc("/", app.IndexHandler)
-	http.HandleFunc("/create", app.CreateHandler)
-	http.HandleFunc("/poll/", app.PollHandler)
-	http.HandleFunc("/vote/", app.VoteHandler)
-	http.HandleFunc("/events/", app.EventsHandler)
-	http.HandleFunc("/api/polls", app.APIListHandler)
+	// Add sample polls on first start only; persistent backends keep
+	// whatever was created before the restart
+	if len(app.store.List()) == 0 && claimSeeding(repo) {
+		seedSamplePolls(app.store)
+	}
 
 	addr := ":8080"
+	server := &http.Server{Addr: addr, Handler: app.Routes()}
+
+	// Shut down cleanly on SIGINT/SIGTERM so the file backend can write
+	// its final snapshot
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	go app.scheduler.Run(ctx)
+	go app.RunPresence(ctx)
+	go app.webhooks.Run(ctx)
+
 	log.Printf("🚀 QuickPoll server starting on http://localhost%s", addr)
-	log.Fatal(http.ListenAndServe(addr, nil))
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+
+	bus.Close()
+	if closer, ok := repo.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.Printf("Failed to close storage: %v", err)
+		}
+	}
+}
+
+// newRepositoryFromEnv picks the storage backend. STORAGE=file keeps polls
+// in DATA_DIR (default "data") so they survive restarts; STORAGE=redis
+// keeps them in Redis (see redisstore.go), shared by every node; anything
+// else uses the in-memory store.
+func newRepositoryFromEnv() (PollRepository, error) {
+	switch strings.ToLower(os.Getenv("STORAGE")) {
+	case "file":
+		log.Printf("Using file storage in %s", dataDir())
+		return OpenFileStore(dataDir(), defaultSnapshotInterval)
+	case "redis":
+		log.Printf("Using Redis storage at %s", redisAddrFromEnv())
+		return OpenRedisStore(redisClientFromEnv())
+	case "", "memory":
+		return NewStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown STORAGE backend %q", os.Getenv("STORAGE"))
+	}
+}
+
+// newWebhooksFromEnv keeps webhook registrations next to the polls when
+// they are stored in files or Redis
+func newWebhooksFromEnv() (*Webhooks, error) {
+	switch strings.ToLower(os.Getenv("STORAGE")) {
+	case "file":
+		return OpenWebhooks(filepath.Join(dataDir(), "webhooks.json"))
+	case "redis":
+		return OpenSharedWebhooks(redisClientFromEnv())
+	}
+	return NewWebhooks(), nil
+}
+
+// dataDir returns the directory used by the file backend
+func dataDir() string {
+	if dir := os.Getenv("DATA_DIR"); dir != "" {
+		return dir
+	}
+	return "data"
+}
+
+// claimSeeding reports whether this node should add the sample polls.
+// Nodes sharing a Redis store may start together; the first one does.
+func claimSeeding(repo PollRepository) bool {
+	store, ok := repo.(*RedisStore)
+	if !ok {
+		return true
+	}
+	claimed, err := store.client.claim("seeded")
+	if err != nil {
+		log.Printf("Failed to claim seeding: %v", err)
+	}
+	return claimed
+}
+
+// seedSamplePolls adds the demo polls shown on a fresh install
+func seedSamplePolls(repo PollRepository) {
+	samples := []struct {
+		question string
+		options  []string
+		votes    []int
+	}{
+		{"What's your favorite programming language?", []string{"Go", "Python", "Rust", "TypeScript"}, []int{42, 38, 25, 31}},
+		{"Best time for team meetings?", []string{"Morning (9-11 AM)", "Afternoon (2-4 PM)", "Late afternoon (4-6 PM)"}, []int{15, 22, 8}},
+	}
+	for _, sample := range samples {
+		poll, err := buildPoll(PollInput{Question: sample.question, Options: sample.options})
+		if err == nil {
+			err = repo.Create(poll)
+		}
+		if err != nil {
+			log.Printf("Failed to seed sample poll: %v", err)
+			return
+		}
+		// Cast real ballots so the counts agree with them
+		voter := 0
+		for i, count := range sample.votes {
+			for n := 0; n < count; n++ {
+				voter++
+				ballot := Ballot{VoterID: fmt.Sprintf("sample-%d", voter), Choices: []string{poll.Options[i].ID}}
+				if _, err := repo.CastBallot(poll.ID, ballot); err != nil {
+					log.Printf("Failed to seed sample ballot: %v", err)
+					return
+				}
+			}
+		}
+	}
 }
@@ -1,20 +1,22 @@
 package main
 
 import (
+	"errors"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 )
 
-// TestGenerateID verifies that generated IDs
+// TestNewID verifies that generated IDs
 // have the correct length and are unique.
-func TestGenerateID(t *testing.T) {
-	id1 := generateID()
-	id2 := generateID()
+func TestNewID(t *testing.T) {
+	id1, _ := NewID(KindPoll)
+	id2, _ := NewID(KindPoll)
 
-	// ID should be 8 hex characters (4 bytes)
-	if len(id1) != 8 {
-		t.Errorf("Expected ID length 8, got %d", len(id1))
+	// ID should be the prefix and 24 base32 characters (15 bytes)
+	if len(id1) != len("poll_")+24 || !strings.HasPrefix(id1, "poll_") {
+		t.Errorf("Expected a prefixed 24-character ID, got %q", id1)
 	}
 
 	// Two generated IDs should not be equal
@@ -53,8 +55,8 @@ func TestStoreGet(t *testing.T) {
 	store.Create(poll)
 
 	// Existing poll should be returned
-	got, exists := store.Get(poll.ID)
-	if !exists {
+	got, err := store.Get(poll.ID)
+	if err != nil {
 		t.Fatal("Expected poll to exist")
 	}
 	if got.Question != poll.Question {
@@ -62,8 +64,8 @@ func TestStoreGet(t *testing.T) {
 	}
 
 	// Non-existent poll should not be found
-	_, exists = store.Get("nonexistent")
-	if exists {
+	_, err = store.Get("nonexistent")
+	if !errors.Is(err, ErrPollNotFound) {
 		t.Error("Expected poll to not exist")
 	}
 }
@@ -161,8 +163,8 @@ func TestStoreDelete(t *testing.T) {
 	}
 
 	// Poll should no longer exist
-	_, exists := store.Get(poll.ID)
-	if exists {
+	_, err := store.Get(poll.ID)
+	if !errors.Is(err, ErrPollNotFound) {
 		t.Error("Poll should not exist after deletion")
 	}
 
@@ -276,13 +278,13 @@ func TestBroadcaster(t *testing.T) {
 	ch := broadcaster.Subscribe(pollID)
 
 	go func() {
-		broadcaster.Broadcast(pollID, "hello")
+		broadcaster.Broadcast(pollID, 1, "hello")
 	}()
 
 	select {
 	case msg := <-ch:
-		if msg != "hello" {
-			t.Errorf("Expected 'hello', got '%s'", msg)
+		if msg.Data != "hello" {
+			t.Errorf("Expected 'hello', got '%s'", msg.Data)
 		}
 	case <-time.After(time.Second):
 		t.Error("Timeout waiting for message")
@@ -300,13 +302,13 @@ func TestBroadcasterMultipleSubscribers(t *testing.T) {
 	ch1 := broadcaster.Subscribe(pollID)
 	ch2 := broadcaster.Subscribe(pollID)
 
-	broadcaster.Broadcast(pollID, "test")
+	broadcaster.Broadcast(pollID, 1, "test")
 
-	for _, ch := range []chan string{ch1, ch2} {
+	for _, ch := range []chan Event{ch1, ch2} {
 		select {
 		case msg := <-ch:
-			if msg != "test" {
-				t.Errorf("Expected 'test', got '%s'", msg)
+			if msg.Data != "test" {
+				t.Errorf("Expected 'test', got '%s'", msg.Data)
 			}
 		case <-time.After(time.Second):
 			t.Error("Timeout")
@@ -336,3 +338,18 @@ func TestCopyPoll(t *testing.T) {
 		t.Error("Original was modified")
 	}
 }
+
+// TestSeedSamplePolls seeds counts that agree with real ballots.
+func TestSeedSamplePolls(t *testing.T) {
+	store := NewStore()
+	seedSamplePolls(store)
+	polls := store.List()
+	if len(polls) != 2 {
+		t.Fatalf("Expected 2 sample polls, got %d", len(polls))
+	}
+	for _, poll := range polls {
+		if poll.TotalVotes() == 0 || poll.TotalVotes() != len(poll.Ballots) {
+			t.Errorf("Expected counts backed by ballots, got %d votes and %d ballots", poll.TotalVotes(), len(poll.Ballots))
+		}
+	}
+}
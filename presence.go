@@ -0,0 +1,191 @@
+// presence.go - Live viewer counts
+// Every open SSE or WebSocket stream is a subscriber of the Broadcaster, so
+// the number of subscribers of a poll is the number of people watching it.
+// Changes are batched briefly and sent to the poll's clients as a "presence"
+// event. Nodes report their local counts to each other over the message
+// bus; a node's report is dropped if it is not refreshed in time, so viewers
+// of a crashed node do not linger.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	// presenceRefreshInterval is how often each node republishes its counts
+	presenceRefreshInterval = 30 * time.Second
+	// presenceExpiry is how long another node's count is trusted
+	presenceExpiry = 3 * presenceRefreshInterval
+)
+
+// presenceDelay batches viewer count changes, so a crowd joining at once
+// causes one presence event rather than one per viewer
+var presenceDelay = 500 * time.Millisecond
+
+// PresenceReport is one node's viewer count for a poll
+type PresenceReport struct {
+	Node    string `json:"node"`
+	Viewers int    `json:"viewers"`
+}
+
+// remoteViewers is the last count reported by another node
+type remoteViewers struct {
+	count int
+	seen  time.Time
+}
+
+// presenceEvent announces the viewer count of a poll. It has no ID: it is
+// not part of the poll's version history and is never replayed.
+func presenceEvent(viewers int) Event {
+	return Event{Type: "presence", Data: fmt.Sprintf(`{"viewers":%d}`, viewers)}
+}
+
+// Viewers returns the number of clients watching a poll on all nodes
+func (b *Broadcaster) Viewers(pollID string) int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.viewersLocked(pollID, time.Now())
+}
+
+func (b *Broadcaster) viewersLocked(pollID string, now time.Time) int {
+	count := len(b.subscribers[pollID])
+	for _, remote := range b.remote[pollID] {
+		if now.Sub(remote.seen) < presenceExpiry {
+			count += remote.count
+		}
+	}
+	return count
+}
+
+// presenceChanged schedules a presence event for a poll. publish is set when
+// the local count changed and other nodes need to hear of it. The caller
+// must hold b.mu.
+func (b *Broadcaster) presenceChanged(pollID string, publish bool) {
+	pending, scheduled := b.presencePending[pollID]
+	b.presencePending[pollID] = pending || publish
+	if !scheduled {
+		time.AfterFunc(presenceDelay, func() { b.flushPresence(pollID) })
+	}
+}
+
+// flushPresence sends the current viewer count of a poll to its local
+// subscribers and reports the local count to other nodes
+func (b *Broadcaster) flushPresence(pollID string) {
+	b.mu.Lock()
+	publish := b.presencePending[pollID]
+	delete(b.presencePending, pollID)
+	local := len(b.subscribers[pollID])
+	ev := presenceEvent(b.viewersLocked(pollID, time.Now()))
+	for ch := range b.subscribers[pollID] {
+		// A subscriber too busy for this event gets the next one
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+	report := b.onPresence
+	b.mu.Unlock()
+
+	if publish && report != nil {
+		report(pollID, local)
+	}
+}
+
+// SetRemoteViewers records the viewer count of a poll on another node
+func (b *Broadcaster) SetRemoteViewers(pollID, node string, count int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if count > 0 {
+		if b.remote[pollID] == nil {
+			b.remote[pollID] = make(map[string]remoteViewers)
+		}
+		b.remote[pollID][node] = remoteViewers{count: count, seen: time.Now()}
+	} else if _, exists := b.remote[pollID][node]; exists {
+		delete(b.remote[pollID], node)
+		if len(b.remote[pollID]) == 0 {
+			delete(b.remote, pollID)
+		}
+	} else {
+		return
+	}
+	b.presenceChanged(pollID, false)
+}
+
+// expireRemoteViewers drops counts of nodes that stopped reporting
+func (b *Broadcaster) expireRemoteViewers(now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for pollID, nodes := range b.remote {
+		for node, remote := range nodes {
+			if now.Sub(remote.seen) >= presenceExpiry {
+				delete(nodes, node)
+				b.presenceChanged(pollID, false)
+			}
+		}
+		if len(nodes) == 0 {
+			delete(b.remote, pollID)
+		}
+	}
+}
+
+// localViewers returns the polls watched on this node and their counts
+func (b *Broadcaster) localViewers() map[string]int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	counts := make(map[string]int)
+	for pollID, subs := range b.subscribers {
+		if len(subs) > 0 {
+			counts[pollID] = len(subs)
+		}
+	}
+	return counts
+}
+
+// publishPresence reports this node's viewer count of a poll to the others
+func (app *App) publishPresence(pollID string, viewers int) {
+	report := &PresenceReport{Node: app.node, Viewers: viewers}
+	if err := app.bus.Publish(BusMessage{PollID: pollID, Presence: report}); err != nil {
+		log.Printf("Failed to publish viewer count for poll %s: %v", pollID, err)
+	}
+}
+
+// receivePresence applies a viewer count reported over the bus
+func (app *App) receivePresence(pollID string, report *PresenceReport) {
+	if report.Node != app.node {
+		app.broadcaster.SetRemoteViewers(pollID, report.Node, report.Viewers)
+	}
+}
+
+// RunPresence republishes this node's viewer counts and expires those of
+// silent nodes until ctx is done
+func (app *App) RunPresence(ctx context.Context) {
+	ticker := time.NewTicker(presenceRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			for pollID, viewers := range app.broadcaster.localViewers() {
+				app.publishPresence(pollID, viewers)
+			}
+			app.broadcaster.expireRemoteViewers(now)
+		}
+	}
+}
+
+// withViewers fills in the current viewer count of polls about to be sent
+// to a client. The polls must be copies returned by the store.
+func (app *App) withViewers(polls ...*Poll) {
+	for _, poll := range polls {
+		poll.Viewers = app.broadcaster.Viewers(poll.ID)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fastPresence shortens the presence batching delay for a test
+func fastPresence(t *testing.T) {
+	old := presenceDelay
+	presenceDelay = 5 * time.Millisecond
+	t.Cleanup(func() { presenceDelay = old })
+}
+
+// nextViewers waits for a presence event on ch and returns its count
+func nextViewers(t *testing.T, ch chan Event) int {
+	t.Helper()
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case ev := <-ch:
+			if ev.Type != "presence" {
+				continue
+			}
+			var presence struct{ Viewers int }
+			json.Unmarshal([]byte(ev.Data), &presence)
+			return presence.Viewers
+		case <-timeout:
+			t.Fatal("Timeout waiting for presence event")
+			return 0
+		}
+	}
+}
+
+// TestPresenceEvents sends the viewer count to subscribers as they come
+// and go.
+func TestPresenceEvents(t *testing.T) {
+	fastPresence(t)
+	app := NewApp()
+
+	first := app.broadcaster.Subscribe("p")
+	second := app.broadcaster.Subscribe("p")
+	if got := nextViewers(t, first); got != 2 {
+		t.Errorf("Expected 2 viewers, got %d", got)
+	}
+
+	app.broadcaster.Unsubscribe("p", second)
+	if got := nextViewers(t, first); got != 1 {
+		t.Errorf("Expected 1 viewer after leaving, got %d", got)
+	}
+	if got := app.broadcaster.Viewers("p"); got != 1 {
+		t.Errorf("Expected Viewers 1, got %d", got)
+	}
+	app.broadcaster.Unsubscribe("p", first)
+}
+
+// TestPresenceAcrossNodes adds up the viewers of two nodes and forgets a
+// node that stops reporting.
+func TestPresenceAcrossNodes(t *testing.T) {
+	fastPresence(t)
+	bus := NewLocalBus()
+	store := NewStore()
+	nodeA := NewAppWithBus(store, bus)
+	nodeB := NewAppWithBus(store, bus)
+
+	a1 := nodeA.broadcaster.Subscribe("p")
+	a2 := nodeA.broadcaster.Subscribe("p")
+	b1 := nodeB.broadcaster.Subscribe("p")
+	defer nodeA.broadcaster.Unsubscribe("p", a1)
+	defer nodeA.broadcaster.Unsubscribe("p", a2)
+	defer nodeB.broadcaster.Unsubscribe("p", b1)
+
+	waitFor(t, "combined count", func() bool {
+		return nodeA.broadcaster.Viewers("p") == 3 && nodeB.broadcaster.Viewers("p") == 3
+	})
+
+	nodeB.broadcaster.expireRemoteViewers(time.Now().Add(presenceExpiry))
+	if got := nodeB.broadcaster.Viewers("p"); got != 1 {
+		t.Errorf("Expected node A's viewers to expire, got %d", got)
+	}
+}
+
+// TestPresenceInPollJSON reports viewers in the API and leaves the
+// client's Last-Event-ID alone.
+func TestPresenceInPollJSON(t *testing.T) {
+	app := NewApp()
+	poll := &Poll{Question: "Q?", Options: []Option{{ID: "a", Text: "A"}, {ID: "b", Text: "B"}}}
+	app.store.Create(poll)
+	ch := app.broadcaster.Subscribe(poll.ID)
+	defer app.broadcaster.Unsubscribe(poll.ID, ch)
+
+	rec := apiCall(t, app, http.MethodGet, "/api/polls/"+poll.ID, "", "")
+	var got Poll
+	json.NewDecoder(rec.Body).Decode(&got)
+	if got.Viewers != 1 {
+		t.Errorf("Expected 1 viewer in poll JSON, got %d", got.Viewers)
+	}
+	if stored, _ := app.store.Get(poll.ID); stored.Viewers != 0 {
+		t.Error("Viewer count leaked into the store")
+	}
+
+	sse := formatSSE([]Event{presenceEvent(1)})
+	if strings.Contains(sse, "id:") || !strings.Contains(sse, "event: presence\n") {
+		t.Errorf("Unexpected presence event %q", sse)
+	}
+	cursor := app.newEventCursor(poll.ID, 5)
+	if events := cursor.receive(presenceEvent(1), false); len(events) != 1 || cursor.lastID != 5 {
+		t.Errorf("Expected presence to pass the cursor unchanged, got %+v", events)
+	}
+}
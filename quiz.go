@@ -0,0 +1,812 @@
+// quiz.go - Quiz mode
+// A quiz groups polls into a session of questions. Each question marks one
+// or more options as correct; the answers stay secret until the question
+// closes and are then part of its final results. Players score
+// quizPoints for each correct answer, plus an optional time bonus of up to
+// time_bonus points that shrinks the later they answered. Single-choice
+// and ranked questions count the first choice; multiple-choice and
+// approval questions need exactly the correct options.
+//
+//   POST /api/quizzes                    create a quiz and its questions
+//   GET  /api/quizzes/{id}               the quiz and the questions the
+//                                        caller may see
+//   GET  /api/quizzes/{id}/leaderboard   the current standings
+//   POST /api/quizzes/{id}/players       choose a nickname for the board
+//   GET  /quiz/{id}                      the quiz page
+//   GET  /quiz/{id}/events               the leaderboard over SSE, sent
+//                                        again after each question closes
+//
+// Questions are closed like any poll, by their schedule or by the owner.
+// Anonymous questions cannot be scored and are refused. With STORAGE=file,
+// quizzes are saved to quizzes.json in the data directory; with
+// STORAGE=redis, every node shares them.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// quizPoints is what a correct answer scores before the time bonus
+	quizPoints = 100
+	// maxTimeBonus bounds the time bonus of a quiz
+	maxTimeBonus = 1000
+	// maxNicknameLength bounds player nicknames, in characters
+	maxNicknameLength = 40
+)
+
+// ErrQuizNotFound is returned for unknown quiz IDs
+var ErrQuizNotFound = errors.New("quiz not found")
+
+// Quiz is a session of polls scored against their correct options.
+// Players maps voter IDs to the nicknames they chose; guestKey labels the
+// players who chose none.
+type Quiz struct {
+	ID        string            `json:"id"`
+	Title     string            `json:"title"`
+	OwnerID   string            `json:"owner_id,omitempty"`
+	PollIDs   []string          `json:"poll_ids"`
+	TimeBonus int               `json:"time_bonus,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+	Players   map[string]string `json:"-"`
+	guestKey  []byte
+}
+
+// storedQuiz is the form in which quizzes are saved, with the players
+// and guest key that are not sent to clients
+type storedQuiz struct {
+	*Quiz
+	Players  map[string]string `json:"players,omitempty"`
+	GuestKey []byte            `json:"guest_key,omitempty"`
+}
+
+// copyQuiz returns a deep copy of a quiz
+func copyQuiz(q *Quiz) *Quiz {
+	cp := *q
+	cp.PollIDs = append([]string(nil), q.PollIDs...)
+	cp.Players = make(map[string]string, len(q.Players))
+	for k, v := range q.Players {
+		cp.Players[k] = v
+	}
+	return &cp
+}
+
+// Quizzes is the registry of quizzes
+type Quizzes struct {
+	mu      sync.Mutex
+	quizzes map[string]*Quiz
+	path    string // where quizzes are saved; empty keeps them in memory
+	// shared keeps the quizzes in Redis instead, for every node
+	shared *redisDoc
+}
+
+// NewQuizzes creates an in-memory quiz registry
+func NewQuizzes() *Quizzes {
+	return &Quizzes{quizzes: make(map[string]*Quiz)}
+}
+
+// OpenQuizzes creates a registry saved to path, loading the quizzes
+// already there
+func OpenQuizzes(path string) (*Quizzes, error) {
+	q := NewQuizzes()
+	q.path = path
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := q.loadLocked(data); err != nil {
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+	return q, nil
+}
+
+// OpenSharedQuizzes creates a registry kept in Redis, where every node
+// sees the same quizzes
+func OpenSharedQuizzes(client *RedisClient) (*Quizzes, error) {
+	q := NewQuizzes()
+	q.shared = newRedisDoc(client, "quizzes")
+	if err := q.shared.sync(q.loadLocked); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// loadLocked replaces the quizzes with saved ones. The caller must hold
+// q.mu.
+func (q *Quizzes) loadLocked(data []byte) error {
+	var stored []storedQuiz
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &stored); err != nil {
+			return err
+		}
+	}
+	q.quizzes = make(map[string]*Quiz, len(stored))
+	for _, sq := range stored {
+		sq.Quiz.Players = sq.Players
+		if sq.Quiz.Players == nil {
+			sq.Quiz.Players = make(map[string]string)
+		}
+		sq.Quiz.guestKey = sq.GuestKey
+		q.quizzes[sq.ID] = sq.Quiz
+	}
+	return nil
+}
+
+// newQuizzesFromEnv keeps quizzes next to the polls when they are stored
+// in files or Redis
+func newQuizzesFromEnv() (*Quizzes, error) {
+	switch strings.ToLower(os.Getenv("STORAGE")) {
+	case "file":
+		return OpenQuizzes(dataDir() + "/quizzes.json")
+	case "redis":
+		return OpenSharedQuizzes(redisClientFromEnv())
+	}
+	return NewQuizzes(), nil
+}
+
+// Create assigns an ID to a quiz and adds a copy of it
+func (q *Quizzes) Create(quiz *Quiz) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := q.shared.sync(q.loadLocked); err != nil {
+		return err
+	}
+
+	id, err := uniqueID(KindQuiz, func(id string) bool {
+		_, taken := q.quizzes[id]
+		return taken
+	})
+	if err != nil {
+		return err
+	}
+	key := make([]byte, voterKeySize)
+	if _, err := randRead(key); err != nil {
+		return fmt.Errorf("%w: %v", ErrEntropy, err)
+	}
+	quiz.ID = id
+	quiz.CreatedAt = time.Now()
+	quiz.guestKey = key
+	q.quizzes[id] = copyQuiz(quiz)
+	if err := q.saveLocked(); err != nil {
+		delete(q.quizzes, id)
+		return err
+	}
+	return nil
+}
+
+// Get returns a copy of a quiz
+func (q *Quizzes) Get(id string) (*Quiz, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := q.shared.sync(q.loadLocked); err != nil {
+		log.Printf("Failed to reload quizzes: %v", err)
+	}
+	quiz, exists := q.quizzes[id]
+	if !exists {
+		return nil, false
+	}
+	return copyQuiz(quiz), true
+}
+
+// SetPlayer records the nickname of a voter in a quiz
+func (q *Quizzes) SetPlayer(id, voterID, name string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := q.shared.sync(q.loadLocked); err != nil {
+		return err
+	}
+	quiz, exists := q.quizzes[id]
+	if !exists {
+		return ErrQuizNotFound
+	}
+	previous, had := quiz.Players[voterID]
+	quiz.Players[voterID] = name
+	if err := q.saveLocked(); err != nil {
+		if had {
+			quiz.Players[voterID] = previous
+		} else {
+			delete(quiz.Players, voterID)
+		}
+		return err
+	}
+	return nil
+}
+
+// setPolls records the questions of a quiz
+func (q *Quizzes) setPolls(id string, pollIDs []string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := q.shared.sync(q.loadLocked); err != nil {
+		return err
+	}
+	quiz, exists := q.quizzes[id]
+	if !exists {
+		return ErrQuizNotFound
+	}
+	quiz.PollIDs = append([]string(nil), pollIDs...)
+	return q.saveLocked()
+}
+
+// remove drops a quiz
+func (q *Quizzes) remove(id string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := q.shared.sync(q.loadLocked); err != nil {
+		log.Printf("Failed to reload quizzes: %v", err)
+	}
+	delete(q.quizzes, id)
+	if err := q.saveLocked(); err != nil {
+		log.Printf("Failed to save quizzes: %v", err)
+	}
+}
+
+// saveLocked writes the quizzes file, or the quizzes in Redis. The caller
+// must hold q.mu.
+func (q *Quizzes) saveLocked() error {
+	if q.path == "" && q.shared == nil {
+		return nil
+	}
+	stored := make([]storedQuiz, 0, len(q.quizzes))
+	for _, quiz := range q.quizzes {
+		stored = append(stored, storedQuiz{Quiz: quiz, Players: quiz.Players, GuestKey: quiz.guestKey})
+	}
+	sort.Slice(stored, func(i, j int) bool { return stored[i].CreatedAt.Before(stored[j].CreatedAt) })
+	data, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		return err
+	}
+	if q.shared != nil {
+		return q.shared.save(data)
+	}
+	return writeFileAtomic(q.path, data)
+}
+
+// parseAnswers turns the texts of the correct options of a new poll into
+// option IDs
+func parseAnswers(poll *Poll, texts []string) ([]string, error) {
+	var answers []string
+	seen := make(map[string]bool)
+	for _, text := range texts {
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+		id := ""
+		for _, opt := range poll.Options {
+			if opt.Text == text {
+				id = opt.ID
+				break
+			}
+		}
+		if id == "" {
+			return nil, &ValidationError{Field: "correct", Message: fmt.Sprintf("%q is not one of the options", text)}
+		}
+		if !seen[id] {
+			seen[id] = true
+			answers = append(answers, id)
+		}
+	}
+	if poll.IsMultiSelect() && len(answers) > poll.ChoiceLimit() {
+		return nil, &ValidationError{Field: "correct", Message: "More options are correct than a voter may select"}
+	}
+	return answers, nil
+}
+
+// parseCorrect reads the correct answers field of the create form, one
+// option text per line
+func parseCorrect(value string) []string {
+	var correct []string
+	for _, line := range strings.Split(value, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			correct = append(correct, line)
+		}
+	}
+	return correct
+}
+
+// QuizInput is the body of POST /api/quizzes
+type QuizInput struct {
+	Title     string      `json:"title"`
+	TimeBonus int         `json:"time_bonus,omitempty"`
+	Questions []PollInput `json:"questions"`
+}
+
+// buildQuiz validates a quiz definition and builds its questions, which
+// are not stored yet
+func buildQuiz(in QuizInput) (*Quiz, []*Poll, error) {
+	title := strings.TrimSpace(in.Title)
+	if title == "" {
+		return nil, nil, &ValidationError{Field: "title", Message: "Title is required"}
+	}
+	if len(in.Questions) == 0 {
+		return nil, nil, &ValidationError{Field: "questions", Message: "At least one question is required"}
+	}
+	if in.TimeBonus < 0 || in.TimeBonus > maxTimeBonus {
+		return nil, nil, &ValidationError{Field: "time_bonus", Message: fmt.Sprintf("Time bonus must be between 0 and %d", maxTimeBonus)}
+	}
+
+	polls := make([]*Poll, 0, len(in.Questions))
+	for i, question := range in.Questions {
+		poll, err := buildPoll(question)
+		if err != nil {
+			var verr *ValidationError
+			if errors.As(err, &verr) {
+				return nil, nil, &ValidationError{Field: verr.Field, Message: fmt.Sprintf("Question %d: %s", i+1, verr.Message)}
+			}
+			return nil, nil, err
+		}
+		if len(poll.Answers) == 0 {
+			return nil, nil, &ValidationError{Field: "correct", Message: fmt.Sprintf("Question %d: mark at least one correct option", i+1)}
+		}
+		if poll.IsAnonymous() {
+			return nil, nil, &ValidationError{Field: "attribution", Message: fmt.Sprintf("Question %d: anonymous questions cannot be scored", i+1)}
+		}
+		polls = append(polls, poll)
+	}
+	return &Quiz{Title: title, TimeBonus: in.TimeBonus}, polls, nil
+}
+
+// QuizScore is one player's line on a leaderboard
+type QuizScore struct {
+	Rank     int    `json:"rank"`
+	Name     string `json:"name"`
+	Points   int    `json:"points"`
+	Correct  int    `json:"correct"`
+	Answered int    `json:"answered"`
+}
+
+// Leaderboard ranks the players of a quiz. Scored counts the questions
+// that have closed and whose results the caller may see.
+type Leaderboard struct {
+	QuizID    string      `json:"quiz_id"`
+	Scored    int         `json:"scored"`
+	Questions int         `json:"questions"`
+	Scores    []QuizScore `json:"scores"`
+}
+
+// isCorrect reports whether a ballot answers the poll correctly
+func (p *Poll) isCorrect(choices []string) bool {
+	if len(choices) == 0 || len(p.Answers) == 0 {
+		return false
+	}
+	correct := make(map[string]bool, len(p.Answers))
+	for _, id := range p.Answers {
+		correct[id] = true
+	}
+	if !p.IsMultiSelect() {
+		return correct[choices[0]]
+	}
+	if len(choices) != len(p.Answers) {
+		return false
+	}
+	for _, id := range choices {
+		if !correct[id] {
+			return false
+		}
+	}
+	return true
+}
+
+// timeBonus is the bonus for a correct answer cast at castAt to a poll
+// that closed at closedAt
+func (q *Quiz) timeBonus(p *Poll, castAt, closedAt time.Time) int {
+	if q.TimeBonus == 0 || castAt.IsZero() {
+		return 0
+	}
+	start := p.OpensAt
+	if start.IsZero() {
+		start = p.CreatedAt
+	}
+	span := closedAt.Sub(start)
+	if span <= 0 {
+		return 0
+	}
+	left := closedAt.Sub(castAt)
+	if left < 0 {
+		left = 0
+	}
+	if left > span {
+		left = span
+	}
+	return int(math.Round(float64(q.TimeBonus) * float64(left) / float64(span)))
+}
+
+// playerName is how a voter appears on the leaderboard. Guests are
+// labelled with the quiz's own key, so the label cannot be matched to
+// their ballots elsewhere.
+func (q *Quiz) playerName(ballot Ballot) string {
+	if ballot.VoterName != "" {
+		return ballot.VoterName
+	}
+	if name := q.Players[ballot.VoterID]; name != "" {
+		return name
+	}
+	return "Guest " + voterHash(q.guestKey, ballot.VoterID)[:4]
+}
+
+// leaderboard scores the closed questions of a quiz whose results the
+// caller may see
+func (app *App) leaderboard(r *http.Request, quiz *Quiz) *Leaderboard {
+	board := &Leaderboard{QuizID: quiz.ID, Questions: len(quiz.PollIDs), Scores: []QuizScore{}}
+	scores := make(map[string]*QuizScore)
+	for _, pollID := range quiz.PollIDs {
+		poll, err := app.viewablePoll(r, pollID)
+		if err != nil || poll.Final == nil || !app.resultsVisible(r, poll) {
+			continue
+		}
+		board.Scored++
+		for _, ballot := range poll.Ballots.List() {
+			if ballot.VoterID == "" {
+				continue
+			}
+			score := scores[ballot.VoterID]
+			if score == nil {
+				score = &QuizScore{Name: quiz.playerName(ballot)}
+				scores[ballot.VoterID] = score
+			}
+			score.Answered++
+			if poll.isCorrect(ballot.Choices) {
+				score.Correct++
+				score.Points += quizPoints + quiz.timeBonus(poll, ballot.CastAt, poll.Final.ClosedAt)
+			}
+		}
+	}
+
+	for _, score := range scores {
+		board.Scores = append(board.Scores, *score)
+	}
+	sort.Slice(board.Scores, func(i, j int) bool {
+		a, b := board.Scores[i], board.Scores[j]
+		if a.Points != b.Points {
+			return a.Points > b.Points
+		}
+		return a.Name < b.Name
+	})
+	// Players with equal points share a rank
+	for i := range board.Scores {
+		board.Scores[i].Rank = i + 1
+		if i > 0 && board.Scores[i].Points == board.Scores[i-1].Points {
+			board.Scores[i].Rank = board.Scores[i-1].Rank
+		}
+	}
+	return board
+}
+
+// questionClosed tells the quiz's stream when one of its questions
+// closes. The event carries no standings; each client is sent the
+// leaderboard it may see.
+func (app *App) questionClosed(pollID string) {
+	poll, err := app.store.Get(pollID)
+	if err != nil || poll.QuizID == "" || poll.Final == nil {
+		return
+	}
+	if _, exists := app.quizzes.Get(poll.QuizID); !exists {
+		return
+	}
+	// Questions close one after another, so their closing times order the
+	// leaderboard events
+	id := uint64(poll.Final.ClosedAt.UnixNano())
+	app.broadcaster.BroadcastEvent(poll.QuizID, Event{ID: id, Type: "leaderboard"})
+}
+
+// quizView is a quiz as sent to clients, with the questions the caller may
+// see
+type quizView struct {
+	*Quiz
+	Questions []*Poll `json:"questions"`
+}
+
+// viewQuiz returns the quiz with the questions the caller may see
+func (app *App) viewQuiz(r *http.Request, quiz *Quiz) *quizView {
+	view := &quizView{Quiz: quiz, Questions: []*Poll{}}
+	for _, pollID := range quiz.PollIDs {
+		if poll, err := app.viewablePoll(r, pollID); err == nil {
+			view.Questions = append(view.Questions, poll)
+		}
+	}
+	app.withResults(r, view.Questions...)
+	return view
+}
+
+// playerRequest is the body of POST /api/quizzes/{id}/players
+type playerRequest struct {
+	Name string `json:"name"`
+}
+
+// parseNickname validates a player's nickname
+func parseNickname(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", &ValidationError{Field: "name", Message: "Name is required"}
+	}
+	if utf8.RuneCountInString(name) > maxNicknameLength {
+		return "", &ValidationError{Field: "name", Message: fmt.Sprintf("Name must be at most %d characters", maxNicknameLength)}
+	}
+	return name, nil
+}
+
+// APIQuizzesHandler serves /api/quizzes and the routes below it
+func (app *App) APIQuizzesHandler(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/quizzes"), "/")
+	if path == "" {
+		if r.Method != http.MethodPost {
+			writeErrorJSON(w, ErrMethodNotAllowed)
+			return
+		}
+		app.apiCreateQuiz(w, r)
+		return
+	}
+
+	quizID, action, _ := strings.Cut(path, "/")
+	quiz, exists := app.quizzes.Get(quizID)
+	if !exists {
+		writeErrorJSON(w, ErrQuizNotFound)
+		return
+	}
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, app.viewQuiz(r, quiz))
+	case action == "leaderboard" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, app.leaderboard(r, quiz))
+	case action == "players" && r.Method == http.MethodPost:
+		var req playerRequest
+		if !decodeJSON(w, r, &req) {
+			return
+		}
+		if err := app.setPlayer(r, quiz.ID, req.Name); err != nil {
+			writeErrorJSON(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case action == "" || action == "leaderboard" || action == "players":
+		writeErrorJSON(w, ErrMethodNotAllowed)
+	default:
+		writeAPIError(w, http.StatusNotFound, "not_found", "Not found")
+	}
+}
+
+// apiCreateQuiz creates a quiz and its questions, owned by the caller
+func (app *App) apiCreateQuiz(w http.ResponseWriter, r *http.Request) {
+	var input QuizInput
+	if !decodeJSON(w, r, &input) {
+		return
+	}
+	quiz, polls, err := buildQuiz(input)
+	if err != nil {
+		writeErrorJSON(w, err)
+		return
+	}
+	quiz.OwnerID = ownerID(r)
+	if err := app.quizzes.Create(quiz); err != nil {
+		writeErrorJSON(w, err)
+		return
+	}
+
+	for _, poll := range polls {
+		poll.OwnerID = quiz.OwnerID
+		poll.QuizID = quiz.ID
+		if err := app.store.Create(poll); err != nil {
+			// Leave no half-made quiz behind
+			for _, created := range quiz.PollIDs {
+				app.store.Delete(created)
+			}
+			app.quizzes.remove(quiz.ID)
+			writeErrorJSON(w, err)
+			return
+		}
+		quiz.PollIDs = append(quiz.PollIDs, poll.ID)
+	}
+	if err := app.quizzes.setPolls(quiz.ID, quiz.PollIDs); err != nil {
+		writeErrorJSON(w, err)
+		return
+	}
+	log.Printf("Created quiz via API: %s - %s (%d questions)", quiz.ID, quiz.Title, len(polls))
+	for _, poll := range polls {
+		app.pollCreated(poll)
+	}
+	app.scheduler.Wake()
+
+	w.Header().Set("Location", "/api/quizzes/"+quiz.ID)
+	writeJSON(w, http.StatusCreated, app.viewQuiz(r, quiz))
+}
+
+// setPlayer sets the caller's nickname in a quiz
+func (app *App) setPlayer(r *http.Request, quizID, name string) error {
+	voterID := voterFromRequest(r)
+	if voterID == "" {
+		return ErrVoterRequired
+	}
+	name, err := parseNickname(name)
+	if err != nil {
+		return err
+	}
+	return app.quizzes.SetPlayer(quizID, voterID, name)
+}
+
+// QuizHandler serves the quiz page, its nickname form and its leaderboard
+// stream
+func (app *App) QuizHandler(w http.ResponseWriter, r *http.Request) {
+	quizID, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/quiz/"), "/")
+	quiz, exists := app.quizzes.Get(quizID)
+	if !exists {
+		http.Error(w, "Quiz not found", http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case action == "events":
+		app.quizEvents(w, r, quiz)
+	case action != "":
+		http.NotFound(w, r)
+	case r.Method == http.MethodPost:
+		if !sameOrigin(r) {
+			http.Error(w, "Cross-origin request refused", http.StatusForbidden)
+			return
+		}
+		if err := app.setPlayer(r, quiz.ID, r.FormValue("name")); err != nil {
+			status, _ := errorStatus(err)
+			http.Error(w, err.Error(), status)
+			return
+		}
+		http.Redirect(w, r, "/quiz/"+quiz.ID, http.StatusSeeOther)
+	case r.Method == http.MethodGet:
+		view := app.viewQuiz(r, quiz)
+		tmpl := template.Must(template.New("quiz").Parse(quizTemplate))
+		tmpl.Execute(w, map[string]interface{}{
+			"Quiz":        view,
+			"Leaderboard": app.leaderboard(r, quiz),
+			"Nickname":    quiz.Players[voterFromRequest(r)],
+		})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// quizEvents streams the leaderboard of a quiz over SSE: the current one
+// first, then a new one each time a question closes, each scoring only
+// the questions whose results the caller may see
+func (app *App) quizEvents(w http.ResponseWriter, r *http.Request, quiz *Quiz) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if _, ok := w.(http.Flusher); !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	ch := app.broadcaster.Subscribe(quiz.ID)
+	defer app.broadcaster.Unsubscribe(quiz.ID, ch)
+
+	conn := newSSEConn(w)
+	data, _ := json.Marshal(app.leaderboard(r, quiz))
+	retry := fmt.Sprintf("retry: %d\n\n", sseRetryInterval.Milliseconds())
+	if err := conn.send(retry + formatSSE([]Event{{Type: "leaderboard", Data: string(data)}})); err != nil {
+		app.reapConnection("SSE", quiz.ID, err)
+		return
+	}
+
+	heartbeat := time.NewTicker(sseHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		var err error
+		select {
+		case ev, ok := <-ch:
+			if !ok {
+				return
+			}
+			// The quiz's channel also carries presence updates
+			if ev.Type == "leaderboard" {
+				// Nicknames may have changed since the stream began
+				if current, exists := app.quizzes.Get(quiz.ID); exists {
+					quiz = current
+				}
+				data, _ := json.Marshal(app.leaderboard(r, quiz))
+				ev.Data = string(data)
+				err = conn.sendEvents([]Event{ev})
+			}
+		case <-heartbeat.C:
+			err = conn.send(": heartbeat\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		if err != nil {
+			app.reapConnection("SSE", quiz.ID, err)
+			return
+		}
+	}
+}
+
+const quizTemplate = baseStyle + `
+    <div class="container mx-auto px-4 py-8 max-w-2xl">
+        <a href="/" class="inline-flex items-center text-indigo-600 hover:text-indigo-800 mb-6">
+            ← Back to polls
+        </a>
+
+        <div class="bg-white rounded-2xl shadow-xl p-8">
+            <h1 class="text-3xl font-bold text-gray-800 mb-2">🏆 {{.Quiz.Title}}</h1>
+            <p class="text-gray-500 mb-6">{{len .Quiz.PollIDs}} questions{{if .Quiz.TimeBonus}} · up to {{.Quiz.TimeBonus}} bonus points for fast answers{{end}}</p>
+
+            <form method="POST" action="/quiz/{{.Quiz.ID}}" class="flex items-center space-x-2 mb-8">
+                <input type="text" name="name" value="{{.Nickname}}" required maxlength="40" placeholder="Your nickname"
+                    class="flex-1 px-4 py-2 border border-gray-300 rounded-lg focus:ring-2 focus:ring-indigo-500 focus:border-indigo-500">
+                <button class="px-4 py-2 bg-indigo-600 hover:bg-indigo-700 text-white rounded-lg transition-colors">{{if .Nickname}}Rename{{else}}Join{{end}}</button>
+            </form>
+
+            <h2 class="text-xl font-semibold text-gray-800 mb-3">Questions</h2>
+            <ol class="space-y-2 mb-8">
+                {{range $i, $q := .Quiz.Questions}}
+                <li>
+                    <a href="/poll/{{$q.ID}}" class="flex justify-between items-center p-4 border border-gray-200 rounded-xl hover:border-indigo-300">
+                        <span class="font-medium text-gray-800">{{$q.Question}}</span>
+                        <span class="inline-flex items-center px-3 py-1 rounded-full text-xs font-medium {{if $q.IsExpired}}bg-red-100 text-red-800{{else if $q.IsDraft}}bg-yellow-100 text-yellow-800{{else}}bg-green-100 text-green-800{{end}}">
+                            {{if $q.IsExpired}}Closed{{else if $q.IsDraft}}Scheduled{{else}}Open{{end}}
+                        </span>
+                    </a>
+                </li>
+                {{end}}
+            </ol>
+
+            <h2 class="text-xl font-semibold text-gray-800 mb-3">Leaderboard <span id="scored" class="text-sm font-normal text-gray-500">after {{.Leaderboard.Scored}} of {{.Leaderboard.Questions}} questions</span></h2>
+            <table class="w-full text-sm">
+                <thead>
+                    <tr class="text-left text-gray-500 border-b border-gray-200">
+                        <th class="py-2">#</th><th class="py-2">Player</th><th class="py-2 text-right">Correct</th><th class="py-2 text-right">Points</th>
+                    </tr>
+                </thead>
+                <tbody id="leaderboard">
+                    {{range .Leaderboard.Scores}}
+                    <tr class="border-b border-gray-100"><td class="py-2">{{.Rank}}</td><td class="py-2">{{.Name}}</td><td class="py-2 text-right">{{.Correct}}/{{.Answered}}</td><td class="py-2 text-right font-semibold">{{.Points}}</td></tr>
+                    {{else}}
+                    <tr><td colspan="4" class="py-4 text-center text-gray-500">Scores appear when the first question closes.</td></tr>
+                    {{end}}
+                </tbody>
+            </table>
+        </div>
+    </div>
+
+    <script>
+        function cell(text, className) {
+            var td = document.createElement('td');
+            td.className = 'py-2' + (className ? ' ' + className : '');
+            td.textContent = text;
+            return td;
+        }
+
+        var events = new EventSource('/quiz/{{.Quiz.ID}}/events');
+        events.addEventListener('leaderboard', function(event) {
+            var board = JSON.parse(event.data);
+            document.getElementById('scored').textContent = 'after ' + board.scored + ' of ' + board.questions + ' questions';
+            var body = document.getElementById('leaderboard');
+            body.innerHTML = '';
+            board.scores.forEach(function(score) {
+                var tr = document.createElement('tr');
+                tr.className = 'border-b border-gray-100';
+                tr.appendChild(cell(score.rank));
+                tr.appendChild(cell(score.name));
+                tr.appendChild(cell(score.correct + '/' + score.answered, 'text-right'));
+                tr.appendChild(cell(score.points, 'text-right font-semibold'));
+                body.appendChild(tr);
+            });
+        });
+    </script>
+` + baseEnd
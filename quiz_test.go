@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// createQuiz creates a quiz of two questions through the API and returns
+// it with its questions
+func createQuiz(t *testing.T, app *App, owner *User, timeBonus int) quizView {
+	t.Helper()
+	body := `{"title":"Friday trivia","time_bonus":` + strconv.Itoa(timeBonus) + `,"questions":[
+		{"question":"Capital of France?","options":["Paris","Lyon"],"correct":["Paris"]},
+		{"question":"Primes?","options":["2","4","7"],"type":"approval","correct":["2","7"]}]}`
+	rec := accountCall(t, app, owner, http.MethodPost, "/api/quizzes", body)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Expected the quiz created, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var quiz quizView
+	json.NewDecoder(rec.Body).Decode(&quiz)
+	return quiz
+}
+
+// closeQuestion closes a question the way the owner would
+func closeQuestion(t *testing.T, app *App, pollID string) {
+	t.Helper()
+	poll, err := app.store.Update(pollID, func(p *Poll) error { return p.closeNow(time.Now()) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.broadcastPollEvent(poll, "closed")
+}
+
+// TestBuildQuiz validates quiz definitions.
+func TestBuildQuiz(t *testing.T) {
+	question := PollInput{Question: "Q?", Options: []string{"A", "B"}, Correct: []string{"A"}}
+	cases := map[string]QuizInput{
+		"title":       {Questions: []PollInput{question}},
+		"questions":   {Title: "Quiz"},
+		"time_bonus":  {Title: "Quiz", TimeBonus: -1, Questions: []PollInput{question}},
+		"correct":     {Title: "Quiz", Questions: []PollInput{{Question: "Q?", Options: []string{"A", "B"}}}},
+		"attribution": {Title: "Quiz", Questions: []PollInput{{Question: "Q?", Options: []string{"A", "B"}, Correct: []string{"B"}, Attribution: "anonymous"}}},
+	}
+	for field, in := range cases {
+		_, _, err := buildQuiz(in)
+		if verr, ok := err.(*ValidationError); !ok || verr.Field != field {
+			t.Errorf("Expected a %s error, got %v", field, err)
+		}
+	}
+
+	if _, err := buildPoll(PollInput{Question: "Q?", Options: []string{"A", "B"}, Correct: []string{"C"}}); err == nil {
+		t.Error("Expected an unknown correct option to be rejected")
+	}
+	quiz, polls, err := buildQuiz(QuizInput{Title: " Quiz ", Questions: []PollInput{question}})
+	if err != nil || quiz.Title != "Quiz" || len(polls) != 1 || len(polls[0].Answers) != 1 || polls[0].Answers[0] != polls[0].Options[0].ID {
+		t.Errorf("Expected a valid quiz, got %+v %+v %v", quiz, polls, err)
+	}
+}
+
+// TestCreateFormCorrect reads correct answers only from their own field
+// and keeps option texts as entered.
+func TestCreateFormCorrect(t *testing.T) {
+	if correct := parseCorrect(" Lyon \n\nNice\n"); strings.Join(correct, ",") != "Lyon,Nice" {
+		t.Errorf("Expected two correct answers, got %v", correct)
+	}
+
+	app := NewApp()
+	create := func(form url.Values) *Poll {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/create", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		app.Routes().ServeHTTP(httptest.NewRecorder(), req)
+		polls := app.store.List()
+		if len(polls) == 0 {
+			t.Fatal("Expected a poll created")
+		}
+		return polls[0]
+	}
+
+	poll := create(url.Values{"question": {"Best band?"}, "options": {"*NSYNC\n* bullet"}})
+	if poll.Options[0].Text != "*NSYNC" || poll.Options[1].Text != "* bullet" || len(poll.Answers) != 0 {
+		t.Errorf("Expected options kept as entered and no answers, got %+v", poll)
+	}
+	poll = create(url.Values{"question": {"Capital?"}, "options": {"Paris\nLyon"}, "correct": {"Paris"}})
+	if len(poll.Answers) != 1 || poll.Answers[0] != poll.Options[0].ID {
+		t.Errorf("Expected Paris correct, got %v", poll.Answers)
+	}
+}
+
+// TestQuizScoring scores correct answers with a bonus for answering early
+// and shares ranks between equal scores.
+func TestQuizScoring(t *testing.T) {
+	app := NewApp()
+	start := time.Now().Add(-100 * time.Second)
+	poll, _ := buildPoll(PollInput{Question: "Q?", Options: []string{"A", "B"}, Correct: []string{"A"}})
+	app.store.Create(poll)
+	right, wrong := poll.Options[0].ID, poll.Options[1].ID
+	app.store.Update(poll.ID, func(p *Poll) error {
+		p.CreatedAt = start
+		return nil
+	})
+	for voterID, ballot := range map[string]Ballot{
+		"early": {Choices: []string{right}, CastAt: start.Add(25 * time.Second)},
+		"late":  {Choices: []string{right}, CastAt: start.Add(75 * time.Second)},
+		"also":  {Choices: []string{right}, CastAt: start.Add(75 * time.Second)},
+		"wrong": {Choices: []string{wrong}, CastAt: start},
+	} {
+		ballot.VoterID = voterID
+		if _, err := app.store.CastBallot(poll.ID, ballot); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	quiz := &Quiz{Title: "Quiz", PollIDs: []string{poll.ID}, TimeBonus: 100, Players: map[string]string{"early": "Ada", "late": "Bob", "also": "Cy"}}
+	app.quizzes.Create(quiz)
+	req := httptest.NewRequest(http.MethodGet, "/api/quizzes/"+quiz.ID+"/leaderboard", nil)
+	if board := app.leaderboard(req, quiz); board.Scored != 0 || len(board.Scores) != 0 {
+		t.Fatalf("Expected no scores before the question closes, got %+v", board)
+	}
+
+	app.store.Update(poll.ID, func(p *Poll) error { return p.closeNow(start.Add(100 * time.Second)) })
+	board := app.leaderboard(req, quiz)
+	want := []QuizScore{
+		{Rank: 1, Name: "Ada", Points: 175, Correct: 1, Answered: 1},
+		{Rank: 2, Name: "Bob", Points: 125, Correct: 1, Answered: 1},
+		{Rank: 2, Name: "Cy", Points: 125, Correct: 1, Answered: 1},
+		{Rank: 4, Name: "Guest " + voterHash(quiz.guestKey, "wrong")[:4], Points: 0, Correct: 0, Answered: 1},
+	}
+	if board.Scored != 1 || len(board.Scores) != len(want) {
+		t.Fatalf("Expected %d scores, got %+v", len(want), board)
+	}
+	for i := range want {
+		if board.Scores[i] != want[i] {
+			t.Errorf("Expected %+v at %d, got %+v", want[i], i, board.Scores[i])
+		}
+	}
+}
+
+// TestQuizAPI creates a quiz, keeps its answers secret until a question
+// closes and shows players by nickname.
+func TestQuizAPI(t *testing.T) {
+	app := NewApp()
+	owner := registerUser(t, app, "owner")
+	quiz := createQuiz(t, app, owner, 0)
+	if len(quiz.Questions) != 2 || quiz.Questions[0].QuizID != quiz.ID {
+		t.Fatalf("Expected two questions of the quiz, got %+v", quiz)
+	}
+	france, primes := quiz.Questions[0], quiz.Questions[1]
+
+	if rec := apiCall(t, app, http.MethodPost, "/api/quizzes/"+quiz.ID+"/players", `{"name":"Ada"}`, "v1"); rec.Code != http.StatusNoContent {
+		t.Fatalf("Expected the nickname saved, got %d", rec.Code)
+	}
+	if rec := apiCall(t, app, http.MethodPost, "/api/quizzes/"+quiz.ID+"/players", `{"name":""}`, "v2"); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected an empty nickname refused, got %d", rec.Code)
+	}
+	apiCall(t, app, http.MethodPost, "/api/polls/"+france.ID+"/votes", `{"options":["`+france.Options[0].ID+`"]}`, "v1")
+	apiCall(t, app, http.MethodPost, "/api/polls/"+primes.ID+"/votes", `{"options":["`+primes.Options[0].ID+`"]}`, "v1")
+
+	rec := apiCall(t, app, http.MethodGet, "/api/polls/"+france.ID, "", "v1")
+	if strings.Contains(rec.Body.String(), "correct") {
+		t.Errorf("Expected the answer secret while open, got %s", rec.Body.String())
+	}
+
+	closeQuestion(t, app, france.ID)
+	got := fetchPoll(t, app, nil, "v1", france.ID)
+	if got.Final == nil || len(got.Final.Correct) != 1 || got.Final.Correct[0] != france.Options[0].ID {
+		t.Errorf("Expected the answer revealed once closed, got %+v", got.Final)
+	}
+
+	rec = apiCall(t, app, http.MethodGet, "/api/quizzes/"+quiz.ID+"/leaderboard", "", "v2")
+	var board Leaderboard
+	json.NewDecoder(rec.Body).Decode(&board)
+	if board.Scored != 1 || board.Questions != 2 || len(board.Scores) != 1 || board.Scores[0].Name != "Ada" || board.Scores[0].Points != quizPoints {
+		t.Errorf("Expected Ada ahead after one question, got %+v", board)
+	}
+
+	closeQuestion(t, app, primes.ID)
+	rec = apiCall(t, app, http.MethodGet, "/api/quizzes/"+quiz.ID+"/leaderboard", "", "v2")
+	json.NewDecoder(rec.Body).Decode(&board)
+	if board.Scored != 2 || board.Scores[0].Correct != 1 || board.Scores[0].Answered != 2 {
+		t.Errorf("Expected a partly correct approval ballot to score nothing, got %+v", board)
+	}
+
+	if rec := apiCall(t, app, http.MethodGet, "/api/quizzes/quiz_missing", "", "v1"); rec.Code != http.StatusNotFound || decodeAPIError(t, rec) != "quiz_not_found" {
+		t.Errorf("Expected an unknown quiz refused, got %d", rec.Code)
+	}
+}
+
+// TestQuizLeaderboardStream broadcasts the leaderboard when a question
+// closes and shows it on the quiz page.
+func TestQuizLeaderboardStream(t *testing.T) {
+	app := NewApp()
+	owner := registerUser(t, app, "owner")
+	quiz := createQuiz(t, app, owner, 50)
+	france := quiz.Questions[0]
+	apiCall(t, app, http.MethodPost, "/api/polls/"+france.ID+"/votes", `{"options":["`+france.Options[0].ID+`"]}`, "v1")
+
+	if events := app.broadcaster.Since(quiz.ID, 0); len(events) != 0 {
+		t.Fatalf("Expected no leaderboard before a question closes, got %+v", events)
+	}
+	closeQuestion(t, app, france.ID)
+	events := app.broadcaster.Since(quiz.ID, 0)
+	if len(events) != 1 || events[0].Type != "leaderboard" {
+		t.Fatalf("Expected a leaderboard event, got %+v", events)
+	}
+	if events[0].Data != "" {
+		t.Errorf("Expected the standings left to each client, got %s", events[0].Data)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/quiz/"+quiz.ID, nil)
+	page := httptest.NewRecorder()
+	app.Routes().ServeHTTP(page, req)
+	if body := page.Body.String(); !strings.Contains(body, "Friday trivia") || !strings.Contains(body, "/quiz/"+quiz.ID+"/events") {
+		t.Error("Expected the quiz page with its leaderboard stream")
+	}
+	req = httptest.NewRequest(http.MethodGet, "/poll/"+france.ID, nil)
+	page = httptest.NewRecorder()
+	app.Routes().ServeHTTP(page, req)
+	if !strings.Contains(page.Body.String(), "correct-answer") {
+		t.Error("Expected the poll page to mark the correct option")
+	}
+}
+
+// TestQuizLeaderboardAccess scores only the questions whose results the
+// caller may see.
+func TestQuizLeaderboardAccess(t *testing.T) {
+	app := NewApp()
+	owner := registerUser(t, app, "owner")
+	body := `{"title":"Staff quiz","questions":[
+		{"question":"Open?","options":["A","B"],"correct":["A"]},
+		{"question":"Owner only?","options":["A","B"],"correct":["A"],"results_visibility":"owner"},
+		{"question":"Private?","options":["A","B"],"correct":["A"],"visibility":"private","members":["owner"]}]}`
+	rec := accountCall(t, app, owner, http.MethodPost, "/api/quizzes", body)
+	var created quizView
+	json.NewDecoder(rec.Body).Decode(&created)
+	quiz, exists := app.quizzes.Get(created.ID)
+	if !exists || len(quiz.PollIDs) != 3 {
+		t.Fatalf("Expected a quiz of three questions, got %d: %s", rec.Code, rec.Body.String())
+	}
+	for _, pollID := range quiz.PollIDs {
+		poll, _ := app.store.Get(pollID)
+		if _, err := app.store.CastBallot(pollID, Ballot{VoterID: owner.ID, Choices: []string{poll.Options[0].ID}}); err != nil {
+			t.Fatal(err)
+		}
+		closeQuestion(t, app, pollID)
+	}
+
+	var board Leaderboard
+	json.NewDecoder(apiCall(t, app, http.MethodGet, "/api/quizzes/"+quiz.ID+"/leaderboard", "", "v1").Body).Decode(&board)
+	if board.Scored != 1 || len(board.Scores) != 1 || board.Scores[0].Answered != 1 {
+		t.Errorf("Expected only the open question scored for others, got %+v", board)
+	}
+	json.NewDecoder(accountCall(t, app, owner, http.MethodGet, "/api/quizzes/"+quiz.ID+"/leaderboard", "").Body).Decode(&board)
+	if board.Scored != 3 || len(board.Scores) != 1 || board.Scores[0].Answered != 3 {
+		t.Errorf("Expected every question scored for the owner, got %+v", board)
+	}
+}
+
+// TestOpenQuizzes keeps quizzes and nicknames across restarts.
+func TestOpenQuizzes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quizzes.json")
+	quizzes, err := OpenQuizzes(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	quiz := &Quiz{Title: "Quiz", PollIDs: []string{"poll_1"}}
+	quizzes.Create(quiz)
+	quizzes.SetPlayer(quiz.ID, "v1", "Ada")
+
+	reopened, err := OpenQuizzes(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, exists := reopened.Get(quiz.ID)
+	if !exists || got.Title != "Quiz" || got.Players["v1"] != "Ada" || string(got.guestKey) != string(quiz.guestKey) {
+		t.Errorf("Expected the quiz reloaded, got %+v", got)
+	}
+}
@@ -0,0 +1,162 @@
+// ranked.go - Ranked-choice (instant-runoff) counting
+// Option.Votes holds first-preference counts for ranked polls, and the full
+// round-by-round result is recomputed from the stored ballots whenever a
+// ballot is added or retracted.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// RunoffResult is the outcome of an instant-runoff count
+type RunoffResult struct {
+	Rounds []RunoffRound `json:"rounds"`
+	Winner string        `json:"winner,omitempty"`
+	Tied   []string      `json:"tied,omitempty"`
+}
+
+// RunoffRound is one counting round. Counts maps each option still in the
+// race to the ballots currently ranking it highest.
+type RunoffRound struct {
+	Number     int            `json:"number"`
+	Counts     map[string]int `json:"counts"`
+	Exhausted  int            `json:"exhausted"`
+	Eliminated string         `json:"eliminated,omitempty"`
+}
+
+// computeRunoff counts ballots by instant runoff. Each round every ballot
+// counts for its highest-ranked option still in the race; an option with
+// more than half of the non-exhausted ballots wins, otherwise the option
+// with the fewest is eliminated. Ties for last place are broken by the
+// earlier rounds' counts and then by option order (later options go
+// first). If every remaining option is level the count ends in a tie.
+func computeRunoff(options []Option, ballots []Ballot) *RunoffResult {
+	result := &RunoffResult{}
+	if len(ballots) == 0 || len(options) == 0 {
+		return result
+	}
+
+	active := make(map[string]bool, len(options))
+	for _, opt := range options {
+		active[opt.ID] = true
+	}
+
+	for round := 1; len(active) > 0; round++ {
+		counts := make(map[string]int, len(active))
+		for id := range active {
+			counts[id] = 0
+		}
+		exhausted := 0
+		for _, b := range ballots {
+			if choice := topActiveChoice(b, active); choice != "" {
+				counts[choice]++
+			} else {
+				exhausted++
+			}
+		}
+
+		current := RunoffRound{Number: round, Counts: counts, Exhausted: exhausted}
+		continuing := len(ballots) - exhausted
+
+		leader, lowest := "", ""
+		for _, opt := range options {
+			if !active[opt.ID] {
+				continue
+			}
+			if leader == "" || counts[opt.ID] > counts[leader] {
+				leader = opt.ID
+			}
+			if lowest == "" || counts[opt.ID] < counts[lowest] ||
+				(counts[opt.ID] == counts[lowest] && breaksTieLower(opt.ID, lowest, result.Rounds)) {
+				lowest = opt.ID
+			}
+		}
+
+		if len(active) == 1 || counts[leader]*2 > continuing {
+			result.Rounds = append(result.Rounds, current)
+			result.Winner = leader
+			return result
+		}
+		if counts[leader] == counts[lowest] {
+			result.Rounds = append(result.Rounds, current)
+			for _, opt := range options {
+				if active[opt.ID] {
+					result.Tied = append(result.Tied, opt.ID)
+				}
+			}
+			return result
+		}
+
+		current.Eliminated = lowest
+		delete(active, lowest)
+		result.Rounds = append(result.Rounds, current)
+	}
+	return result
+}
+
+// topActiveChoice returns the highest-ranked option on a ballot that is
+// still in the race, or "" if the ballot is exhausted
+func topActiveChoice(b Ballot, active map[string]bool) string {
+	for _, id := range b.Choices {
+		if active[id] {
+			return id
+		}
+	}
+	return ""
+}
+
+// breaksTieLower decides between two options level on the current count.
+// It walks back through earlier rounds and reports whether candidate had
+// fewer votes than current at the most recent round where they differed.
+// With no difference the later option (candidate, since options are
+// visited in order) is eliminated first.
+func breaksTieLower(candidate, current string, rounds []RunoffRound) bool {
+	for i := len(rounds) - 1; i >= 0; i-- {
+		a, b := rounds[i].Counts[candidate], rounds[i].Counts[current]
+		if a != b {
+			return a < b
+		}
+	}
+	return true
+}
+
+// rankingFromForm builds an ordered ballot from a submitted form. Browsers
+// send "rank-<optionID>=<position>" for each ranked option; API clients may
+// instead repeat "option" in order of preference.
+func rankingFromForm(r *http.Request, poll *Poll) ([]string, error) {
+	type ranked struct {
+		id   string
+		rank int
+	}
+	var picks []ranked
+	for _, opt := range poll.Options {
+		value := strings.TrimSpace(r.FormValue("rank-" + opt.ID))
+		if value == "" {
+			continue
+		}
+		rank, err := strconv.Atoi(value)
+		if err != nil || rank < 1 {
+			return nil, fmt.Errorf("invalid rank for %q", opt.Text)
+		}
+		picks = append(picks, ranked{opt.ID, rank})
+	}
+
+	if len(picks) == 0 {
+		return r.Form["option"], nil
+	}
+
+	sort.SliceStable(picks, func(i, j int) bool { return picks[i].rank < picks[j].rank })
+	choices := make([]string, len(picks))
+	for i, p := range picks {
+		if i > 0 && p.rank == picks[i-1].rank {
+			return nil, fmt.Errorf("each rank can only be used once")
+		}
+		choices[i] = p.id
+	}
+	return choices, nil
+}
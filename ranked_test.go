@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func rankedOptions() []Option {
+	return []Option{{ID: "a", Text: "Alpha"}, {ID: "b", Text: "Beta"}, {ID: "c", Text: "Gamma"}}
+}
+
+func ballots(rankings ...string) []Ballot {
+	var out []Ballot
+	for _, r := range rankings {
+		out = append(out, Ballot{Choices: strings.Split(r, "")})
+	}
+	return out
+}
+
+// TestRunoffMajorityFirstRound verifies that an outright
+// majority wins without eliminations.
+func TestRunoffMajorityFirstRound(t *testing.T) {
+	result := computeRunoff(rankedOptions(), ballots("ab", "ac", "b"))
+
+	if result.Winner != "a" {
+		t.Errorf("Expected a to win, got %q", result.Winner)
+	}
+	if len(result.Rounds) != 1 {
+		t.Errorf("Expected 1 round, got %d", len(result.Rounds))
+	}
+}
+
+// TestRunoffTransfersVotes checks that eliminated options'
+// ballots move to the next preference.
+func TestRunoffTransfersVotes(t *testing.T) {
+	// First round: a=2, b=2, c=1 -> c eliminated, its ballot goes to b
+	result := computeRunoff(rankedOptions(), ballots("a", "a", "b", "b", "cb"))
+
+	if result.Winner != "b" {
+		t.Fatalf("Expected b to win, got %q", result.Winner)
+	}
+	if len(result.Rounds) != 2 {
+		t.Fatalf("Expected 2 rounds, got %d", len(result.Rounds))
+	}
+	if result.Rounds[0].Eliminated != "c" {
+		t.Errorf("Expected c eliminated in round 1, got %q", result.Rounds[0].Eliminated)
+	}
+	if _, ok := result.Rounds[1].Counts["c"]; ok {
+		t.Error("Eliminated option should not be counted in later rounds")
+	}
+	if result.Rounds[1].Counts["b"] != 3 {
+		t.Errorf("Expected b=3 in round 2, got %d", result.Rounds[1].Counts["b"])
+	}
+}
+
+// TestRunoffExhaustedAndTie ensures exhausted ballots are
+// reported and a level final count ends in a tie.
+func TestRunoffExhaustedAndTie(t *testing.T) {
+	// c is eliminated and its only ballot has no further preference
+	result := computeRunoff(rankedOptions(), ballots("a", "a", "b", "b", "c"))
+
+	if result.Winner != "" {
+		t.Errorf("Expected no winner, got %q", result.Winner)
+	}
+	last := result.Rounds[len(result.Rounds)-1]
+	if last.Exhausted != 1 {
+		t.Errorf("Expected 1 exhausted ballot, got %d", last.Exhausted)
+	}
+	if len(result.Tied) != 2 {
+		t.Errorf("Expected a two-way tie, got %v", result.Tied)
+	}
+}
+
+// TestStoreRankedBallot verifies ranked ballots are stored,
+// counted as first preferences and validated.
+func TestStoreRankedBallot(t *testing.T) {
+	store := NewStore()
+	poll := &Poll{Question: "Venue?", Type: PollRanked, Options: rankedOptions()}
+	store.Create(poll)
+
+	updated, err := store.CastBallot(poll.ID, Ballot{Choices: []string{"b", "a"}})
+	if err != nil {
+		t.Fatalf("CastBallot failed: %v", err)
+	}
+	if updated.Options[1].Votes != 1 || len(updated.Ballots) != 1 {
+		t.Errorf("Expected one stored first preference for b, got %+v", updated)
+	}
+	if updated.Runoff == nil || updated.Runoff.Winner != "b" {
+		t.Errorf("Expected runoff winner b, got %+v", updated.Runoff)
+	}
+
+	// Ranking an option twice is rejected
+	if _, err := store.CastBallot(poll.ID, Ballot{Choices: []string{"a", "a"}}); err == nil {
+		t.Error("Expected error for duplicate ranking")
+	}
+
+	// Single-choice polls reject several options
+	single := &Poll{Question: "One?", Options: rankedOptions()}
+	store.Create(single)
+	if _, err := store.CastBallot(single.ID, Ballot{Choices: []string{"a", "b"}}); err == nil {
+		t.Error("Expected error for multiple choices on a single-choice poll")
+	}
+}
+
+// TestRankedVoteHandler checks that rank-* form fields are
+// turned into an ordered ballot and the rounds are rendered.
+func TestRankedVoteHandler(t *testing.T) {
+	app := NewApp()
+	poll := &Poll{Question: "Venue?", Type: PollRanked, Options: rankedOptions()}
+	app.store.Create(poll)
+
+	form := url.Values{"rank-c": {"1"}, "rank-a": {"2"}}
+	req := httptest.NewRequest(http.MethodPost, "/vote/"+poll.ID, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	signIn(app, req, "voter-1")
+	rec := httptest.NewRecorder()
+	app.Routes().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("Expected redirect, got %d: %s", rec.Code, rec.Body.String())
+	}
+	got, _ := app.store.Get(poll.ID)
+	if len(got.Ballots) != 1 || strings.Join(got.Ballots.List()[0].Choices, "") != "ca" {
+		t.Errorf("Expected ballot [c a], got %+v", got.Ballots)
+	}
+
+	rec = httptest.NewRecorder()
+	app.PollHandler(rec, httptest.NewRequest(http.MethodGet, "/poll/"+poll.ID, nil))
+	if !strings.Contains(rec.Body.String(), "Winner: Gamma") {
+		t.Error("Expected rendered runoff winner on poll page")
+	}
+}
@@ -0,0 +1,347 @@
+// redisbus.go - Message bus over Redis pub/sub
+// Speaks just enough of the Redis protocol (RESP) to AUTH, PUBLISH and
+// SUBSCRIBE, so any Redis-compatible server works without a client
+// library. Publishing uses one connection; a second one stays subscribed
+// and is re-established with backoff if it drops. Messages published while
+// a node is disconnected are not replayed; its clients catch up with the
+// next event.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	redisEventsChannel  = "quickpoll:events"
+	redisDialTimeout    = 5 * time.Second
+	redisCommandTimeout = 5 * time.Second
+	redisPingInterval   = 30 * time.Second
+	redisMaxBackoff     = 5 * time.Second
+	redisMaxBulkLength  = 16 << 20
+	redisMaxArrayLength = 1 << 16
+	redisInitialBackoff = 100 * time.Millisecond
+)
+
+// redisError is an error reply from the server
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// RedisBus publishes and receives poll events through a Redis channel
+type RedisBus struct {
+	addr     string
+	password string
+	channel  string
+
+	pubMu   sync.Mutex
+	pubConn net.Conn
+	pubBuf  *bufio.Reader
+
+	mu          sync.Mutex
+	subscribers []func(BusMessage)
+	subConn     net.Conn
+	started     bool
+	closed      bool
+	done        chan struct{}
+}
+
+// NewRedisBus creates a bus on the given Redis channel. Connections are
+// opened on first use.
+func NewRedisBus(addr, password, channel string) *RedisBus {
+	return &RedisBus{
+		addr:     addr,
+		password: password,
+		channel:  channel,
+		done:     make(chan struct{}),
+	}
+}
+
+// Publish sends a message to every subscribed node
+func (b *RedisBus) Publish(msg BusMessage) error {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	b.pubMu.Lock()
+	defer b.pubMu.Unlock()
+
+	// A connection that broke since the last publish is replaced once
+	for attempt := 0; attempt < 2; attempt++ {
+		if b.pubConn == nil {
+			conn, br, err := b.dial()
+			if err != nil {
+				return err
+			}
+			b.pubConn, b.pubBuf = conn, br
+		}
+		_, err = redisCommand(b.pubConn, b.pubBuf, "PUBLISH", b.channel, string(payload))
+		var rerr redisError
+		if err == nil || errors.As(err, &rerr) {
+			return err
+		}
+		b.pubConn.Close()
+		b.pubConn, b.pubBuf = nil, nil
+	}
+	return err
+}
+
+// Subscribe registers fn to receive every published message. The first
+// call starts the subscriber connection.
+func (b *RedisBus) Subscribe(fn func(BusMessage)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.subscribers = append(b.subscribers, fn)
+	if !b.started && !b.closed {
+		b.started = true
+		go b.subscribeLoop()
+	}
+}
+
+// Close stops the subscriber and closes both connections
+func (b *RedisBus) Close() error {
+	b.mu.Lock()
+	if !b.closed {
+		b.closed = true
+		close(b.done)
+		if b.subConn != nil {
+			b.subConn.Close()
+		}
+	}
+	b.mu.Unlock()
+
+	b.pubMu.Lock()
+	defer b.pubMu.Unlock()
+	if b.pubConn != nil {
+		b.pubConn.Close()
+		b.pubConn = nil
+	}
+	return nil
+}
+
+// subscribeLoop keeps a subscribed connection open until Close
+func (b *RedisBus) subscribeLoop() {
+	backoff := redisInitialBackoff
+	for {
+		start := time.Now()
+		err := b.subscribeOnce()
+
+		select {
+		case <-b.done:
+			return
+		default:
+		}
+		if time.Since(start) > redisMaxBackoff {
+			backoff = redisInitialBackoff
+		}
+		log.Printf("Redis subscription to %s lost: %v; reconnecting in %v", b.channel, err, backoff)
+
+		select {
+		case <-b.done:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > redisMaxBackoff {
+			backoff = redisMaxBackoff
+		}
+	}
+}
+
+// subscribeOnce subscribes on a new connection and delivers messages until
+// the connection fails
+func (b *RedisBus) subscribeOnce() error {
+	conn, br, err := b.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return errors.New("bus closed")
+	}
+	b.subConn = conn
+	b.mu.Unlock()
+
+	var writeMu sync.Mutex
+	send := func(args ...string) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		conn.SetWriteDeadline(time.Now().Add(redisCommandTimeout))
+		return writeRedisCommand(conn, args...)
+	}
+	if err := send("SUBSCRIBE", b.channel); err != nil {
+		return err
+	}
+
+	// Pings keep idle connections open and reveal dead ones
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(redisPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if send("PING") != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(2 * redisPingInterval))
+		reply, err := readRedisReply(br)
+		if err != nil {
+			return err
+		}
+		parts, ok := reply.([]interface{})
+		if !ok || len(parts) < 3 {
+			continue
+		}
+		kind, _ := parts[0].(string)
+		switch kind {
+		case "subscribe":
+			log.Printf("Subscribed to Redis channel %s", b.channel)
+		case "message":
+			payload, _ := parts[2].(string)
+			b.deliver(payload)
+		}
+	}
+}
+
+// deliver decodes a message and passes it to the subscribers
+func (b *RedisBus) deliver(payload string) {
+	var msg BusMessage
+	if err := json.Unmarshal([]byte(payload), &msg); err != nil {
+		log.Printf("Ignoring malformed bus message: %v", err)
+		return
+	}
+
+	b.mu.Lock()
+	subscribers := b.subscribers
+	b.mu.Unlock()
+	for _, fn := range subscribers {
+		fn(msg)
+	}
+}
+
+// dial opens and authenticates a connection
+func (b *RedisBus) dial() (net.Conn, *bufio.Reader, error) {
+	return redisDial(b.addr, b.password)
+}
+
+// redisDial opens a connection to addr, authenticating with password if
+// it is set
+func redisDial(addr, password string) (net.Conn, *bufio.Reader, error) {
+	conn, err := net.DialTimeout("tcp", addr, redisDialTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	br := bufio.NewReader(conn)
+	if password != "" {
+		if _, err := redisCommand(conn, br, "AUTH", password); err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+	}
+	return conn, br, nil
+}
+
+// redisCommand sends one command and reads its reply
+func redisCommand(conn net.Conn, br *bufio.Reader, args ...string) (interface{}, error) {
+	conn.SetDeadline(time.Now().Add(redisCommandTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	if err := writeRedisCommand(conn, args...); err != nil {
+		return nil, err
+	}
+	return readRedisReply(br)
+}
+
+// writeRedisCommand encodes a command as an array of bulk strings
+func writeRedisCommand(w io.Writer, args ...string) error {
+	buf := make([]byte, 0, 64)
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, "\r\n"...)
+	for _, arg := range args {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+		buf = append(buf, "\r\n"...)
+		buf = append(buf, arg...)
+		buf = append(buf, "\r\n"...)
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+// readRedisReply decodes one reply. Simple and bulk strings become string,
+// integers int64, arrays []interface{}, nulls nil and error replies a
+// redisError.
+func readRedisReply(br *bufio.Reader) (interface{}, error) {
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	kind, body := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, redisError(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil || n > redisMaxBulkLength {
+			return nil, fmt.Errorf("redis: bad bulk length %q", body)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(br, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil || n > redisMaxArrayLength {
+			return nil, fmt.Errorf("redis: bad array length %q", body)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = readRedisReply(br); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("redis: unknown reply type %q", kind)
+	}
+}
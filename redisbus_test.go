@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is a stand-in for a Redis server supporting AUTH, PING,
+// SUBSCRIBE and PUBLISH, the string and set commands the store uses, and
+// WATCH/MULTI/EXEC transactions
+type fakeRedis struct {
+	ln       net.Listener
+	password string
+
+	mu          sync.Mutex
+	conns       map[net.Conn]bool
+	subscribers map[string][]net.Conn
+	values      map[string]string
+	sets        map[string]map[string]bool
+	versions    map[string]uint64 // bumped by every write, for WATCH
+}
+
+// fakeStatus is a simple string reply
+type fakeStatus string
+
+// fakeSession is the state of one client connection
+type fakeSession struct {
+	authed  bool
+	watched map[string]uint64
+	queued  [][]string // commands of an open MULTI; nil outside one
+}
+
+func startFakeRedis(t *testing.T, password string) *fakeRedis {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	srv := &fakeRedis{
+		ln:          ln,
+		password:    password,
+		conns:       make(map[net.Conn]bool),
+		subscribers: make(map[string][]net.Conn),
+		values:      make(map[string]string),
+		sets:        make(map[string]map[string]bool),
+		versions:    make(map[string]uint64),
+	}
+	go srv.serve()
+	t.Cleanup(func() { ln.Close(); srv.dropAll() })
+	return srv
+}
+
+func (s *fakeRedis) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns[conn] = true
+		s.mu.Unlock()
+		go s.handle(conn)
+	}
+}
+
+func (s *fakeRedis) handle(conn net.Conn) {
+	defer s.drop(conn)
+	br := bufio.NewReader(conn)
+	sess := &fakeSession{authed: s.password == ""}
+
+	for {
+		reply, err := readRedisReply(br)
+		if err != nil {
+			return
+		}
+		parts, _ := reply.([]interface{})
+		args := make([]string, len(parts))
+		for i, p := range parts {
+			args[i], _ = p.(string)
+		}
+		if len(args) == 0 {
+			return
+		}
+
+		s.mu.Lock()
+		writeFakeReply(conn, s.session(conn, sess, args))
+		s.mu.Unlock()
+	}
+}
+
+// session runs the commands that depend on the connection's state. The
+// caller must hold s.mu.
+func (s *fakeRedis) session(conn net.Conn, sess *fakeSession, args []string) interface{} {
+	switch cmd := strings.ToUpper(args[0]); {
+	case cmd == "AUTH":
+		sess.authed = args[1] == s.password
+		if !sess.authed {
+			return redisError("WRONGPASS invalid password")
+		}
+		return fakeStatus("OK")
+	case !sess.authed:
+		return redisError("NOAUTH Authentication required.")
+	case cmd == "MULTI":
+		sess.queued = [][]string{}
+		return fakeStatus("OK")
+	case cmd == "EXEC":
+		if sess.queued == nil {
+			return redisError("ERR EXEC without MULTI")
+		}
+		queued, watched := sess.queued, sess.watched
+		sess.queued, sess.watched = nil, nil
+		for key, version := range watched {
+			if s.versions[key] != version {
+				return nil
+			}
+		}
+		replies := make([]interface{}, len(queued))
+		for i, q := range queued {
+			replies[i] = s.run(conn, q)
+		}
+		return replies
+	case cmd == "DISCARD":
+		sess.queued, sess.watched = nil, nil
+		return fakeStatus("OK")
+	case sess.queued != nil:
+		sess.queued = append(sess.queued, args)
+		return fakeStatus("QUEUED")
+	case cmd == "WATCH":
+		if sess.watched == nil {
+			sess.watched = make(map[string]uint64)
+		}
+		for _, key := range args[1:] {
+			sess.watched[key] = s.versions[key]
+		}
+		return fakeStatus("OK")
+	case cmd == "UNWATCH":
+		sess.watched = nil
+		return fakeStatus("OK")
+	default:
+		return s.run(conn, args)
+	}
+}
+
+// run runs one command. The caller must hold s.mu.
+func (s *fakeRedis) run(conn net.Conn, args []string) interface{} {
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		return fakeStatus("PONG")
+	case "SUBSCRIBE":
+		s.subscribers[args[1]] = append(s.subscribers[args[1]], conn)
+		return []interface{}{"subscribe", args[1]}
+	case "PUBLISH":
+		subs := s.subscribers[args[1]]
+		for _, sub := range subs {
+			writeRedisCommand(sub, "message", args[1], args[2])
+		}
+		return int64(len(subs))
+	case "GET":
+		if value, exists := s.values[args[1]]; exists {
+			return value
+		}
+		return nil
+	case "MGET":
+		values := make([]interface{}, len(args)-1)
+		for i, key := range args[1:] {
+			if value, exists := s.values[key]; exists {
+				values[i] = value
+			}
+		}
+		return values
+	case "SET":
+		if _, exists := s.values[args[1]]; exists && len(args) > 3 && strings.ToUpper(args[3]) == "NX" {
+			return nil
+		}
+		s.values[args[1]] = args[2]
+		s.versions[args[1]]++
+		return fakeStatus("OK")
+	case "INCR":
+		n, _ := strconv.ParseInt(s.values[args[1]], 10, 64)
+		n++
+		s.values[args[1]] = strconv.FormatInt(n, 10)
+		s.versions[args[1]]++
+		return n
+	case "EXISTS", "DEL":
+		n := int64(0)
+		for _, key := range args[1:] {
+			_, value := s.values[key]
+			_, set := s.sets[key]
+			if value || set {
+				n++
+				if strings.ToUpper(args[0]) == "DEL" {
+					delete(s.values, key)
+					delete(s.sets, key)
+					s.versions[key]++
+				}
+			}
+		}
+		return n
+	case "SADD":
+		set := s.sets[args[1]]
+		if set == nil {
+			set = make(map[string]bool)
+			s.sets[args[1]] = set
+		}
+		n := int64(0)
+		for _, member := range args[2:] {
+			if !set[member] {
+				set[member] = true
+				n++
+			}
+		}
+		s.versions[args[1]]++
+		return n
+	case "SREM":
+		set := s.sets[args[1]]
+		n := int64(0)
+		for _, member := range args[2:] {
+			if set[member] {
+				delete(set, member)
+				n++
+			}
+		}
+		if len(set) == 0 {
+			delete(s.sets, args[1])
+		}
+		s.versions[args[1]]++
+		return n
+	case "SMEMBERS":
+		members := make([]interface{}, 0, len(s.sets[args[1]]))
+		for member := range s.sets[args[1]] {
+			members = append(members, member)
+		}
+		return members
+	default:
+		return redisError(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+	}
+}
+
+// writeFakeReply encodes a reply of the fake server
+func writeFakeReply(w io.Writer, reply interface{}) {
+	switch v := reply.(type) {
+	case nil:
+		fmt.Fprint(w, "$-1\r\n")
+	case fakeStatus:
+		fmt.Fprintf(w, "+%s\r\n", v)
+	case redisError:
+		fmt.Fprintf(w, "-%s\r\n", string(v))
+	case int64:
+		fmt.Fprintf(w, ":%d\r\n", v)
+	case string:
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(v), v)
+	case []interface{}:
+		fmt.Fprintf(w, "*%d\r\n", len(v))
+		for _, item := range v {
+			writeFakeReply(w, item)
+		}
+	}
+}
+
+// subscriberCount returns the number of connections subscribed to channel
+func (s *fakeRedis) subscriberCount(channel string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.subscribers[channel])
+}
+
+func (s *fakeRedis) drop(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	conn.Close()
+	delete(s.conns, conn)
+	for ch, subs := range s.subscribers {
+		kept := subs[:0]
+		for _, sub := range subs {
+			if sub != conn {
+				kept = append(kept, sub)
+			}
+		}
+		s.subscribers[ch] = kept
+	}
+}
+
+// dropAll closes every client connection, as a server restart would
+func (s *fakeRedis) dropAll() {
+	s.mu.Lock()
+	conns := make([]net.Conn, 0, len(s.conns))
+	for conn := range s.conns {
+		conns = append(conns, conn)
+	}
+	s.mu.Unlock()
+	for _, conn := range conns {
+		s.drop(conn)
+	}
+}
+
+// waitFor polls cond until it holds or a second has passed
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timeout waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// TestReadRedisReply decodes each reply type.
+func TestReadRedisReply(t *testing.T) {
+	input := "+OK\r\n:3\r\n$5\r\nhello\r\n$-1\r\n*2\r\n$1\r\na\r\n:1\r\n-ERR boom\r\n"
+	br := bufio.NewReader(strings.NewReader(input))
+
+	want := []interface{}{"OK", int64(3), "hello", nil, []interface{}{"a", int64(1)}}
+	for _, w := range want {
+		got, err := readRedisReply(br)
+		if err != nil || fmt.Sprint(got) != fmt.Sprint(w) {
+			t.Errorf("Expected %v, got %v (%v)", w, got, err)
+		}
+	}
+	var rerr redisError
+	if _, err := readRedisReply(br); !errors.As(err, &rerr) || string(rerr) != "ERR boom" {
+		t.Errorf("Expected error reply, got %v", err)
+	}
+}
+
+// TestRedisBusFanOut runs two nodes on one store and checks that a vote on
+// one reaches subscribers of the other, including after the connection to
+// the server drops.
+func TestRedisBusFanOut(t *testing.T) {
+	srv := startFakeRedis(t, "s3cret")
+	addr := srv.ln.Addr().String()
+
+	store := NewStore()
+	busA := NewRedisBus(addr, "s3cret", redisEventsChannel)
+	busB := NewRedisBus(addr, "s3cret", redisEventsChannel)
+	defer busA.Close()
+	defer busB.Close()
+	nodeA := NewAppWithBus(store, busA)
+	nodeB := NewAppWithBus(store, busB)
+	waitFor(t, "subscriptions", func() bool { return srv.subscriberCount(redisEventsChannel) == 2 })
+
+	poll := &Poll{Question: "Q?", Options: []Option{{ID: "a", Text: "A"}, {ID: "b", Text: "B"}}}
+	store.Create(poll)
+	ch := nodeB.broadcaster.Subscribe(poll.ID)
+	defer nodeB.broadcaster.Unsubscribe(poll.ID, ch)
+
+	vote := func(voter string) uint64 {
+		p, err := store.CastBallot(poll.ID, Ballot{VoterID: voter, Choices: []string{"a"}})
+		if err != nil {
+			t.Fatalf("Vote failed: %v", err)
+		}
+		nodeA.broadcastPoll(p)
+		return p.Version
+	}
+	expect := func(version uint64) {
+		t.Helper()
+		select {
+		case ev := <-ch:
+			if ev.ID != version {
+				t.Errorf("Expected event %d on the other node, got %d", version, ev.ID)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Timeout waiting for event %d on the other node", version)
+		}
+	}
+
+	expect(vote("v1"))
+
+	srv.dropAll()
+	waitFor(t, "resubscription", func() bool { return srv.subscriberCount(redisEventsChannel) == 2 })
+	expect(vote("v2"))
+}
+
+// TestRedisBusAuthFailure checks that a bad password surfaces as an error
+// and the event is still delivered locally.
+func TestRedisBusAuthFailure(t *testing.T) {
+	srv := startFakeRedis(t, "s3cret")
+	bus := NewRedisBus(srv.ln.Addr().String(), "wrong", redisEventsChannel)
+	defer bus.Close()
+
+	if err := bus.Publish(BusMessage{PollID: "p"}); err == nil {
+		t.Fatal("Expected publish with a bad password to fail")
+	}
+
+	app := NewAppWithBus(NewStore(), bus)
+	app.publishEvent("p", Event{ID: 1, Data: "x"})
+	if events := app.broadcaster.Since("p", 0); len(events) != 1 {
+		t.Errorf("Expected local fallback delivery, got %v", events)
+	}
+}
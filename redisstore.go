@@ -0,0 +1,575 @@
+// redisstore.go - Storage shared by every node through Redis
+// With STORAGE=redis, nodes keep their polls here: each poll is one key
+// holding its full state, and updates are compare-and-set transactions
+// (WATCH/MULTI/EXEC) retried when another node got there first, so
+// versions stay in step across nodes and a scheduled closing is applied
+// by one node only. Registries such as the webhooks are each kept in one
+// key next to a revision counter; a node reloads its copy when the
+// counter moved, and refuses to save over a revision it has not seen. The
+// key that salts anonymous voter hashes is shared too, and side effects
+// only one node should run are claimed with SET NX.
+//
+//   quickpoll:poll:<id>     a poll, as the file backend saves it
+//   quickpoll:code:<code>   the poll ID of a share code
+//   quickpoll:polls         the set of poll IDs
+//   quickpoll:voter-key     the voter hash key
+//   quickpoll:<registry>    a registry, with its revision in :rev
+//   quickpoll:claim:<name>  set by the node that ran a side effect
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+const (
+	redisPollPrefix     = "quickpoll:poll:"
+	redisCodePrefix     = "quickpoll:code:"
+	redisPollsKey       = "quickpoll:polls"
+	redisVoterKey       = "quickpoll:voter-key"
+	redisClaimPrefix    = "quickpoll:claim:"
+	redisUpdateAttempts = 10
+	redisMaxIdle        = 8
+)
+
+// ErrConcurrentUpdate is returned when another node kept changing the
+// same data until this node gave up
+var ErrConcurrentUpdate = errors.New("changed by another request at the same time; try again")
+
+// ErrStoreUnavailable is returned when Redis cannot be reached or refuses
+// a command, so that callers can tell it from a poll that does not exist
+var ErrStoreUnavailable = errors.New("storage unavailable")
+
+// errRedisConflict aborts a transaction whose watched keys changed
+var errRedisConflict = errors.New("redis: watched key changed")
+
+// redisConn is one connection of a RedisClient
+type redisConn struct {
+	conn    net.Conn
+	br      *bufio.Reader
+	replies int  // replies read so far
+	broken  bool // the connection failed and cannot be reused
+}
+
+// do runs one command
+func (c *redisConn) do(args ...string) (interface{}, error) {
+	reply, err := redisCommand(c.conn, c.br, args...)
+	var rerr redisError
+	if err != nil && !errors.As(err, &rerr) {
+		c.broken = true
+		return nil, fmt.Errorf("%w: %w", ErrStoreUnavailable, err)
+	}
+	c.replies++
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrStoreUnavailable, err)
+	}
+	return reply, nil
+}
+
+// exec runs cmds as one MULTI/EXEC transaction and returns their replies.
+// It fails with errRedisConflict if a watched key changed.
+func (c *redisConn) exec(cmds ...[]string) ([]interface{}, error) {
+	if _, err := c.do("MULTI"); err != nil {
+		return nil, err
+	}
+	for _, cmd := range cmds {
+		if _, err := c.do(cmd...); err != nil {
+			c.do("DISCARD")
+			return nil, err
+		}
+	}
+	reply, err := c.do("EXEC")
+	if err != nil {
+		// An error inside the replies leaves the rest of them unread
+		c.broken = true
+		return nil, err
+	}
+	if reply == nil {
+		return nil, errRedisConflict
+	}
+	replies, _ := reply.([]interface{})
+	if len(replies) != len(cmds) {
+		return nil, fmt.Errorf("%w: redis: expected %d replies, got %d", ErrStoreUnavailable, len(cmds), len(replies))
+	}
+	return replies, nil
+}
+
+// RedisClient runs commands on a small pool of connections
+type RedisClient struct {
+	addr     string
+	password string
+
+	mu   sync.Mutex
+	idle []*redisConn
+}
+
+// NewRedisClient creates a client for the server at addr. Connections are
+// opened on first use.
+func NewRedisClient(addr, password string) *RedisClient {
+	return &RedisClient{addr: addr, password: password}
+}
+
+// redisAddrFromEnv returns REDIS_ADDR, by default "localhost:6379"
+func redisAddrFromEnv() string {
+	if addr := os.Getenv("REDIS_ADDR"); addr != "" {
+		return addr
+	}
+	return "localhost:6379"
+}
+
+// redisClientFromEnv connects to the server the Redis bus uses
+func redisClientFromEnv() *RedisClient {
+	return NewRedisClient(redisAddrFromEnv(), os.Getenv("REDIS_PASSWORD"))
+}
+
+// get takes an idle connection, or opens one. reused reports which.
+func (c *RedisClient) get() (rc *redisConn, reused bool, err error) {
+	c.mu.Lock()
+	if n := len(c.idle); n > 0 {
+		rc = c.idle[n-1]
+		c.idle = c.idle[:n-1]
+		c.mu.Unlock()
+		rc.replies = 0
+		return rc, true, nil
+	}
+	c.mu.Unlock()
+
+	conn, br, err := redisDial(c.addr, c.password)
+	if err != nil {
+		return nil, false, fmt.Errorf("%w: %w", ErrStoreUnavailable, err)
+	}
+	return &redisConn{conn: conn, br: br}, false, nil
+}
+
+// put returns a connection to the pool, or closes it
+func (c *RedisClient) put(rc *redisConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if rc.broken || len(c.idle) >= redisMaxIdle {
+		rc.conn.Close()
+		return
+	}
+	c.idle = append(c.idle, rc)
+}
+
+// with runs fn on a connection of its own. An idle connection that the
+// server closed in the meantime fails before its first reply; fn is then
+// run once more on a new one.
+func (c *RedisClient) with(fn func(*redisConn) error) error {
+	for attempt := 0; ; attempt++ {
+		rc, reused, err := c.get()
+		if err != nil {
+			return err
+		}
+		err = fn(rc)
+		if err != nil && !rc.broken {
+			// Leave nothing watched for the next user
+			rc.do("UNWATCH")
+		}
+		c.put(rc)
+		if rc.broken && reused && rc.replies == 0 && attempt == 0 {
+			continue
+		}
+		return err
+	}
+}
+
+// do runs one command
+func (c *RedisClient) do(args ...string) (interface{}, error) {
+	var reply interface{}
+	err := c.with(func(rc *redisConn) error {
+		var err error
+		reply, err = rc.do(args...)
+		return err
+	})
+	return reply, err
+}
+
+// claim reports whether this node is the first to claim key, so that
+// something every node would do is done once
+func (c *RedisClient) claim(key string) (bool, error) {
+	reply, err := c.do("SET", redisClaimPrefix+key, "1", "NX")
+	return reply != nil, err
+}
+
+// Close closes the idle connections
+func (c *RedisClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, rc := range c.idle {
+		rc.conn.Close()
+	}
+	c.idle = nil
+	return nil
+}
+
+// RedisStore is a PollRepository kept in Redis and shared by every node
+type RedisStore struct {
+	client   *RedisClient
+	voterKey []byte
+}
+
+// OpenRedisStore connects to the store, creating the voter hash key if
+// this is the first node to use it
+func OpenRedisStore(client *RedisClient) (*RedisStore, error) {
+	if _, err := client.do("SET", redisVoterKey, string(newVoterKey()), "NX"); err != nil {
+		return nil, err
+	}
+	reply, err := client.do("GET", redisVoterKey)
+	if err != nil {
+		return nil, err
+	}
+	key, _ := reply.(string)
+	if len(key) != voterKeySize {
+		return nil, fmt.Errorf("%s: expected a %d-byte key", redisVoterKey, voterKeySize)
+	}
+	return &RedisStore{client: client, voterKey: []byte(key)}, nil
+}
+
+// encodePoll returns the saved form of a poll
+func encodePoll(poll *Poll) string {
+	data, _ := json.Marshal(toStored(poll))
+	return string(data)
+}
+
+// decode reads a saved poll and derives its voter salt
+func (s *RedisStore) decode(data string) (*Poll, error) {
+	var sp storedPoll
+	if err := json.Unmarshal([]byte(data), &sp); err != nil {
+		return nil, err
+	}
+	if sp.Poll == nil {
+		return nil, errors.New("poll missing")
+	}
+	poll := sp.poll()
+	poll.voterSalt = voterSalt(s.voterKey, poll.ID)
+	return poll, nil
+}
+
+// Create adds a new poll. It fails with ErrDuplicateID if the poll's ID
+// is already taken.
+func (s *RedisStore) Create(poll *Poll) error {
+	var lookupErr error
+	taken := func(id string) bool {
+		reply, err := s.client.do("EXISTS", redisPollPrefix+id, redisCodePrefix+id)
+		if err != nil {
+			lookupErr = err
+			return true
+		}
+		n, _ := reply.(int64)
+		return n > 0
+	}
+	if err := preparePoll(poll, taken); err != nil {
+		if lookupErr != nil {
+			return lookupErr
+		}
+		return err
+	}
+	poll.voterSalt = voterSalt(s.voterKey, poll.ID)
+
+	// The ID and share code are claimed together or not at all
+	key, codeKey := redisPollPrefix+poll.ID, redisCodePrefix+poll.ShareCode
+	err := s.client.with(func(rc *redisConn) error {
+		if _, err := rc.do("WATCH", key, codeKey); err != nil {
+			return err
+		}
+		reply, err := rc.do("EXISTS", key, codeKey)
+		if err != nil {
+			return err
+		}
+		if n, _ := reply.(int64); n > 0 {
+			return ErrDuplicateID
+		}
+		_, err = rc.exec(
+			[]string{"SET", key, encodePoll(poll)},
+			[]string{"SET", codeKey, poll.ID},
+			[]string{"SADD", redisPollsKey, poll.ID},
+		)
+		return err
+	})
+	if errors.Is(err, errRedisConflict) {
+		return ErrDuplicateID
+	}
+	return err
+}
+
+// Get retrieves a poll by ID. It fails with ErrPollNotFound if there is
+// no such poll, and with ErrStoreUnavailable if Redis cannot tell.
+func (s *RedisStore) Get(id string) (*Poll, error) {
+	reply, err := s.client.do("GET", redisPollPrefix+id)
+	if err != nil {
+		return nil, err
+	}
+	data, ok := reply.(string)
+	if !ok {
+		return nil, ErrPollNotFound
+	}
+	return s.decode(data)
+}
+
+// modify applies fn to the current state of a poll and saves the result,
+// starting over if another node saved the poll in the meantime
+func (s *RedisStore) modify(id string, fn func(*Poll) error) (*Poll, error) {
+	key := redisPollPrefix + id
+	for attempt := 0; attempt < redisUpdateAttempts; attempt++ {
+		var poll *Poll
+		err := s.client.with(func(rc *redisConn) error {
+			if _, err := rc.do("WATCH", key); err != nil {
+				return err
+			}
+			reply, err := rc.do("GET", key)
+			if err != nil {
+				return err
+			}
+			data, ok := reply.(string)
+			if !ok {
+				return ErrPollNotFound
+			}
+			if poll, err = s.decode(data); err != nil {
+				return err
+			}
+			if err := fn(poll); err != nil {
+				return err
+			}
+			_, err = rc.exec([]string{"SET", key, encodePoll(poll)})
+			return err
+		})
+		if errors.Is(err, errRedisConflict) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return poll, nil
+	}
+	return nil, ErrConcurrentUpdate
+}
+
+// Vote adds a vote to an option
+func (s *RedisStore) Vote(pollID, optionID string) (*Poll, error) {
+	return s.CastBallot(pollID, Ballot{Choices: []string{optionID}})
+}
+
+// CastBallot records a ballot for a poll
+func (s *RedisStore) CastBallot(pollID string, ballot Ballot) (*Poll, error) {
+	return s.modify(pollID, func(p *Poll) error { return p.addBallot(ballot) })
+}
+
+// RetractBallot removes a voter's ballot from a poll
+func (s *RedisStore) RetractBallot(pollID, voterID string) (*Poll, error) {
+	return s.modify(pollID, func(p *Poll) error { return p.retractBallot(voterID) })
+}
+
+// Update applies fn to a copy of a poll and stores the result if fn
+// succeeds. fn may run more than once.
+func (s *RedisStore) Update(id string, fn func(*Poll) error) (*Poll, error) {
+	return s.modify(id, func(p *Poll) error {
+		version := p.Version
+		if err := fn(p); err != nil {
+			return err
+		}
+		p.ID = id
+		p.Version = version + 1
+		return nil
+	})
+}
+
+// List returns all polls sorted by creation date (newest first)
+func (s *RedisStore) List() []*Poll {
+	reply, err := s.client.do("SMEMBERS", redisPollsKey)
+	if err != nil {
+		log.Printf("Failed to list polls: %v", err)
+		return nil
+	}
+	ids, _ := reply.([]interface{})
+	if len(ids) == 0 {
+		return []*Poll{}
+	}
+	args := []string{"MGET"}
+	for _, id := range ids {
+		if id, ok := id.(string); ok {
+			args = append(args, redisPollPrefix+id)
+		}
+	}
+	reply, err = s.client.do(args...)
+	if err != nil {
+		log.Printf("Failed to list polls: %v", err)
+		return nil
+	}
+	values, _ := reply.([]interface{})
+	polls := make([]*Poll, 0, len(values))
+	for _, value := range values {
+		// Polls deleted since SMEMBERS are nil
+		data, ok := value.(string)
+		if !ok {
+			continue
+		}
+		poll, err := s.decode(data)
+		if err != nil {
+			log.Printf("Skipping unreadable poll: %v", err)
+			continue
+		}
+		polls = append(polls, poll)
+	}
+	sort.Slice(polls, func(i, j int) bool {
+		return polls[i].CreatedAt.After(polls[j].CreatedAt)
+	})
+	return polls
+}
+
+// Delete removes a poll from the store
+func (s *RedisStore) Delete(id string) bool {
+	poll, err := s.Get(id)
+	if err != nil {
+		if !errors.Is(err, ErrPollNotFound) {
+			log.Printf("Failed to delete poll %s: %v", id, err)
+		}
+		return false
+	}
+	var deleted bool
+	err = s.client.with(func(rc *redisConn) error {
+		replies, err := rc.exec(
+			[]string{"DEL", redisPollPrefix + id},
+			[]string{"DEL", redisCodePrefix + poll.ShareCode},
+			[]string{"SREM", redisPollsKey, id},
+		)
+		if err != nil {
+			return err
+		}
+		// Another node may have deleted it first
+		n, _ := replies[0].(int64)
+		deleted = n > 0
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to delete poll %s: %v", id, err)
+	}
+	return deleted
+}
+
+// GetByShareCode retrieves a poll by its share code
+func (s *RedisStore) GetByShareCode(code string) (*Poll, error) {
+	if code == "" {
+		return nil, ErrPollNotFound
+	}
+	reply, err := s.client.do("GET", redisCodePrefix+code)
+	if err != nil {
+		return nil, err
+	}
+	id, ok := reply.(string)
+	if !ok {
+		return nil, ErrPollNotFound
+	}
+	return s.Get(id)
+}
+
+// Close closes the connections to Redis
+func (s *RedisStore) Close() error {
+	return s.client.Close()
+}
+
+// redisDoc is a registry kept in one Redis key, with a revision counter
+// that tells each node when its copy is out of date
+type redisDoc struct {
+	client *RedisClient
+	name   string
+	key    string
+
+	mu  sync.Mutex
+	rev int64 // the revision this node last read or wrote
+}
+
+// newRedisDoc names the key of a registry
+func newRedisDoc(client *RedisClient, name string) *redisDoc {
+	return &redisDoc{client: client, name: name, key: "quickpoll:" + name}
+}
+
+// parseRevision reads a revision counter; a missing one is 0
+func parseRevision(reply interface{}) int64 {
+	switch v := reply.(type) {
+	case int64:
+		return v
+	case string:
+		n, _ := strconv.ParseInt(v, 10, 64)
+		return n
+	}
+	return 0
+}
+
+// sync passes the saved registry to load if another node saved it since
+// this node last read or wrote it. It does nothing for registries that
+// are not shared. The caller must hold the registry's lock.
+func (d *redisDoc) sync(load func([]byte) error) error {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	reply, err := d.client.do("GET", d.key+":rev")
+	if err != nil {
+		return err
+	}
+	if parseRevision(reply) == d.rev {
+		return nil
+	}
+	var data string
+	var rev int64
+	err = d.client.with(func(rc *redisConn) error {
+		replies, err := rc.exec([]string{"GET", d.key}, []string{"GET", d.key + ":rev"})
+		if err != nil {
+			return err
+		}
+		data, _ = replies[0].(string)
+		rev = parseRevision(replies[1])
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := load([]byte(data)); err != nil {
+		return fmt.Errorf("read %s: %w", d.key, err)
+	}
+	d.rev = rev
+	return nil
+}
+
+// save replaces the saved registry. It fails with ErrConcurrentUpdate if
+// another node saved it since this node last read or wrote it.
+func (d *redisDoc) save(data []byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	revKey := d.key + ":rev"
+	err := d.client.with(func(rc *redisConn) error {
+		if _, err := rc.do("WATCH", revKey); err != nil {
+			return err
+		}
+		reply, err := rc.do("GET", revKey)
+		if err != nil {
+			return err
+		}
+		if parseRevision(reply) != d.rev {
+			return ErrConcurrentUpdate
+		}
+		replies, err := rc.exec([]string{"SET", d.key, string(data)}, []string{"INCR", revKey})
+		if err != nil {
+			return err
+		}
+		d.rev = parseRevision(replies[1])
+		return nil
+	})
+	if errors.Is(err, errRedisConflict) {
+		return ErrConcurrentUpdate
+	}
+	return err
+}
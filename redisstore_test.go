@@ -0,0 +1,262 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// openRedisNodes opens one RedisStore per node on a fake server
+func openRedisNodes(t *testing.T, srv *fakeRedis, nodes int) []*RedisStore {
+	t.Helper()
+	stores := make([]*RedisStore, nodes)
+	for i := range stores {
+		store, err := OpenRedisStore(NewRedisClient(srv.ln.Addr().String(), "s3cret"))
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		t.Cleanup(func() { store.Close() })
+		stores[i] = store
+	}
+	return stores
+}
+
+// TestRedisStore shares polls, ballots and versions between nodes.
+func TestRedisStore(t *testing.T) {
+	srv := startFakeRedis(t, "s3cret")
+	stores := openRedisNodes(t, srv, 2)
+	a, b := stores[0], stores[1]
+
+	poll := &Poll{Question: "Q?", Attribution: AttributionAnonymous, Options: []Option{{ID: "a", Text: "A"}, {ID: "b", Text: "B"}}}
+	if err := a.Create(poll); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if err := b.Create(&Poll{ID: poll.ID, Question: "Again?"}); !errors.Is(err, ErrDuplicateID) {
+		t.Errorf("Expected the ID taken on the other node, got %v", err)
+	}
+
+	if _, err := a.CastBallot(poll.ID, Ballot{VoterID: "v1", Choices: []string{"a"}}); err != nil {
+		t.Fatal(err)
+	}
+	voted, err := b.CastBallot(poll.ID, Ballot{VoterID: "v2", Choices: []string{"b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if voted.Version != 3 || voted.TotalBallots() != 2 {
+		t.Errorf("Expected both ballots in version 3, got %d ballots in version %d", voted.TotalBallots(), voted.Version)
+	}
+	// Both nodes salt voter hashes with the same key
+	if got, _ := b.Get(poll.ID); !got.HasVoted("v1") {
+		t.Error("Expected a ballot cast on one node to be known on the other")
+	}
+	if _, err := b.CastBallot(poll.ID, Ballot{VoterID: "v1", Choices: []string{"b"}}); !errors.Is(err, ErrBallotFinal) {
+		t.Errorf("Expected the anonymous ballot final on the other node, got %v", err)
+	}
+
+	updated, err := a.Update(poll.ID, func(p *Poll) error {
+		p.Question = "Edited?"
+		return nil
+	})
+	if err != nil || updated.Version != 4 {
+		t.Fatalf("Expected version 4, got %+v %v", updated, err)
+	}
+	if got, err := b.GetByShareCode(poll.ShareCode); err != nil || got.Question != "Edited?" {
+		t.Errorf("Expected the edit by share code on the other node, got %+v", got)
+	}
+	if polls := b.List(); len(polls) != 1 || polls[0].ID != poll.ID {
+		t.Errorf("Expected one poll listed, got %+v", polls)
+	}
+
+	if !b.Delete(poll.ID) || a.Delete(poll.ID) {
+		t.Error("Expected the poll deleted once")
+	}
+	if _, err := a.GetByShareCode(poll.ShareCode); !errors.Is(err, ErrPollNotFound) {
+		t.Error("Expected the share code gone")
+	}
+	if _, err := a.CastBallot(poll.ID, Ballot{VoterID: "v3", Choices: []string{"a"}}); !errors.Is(err, ErrPollNotFound) {
+		t.Errorf("Expected ErrPollNotFound, got %v", err)
+	}
+}
+
+// TestRedisStoreConflicts redoes an update that another node overtook, and
+// counts every ballot of concurrent voters.
+func TestRedisStoreConflicts(t *testing.T) {
+	srv := startFakeRedis(t, "s3cret")
+	stores := openRedisNodes(t, srv, 2)
+	a, b := stores[0], stores[1]
+	poll := &Poll{Question: "Q?", Options: []Option{{ID: "a", Text: "A"}, {ID: "b", Text: "B"}}}
+	a.Create(poll)
+
+	calls := 0
+	updated, err := a.Update(poll.ID, func(p *Poll) error {
+		calls++
+		if calls == 1 {
+			if _, err := b.CastBallot(poll.ID, Ballot{VoterID: "v1", Choices: []string{"a"}}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		p.Question = "Edited?"
+		return nil
+	})
+	if err != nil || calls != 2 || updated.TotalBallots() != 1 || updated.Version != 3 {
+		t.Fatalf("Expected the update redone on top of the ballot, got %d calls, %+v, %v", calls, updated, err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			store := stores[i%2]
+			voter := string(rune('a'+i)) + "-voter"
+			if _, err := store.CastBallot(poll.ID, Ballot{VoterID: voter, Choices: []string{"b"}}); err != nil {
+				t.Errorf("Vote failed: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if got, _ := b.Get(poll.ID); got.TotalBallots() != 7 || got.Version != 9 {
+		t.Errorf("Expected 7 ballots in version 9, got %d in version %d", got.TotalBallots(), got.Version)
+	}
+}
+
+// TestRedisSchedulerClosesOnce lets every node's scheduler see a poll
+// expire; only one closes it.
+func TestRedisSchedulerClosesOnce(t *testing.T) {
+	srv := startFakeRedis(t, "s3cret")
+	stores := openRedisNodes(t, srv, 2)
+	bus := NewLocalBus()
+	nodeA := NewAppWithBus(stores[0], bus)
+	nodeB := NewAppWithBus(stores[1], bus)
+
+	closes := time.Now().Add(time.Hour)
+	poll := &Poll{Question: "Q?", Options: []Option{{ID: "a", Text: "A"}, {ID: "b", Text: "B"}}, ExpiresAt: closes}
+	stores[0].Create(poll)
+	nodeA.scheduler.advance(closes)
+	nodeB.scheduler.advance(closes)
+
+	closed := 0
+	for _, ev := range nodeA.broadcaster.Since(poll.ID, 0) {
+		if ev.Type == "closed" {
+			closed++
+		}
+	}
+	if closed != 1 {
+		t.Errorf("Expected one closed event, got %d", closed)
+	}
+	if !claimSeeding(stores[0]) || claimSeeding(stores[1]) {
+		t.Error("Expected one node to seed the sample polls")
+	}
+}
+
+// TestSharedWebhooks shows webhooks registered on one node to the others,
+// and sends a threshold event from one node only.
+func TestSharedWebhooks(t *testing.T) {
+	srv := startFakeRedis(t, "s3cret")
+	addr := srv.ln.Addr().String()
+	hooksA, _ := OpenSharedWebhooks(NewRedisClient(addr, "s3cret"))
+	hooksB, _ := OpenSharedWebhooks(NewRedisClient(addr, "s3cret"))
+
+	hook := &Webhook{URL: "https://203.0.113.10/hook", Events: []string{WebhookThreshold}, Threshold: 1}
+	if err := hooksA.Register(hook); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := hooksB.Get(hook.ID); !exists {
+		t.Error("Expected the webhook on the other node")
+	}
+
+	poll := &Poll{ID: "poll_1", Question: "Q?", Options: []Option{{ID: "a", Text: "A"}, {ID: "b", Text: "B"}}}
+	poll.addBallot(Ballot{VoterID: "v1", Choices: []string{"a"}})
+	hooksB.Notify(WebhookVoted, poll)
+	hooksA.Notify(WebhookVoted, poll)
+	if queued := len(hooksA.queue) + len(hooksB.queue); queued != 1 {
+		t.Errorf("Expected the threshold event sent by one node, got %d", queued)
+	}
+}
+
+// TestSharedUsers lets an account registered on one node sign in on the
+// others, and keeps its name taken there.
+func TestSharedUsers(t *testing.T) {
+	srv := startFakeRedis(t, "s3cret")
+	addr := srv.ln.Addr().String()
+	usersA, _ := OpenSharedUsers(NewRedisClient(addr, "s3cret"))
+	usersB, _ := OpenSharedUsers(NewRedisClient(addr, "s3cret"))
+
+	ada, err := usersA.Register("ada", "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, exists := usersB.Get(ada.ID); !exists || got.Name != "ada" {
+		t.Errorf("Expected the account on the other node, got %+v", got)
+	}
+	if _, err := usersB.Register("ada", "another password"); err == nil {
+		t.Error("Expected the name taken on the other node")
+	}
+}
+
+// TestSharedAPIKeys accepts a key on every node until it is revoked on
+// one of them.
+func TestSharedAPIKeys(t *testing.T) {
+	srv := startFakeRedis(t, "s3cret")
+	addr := srv.ln.Addr().String()
+	keysA, _ := OpenSharedAPIKeys(NewRedisClient(addr, "s3cret"))
+	keysB, _ := OpenSharedAPIKeys(NewRedisClient(addr, "s3cret"))
+
+	key, err := keysA.Create("user_1", "ci", []string{ScopePollsRead})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keysB.Authenticate(key.Key, time.Now()); err != nil {
+		t.Errorf("Expected the key accepted on the other node, got %v", err)
+	}
+	if err := keysA.Revoke("user_1", key.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keysB.Authenticate(key.Key, time.Now()); !errors.Is(err, ErrInvalidAPIKey) {
+		t.Errorf("Expected the revoked key refused on the other node, got %v", err)
+	}
+}
+
+// TestSharedQuizzes shows a quiz and its players to every node.
+func TestSharedQuizzes(t *testing.T) {
+	srv := startFakeRedis(t, "s3cret")
+	addr := srv.ln.Addr().String()
+	quizzesA, _ := OpenSharedQuizzes(NewRedisClient(addr, "s3cret"))
+	quizzesB, _ := OpenSharedQuizzes(NewRedisClient(addr, "s3cret"))
+
+	quiz := &Quiz{Title: "Capitals", Players: map[string]string{}}
+	if err := quizzesA.Create(quiz); err != nil {
+		t.Fatal(err)
+	}
+	if err := quizzesB.SetPlayer(quiz.ID, "v1", "ada"); err != nil {
+		t.Fatal(err)
+	}
+	got, exists := quizzesA.Get(quiz.ID)
+	if !exists || got.Players["v1"] != "ada" || string(got.guestKey) != string(quiz.guestKey) {
+		t.Errorf("Expected the quiz and player on both nodes, got %+v", got)
+	}
+}
+
+// TestRedisStoreUnavailable tells a Redis outage apart from a missing poll.
+func TestRedisStoreUnavailable(t *testing.T) {
+	srv := startFakeRedis(t, "s3cret")
+	store := openRedisNodes(t, srv, 1)[0]
+	app := NewAppWithBus(store, NewLocalBus())
+	poll := &Poll{Question: "Q?", Options: []Option{{ID: "a", Text: "A"}, {ID: "b", Text: "B"}}}
+	store.Create(poll)
+
+	srv.ln.Close()
+	srv.dropAll()
+	if _, err := store.Get(poll.ID); !errors.Is(err, ErrStoreUnavailable) {
+		t.Errorf("Expected ErrStoreUnavailable, got %v", err)
+	}
+	if _, err := store.GetByShareCode(poll.ShareCode); !errors.Is(err, ErrStoreUnavailable) {
+		t.Errorf("Expected ErrStoreUnavailable by share code, got %v", err)
+	}
+	rec := apiCall(t, app, http.MethodGet, "/api/polls/"+poll.ID, "", "")
+	if rec.Code != http.StatusServiceUnavailable || decodeAPIError(t, rec) != "storage_unavailable" {
+		t.Errorf("Expected 503 storage_unavailable, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,167 @@
+// results.go - When results are shown
+// Live counts sway the voters who come later, so a poll can hold its
+// results back:
+//   always       counts are shown to everyone (the default)
+//   after_vote   a voter sees counts once they have voted
+//   after_close  counts are shown once the poll closes
+//   owner        only the owner and admins see counts
+// Owners and admins always see their polls' results, and closing a poll
+// reveals them except in owner mode. Hidden results are redacted on the
+// server: polls are sent with zero counts, no runoff, roster or final
+// results, and "results_hidden": true, on pages, in the API, vote
+// responses, event streams and the activity stream. Versions grow with
+// every ballot, so redacted polls have version 0, redacted events have no
+// event ID, and streams leave out redacted events that changed nothing
+// else. Exports are refused.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// ResultsVisibility controls who sees a poll's counts
+type ResultsVisibility string
+
+// Result visibilities
+const (
+	ResultsAlways     ResultsVisibility = "always"
+	ResultsAfterVote  ResultsVisibility = "after_vote"
+	ResultsAfterClose ResultsVisibility = "after_close"
+	ResultsOwner      ResultsVisibility = "owner"
+)
+
+// ErrResultsHidden is returned for requests that need results the caller
+// may not see yet
+var ErrResultsHidden = errors.New("results of this poll are hidden")
+
+// parseResultsVisibility validates a result visibility submitted by a
+// client; empty means always
+func parseResultsVisibility(value string) (ResultsVisibility, error) {
+	switch ResultsVisibility(value) {
+	case "", ResultsAlways:
+		return "", nil
+	case ResultsAfterVote, ResultsAfterClose, ResultsOwner:
+		return ResultsVisibility(value), nil
+	default:
+		return "", fmt.Errorf("unknown results visibility %q", value)
+	}
+}
+
+// publicResults reports whether everyone may see the poll's counts
+func (p *Poll) publicResults(now time.Time) bool {
+	switch p.ResultsVisibility {
+	case "", ResultsAlways:
+		return true
+	case ResultsOwner:
+		return false
+	default:
+		return p.StatusAt(now) == PollClosed
+	}
+}
+
+// resultsVisible reports whether the caller may see the poll's counts
+func (app *App) resultsVisible(r *http.Request, poll *Poll) bool {
+	if poll.publicResults(time.Now()) || app.canManage(r, poll) {
+		return true
+	}
+	if poll.ResultsVisibility == ResultsAfterVote {
+		voterID, _, _ := pollIdentity(r, poll)
+		return poll.HasVoted(voterID)
+	}
+	return false
+}
+
+// hideResults removes everything from which the counts could be read
+func (p *Poll) hideResults() {
+	p.Version = 0
+	for i := range p.Options {
+		p.Options[i].Votes = 0
+	}
+	p.BallotCount = 0
+	p.Runoff = nil
+	p.Roster = nil
+	if p.Final != nil {
+		p.Final = &PollResult{ClosedAt: p.Final.ClosedAt}
+	}
+	p.ResultsHidden = true
+}
+
+// withResults hides the results of the polls the caller may not see. The
+// polls must be copies that are not shared.
+func (app *App) withResults(r *http.Request, polls ...*Poll) {
+	for _, poll := range polls {
+		if !app.resultsVisible(r, poll) {
+			poll.hideResults()
+		}
+	}
+}
+
+// resultsFor returns poll as the caller may see it, copying it if its
+// results have to be hidden
+func (app *App) resultsFor(r *http.Request, poll *Poll) *Poll {
+	if app.resultsVisible(r, poll) {
+		return poll
+	}
+	cp := copyPoll(poll)
+	cp.hideResults()
+	return cp
+}
+
+// resultsGate redacts the events of one stream until its client may see
+// the poll's results
+type resultsGate struct {
+	app    *App
+	r      *http.Request
+	pollID string
+	shown  bool
+}
+
+// newResultsGate returns the gate for a stream of pollID opened by r
+func (app *App) newResultsGate(r *http.Request, pollID string) *resultsGate {
+	return &resultsGate{app: app, r: r, pollID: pollID}
+}
+
+// visible reports whether the client may now see results; once it may, it
+// always may
+func (g *resultsGate) visible() bool {
+	if !g.shown {
+		poll, err := g.app.store.Get(g.pollID)
+		g.shown = err == nil && g.app.resultsVisible(g.r, poll)
+	}
+	return g.shown
+}
+
+// redactEvent hides the results in a poll event and drops its delta, which
+// holds nothing but results, and its ID, which is the poll's version
+func redactEvent(ev Event) Event {
+	var poll Poll
+	if err := json.Unmarshal([]byte(ev.Data), &poll); err != nil {
+		return Event{Type: ev.Type, Data: "{}"}
+	}
+	poll.hideResults()
+	data, _ := json.Marshal(&poll)
+	return Event{Type: ev.Type, Data: string(data)}
+}
+
+// publicResultsEvent returns a poll event as everyone may see it, for the
+// activity stream
+func publicResultsEvent(ev Event) Event {
+	var poll struct {
+		ResultsVisibility ResultsVisibility `json:"results_visibility"`
+		Status            PollStatus        `json:"status"`
+		ExpiresAt         time.Time         `json:"expires_at"`
+	}
+	if err := json.Unmarshal([]byte(ev.Data), &poll); err != nil {
+		return ev
+	}
+	p := Poll{ResultsVisibility: poll.ResultsVisibility, Status: poll.Status, ExpiresAt: poll.ExpiresAt}
+	if p.publicResults(time.Now()) {
+		return ev
+	}
+	return redactEvent(ev)
+}
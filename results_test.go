@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// createResultsPoll creates a poll of owner's with the given result
+// visibility and one vote for its first option
+func createResultsPoll(t *testing.T, app *App, owner *User, visibility ResultsVisibility) *Poll {
+	t.Helper()
+	poll, err := buildPoll(PollInput{Question: "Q?", Options: []string{"A", "B"}, ResultsVisibility: string(visibility)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	poll.OwnerID = owner.ID
+	app.store.Create(poll)
+	if _, err := app.store.CastBallot(poll.ID, Ballot{VoterID: "first", Choices: []string{poll.Options[0].ID}}); err != nil {
+		t.Fatal(err)
+	}
+	return poll
+}
+
+// fetchPoll gets a poll from the API as voterID, or as user if set
+func fetchPoll(t *testing.T, app *App, user *User, voterID, pollID string) Poll {
+	t.Helper()
+	var rec *httptest.ResponseRecorder
+	if user != nil {
+		rec = accountCall(t, app, user, http.MethodGet, "/api/polls/"+pollID, "")
+	} else {
+		rec = apiCall(t, app, http.MethodGet, "/api/polls/"+pollID, "", voterID)
+	}
+	var poll Poll
+	json.NewDecoder(rec.Body).Decode(&poll)
+	return poll
+}
+
+// TestBuildPollResultsVisibility validates the result visibility of new
+// polls.
+func TestBuildPollResultsVisibility(t *testing.T) {
+	for _, value := range []string{"", "always", "after_vote", "after_close", "owner"} {
+		if _, err := buildPoll(PollInput{Question: "Q?", Options: []string{"A", "B"}, ResultsVisibility: value}); err != nil {
+			t.Errorf("Expected %q accepted, got %v", value, err)
+		}
+	}
+	if _, err := buildPoll(PollInput{Question: "Q?", Options: []string{"A", "B"}, ResultsVisibility: "never"}); err == nil {
+		t.Error("Expected an unknown results visibility to be rejected")
+	}
+}
+
+// TestResultsAfterVote shows counts to a voter only once they have voted.
+func TestResultsAfterVote(t *testing.T) {
+	app := NewApp()
+	owner := registerUser(t, app, "owner")
+	poll := createResultsPoll(t, app, owner, ResultsAfterVote)
+
+	got := fetchPoll(t, app, nil, "v1", poll.ID)
+	if !got.ResultsHidden || got.Options[0].Votes != 0 || got.Version != 0 {
+		t.Fatalf("Expected hidden results and version before voting, got %+v", got)
+	}
+	if got := fetchPoll(t, app, owner, "", poll.ID); got.ResultsHidden || got.Options[0].Votes != 1 {
+		t.Errorf("Expected the owner to see results, got %+v", got)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/poll/"+poll.ID, nil)
+	signIn(app, req, "v1")
+	page := httptest.NewRecorder()
+	app.Routes().ServeHTTP(page, req)
+	if body := page.Body.String(); !strings.Contains(body, "Results are shown once you have voted") || strings.Contains(body, "1 votes") {
+		t.Error("Expected the poll page without counts")
+	}
+	if rec := apiCall(t, app, http.MethodGet, "/api/polls/"+poll.ID+"/export", "", "v1"); rec.Code != http.StatusForbidden || decodeAPIError(t, rec) != "results_hidden" {
+		t.Errorf("Expected the export refused, got %d", rec.Code)
+	}
+
+	rec := apiCall(t, app, http.MethodPost, "/api/polls/"+poll.ID+"/votes", `{"options":["`+poll.Options[1].ID+`"]}`, "v1")
+	var voted Poll
+	json.NewDecoder(rec.Body).Decode(&voted)
+	if voted.ResultsHidden || voted.Options[0].Votes != 1 || voted.Options[1].Votes != 1 {
+		t.Errorf("Expected results in the vote response, got %+v", voted)
+	}
+	if got := fetchPoll(t, app, nil, "v1", poll.ID); got.ResultsHidden {
+		t.Error("Expected results once the voter has voted")
+	}
+}
+
+// TestResultsAfterCloseAndOwner hides results in lists and reveals them on
+// closing, except to others in owner mode.
+func TestResultsAfterCloseAndOwner(t *testing.T) {
+	app := NewApp()
+	owner := registerUser(t, app, "owner")
+	afterClose := createResultsPoll(t, app, owner, ResultsAfterClose)
+	ownerOnly := createResultsPoll(t, app, owner, ResultsOwner)
+
+	rec := apiCall(t, app, http.MethodGet, "/api/polls", "", "v1")
+	var polls []Poll
+	json.NewDecoder(rec.Body).Decode(&polls)
+	for _, poll := range polls {
+		if !poll.ResultsHidden || poll.TotalVotes() != 0 {
+			t.Errorf("Expected hidden results in the list, got %+v", poll)
+		}
+	}
+
+	for _, poll := range []*Poll{afterClose, ownerOnly} {
+		app.store.Update(poll.ID, func(p *Poll) error { return p.closeNow(time.Now()) })
+	}
+	if got := fetchPoll(t, app, nil, "v1", afterClose.ID); got.ResultsHidden || got.Final == nil || got.Final.Options[0].Votes != 1 {
+		t.Errorf("Expected results once closed, got %+v", got)
+	}
+	got := fetchPoll(t, app, nil, "v1", ownerOnly.ID)
+	if !got.ResultsHidden || got.Final == nil || len(got.Final.Options) != 0 {
+		t.Errorf("Expected owner-only results hidden after closing, got %+v", got)
+	}
+}
+
+// TestActivityHidesVotes leaves votes on polls with hidden results out of
+// the activity stream.
+func TestActivityHidesVotes(t *testing.T) {
+	app := NewApp()
+	owner := registerUser(t, app, "owner")
+	poll := createResultsPoll(t, app, owner, ResultsAfterClose)
+	ch := app.activity.Subscribe(ActivityFilter{})
+	defer app.activity.Unsubscribe(ch)
+
+	for _, voter := range []string{"v2", "v3"} {
+		p, _ := app.store.CastBallot(poll.ID, Ballot{VoterID: voter, Choices: []string{poll.Options[0].ID}})
+		app.broadcastPoll(p)
+	}
+	if a := nextActivity(t, ch); a.Type != ActivityVotes || !strings.Contains(string(a.Poll), `"version":0`) {
+		t.Errorf("Expected one redacted update without version, got %+v", a)
+	}
+	select {
+	case a := <-ch:
+		t.Errorf("Expected the second vote left out, got %+v", a)
+	default:
+	}
+}
+
+// TestEventCursorHidesResults redacts stream events until the client has
+// voted, leaving out other voters' votes and the versions that count
+// them, then sends a full update rather than a delta.
+func TestEventCursorHidesResults(t *testing.T) {
+	app := NewApp()
+	owner := registerUser(t, app, "owner")
+	poll := createResultsPoll(t, app, owner, ResultsAfterVote)
+
+	req := httptest.NewRequest(http.MethodGet, "/events/"+poll.ID, nil)
+	req = req.WithContext(context.WithValue(req.Context(), voterContextKey{}, "v1"))
+	cursor := app.newEventCursor(poll.ID, 0)
+	cursor.deltas = true
+	cursor.results = app.newResultsGate(req, poll.ID)
+
+	decode := func(ev Event) Poll {
+		var p Poll
+		if err := json.Unmarshal([]byte(ev.Data), &p); err != nil {
+			t.Fatalf("Expected a full poll event, got %+v", ev)
+		}
+		return p
+	}
+	first := cursor.start()[0]
+	if got := decode(first); !got.ResultsHidden || got.Options[0].Votes != 0 || got.Version != 0 || first.ID != 0 {
+		t.Fatalf("Expected a redacted first event without version, got %+v", first)
+	}
+
+	p, _ := app.store.CastBallot(poll.ID, Ballot{VoterID: "v2", Choices: []string{poll.Options[0].ID}})
+	app.broadcastPoll(p)
+	if events := cursor.receive(app.broadcaster.Since(poll.ID, 0)[0], true); len(events) != 0 {
+		t.Errorf("Expected another voter's vote left out, got %+v", events)
+	}
+
+	p, _ = app.store.CastBallot(poll.ID, Ballot{VoterID: "v1", Choices: []string{poll.Options[1].ID}})
+	app.broadcastPoll(p)
+	events := cursor.receive(app.broadcaster.Since(poll.ID, p.Version-1)[0], true)
+	if events[0].Type == "delta" {
+		t.Fatal("Expected a full update after a redacted one")
+	}
+	if got := decode(events[0]); got.ResultsHidden || got.Options[0].Votes != 2 {
+		t.Errorf("Expected results after voting, got %+v", got)
+	}
+}
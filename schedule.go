@@ -0,0 +1,217 @@
+// schedule.go - Scheduled opening and closing
+// A poll is a draft until OpensAt, open until ExpiresAt, and closed after.
+// Votes check the times directly, so voting starts and stops on time even
+// between scheduler runs. The Scheduler records each transition in the
+// store, freezes the final results when a poll closes and broadcasts the
+// change - a "closed" event in the case of closing - at the moment it
+// happens, without waiting for anyone to vote.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+)
+
+// PollStatus is the stage of a poll's lifecycle
+type PollStatus string
+
+const (
+	PollDraft  PollStatus = "draft"
+	PollOpen   PollStatus = "open"
+	PollClosed PollStatus = "closed"
+)
+
+// schedulerMaxSleep bounds how long the scheduler waits between checks
+const schedulerMaxSleep = time.Minute
+
+// ErrPollNotOpen is returned for votes on a poll before it opens
+var ErrPollNotOpen = errors.New("poll has not opened yet")
+
+// errUnchanged aborts a store update that turned out to be unnecessary
+var errUnchanged = errors.New("unchanged")
+
+// PollResult is the frozen outcome of a closed poll
+type PollResult struct {
+	ClosedAt    time.Time     `json:"closed_at"`
+	Options     []Option      `json:"options"`
+	BallotCount int           `json:"ballot_count,omitempty"`
+	Runoff      *RunoffResult `json:"runoff,omitempty"`
+	// Correct reveals the poll's correct options (see quiz.go)
+	Correct []string `json:"correct,omitempty"`
+}
+
+// StatusAt returns the stage the poll is in at the given time
+func (p *Poll) StatusAt(now time.Time) PollStatus {
+	switch {
+	case p.Status == PollClosed:
+		return PollClosed
+	case !p.ExpiresAt.IsZero() && !now.Before(p.ExpiresAt):
+		return PollClosed
+	case now.Before(p.OpensAt):
+		return PollDraft
+	default:
+		return PollOpen
+	}
+}
+
+// IsDraft checks if the poll has yet to open
+func (p *Poll) IsDraft() bool {
+	return p.StatusAt(time.Now()) == PollDraft
+}
+
+// IsOpen checks if the poll accepts votes
+func (p *Poll) IsOpen() bool {
+	return p.StatusAt(time.Now()) == PollOpen
+}
+
+// checkOpen returns the error for voting on a poll that is not open
+func (p *Poll) checkOpen() error {
+	switch p.StatusAt(time.Now()) {
+	case PollDraft:
+		return ErrPollNotOpen
+	case PollClosed:
+		return ErrPollExpired
+	default:
+		return nil
+	}
+}
+
+// nextTransition returns when the poll's status next changes, or the zero
+// time if it never will
+func (p *Poll) nextTransition(now time.Time) time.Time {
+	switch status := p.StatusAt(now); {
+	case status != p.Status:
+		return now
+	case status == PollDraft:
+		return p.OpensAt
+	case status == PollOpen && !p.ExpiresAt.IsZero():
+		return p.ExpiresAt
+	default:
+		return time.Time{}
+	}
+}
+
+// finalize marks the poll closed and freezes its results
+func (p *Poll) finalize(now time.Time) {
+	p.Status = PollClosed
+	result := &PollResult{
+		ClosedAt:    now,
+		Options:     make([]Option, len(p.Options)),
+		BallotCount: p.BallotCount,
+		Runoff:      p.Runoff,
+		Correct:     p.Answers,
+	}
+	copy(result.Options, p.Options)
+	p.Final = result
+}
+
+// validateSchedule checks that a poll closes after it opens
+func validateSchedule(opensAt, expiresAt time.Time) error {
+	if !opensAt.IsZero() && !expiresAt.IsZero() && !expiresAt.After(opensAt) {
+		return &ValidationError{Field: "expires_at", Message: "Expiry must be after the opening time"}
+	}
+	return nil
+}
+
+// Scheduler moves polls through their lifecycle at the scheduled times
+type Scheduler struct {
+	app  *App
+	wake chan struct{}
+}
+
+// NewScheduler creates a scheduler for an app's polls
+func NewScheduler(app *App) *Scheduler {
+	return &Scheduler{app: app, wake: make(chan struct{}, 1)}
+}
+
+// Wake makes a running scheduler re-read poll times, for example after a
+// poll was created or rescheduled
+func (s *Scheduler) Wake() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run applies transitions until ctx is done
+func (s *Scheduler) Run(ctx context.Context) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		case <-s.wake:
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+		}
+
+		wait := schedulerMaxSleep
+		if next := s.advance(time.Now()); !next.IsZero() {
+			if d := time.Until(next); d < wait {
+				wait = d
+			}
+		}
+		timer.Reset(wait)
+	}
+}
+
+// advance applies every transition due at now and returns the time of the
+// next one, or the zero time if none is scheduled
+func (s *Scheduler) advance(now time.Time) time.Time {
+	var next time.Time
+	for _, poll := range s.app.store.List() {
+		if poll.StatusAt(now) != poll.Status {
+			updated, ok := s.transition(poll.ID, now)
+			if !ok {
+				// Retried on the next periodic check
+				continue
+			}
+			poll = updated
+		}
+		if t := poll.nextTransition(now); !t.IsZero() && (next.IsZero() || t.Before(next)) {
+			next = t
+		}
+	}
+	return next
+}
+
+// transition records a poll's new status and announces it
+func (s *Scheduler) transition(pollID string, now time.Time) (*Poll, bool) {
+	poll, err := s.app.store.Update(pollID, func(p *Poll) error {
+		status := p.StatusAt(now)
+		if status == p.Status {
+			return errUnchanged
+		}
+		if status == PollClosed {
+			p.finalize(now)
+		} else {
+			p.Status = status
+		}
+		return nil
+	})
+	if err != nil {
+		if !errors.Is(err, errUnchanged) && !errors.Is(err, ErrPollNotFound) {
+			log.Printf("Failed to update status of poll %s: %v", pollID, err)
+		}
+		return nil, false
+	}
+
+	log.Printf("Poll %s is now %s", pollID, poll.Status)
+	if poll.Status == PollClosed {
+		s.app.broadcastPollEvent(poll, "closed")
+		s.app.webhooks.Notify(WebhookClosed, poll)
+	} else {
+		s.app.broadcastPoll(poll)
+	}
+	return poll, true
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// TestPollStatusAt checks the lifecycle stages derived from poll times.
+func TestPollStatusAt(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name string
+		poll Poll
+		want PollStatus
+	}{
+		{"no times", Poll{}, PollOpen},
+		{"before opening", Poll{OpensAt: now.Add(time.Hour)}, PollDraft},
+		{"after opening", Poll{OpensAt: now.Add(-time.Hour)}, PollOpen},
+		{"at expiry", Poll{ExpiresAt: now}, PollClosed},
+		{"finalized", Poll{Status: PollClosed}, PollClosed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.poll.StatusAt(now); got != tt.want {
+				t.Errorf("Expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+// TestVoteBeforeOpening ensures draft polls reject ballots.
+func TestVoteBeforeOpening(t *testing.T) {
+	store := NewStore()
+	poll := &Poll{Question: "Q?", Options: []Option{{ID: "a", Text: "A"}, {ID: "b", Text: "B"}}, OpensAt: time.Now().Add(time.Hour)}
+	store.Create(poll)
+	if poll.Status != PollDraft {
+		t.Fatalf("Expected new poll to be a draft, got %s", poll.Status)
+	}
+
+	_, err := store.CastBallot(poll.ID, Ballot{VoterID: "v1", Choices: []string{"a"}})
+	if !errors.Is(err, ErrPollNotOpen) {
+		t.Errorf("Expected ErrPollNotOpen, got %v", err)
+	}
+}
+
+// TestSchedulerAdvance walks a poll through draft, open and closed.
+func TestSchedulerAdvance(t *testing.T) {
+	app := NewApp()
+	now := time.Now()
+	opens, closes := now.Add(time.Hour), now.Add(2*time.Hour)
+	poll := &Poll{Question: "Q?", Options: []Option{{ID: "a", Text: "A"}, {ID: "b", Text: "B"}}, OpensAt: opens, ExpiresAt: closes}
+	app.store.Create(poll)
+
+	if next := app.scheduler.advance(now); !next.Equal(opens) {
+		t.Fatalf("Expected next transition at opening, got %v", next)
+	}
+
+	if next := app.scheduler.advance(opens); !next.Equal(closes) {
+		t.Errorf("Expected next transition at expiry, got %v", next)
+	}
+	if p, _ := app.store.Get(poll.ID); p.Status != PollOpen {
+		t.Fatalf("Expected open poll, got %s", p.Status)
+	}
+
+	if next := app.scheduler.advance(closes); !next.IsZero() {
+		t.Errorf("Expected no further transitions, got %v", next)
+	}
+
+	closed, _ := app.store.Get(poll.ID)
+	if closed.Status != PollClosed || closed.Final == nil || !closed.Final.ClosedAt.Equal(closes) {
+		t.Fatalf("Expected frozen final results, got %+v", closed)
+	}
+	events := app.broadcaster.Since(poll.ID, 0)
+	if last := events[len(events)-1]; last.Type != "closed" || last.ID != closed.Version {
+		t.Errorf("Expected closed event last, got %+v", last)
+	}
+}
+
+// TestSchedulerClosesOnTime runs the scheduler and waits for the closed
+// event without any votes.
+func TestSchedulerClosesOnTime(t *testing.T) {
+	app := NewApp()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go app.scheduler.Run(ctx)
+
+	poll := &Poll{Question: "Q?", Options: []Option{{ID: "a", Text: "A"}, {ID: "b", Text: "B"}}, ExpiresAt: time.Now().Add(50 * time.Millisecond)}
+	app.store.Create(poll)
+	ch := app.broadcaster.Subscribe(poll.ID)
+	defer app.broadcaster.Unsubscribe(poll.ID, ch)
+	app.scheduler.Wake()
+
+	for {
+		select {
+		case ev := <-ch:
+			if ev.Type == "closed" {
+				return
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("Timeout waiting for closed event")
+		}
+	}
+}
+
+// TestAPISchedule covers scheduling rules in the API.
+func TestAPISchedule(t *testing.T) {
+	app := NewApp()
+	owner := registerUser(t, app, "owner")
+	draft := &Poll{Question: "Q?", Options: []Option{{ID: "a", Text: "A"}, {ID: "b", Text: "B"}}, OpensAt: time.Now().Add(time.Hour), OwnerID: owner.ID}
+	app.store.Create(draft)
+	open := &Poll{Question: "Q?", Options: []Option{{ID: "a", Text: "A"}, {ID: "b", Text: "B"}}, OwnerID: owner.ID}
+	app.store.Create(open)
+
+	tests := []struct {
+		name, method, path, body, voter string
+		status                          int
+		code                            string
+	}{
+		{"closes before opening", http.MethodPost, "/api/polls", `{"question":"Q","options":["a","b"],"opens_at":"2030-01-02T00:00:00Z","expires_at":"2030-01-01T00:00:00Z"}`, "", 400, "validation_failed"},
+		{"vote on draft", http.MethodPost, "/api/polls/" + draft.ID + "/votes", `{"options":["a"]}`, "v1", 409, "poll_not_open"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := apiCall(t, app, tt.method, tt.path, tt.body, tt.voter)
+			if code := decodeAPIError(t, rec); rec.Code != tt.status || code != tt.code {
+				t.Errorf("Expected %d %s, got %d %s", tt.status, tt.code, rec.Code, code)
+			}
+		})
+	}
+
+	rec := accountCall(t, app, owner, http.MethodPatch, "/api/polls/"+open.ID, `{"opens_at":"2030-01-01T00:00:00Z"}`)
+	if code := decodeAPIError(t, rec); rec.Code != http.StatusBadRequest || code != "validation_failed" {
+		t.Errorf("Expected an open poll not to be rescheduled, got %d %s", rec.Code, code)
+	}
+
+	rec = accountCall(t, app, owner, http.MethodPatch, "/api/polls/"+draft.ID, `{"opens_at":null}`)
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected draft to be rescheduled, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
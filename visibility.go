@@ -0,0 +1,258 @@
+// visibility.go - Who can see a poll
+// Every poll has a visibility:
+//   public    listed on the index and open to everyone (the default)
+//   unlisted  open to anyone with the link, but not listed
+//   private   only for its members (user names), its owner and admins
+//   password  only for those who enter the poll's password
+// Owners and admins can always see their polls, and only they see unlisted
+// and password-protected polls in lists. Private polls look like missing
+// polls to everyone else. Entering the password on the poll page sets a
+// signed cookie for that poll; API clients can send the password in the
+// X-Poll-Password header instead. Only public polls are sent to the
+// activity stream.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+)
+
+// Visibility controls who can see a poll
+type Visibility string
+
+// Poll visibilities
+const (
+	VisibilityPublic   Visibility = "public"
+	VisibilityUnlisted Visibility = "unlisted"
+	VisibilityPrivate  Visibility = "private"
+	VisibilityPassword Visibility = "password"
+)
+
+const (
+	unlockCookiePrefix = "quickpoll_unlock_"
+	pollPasswordHeader = "X-Poll-Password"
+)
+
+// ErrPollLocked is returned for password-protected polls the caller has
+// not unlocked
+var ErrPollLocked = errors.New("poll is password-protected")
+
+// IsPublic reports whether the poll is listed for everyone
+func (p *Poll) IsPublic() bool {
+	return p.Visibility == "" || p.Visibility == VisibilityPublic
+}
+
+// isMember reports whether the user named name is a member of the poll
+func (p *Poll) isMember(name string) bool {
+	for _, member := range p.Members {
+		if member == name {
+			return true
+		}
+	}
+	return false
+}
+
+// parseVisibility validates a visibility submitted by a client; empty
+// means public
+func parseVisibility(value string) (Visibility, error) {
+	switch Visibility(value) {
+	case "", VisibilityPublic:
+		return VisibilityPublic, nil
+	case VisibilityUnlisted, VisibilityPrivate, VisibilityPassword:
+		return Visibility(value), nil
+	default:
+		return "", fmt.Errorf("unknown visibility %q", value)
+	}
+}
+
+// applyVisibility validates the access settings of in and applies them to
+// poll
+func applyVisibility(poll *Poll, in PollInput) error {
+	visibility, err := parseVisibility(in.Visibility)
+	if err != nil {
+		return &ValidationError{Field: "visibility", Message: err.Error()}
+	}
+	poll.Visibility = visibility
+
+	switch visibility {
+	case VisibilityPassword:
+		if in.Password == "" {
+			return &ValidationError{Field: "password", Message: "Password-protected polls need a password"}
+		}
+		if poll.PasswordHash, err = hashPassword(in.Password); err != nil {
+			return err
+		}
+	case VisibilityPrivate:
+		seen := make(map[string]bool)
+		for _, name := range in.Members {
+			if name = normalizeUserName(name); name != "" && !seen[name] {
+				seen[name] = true
+				poll.Members = append(poll.Members, name)
+			}
+		}
+	}
+	if in.Password != "" && visibility != VisibilityPassword {
+		return &ValidationError{Field: "password", Message: "Only password-protected polls take a password"}
+	}
+	if len(in.Members) > 0 && visibility != VisibilityPrivate {
+		return &ValidationError{Field: "members", Message: "Only private polls have members"}
+	}
+	return nil
+}
+
+// checkView returns nil if the caller may see poll, ErrPollNotFound if the
+// poll is private to others and ErrPollLocked if it needs a password
+func (app *App) checkView(r *http.Request, poll *Poll) error {
+	switch poll.Visibility {
+	case VisibilityPrivate:
+		if user := userFromRequest(r); user != nil && poll.isMember(user.Name) {
+			return nil
+		}
+		if !app.canManage(r, poll) {
+			return ErrPollNotFound
+		}
+	case VisibilityPassword:
+		if !app.unlocked(r, poll) && !app.canManage(r, poll) {
+			return ErrPollLocked
+		}
+	}
+	return nil
+}
+
+// viewablePoll returns a poll if the caller may see it
+func (app *App) viewablePoll(r *http.Request, pollID string) (*Poll, error) {
+	poll, err := app.store.Get(pollID)
+	if err != nil {
+		return nil, err
+	}
+	if err := app.checkView(r, poll); err != nil {
+		return nil, err
+	}
+	return poll, nil
+}
+
+// listed reports whether poll appears in the caller's poll lists
+func (app *App) listed(r *http.Request, poll *Poll) bool {
+	if poll.IsPublic() {
+		return true
+	}
+	if poll.Visibility == VisibilityPrivate && app.checkView(r, poll) == nil {
+		return true
+	}
+	return app.canManage(r, poll)
+}
+
+// listPolls returns the polls listed for the caller, newest first
+func (app *App) listPolls(r *http.Request) []*Poll {
+	var polls []*Poll
+	for _, poll := range app.store.List() {
+		if app.listed(r, poll) {
+			polls = append(polls, poll)
+		}
+	}
+	return polls
+}
+
+// unlockFingerprint identifies the current password of a poll, so that
+// changing it invalidates unlock cookies
+func unlockFingerprint(poll *Poll) string {
+	sum := sha256.Sum256([]byte(poll.PasswordHash))
+	return hex.EncodeToString(sum[:8])
+}
+
+// unlocked reports whether the caller has the poll's password, in the
+// request header or as an unlock cookie
+func (app *App) unlocked(r *http.Request, poll *Poll) bool {
+	if password := r.Header.Get(pollPasswordHeader); password != "" {
+		return checkPassword(poll.PasswordHash, password)
+	}
+	cookie, err := r.Cookie(unlockCookiePrefix + poll.ID)
+	if err != nil {
+		return false
+	}
+	payload, ok := app.sessions.Verify(cookie.Value)
+	return ok && payload == poll.ID+":"+unlockFingerprint(poll)
+}
+
+// unlock checks the password form of a poll page and, if it is right,
+// remembers it in a cookie for the poll's pages and streams
+func (app *App) unlock(w http.ResponseWriter, r *http.Request, poll *Poll) {
+	if !sameOrigin(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if !checkPassword(poll.PasswordHash, r.FormValue("password")) {
+		w.WriteHeader(http.StatusForbidden)
+		renderUnlockForm(w, poll, "Wrong password")
+		return
+	}
+	payload := poll.ID + ":" + unlockFingerprint(poll)
+	http.SetCookie(w, &http.Cookie{
+		Name:     unlockCookiePrefix + poll.ID,
+		Value:    payload + "." + app.sessions.sign(payload),
+		Path:     "/",
+		MaxAge:   int(sessionMaxAge.Seconds()),
+		HttpOnly: true,
+		Secure:   isSecureRequest(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, "/poll/"+poll.ID, http.StatusSeeOther)
+}
+
+// renderUnlockForm asks for the password of a poll
+func renderUnlockForm(w http.ResponseWriter, poll *Poll, message string) {
+	tmpl := template.Must(template.New("unlock").Parse(unlockTemplate))
+	tmpl.Execute(w, map[string]interface{}{"ID": poll.ID, "Error": message})
+}
+
+// publicActivity reports whether a poll event may go to the activity
+// stream, which everyone can follow
+func publicActivity(ev Event) bool {
+	var poll struct {
+		Visibility Visibility `json:"visibility"`
+	}
+	if err := json.Unmarshal([]byte(ev.Data), &poll); err != nil {
+		return false
+	}
+	return poll.Visibility == "" || poll.Visibility == VisibilityPublic
+}
+
+// parseMembers splits a list of user names separated by commas or lines
+func parseMembers(value string) []string {
+	return strings.FieldsFunc(value, func(c rune) bool {
+		return c == ',' || c == '\n' || c == '\r' || c == ' '
+	})
+}
+
+const unlockTemplate = baseStyle + `
+    <div class="container mx-auto px-4 py-8 max-w-md">
+        <a href="/" class="inline-flex items-center text-indigo-600 hover:text-indigo-800 mb-6">
+            ← Back to polls
+        </a>
+
+        <div class="bg-white rounded-2xl shadow-xl p-8">
+            <h1 class="text-3xl font-bold text-gray-800 mb-2">🔒 Protected poll</h1>
+            <p class="text-gray-500 mb-6">Enter the poll's password to see it and vote.</p>
+
+            {{if .Error}}
+            <p class="mb-4 px-4 py-3 rounded-xl bg-red-50 text-red-800 text-sm">{{.Error}}</p>
+            {{end}}
+
+            <form method="POST" action="/poll/{{.ID}}" class="space-y-6">
+                <input type="password" name="password" required autofocus
+                    class="w-full px-4 py-3 border border-gray-300 rounded-xl focus:ring-2 focus:ring-indigo-500 focus:border-transparent">
+                <button type="submit"
+                    class="w-full px-6 py-3 bg-gradient-to-r from-indigo-600 to-purple-600 text-white font-semibold rounded-xl shadow-lg hover:shadow-xl transition-all duration-200">
+                    Unlock
+                </button>
+            </form>
+        </div>
+    </div>
+` + baseEnd
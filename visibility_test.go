@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// listedIDs returns the IDs of the polls GET /api/polls shows user, or an
+// anonymous caller if user is nil
+func listedIDs(t *testing.T, app *App, user *User) map[string]bool {
+	t.Helper()
+	var rec *httptest.ResponseRecorder
+	if user != nil {
+		rec = accountCall(t, app, user, http.MethodGet, "/api/polls", "")
+	} else {
+		rec = apiCall(t, app, http.MethodGet, "/api/polls", "", "")
+	}
+	var polls []Poll
+	json.NewDecoder(rec.Body).Decode(&polls)
+	ids := make(map[string]bool)
+	for _, poll := range polls {
+		ids[poll.ID] = true
+	}
+	return ids
+}
+
+// TestBuildPollVisibility validates the access settings of new polls.
+func TestBuildPollVisibility(t *testing.T) {
+	base := PollInput{Question: "Q?", Options: []string{"A", "B"}}
+
+	poll, err := buildPoll(base)
+	if err != nil || !poll.IsPublic() {
+		t.Fatalf("Expected a public poll by default, got %+v %v", poll, err)
+	}
+
+	tests := []struct {
+		name       string
+		visibility string
+		password   string
+		members    []string
+	}{
+		{"unknown visibility", "secret", "", nil},
+		{"password without one", "password", "", nil},
+		{"password on a public poll", "public", "pw", nil},
+		{"members on an unlisted poll", "unlisted", "", []string{"alice"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in := base
+			in.Visibility, in.Password, in.Members = tt.visibility, tt.password, tt.members
+			if _, err := buildPoll(in); err == nil {
+				t.Error("Expected a validation error")
+			}
+		})
+	}
+
+	in := base
+	in.Visibility, in.Members = "private", []string{"Alice", "bob", "alice"}
+	poll, _ = buildPoll(in)
+	if len(poll.Members) != 2 || !poll.isMember("alice") {
+		t.Errorf("Expected normalized members, got %v", poll.Members)
+	}
+}
+
+// TestPollVisibility lists and serves polls according to their visibility.
+func TestPollVisibility(t *testing.T) {
+	app := NewApp()
+	owner := registerUser(t, app, "owner")
+	member := registerUser(t, app, "member")
+	stranger := registerUser(t, app, "stranger")
+
+	polls := make(map[Visibility]*Poll)
+	for _, visibility := range []Visibility{VisibilityPublic, VisibilityUnlisted, VisibilityPrivate, VisibilityPassword} {
+		in := PollInput{Question: string(visibility), Options: []string{"A", "B"}, Visibility: string(visibility)}
+		if visibility == VisibilityPrivate {
+			in.Members = []string{"member"}
+		}
+		if visibility == VisibilityPassword {
+			in.Password = "opensesame"
+		}
+		poll, err := buildPoll(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		poll.OwnerID = owner.ID
+		app.store.Create(poll)
+		polls[visibility] = poll
+	}
+
+	anonymous := listedIDs(t, app, nil)
+	if len(anonymous) != 1 || !anonymous[polls[VisibilityPublic].ID] {
+		t.Errorf("Expected only the public poll listed anonymously, got %v", anonymous)
+	}
+	if got := listedIDs(t, app, member); len(got) != 2 || !got[polls[VisibilityPrivate].ID] {
+		t.Errorf("Expected a member to see the private poll listed, got %v", got)
+	}
+	if got := listedIDs(t, app, owner); len(got) != 4 {
+		t.Errorf("Expected the owner to see every poll listed, got %v", got)
+	}
+
+	get := func(user *User, visibility Visibility, header string) int {
+		req := httptest.NewRequest(http.MethodGet, "/api/polls/"+polls[visibility].ID, nil)
+		if user != nil {
+			signInAccount(app, req, user)
+		}
+		if header != "" {
+			req.Header.Set(pollPasswordHeader, header)
+		}
+		rec := httptest.NewRecorder()
+		app.Routes().ServeHTTP(rec, req)
+		return rec.Code
+	}
+	if code := get(nil, VisibilityUnlisted, ""); code != http.StatusOK {
+		t.Errorf("Expected an unlisted poll open by link, got %d", code)
+	}
+	if code := get(stranger, VisibilityPrivate, ""); code != http.StatusNotFound {
+		t.Errorf("Expected a private poll hidden from others, got %d", code)
+	}
+	if code := get(member, VisibilityPrivate, ""); code != http.StatusOK {
+		t.Errorf("Expected a member to see the private poll, got %d", code)
+	}
+	if code := get(nil, VisibilityPassword, "wrong"); code != http.StatusForbidden {
+		t.Errorf("Expected 403 with a wrong password, got %d", code)
+	}
+	if code := get(nil, VisibilityPassword, "opensesame"); code != http.StatusOK {
+		t.Errorf("Expected the password to open the poll, got %d", code)
+	}
+
+	rec := apiCall(t, app, http.MethodPost, "/vote/"+polls[VisibilityPrivate].ID, "", "v1")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected votes on a hidden private poll refused, got %d", rec.Code)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/events/"+polls[VisibilityPassword].ID, nil)
+	rec = httptest.NewRecorder()
+	app.Routes().ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("Expected the stream of a locked poll refused, got %d", rec.Code)
+	}
+}
+
+// TestPollUnlock unlocks a password-protected poll page with a cookie.
+func TestPollUnlock(t *testing.T) {
+	app := NewApp()
+	poll, _ := buildPoll(PollInput{Question: "Raise?", Options: []string{"Yes", "No"}, Visibility: "password", Password: "opensesame"})
+	app.store.Create(poll)
+
+	rec := httptest.NewRecorder()
+	app.Routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/poll/"+poll.ID, nil))
+	if rec.Code != http.StatusForbidden || strings.Contains(rec.Body.String(), "Raise?") {
+		t.Fatalf("Expected the unlock form without the question, got %d", rec.Code)
+	}
+
+	unlock := func(password string) *httptest.ResponseRecorder {
+		form := url.Values{"password": {password}}
+		req := httptest.NewRequest(http.MethodPost, "/poll/"+poll.ID, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		app.Routes().ServeHTTP(rec, req)
+		return rec
+	}
+	if rec := unlock("guess"); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected a wrong password refused, got %d", rec.Code)
+	}
+	rec = unlock("opensesame")
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("Expected a redirect after unlocking, got %d", rec.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/poll/"+poll.ID, nil)
+	for _, cookie := range rec.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+	rec = httptest.NewRecorder()
+	app.Routes().ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "Raise?") {
+		t.Errorf("Expected the unlocked poll page, got %d", rec.Code)
+	}
+}
+
+// TestActivityHidesNonPublicPolls keeps polls that are not public out of
+// the activity stream.
+func TestActivityHidesNonPublicPolls(t *testing.T) {
+	app := NewApp()
+	ch := app.activity.Subscribe(ActivityFilter{})
+	defer app.activity.Unsubscribe(ch)
+
+	rec := apiCall(t, app, http.MethodPost, "/api/polls", `{"question":"Secret?","options":["A","B"],"visibility":"unlisted"}`, "")
+	var hidden Poll
+	json.NewDecoder(rec.Body).Decode(&hidden)
+	apiCall(t, app, http.MethodPost, "/api/polls/"+hidden.ID+"/votes", `{"options":["`+hidden.Options[0].ID+`"]}`, "v1")
+	apiCall(t, app, http.MethodPost, "/api/polls", `{"question":"Open?","options":["A","B"]}`, "")
+
+	if a := nextActivity(t, ch); a.PollID == hidden.ID {
+		t.Errorf("Expected no activity for the unlisted poll, got %+v", a)
+	}
+}
@@ -0,0 +1,133 @@
+// voters.go - Voter identity
+// Every browser gets a random voter ID in a signed cookie on its first page
+// view. Ballots are keyed by that ID, so voting again changes the vote
+// instead of adding another one. The signature stops clients from minting
+// identities without visiting the site; set SESSION_SECRET so cookies stay
+// valid across restarts. Signed-in users, in the browser or with an API
+// key, vote as their account instead, so an account has one ballot per
+// poll.
+
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	voterCookieName   = "quickpoll_voter"
+	voterCookieMaxAge = 365 * 24 * time.Hour
+)
+
+type voterContextKey struct{}
+
+// VoterSigner issues and verifies signed voter cookies
+type VoterSigner struct {
+	secret []byte
+}
+
+// NewVoterSigner creates a signer using the given secret
+func NewVoterSigner(secret []byte) *VoterSigner {
+	return &VoterSigner{secret: secret}
+}
+
+// Issue creates a new voter ID and the cookie value that carries it
+func (v *VoterSigner) Issue() (string, string, error) {
+	id, err := NewID(KindVoter)
+	if err != nil {
+		return "", "", err
+	}
+	return id, id + "." + v.sign(id), nil
+}
+
+// Verify returns the voter ID from a cookie value if its signature is valid
+func (v *VoterSigner) Verify(value string) (string, bool) {
+	id, sig, ok := strings.Cut(value, ".")
+	if !ok || id == "" {
+		return "", false
+	}
+	if !hmac.Equal([]byte(sig), []byte(v.sign(id))) {
+		return "", false
+	}
+	return id, true
+}
+
+func (v *VoterSigner) sign(id string) string {
+	mac := hmac.New(sha256.New, v.secret)
+	mac.Write([]byte(id))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// sessionSecret returns SESSION_SECRET, or a random secret when it is not
+// set. With a random secret every restart invalidates existing cookies.
+func sessionSecret() []byte {
+	if secret := os.Getenv("SESSION_SECRET"); secret != "" {
+		return []byte(secret)
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		log.Fatalf("Failed to generate session secret: %v", err)
+	}
+	return secret
+}
+
+// withVoter attaches the caller's voter ID to the request context. Page
+// views (GET requests) without a valid cookie are issued a new identity;
+// other requests only carry an identity if they already have one. If no
+// identity can be issued the page is served without one.
+func (app *App) withVoter(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var voterID string
+		if cookie, err := r.Cookie(voterCookieName); err == nil {
+			voterID, _ = app.voters.Verify(cookie.Value)
+		}
+
+		if voterID == "" && r.Method == http.MethodGet {
+			id, value, err := app.voters.Issue()
+			if err != nil {
+				log.Printf("Failed to issue voter ID: %v", err)
+				next.ServeHTTP(w, r)
+				return
+			}
+			voterID = id
+			http.SetCookie(w, &http.Cookie{
+				Name:     voterCookieName,
+				Value:    value,
+				Path:     "/",
+				MaxAge:   int(voterCookieMaxAge.Seconds()),
+				HttpOnly: true,
+				Secure:   isSecureRequest(r),
+				SameSite: http.SameSiteLaxMode,
+			})
+		}
+
+		if voterID != "" {
+			r = r.WithContext(context.WithValue(r.Context(), voterContextKey{}, voterID))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// voterFromRequest returns the signed-in user's ID, else the voter ID
+// attached by withVoter, or ""
+func voterFromRequest(r *http.Request) string {
+	if user := userFromRequest(r); user != nil {
+		return user.ID
+	}
+	id, _ := r.Context().Value(voterContextKey{}).(string)
+	return id
+}
+
+// isSecureRequest reports whether the client reached us over HTTPS,
+// directly or through a proxy such as Render's
+func isSecureRequest(r *http.Request) bool {
+	return r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+}
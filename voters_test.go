@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// signIn attaches a validly signed voter cookie to a request
+func signIn(app *App, req *http.Request, voterID string) {
+	req.AddCookie(&http.Cookie{Name: voterCookieName, Value: voterID + "." + app.voters.sign(voterID)})
+}
+
+// TestVoterSigner verifies that issued cookies verify and
+// tampered ones do not.
+func TestVoterSigner(t *testing.T) {
+	signer := NewVoterSigner([]byte("secret"))
+	id, value, err := signer.Issue()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, ok := signer.Verify(value)
+	if !ok || got != id {
+		t.Fatalf("Expected %q to verify, got %q %v", id, got, ok)
+	}
+
+	// Changing the ID invalidates the signature
+	_, sig, _ := strings.Cut(value, ".")
+	if _, ok := signer.Verify("someone-else." + sig); ok {
+		t.Error("Expected forged cookie to fail verification")
+	}
+
+	// A different secret rejects the cookie
+	if _, ok := NewVoterSigner([]byte("other")).Verify(value); ok {
+		t.Error("Expected cookie from another secret to fail verification")
+	}
+}
+
+// TestVoteReplacement ensures a voter's second ballot moves
+// their vote instead of adding another.
+func TestVoteReplacement(t *testing.T) {
+	store := NewStore()
+	poll := &Poll{Question: "Lunch?", Options: []Option{{ID: "a", Text: "Pizza"}, {ID: "b", Text: "Sushi"}}}
+	store.Create(poll)
+
+	store.CastBallot(poll.ID, Ballot{VoterID: "v1", Choices: []string{"a"}})
+	store.CastBallot(poll.ID, Ballot{VoterID: "v2", Choices: []string{"a"}})
+	updated, err := store.CastBallot(poll.ID, Ballot{VoterID: "v1", Choices: []string{"b"}})
+	if err != nil {
+		t.Fatalf("CastBallot failed: %v", err)
+	}
+
+	if updated.Options[0].Votes != 1 || updated.Options[1].Votes != 1 {
+		t.Errorf("Expected 1/1 after moving a vote, got %d/%d", updated.Options[0].Votes, updated.Options[1].Votes)
+	}
+	if updated.TotalVotes() != 2 {
+		t.Errorf("Expected 2 votes total, got %d", updated.TotalVotes())
+	}
+
+	// An invalid replacement leaves the original ballot in place
+	if _, err := store.CastBallot(poll.ID, Ballot{VoterID: "v1", Choices: []string{"missing"}}); err == nil {
+		t.Error("Expected error for invalid option")
+	}
+	got, _ := store.Get(poll.ID)
+	if ballot, _ := got.BallotOf("v1"); len(ballot.Choices) != 1 || ballot.Choices[0] != "b" {
+		t.Errorf("Expected v1 ballot to stay on b, got %+v", ballot)
+	}
+}
+
+// TestRetractBallot verifies retraction removes the vote for
+// every poll type.
+func TestRetractBallot(t *testing.T) {
+	store := NewStore()
+	options := []Option{{ID: "a", Text: "A"}, {ID: "b", Text: "B"}}
+
+	for _, pollType := range []PollType{PollSingle, PollRanked, PollApproval} {
+		poll := &Poll{Question: string(pollType), Type: pollType, Options: append([]Option(nil), options...)}
+		store.Create(poll)
+
+		choices := []string{"a"}
+		if pollType != PollSingle {
+			choices = []string{"a", "b"}
+		}
+		store.CastBallot(poll.ID, Ballot{VoterID: "v1", Choices: choices})
+
+		updated, err := store.RetractBallot(poll.ID, "v1")
+		if err != nil {
+			t.Fatalf("%s: RetractBallot failed: %v", pollType, err)
+		}
+		if updated.TotalVotes() != 0 || updated.TotalBallots() != 0 || len(updated.Ballots) != 0 {
+			t.Errorf("%s: expected no votes after retraction, got %+v", pollType, updated)
+		}
+
+		// Nothing left to retract
+		if _, err := store.RetractBallot(poll.ID, "v1"); err == nil {
+			t.Errorf("%s: expected error retracting twice", pollType)
+		}
+	}
+}
+
+// TestVoteHandlerIdentity checks that votes need a voter cookie,
+// that page views issue one, and that DELETE retracts.
+func TestVoteHandlerIdentity(t *testing.T) {
+	app := NewApp()
+	routes := app.Routes()
+	poll := &Poll{Question: "Q?", Options: []Option{{ID: "a", Text: "A"}, {ID: "b", Text: "B"}}}
+	app.store.Create(poll)
+
+	vote := func(method string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/vote/"+poll.ID, strings.NewReader(url.Values{"option": {"a"}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Accept", "application/json")
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		rec := httptest.NewRecorder()
+		routes.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// No cookie: rejected
+	if rec := vote(http.MethodPost, nil); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 without identity, got %d", rec.Code)
+	}
+
+	// Viewing the poll issues a cookie
+	rec := httptest.NewRecorder()
+	routes.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/poll/"+poll.ID, nil))
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != voterCookieName {
+		t.Fatalf("Expected voter cookie on first visit, got %v", cookies)
+	}
+
+	// Voting twice with the same cookie counts once
+	vote(http.MethodPost, cookies[0])
+	rec = vote(http.MethodPost, cookies[0])
+	var got Poll
+	json.NewDecoder(rec.Body).Decode(&got)
+	if got.Options[0].Votes != 1 {
+		t.Errorf("Expected 1 vote after voting twice, got %d", got.Options[0].Votes)
+	}
+
+	rec = vote(http.MethodDelete, cookies[0])
+	json.NewDecoder(rec.Body).Decode(&got)
+	if rec.Code != http.StatusOK || got.Options[0].Votes != 0 {
+		t.Errorf("Expected retraction to remove the vote, got %d with %d votes", rec.Code, got.Options[0].Votes)
+	}
+}
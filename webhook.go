@@ -0,0 +1,755 @@
+// webhook.go - Webhooks for poll lifecycle events
+// Services register a URL for some or all of these events, either for one
+// poll or for every poll:
+//   poll.created    a poll was created
+//   poll.voted      a vote was cast or changed
+//   poll.threshold  a poll reached the registration's vote threshold
+//   poll.closed     a poll closed
+// Each event is POSTed as JSON with an X-Signature header holding
+// "sha256=" and the hex HMAC-SHA256 of the body, keyed with the
+// registration's secret. Failed deliveries are retried with exponential
+// backoff; those that keep failing end up in a dead-letter list, from which
+// they can be retried by hand. Only the node that handled the change sends
+// the webhook. The polls whose threshold event was sent are saved with the
+// registrations, so it is sent once per poll, across restarts and, with
+// STORAGE=redis, across nodes. Dead letters stay on the node that gave up
+// on them.
+//
+// Managing webhooks needs a signed-in user, an admin or an API key with the
+// webhooks:manage scope. Users see and manage only the webhooks and dead
+// letters of their own registrations; only admins may register webhooks for
+// every poll. Receivers must be public: URLs whose host resolves to a
+// private, loopback or link-local address are refused, both when they are
+// registered and again when each delivery connects.
+//
+//   GET    /api/webhooks                             list registrations
+//   POST   /api/webhooks                             register a webhook
+//   GET    /api/webhooks/{id}                        fetch a registration
+//   DELETE /api/webhooks/{id}                        remove a registration
+//   GET    /api/webhooks/dead-letters                list failed deliveries
+//   POST   /api/webhooks/dead-letters/{id}/retry     deliver one again
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Webhook event types
+const (
+	WebhookCreated   = "poll.created"
+	WebhookVoted     = "poll.voted"
+	WebhookThreshold = "poll.threshold"
+	WebhookClosed    = "poll.closed"
+)
+
+const (
+	webhookWorkers      = 4
+	webhookQueueSize    = 256
+	webhookTimeout      = 10 * time.Second
+	webhookMaxAttempts  = 6
+	webhookFirstBackoff = time.Second
+	deadLetterLimit     = 100
+	// webhookSaveAttempts bounds how often a threshold event is retried
+	// when another node saved the registrations at the same time
+	webhookSaveAttempts = 5
+)
+
+// Webhook errors
+var (
+	ErrWebhookNotFound  = errors.New("webhook not found")
+	ErrWebhookSignIn    = errors.New("sign in or use an API key to manage webhooks")
+	ErrGlobalWebhook    = errors.New("only admins can register webhooks for every poll")
+	errPrivateAddress   = errors.New("webhook receivers must not be on a private, loopback or link-local address")
+	errUnresolvableHost = errors.New("webhook URL host cannot be resolved")
+)
+
+// sharedAddressSpace is the carrier-grade NAT range (RFC 6598), which
+// cloud providers also use for metadata services
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// Webhook is a registered receiver. An empty PollID receives events of all
+// polls, and empty Events all event types. Threshold events need a
+// Threshold.
+type Webhook struct {
+	ID        string          `json:"id"`
+	OwnerID   string          `json:"owner_id,omitempty"`
+	URL       string          `json:"url"`
+	Secret    string          `json:"secret,omitempty"`
+	PollID    string          `json:"poll_id,omitempty"`
+	Events    []string        `json:"events,omitempty"`
+	Threshold int             `json:"threshold,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+	fired     map[string]bool // polls whose threshold event was sent
+}
+
+// storedWebhook is the form in which registrations are saved, with the
+// polls whose threshold event was sent
+type storedWebhook struct {
+	*Webhook
+	Fired []string `json:"fired,omitempty"`
+}
+
+// wants reports whether the webhook receives event for poll
+func (h *Webhook) wants(event, pollID string) bool {
+	if h.PollID != "" && h.PollID != pollID {
+		return false
+	}
+	if event == WebhookThreshold && h.Threshold <= 0 {
+		return false
+	}
+	if len(h.Events) == 0 {
+		return true
+	}
+	for _, e := range h.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// redacted returns the webhook without its secret
+func (h *Webhook) redacted() *Webhook {
+	cp := *h
+	cp.Secret = ""
+	return &cp
+}
+
+// WebhookPayload is the body POSTed to receivers
+type WebhookPayload struct {
+	ID        string    `json:"id"`
+	Event     string    `json:"event"`
+	WebhookID string    `json:"webhook_id"`
+	CreatedAt time.Time `json:"created_at"`
+	Threshold int       `json:"threshold,omitempty"`
+	Poll      *Poll     `json:"poll"`
+}
+
+// WebhookDelivery is one payload on its way to a receiver. Retries keep
+// the delivery ID, so receivers can drop duplicates.
+type WebhookDelivery struct {
+	ID        string          `json:"id"`
+	WebhookID string          `json:"webhook_id"`
+	Event     string          `json:"event"`
+	URL       string          `json:"url"`
+	Payload   json.RawMessage `json:"payload"`
+	Attempts  int             `json:"attempts"`
+	LastError string          `json:"last_error,omitempty"`
+	FailedAt  time.Time       `json:"failed_at,omitempty"`
+
+	secret string
+	owner  string // the OwnerID of the webhook
+}
+
+// Webhooks holds registrations and delivers events to them
+type Webhooks struct {
+	path string // registrations file; empty keeps them in memory
+	// shared keeps the registrations in Redis instead, for every node
+	shared      *redisDoc
+	client      *http.Client
+	queue       chan *WebhookDelivery
+	backoff     time.Duration
+	maxAttempts int
+	// allowPrivate lets tests deliver to receivers on this host
+	allowPrivate bool
+
+	mu    sync.Mutex
+	hooks map[string]*Webhook
+	dead  []*WebhookDelivery
+}
+
+// NewWebhooks creates an empty registry kept in memory
+func NewWebhooks() *Webhooks {
+	w := &Webhooks{
+		queue:       make(chan *WebhookDelivery, webhookQueueSize),
+		backoff:     webhookFirstBackoff,
+		maxAttempts: webhookMaxAttempts,
+		hooks:       make(map[string]*Webhook),
+	}
+	// The address is checked once resolved, right before connecting, so a
+	// host cannot pass registration and later resolve to a private address.
+	// Proxies would hide the receiver's address, so none is used.
+	dialer := &net.Dialer{Timeout: webhookTimeout, Control: func(network, address string, _ syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		if ip := net.ParseIP(host); ip == nil || !w.receiverAllowed(ip) {
+			return errPrivateAddress
+		}
+		return nil
+	}}
+	w.client = &http.Client{
+		Timeout:   webhookTimeout,
+		Transport: &http.Transport{DialContext: dialer.DialContext, TLSHandshakeTimeout: webhookTimeout},
+	}
+	return w
+}
+
+// OpenWebhooks creates a registry saved to path, loading the registrations
+// already there
+func OpenWebhooks(path string) (*Webhooks, error) {
+	w := NewWebhooks()
+	w.path = path
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return w, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := w.loadLocked(data); err != nil {
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+	return w, nil
+}
+
+// OpenSharedWebhooks creates a registry kept in Redis, where every node
+// sees the same registrations
+func OpenSharedWebhooks(client *RedisClient) (*Webhooks, error) {
+	w := NewWebhooks()
+	w.shared = newRedisDoc(client, "webhooks")
+	if err := w.shared.sync(w.loadLocked); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// loadLocked replaces the registrations with saved ones. The caller must
+// hold w.mu.
+func (w *Webhooks) loadLocked(data []byte) error {
+	var stored []storedWebhook
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &stored); err != nil {
+			return err
+		}
+	}
+	w.hooks = make(map[string]*Webhook, len(stored))
+	for _, sh := range stored {
+		sh.Webhook.fired = make(map[string]bool, len(sh.Fired))
+		for _, pollID := range sh.Fired {
+			sh.Webhook.fired[pollID] = true
+		}
+		w.hooks[sh.ID] = sh.Webhook
+	}
+	return nil
+}
+
+// syncLocked reloads shared registrations that another node changed. The
+// caller must hold w.mu.
+func (w *Webhooks) syncLocked() {
+	if err := w.shared.sync(w.loadLocked); err != nil {
+		log.Printf("Failed to reload webhooks: %v", err)
+	}
+}
+
+// publicAddress reports whether ip may receive webhooks
+func publicAddress(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() &&
+		!ip.IsLinkLocalMulticast() && !ip.IsInterfaceLocalMulticast() &&
+		!ip.IsUnspecified() && !ip.IsMulticast() && !sharedAddressSpace.Contains(ip)
+}
+
+// receiverAllowed reports whether deliveries may connect to ip
+func (w *Webhooks) receiverAllowed(ip net.IP) bool {
+	return w.allowPrivate || publicAddress(ip)
+}
+
+// checkReceiver resolves the host of a receiver URL and refuses it unless
+// every address it resolves to is public
+func (w *Webhooks) checkReceiver(u *url.URL) error {
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, u.Hostname())
+	if err != nil || len(addrs) == 0 {
+		return errUnresolvableHost
+	}
+	for _, addr := range addrs {
+		if !w.receiverAllowed(addr.IP) {
+			return errPrivateAddress
+		}
+	}
+	return nil
+}
+
+// Register validates and adds a webhook, generating its ID and, if none
+// was given, its secret
+func (w *Webhooks) Register(h *Webhook) error {
+	u, err := url.Parse(h.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return &ValidationError{Field: "url", Message: "URL must be an absolute http or https URL"}
+	}
+	if err := w.checkReceiver(u); err != nil {
+		return &ValidationError{Field: "url", Message: err.Error()}
+	}
+	for _, e := range h.Events {
+		switch e {
+		case WebhookCreated, WebhookVoted, WebhookThreshold, WebhookClosed:
+		default:
+			return &ValidationError{Field: "events", Message: fmt.Sprintf("Unknown event %q", e)}
+		}
+	}
+	if h.Threshold < 0 {
+		return &ValidationError{Field: "threshold", Message: "Threshold cannot be negative"}
+	}
+	if h.Secret == "" {
+		secret := make([]byte, 32)
+		if _, err := randRead(secret); err != nil {
+			return fmt.Errorf("%w: %v", ErrEntropy, err)
+		}
+		h.Secret = hex.EncodeToString(secret)
+	}
+	id, err := NewID(KindWebhook)
+	if err != nil {
+		return err
+	}
+	h.ID = id
+	h.CreatedAt = time.Now()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.shared.sync(w.loadLocked); err != nil {
+		return err
+	}
+	w.hooks[h.ID] = h
+	if err := w.saveLocked(); err != nil {
+		delete(w.hooks, h.ID)
+		return err
+	}
+	return nil
+}
+
+// Get returns a registration without its secret
+func (w *Webhooks) Get(id string) (*Webhook, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.syncLocked()
+	h, exists := w.hooks[id]
+	if !exists {
+		return nil, false
+	}
+	return h.redacted(), true
+}
+
+// List returns all registrations without their secrets, oldest first
+func (w *Webhooks) List() []*Webhook {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.syncLocked()
+
+	hooks := make([]*Webhook, 0, len(w.hooks))
+	for _, h := range w.hooks {
+		hooks = append(hooks, h.redacted())
+	}
+	sort.Slice(hooks, func(i, j int) bool { return hooks[i].CreatedAt.Before(hooks[j].CreatedAt) })
+	return hooks
+}
+
+// Delete removes a registration. Deliveries already queued still go out.
+func (w *Webhooks) Delete(id string) (bool, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.shared.sync(w.loadLocked); err != nil {
+		return false, err
+	}
+	h, exists := w.hooks[id]
+	if !exists {
+		return false, nil
+	}
+	delete(w.hooks, id)
+	if err := w.saveLocked(); err != nil {
+		w.hooks[id] = h
+		return false, err
+	}
+	return true, nil
+}
+
+// saveLocked writes the registrations file, or the registrations in
+// Redis. The caller must hold w.mu.
+func (w *Webhooks) saveLocked() error {
+	if w.path == "" && w.shared == nil {
+		return nil
+	}
+	stored := make([]storedWebhook, 0, len(w.hooks))
+	for _, h := range w.hooks {
+		sh := storedWebhook{Webhook: h}
+		for pollID := range h.fired {
+			sh.Fired = append(sh.Fired, pollID)
+		}
+		sort.Strings(sh.Fired)
+		stored = append(stored, sh)
+	}
+	sort.Slice(stored, func(i, j int) bool { return stored[i].CreatedAt.Before(stored[j].CreatedAt) })
+	data, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		return err
+	}
+	if w.shared != nil {
+		return w.shared.save(data)
+	}
+	return writeFileAtomic(w.path, data)
+}
+
+// Notify queues event for every webhook that wants it. Votes also trigger
+// the threshold event of webhooks whose threshold the poll has reached,
+// once per poll: the event is only sent once the registrations record it.
+func (w *Webhooks) Notify(event string, poll *Poll) {
+	w.mu.Lock()
+	w.syncLocked()
+	var deliveries []*WebhookDelivery
+	for _, h := range w.hooks {
+		if !h.wants(event, poll.ID) {
+			continue
+		}
+		if d, err := newDelivery(h, event, poll); err != nil {
+			log.Printf("Webhook %s: dropping %s: %v", h.ID, event, err)
+		} else {
+			deliveries = append(deliveries, d)
+		}
+	}
+	if event == WebhookVoted {
+		deliveries = append(deliveries, w.thresholdsLocked(poll)...)
+	}
+	w.mu.Unlock()
+
+	for _, d := range deliveries {
+		w.enqueue(d)
+	}
+}
+
+// thresholdsLocked returns the threshold events poll has newly triggered,
+// after recording them as sent. Another node saving the registrations at
+// the same time may have sent some of them; the check is then repeated on
+// its copy. The caller must hold w.mu.
+func (w *Webhooks) thresholdsLocked(poll *Poll) []*WebhookDelivery {
+	for attempt := 1; ; attempt++ {
+		var due []*Webhook
+		var deliveries []*WebhookDelivery
+		for _, h := range w.hooks {
+			if !h.wants(WebhookThreshold, poll.ID) || poll.TotalBallots() < h.Threshold || h.fired[poll.ID] {
+				continue
+			}
+			d, err := newDelivery(h, WebhookThreshold, poll)
+			if err != nil {
+				log.Printf("Webhook %s: dropping %s: %v", h.ID, WebhookThreshold, err)
+				continue
+			}
+			due = append(due, h)
+			deliveries = append(deliveries, d)
+		}
+		if len(due) == 0 {
+			return nil
+		}
+
+		for _, h := range due {
+			if h.fired == nil {
+				h.fired = make(map[string]bool)
+			}
+			h.fired[poll.ID] = true
+		}
+		err := w.saveLocked()
+		if err == nil {
+			return deliveries
+		}
+		for _, h := range due {
+			delete(h.fired, poll.ID)
+		}
+		if !errors.Is(err, ErrConcurrentUpdate) || attempt == webhookSaveAttempts {
+			log.Printf("Webhooks: not sending threshold events for poll %s: %v", poll.ID, err)
+			return nil
+		}
+		w.syncLocked()
+	}
+}
+
+// newDelivery builds the delivery of event to h
+func newDelivery(h *Webhook, event string, poll *Poll) (*WebhookDelivery, error) {
+	id, err := NewID(KindDelivery)
+	if err != nil {
+		return nil, err
+	}
+	payload := WebhookPayload{
+		ID:        id,
+		Event:     event,
+		WebhookID: h.ID,
+		CreatedAt: time.Now(),
+		Poll:      poll,
+	}
+	if event == WebhookThreshold {
+		payload.Threshold = h.Threshold
+	}
+	data, _ := json.Marshal(payload)
+	return &WebhookDelivery{
+		ID:        payload.ID,
+		WebhookID: h.ID,
+		Event:     event,
+		URL:       h.URL,
+		Payload:   data,
+		secret:    h.Secret,
+		owner:     h.OwnerID,
+	}, nil
+}
+
+// enqueue hands a delivery to the workers, or dead-letters it if they are
+// too far behind
+func (w *Webhooks) enqueue(d *WebhookDelivery) {
+	select {
+	case w.queue <- d:
+	default:
+		d.LastError = "delivery queue full"
+		w.deadLetter(d)
+	}
+}
+
+// Run delivers queued events until ctx is done. Retries still waiting at
+// that point are lost.
+func (w *Webhooks) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i := 0; i < webhookWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case d := <-w.queue:
+					w.attempt(ctx, d)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// attempt delivers d once, scheduling a retry or dead-lettering it if that
+// fails
+func (w *Webhooks) attempt(ctx context.Context, d *WebhookDelivery) {
+	d.Attempts++
+	err := w.deliver(ctx, d)
+	if err == nil {
+		return
+	}
+	d.LastError = err.Error()
+
+	if d.Attempts >= w.maxAttempts {
+		log.Printf("Giving up on %s webhook delivery %s to %s after %d attempts: %v", d.Event, d.ID, d.URL, d.Attempts, err)
+		w.deadLetter(d)
+		return
+	}
+	delay := w.backoff << (d.Attempts - 1)
+	log.Printf("Webhook delivery %s to %s failed: %v; retrying in %v", d.ID, d.URL, err, delay)
+	time.AfterFunc(delay, func() { w.enqueue(d) })
+}
+
+// deliver POSTs the payload of d, succeeding on any 2xx response
+func (w *Webhooks) deliver(ctx context.Context, d *WebhookDelivery) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "QuickPoll-Webhooks")
+	req.Header.Set("X-Webhook-Event", d.Event)
+	req.Header.Set("X-Webhook-Delivery", d.ID)
+	req.Header.Set("X-Signature", signPayload(d.secret, d.Payload))
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("receiver answered %s", resp.Status)
+	}
+	return nil
+}
+
+// signPayload returns the X-Signature header value for body
+func signPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deadLetter keeps a delivery that failed for good, dropping the oldest
+// beyond deadLetterLimit
+func (w *Webhooks) deadLetter(d *WebhookDelivery) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	d.FailedAt = time.Now()
+	if len(w.dead) == deadLetterLimit {
+		w.dead = append(w.dead[:0], w.dead[1:]...)
+	}
+	w.dead = append(w.dead, d)
+}
+
+// DeadLetters returns the failed deliveries, oldest first
+func (w *Webhooks) DeadLetters() []*WebhookDelivery {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]*WebhookDelivery(nil), w.dead...)
+}
+
+// Retry takes a delivery off the dead-letter list and queues it again
+// with a fresh set of attempts. allowed says whose deliveries the caller
+// may retry, by webhook owner.
+func (w *Webhooks) Retry(id string, allowed func(owner string) bool) error {
+	w.mu.Lock()
+	var found *WebhookDelivery
+	for i, d := range w.dead {
+		if d.ID == id && allowed(d.owner) {
+			found = d
+			w.dead = append(w.dead[:i], w.dead[i+1:]...)
+			break
+		}
+	}
+	w.mu.Unlock()
+	if found == nil {
+		return ErrWebhookNotFound
+	}
+
+	retry := *found
+	retry.Attempts, retry.LastError, retry.FailedAt = 0, "", time.Time{}
+	w.enqueue(&retry)
+	return nil
+}
+
+// notifyVote tells webhooks about a vote cast through any transport
+func (app *App) notifyVote(poll *Poll) {
+	app.webhooks.Notify(WebhookVoted, poll)
+}
+
+// webhookCaller returns the user whose webhooks the request manages, and
+// whether it may manage every webhook
+func (app *App) webhookCaller(r *http.Request) (string, bool, error) {
+	if app.isAdmin(r) {
+		return ownerID(r), true, nil
+	}
+	if user := userFromRequest(r); user != nil {
+		return user.ID, false, nil
+	}
+	return "", false, ErrWebhookSignIn
+}
+
+// APIWebhooksHandler serves /api/webhooks and everything below it
+func (app *App) APIWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	owner, all, err := app.webhookCaller(r)
+	if err != nil {
+		writeErrorJSON(w, err)
+		return
+	}
+	mine := func(ownerID string) bool { return all || ownerID == owner }
+
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/webhooks"), "/")
+	parts := strings.Split(rest, "/")
+
+	switch {
+	case rest == "" && r.Method == http.MethodGet:
+		hooks := make([]*Webhook, 0)
+		for _, hook := range app.webhooks.List() {
+			if mine(hook.OwnerID) {
+				hooks = append(hooks, hook)
+			}
+		}
+		writeJSON(w, http.StatusOK, hooks)
+	case rest == "" && r.Method == http.MethodPost:
+		app.apiRegisterWebhook(w, r, owner, all)
+	case rest == "dead-letters" && r.Method == http.MethodGet:
+		dead := make([]*WebhookDelivery, 0)
+		for _, d := range app.webhooks.DeadLetters() {
+			if mine(d.owner) {
+				dead = append(dead, d)
+			}
+		}
+		writeJSON(w, http.StatusOK, dead)
+	case len(parts) == 3 && parts[0] == "dead-letters" && parts[2] == "retry" && r.Method == http.MethodPost:
+		if err := app.webhooks.Retry(parts[1], mine); err != nil {
+			writeErrorJSON(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		hook, exists := app.webhooks.Get(parts[0])
+		if !exists || !mine(hook.OwnerID) {
+			writeErrorJSON(w, ErrWebhookNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, hook)
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		if hook, exists := app.webhooks.Get(parts[0]); !exists || !mine(hook.OwnerID) {
+			writeErrorJSON(w, ErrWebhookNotFound)
+			return
+		}
+		deleted, err := app.webhooks.Delete(parts[0])
+		if err != nil {
+			writeErrorJSON(w, err)
+			return
+		}
+		if !deleted {
+			writeErrorJSON(w, ErrWebhookNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 1 || (len(parts) == 3 && parts[0] == "dead-letters" && parts[2] == "retry"):
+		writeErrorJSON(w, ErrMethodNotAllowed)
+	default:
+		writeAPIError(w, http.StatusNotFound, "not_found", "Not found")
+	}
+}
+
+// apiRegisterWebhook registers a webhook owned by owner. Only admins (all)
+// may register one for every poll.
+func (app *App) apiRegisterWebhook(w http.ResponseWriter, r *http.Request, owner string, all bool) {
+	var hook Webhook
+	if !decodeJSON(w, r, &hook) {
+		return
+	}
+	if hook.PollID == "" && !all {
+		writeErrorJSON(w, ErrGlobalWebhook)
+		return
+	}
+	if hook.PollID != "" {
+		poll, err := app.viewablePoll(r, hook.PollID)
+		if err != nil {
+			writeErrorJSON(w, err)
+			return
+		}
+		// Deliveries carry the counts
+		if !app.resultsVisible(r, poll) {
+			writeErrorJSON(w, ErrResultsHidden)
+			return
+		}
+	}
+	hook.OwnerID = owner
+	if err := app.webhooks.Register(&hook); err != nil {
+		writeErrorJSON(w, err)
+		return
+	}
+	log.Printf("Registered webhook %s for %s", hook.ID, hook.URL)
+
+	// The secret is only ever shown here
+	w.Header().Set("Location", "/api/webhooks/"+hook.ID)
+	writeJSON(w, http.StatusCreated, &hook)
+}
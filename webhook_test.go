@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookReceiver records the requests a test receiver gets and answers
+// with the given status codes in turn, then 200
+type webhookReceiver struct {
+	mu       sync.Mutex
+	statuses []int
+	requests []receivedWebhook
+}
+
+type receivedWebhook struct {
+	header http.Header
+	body   []byte
+}
+
+func (rcv *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	rcv.mu.Lock()
+	rcv.requests = append(rcv.requests, receivedWebhook{header: r.Header, body: body})
+	status := http.StatusOK
+	if len(rcv.statuses) > 0 {
+		status, rcv.statuses = rcv.statuses[0], rcv.statuses[1:]
+	}
+	rcv.mu.Unlock()
+	w.WriteHeader(status)
+}
+
+func (rcv *webhookReceiver) received() []receivedWebhook {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	return append([]receivedWebhook(nil), rcv.requests...)
+}
+
+// startWebhooks runs the delivery workers of app with fast retries,
+// allowing receivers on this host
+func startWebhooks(t *testing.T, app *App) {
+	app.webhooks.allowPrivate = true
+	app.webhooks.backoff = time.Millisecond
+	app.webhooks.maxAttempts = 3
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go app.webhooks.Run(ctx)
+}
+
+// webhookAdmin registers a user allowed to manage every webhook
+func webhookAdmin(t *testing.T, app *App) *User {
+	t.Helper()
+	app.adminUsers = map[string]bool{"admin": true}
+	return registerUser(t, app, "admin")
+}
+
+// registerWebhook registers a webhook through the API as user
+func registerWebhook(t *testing.T, app *App, user *User, body string) Webhook {
+	t.Helper()
+	rec := accountCall(t, app, user, http.MethodPost, "/api/webhooks", body)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d: %s", rec.Code, rec.Body)
+	}
+	var hook Webhook
+	json.NewDecoder(rec.Body).Decode(&hook)
+	return hook
+}
+
+// TestWebhookSignedDelivery delivers a creation event with a signature the
+// receiver can verify.
+func TestWebhookSignedDelivery(t *testing.T) {
+	rcv := &webhookReceiver{}
+	server := httptest.NewServer(rcv)
+	defer server.Close()
+
+	app := NewApp()
+	startWebhooks(t, app)
+	hook := registerWebhook(t, app, webhookAdmin(t, app), `{"url":"`+server.URL+`","events":["poll.created"]}`)
+	if hook.Secret == "" {
+		t.Fatal("Expected a generated secret in the registration response")
+	}
+
+	apiCall(t, app, http.MethodPost, "/api/polls", `{"question":"Q?","options":["A","B"]}`, "")
+	waitFor(t, "delivery", func() bool { return len(rcv.received()) == 1 })
+
+	got := rcv.received()[0]
+	if sig := got.header.Get("X-Signature"); sig != signPayload(hook.Secret, got.body) {
+		t.Errorf("Signature %q does not match the body", sig)
+	}
+	var payload WebhookPayload
+	json.Unmarshal(got.body, &payload)
+	if payload.Event != WebhookCreated || payload.WebhookID != hook.ID || payload.Poll == nil || payload.Poll.Question != "Q?" {
+		t.Errorf("Unexpected payload %s", got.body)
+	}
+	if got.header.Get("X-Webhook-Delivery") != payload.ID {
+		t.Errorf("Expected delivery ID header %q", payload.ID)
+	}
+}
+
+// TestWebhookRetries retries failed deliveries with the same ID, keeps
+// those that never succeed as dead letters and delivers them again on
+// request.
+func TestWebhookRetries(t *testing.T) {
+	flaky := &webhookReceiver{statuses: []int{500, 503}}
+	flakyServer := httptest.NewServer(flaky)
+	defer flakyServer.Close()
+	down := &webhookReceiver{statuses: []int{500, 500, 500}}
+	downServer := httptest.NewServer(down)
+	defer downServer.Close()
+
+	app := NewApp()
+	startWebhooks(t, app)
+	admin := webhookAdmin(t, app)
+	registerWebhook(t, app, admin, `{"url":"`+flakyServer.URL+`"}`)
+	registerWebhook(t, app, admin, `{"url":"`+downServer.URL+`"}`)
+
+	poll := &Poll{ID: "p1", Question: "Q?"}
+	app.webhooks.Notify(WebhookClosed, poll)
+
+	waitFor(t, "retries", func() bool { return len(flaky.received()) == 3 })
+	attempts := flaky.received()
+	if attempts[0].header.Get("X-Webhook-Delivery") != attempts[2].header.Get("X-Webhook-Delivery") {
+		t.Error("Expected retries to keep the delivery ID")
+	}
+
+	waitFor(t, "dead letter", func() bool { return len(app.webhooks.DeadLetters()) == 1 })
+	dead := app.webhooks.DeadLetters()[0]
+	if dead.Attempts != 3 || dead.URL != downServer.URL || dead.LastError == "" {
+		t.Errorf("Unexpected dead letter %+v", dead)
+	}
+
+	rec := accountCall(t, app, admin, http.MethodPost, "/api/webhooks/dead-letters/"+dead.ID+"/retry", "")
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("Expected 202, got %d", rec.Code)
+	}
+	waitFor(t, "redelivery", func() bool { return len(down.received()) == 4 })
+	if len(app.webhooks.DeadLetters()) != 0 {
+		t.Error("Expected the dead letter to be removed after a successful retry")
+	}
+	if rec := accountCall(t, app, admin, http.MethodPost, "/api/webhooks/dead-letters/"+dead.ID+"/retry", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a retried dead letter, got %d", rec.Code)
+	}
+}
+
+// TestWebhookThreshold sends the threshold event once, when the poll
+// reaches it.
+func TestWebhookThreshold(t *testing.T) {
+	rcv := &webhookReceiver{}
+	server := httptest.NewServer(rcv)
+	defer server.Close()
+
+	app := NewApp()
+	startWebhooks(t, app)
+	poll := &Poll{Question: "Q?", Options: []Option{{ID: "a", Text: "A"}, {ID: "b", Text: "B"}}}
+	app.store.Create(poll)
+	registerWebhook(t, app, registerUser(t, app, "ada"), `{"url":"`+server.URL+`","poll_id":"`+poll.ID+`","events":["poll.threshold"],"threshold":2}`)
+
+	for _, voter := range []string{"v1", "v2", "v3"} {
+		apiCall(t, app, http.MethodPost, "/api/polls/"+poll.ID+"/votes", `{"options":["a"]}`, voter)
+	}
+	waitFor(t, "threshold delivery", func() bool { return len(rcv.received()) == 1 })
+	time.Sleep(20 * time.Millisecond)
+
+	got := rcv.received()
+	if len(got) != 1 {
+		t.Fatalf("Expected one threshold delivery, got %d", len(got))
+	}
+	var payload WebhookPayload
+	json.Unmarshal(got[0].body, &payload)
+	if payload.Event != WebhookThreshold || payload.Threshold != 2 || payload.Poll.TotalBallots() != 2 {
+		t.Errorf("Unexpected payload %s", got[0].body)
+	}
+}
+
+// TestWebhookRegistrationAPI validates registrations and never shows
+// secrets after creation.
+func TestWebhookRegistrationAPI(t *testing.T) {
+	app := NewApp()
+	admin := webhookAdmin(t, app)
+
+	for _, body := range []string{
+		`{"url":"ftp://203.0.113.10/hook"}`,
+		`{"url":"https://203.0.113.10/hook","events":["poll.exploded"]}`,
+	} {
+		if rec := accountCall(t, app, admin, http.MethodPost, "/api/webhooks", body); rec.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %s, got %d", body, rec.Code)
+		}
+	}
+	if rec := accountCall(t, app, admin, http.MethodPost, "/api/webhooks", `{"url":"https://203.0.113.10/hook","poll_id":"missing"}`); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown poll, got %d", rec.Code)
+	}
+
+	hook := registerWebhook(t, app, admin, `{"url":"https://203.0.113.10/hook","secret":"s3cret"}`)
+	rec := accountCall(t, app, admin, http.MethodGet, "/api/webhooks/"+hook.ID, "")
+	var fetched Webhook
+	json.NewDecoder(rec.Body).Decode(&fetched)
+	if fetched.URL != hook.URL || fetched.Secret != "" || fetched.OwnerID != admin.ID {
+		t.Errorf("Expected the registration without its secret, got %+v", fetched)
+	}
+
+	if rec := accountCall(t, app, admin, http.MethodDelete, "/api/webhooks/"+hook.ID, ""); rec.Code != http.StatusNoContent {
+		t.Errorf("Expected 204, got %d", rec.Code)
+	}
+	rec = accountCall(t, app, admin, http.MethodDelete, "/api/webhooks/"+hook.ID, "")
+	if code := decodeAPIError(t, rec); code != "webhook_not_found" {
+		t.Errorf("Expected webhook_not_found, got %q", code)
+	}
+}
+
+// TestWebhookAccess requires a signed-in caller, keeps webhooks for every
+// poll to admins and hides other users' webhooks.
+func TestWebhookAccess(t *testing.T) {
+	app := NewApp()
+	admin := webhookAdmin(t, app)
+	ada, bob := registerUser(t, app, "ada"), registerUser(t, app, "bob")
+	poll := &Poll{Question: "Q?", Options: []Option{{ID: "a", Text: "A"}, {ID: "b", Text: "B"}}}
+	app.store.Create(poll)
+
+	if rec := apiCall(t, app, http.MethodGet, "/api/webhooks", "", "v1"); rec.Code != http.StatusUnauthorized || decodeAPIError(t, rec) != "sign_in_required" {
+		t.Errorf("Expected anonymous callers refused, got %d", rec.Code)
+	}
+	if rec := accountCall(t, app, ada, http.MethodPost, "/api/webhooks", `{"url":"https://203.0.113.10/hook"}`); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected a webhook for every poll refused to a user, got %d", rec.Code)
+	}
+
+	hook := registerWebhook(t, app, ada, `{"url":"https://203.0.113.10/hook","poll_id":"`+poll.ID+`"}`)
+	if rec := accountCall(t, app, bob, http.MethodGet, "/api/webhooks/"+hook.ID, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected another user's webhook hidden, got %d", rec.Code)
+	}
+	if rec := accountCall(t, app, bob, http.MethodDelete, "/api/webhooks/"+hook.ID, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected another user's webhook kept, got %d", rec.Code)
+	}
+	for user, want := range map[*User]int{ada: 1, bob: 0, admin: 1} {
+		var hooks []Webhook
+		json.NewDecoder(accountCall(t, app, user, http.MethodGet, "/api/webhooks", "").Body).Decode(&hooks)
+		if len(hooks) != want {
+			t.Errorf("Expected %s to list %d webhooks, got %d", user.Name, want, len(hooks))
+		}
+	}
+
+	d, err := newDelivery(app.webhooks.hooks[hook.ID], WebhookClosed, poll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.webhooks.deadLetter(d)
+	var dead []WebhookDelivery
+	json.NewDecoder(accountCall(t, app, bob, http.MethodGet, "/api/webhooks/dead-letters", "").Body).Decode(&dead)
+	if len(dead) != 0 {
+		t.Errorf("Expected another user's dead letters hidden, got %d", len(dead))
+	}
+	id := app.webhooks.DeadLetters()[0].ID
+	if rec := accountCall(t, app, bob, http.MethodPost, "/api/webhooks/dead-letters/"+id+"/retry", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected another user's dead letter not retried, got %d", rec.Code)
+	}
+}
+
+// TestWebhookPrivateReceivers refuses receivers on private addresses when
+// registering and when delivering.
+func TestWebhookPrivateReceivers(t *testing.T) {
+	app := NewApp()
+	admin := webhookAdmin(t, app)
+	for _, url := range []string{
+		"http://127.0.0.1:8080/hook",
+		"http://localhost/hook",
+		"http://10.0.0.5/hook",
+		"http://192.168.1.1/hook",
+		"http://169.254.169.254/latest/meta-data",
+		"http://[::1]/hook",
+		"http://[fe80::1]/hook",
+		"http://100.100.100.200/hook",
+	} {
+		rec := accountCall(t, app, admin, http.MethodPost, "/api/webhooks", `{"url":"`+url+`"}`)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("Expected %s refused, got %d", url, rec.Code)
+		}
+	}
+
+	server := httptest.NewServer(&webhookReceiver{})
+	defer server.Close()
+	_, err := app.webhooks.client.Post(server.URL, "application/json", nil)
+	if err == nil || !errors.Is(err, errPrivateAddress) {
+		t.Errorf("Expected a delivery to this host refused, got %v", err)
+	}
+}
+
+// TestOpenWebhooks keeps registrations across restarts.
+func TestOpenWebhooks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "webhooks.json")
+	hooks, err := OpenWebhooks(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	hook := &Webhook{URL: "https://203.0.113.10/hook", Secret: "s3cret"}
+	if err := hooks.Register(hook); err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+
+	reopened, err := OpenWebhooks(path)
+	if err != nil {
+		t.Fatalf("Reopen failed: %v", err)
+	}
+	if got, exists := reopened.Get(hook.ID); !exists || got.URL != hook.URL {
+		t.Errorf("Expected registration %s after reopening, got %+v", hook.ID, got)
+	}
+	if reopened.hooks[hook.ID].Secret != "s3cret" {
+		t.Error("Expected the secret to be kept")
+	}
+}
+
+// TestWebhookThresholdRestart keeps a threshold event that was sent from
+// being sent again after a restart.
+func TestWebhookThresholdRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "webhooks.json")
+	hooks, _ := OpenWebhooks(path)
+	hook := &Webhook{URL: "https://203.0.113.10/hook", Events: []string{WebhookThreshold}, Threshold: 1}
+	if err := hooks.Register(hook); err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+	poll := &Poll{ID: "poll_1", Question: "Q?", Options: []Option{{ID: "a", Text: "A"}, {ID: "b", Text: "B"}}}
+	poll.addBallot(Ballot{VoterID: "v1", Choices: []string{"a"}})
+	hooks.Notify(WebhookVoted, poll)
+	if len(hooks.queue) != 1 {
+		t.Fatalf("Expected the threshold event queued, got %d", len(hooks.queue))
+	}
+
+	reopened, err := OpenWebhooks(path)
+	if err != nil {
+		t.Fatalf("Reopen failed: %v", err)
+	}
+	poll.addBallot(Ballot{VoterID: "v2", Choices: []string{"b"}})
+	reopened.Notify(WebhookVoted, poll)
+	if len(reopened.queue) != 0 {
+		t.Errorf("Expected no threshold event after reopening, got %d", len(reopened.queue))
+	}
+}
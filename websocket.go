@@ -0,0 +1,427 @@
+// websocket.go - WebSocket transport (RFC 6455)
+// /ws/{id} streams the same poll JSON as /events/{id} for clients behind
+// proxies that buffer SSE, and accepts vote messages on the same socket:
+//   {"action": "vote", "options": ["<option id>", ...]}
+//   {"action": "retract"}
+// Failed actions are answered with {"error": {"code": ..., "message": ...}};
+// successful ones are visible through the poll update that follows. With
+// ?delta=1, updates after the first may be PollDelta objects, recognisable
+// by their "base" field.
+// Only the parts of the protocol this app needs are implemented: no
+// extensions, no subprotocols, and text frames only from the server.
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	wsGUID           = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	wsMaxMessageSize = 64 << 10
+	wsWriteTimeout   = 10 * time.Second
+	wsPingInterval   = 30 * time.Second
+)
+
+// WebSocket opcodes
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+)
+
+// WebSocket close codes
+const (
+	wsCloseNormal        = 1000
+	wsCloseGoingAway     = 1001
+	wsCloseProtocolError = 1002
+	wsCloseTooBig        = 1009
+)
+
+var errWSClosed = errors.New("websocket closed")
+
+// wsConn is a server-side WebSocket connection
+type wsConn struct {
+	conn    net.Conn
+	br      *bufio.Reader
+	writeMu sync.Mutex
+}
+
+// wsMessage is a client-to-server message
+type wsMessage struct {
+	Action  string   `json:"action"`
+	Options []string `json:"options"`
+}
+
+// WebSocketHandler upgrades /ws/{id} to a WebSocket that streams poll
+// updates and accepts votes
+func (app *App) WebSocketHandler(w http.ResponseWriter, r *http.Request) {
+	pollID := strings.TrimPrefix(r.URL.Path, "/ws/")
+
+	if _, err := app.viewablePoll(r, pollID); err != nil {
+		status, _ := errorStatus(err)
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	ws, err := upgradeWebSocket(w, r)
+	if err != nil {
+		log.Printf("WebSocket upgrade failed for poll %s: %v", pollID, err)
+		return
+	}
+	defer ws.conn.Close()
+
+	ch := app.broadcaster.Subscribe(pollID)
+	defer app.broadcaster.Unsubscribe(pollID, ch)
+
+	// Votes are only taken from pages served by this site, so another
+	// site cannot vote with a visitor's cookie
+	canVote := sameOrigin(r)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			data, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			if !canVote {
+				ws.writeError(ErrVoterRequired)
+				continue
+			}
+			app.handleWSMessage(ws, r, pollID, data)
+		}
+	}()
+
+	cursor := app.newEventCursor(pollID, 0)
+	cursor.deltas = r.URL.Query().Get("delta") == "1"
+	cursor.results = app.newResultsGate(r, pollID)
+	events := append(cursor.start(), presenceEvent(app.broadcaster.Viewers(pollID)))
+	if err := ws.writeEvents(events); err != nil {
+		app.reapConnection("WebSocket", pollID, err)
+		return
+	}
+
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+
+	for {
+		var err error
+		select {
+		case ev, ok := <-ch:
+			if !ok {
+				ws.Close(wsCloseGoingAway, "subscriber stalled")
+				return
+			}
+			err = ws.writeEvents(cursor.receive(ev, len(ch) == 0))
+		case <-ping.C:
+			err = ws.writeFrame(wsOpPing, nil)
+		case <-done:
+			return
+		}
+		if err != nil {
+			app.reapConnection("WebSocket", pollID, err)
+			return
+		}
+	}
+}
+
+// handleWSMessage applies a vote or retraction sent over the socket opened
+// by r
+func (app *App) handleWSMessage(ws *wsConn, r *http.Request, pollID string, data []byte) {
+	var msg wsMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		ws.writeError(fmt.Errorf("%w: invalid message", ErrInvalidBallot))
+		return
+	}
+	voterID, voterName, err := app.ballotIdentity(r, pollID)
+	if err != nil {
+		ws.writeError(err)
+		return
+	}
+
+	var poll *Poll
+	switch msg.Action {
+	case "vote":
+		poll, err = app.store.CastBallot(pollID, Ballot{VoterID: voterID, VoterName: voterName, Choices: msg.Options})
+	case "retract":
+		poll, err = app.store.RetractBallot(pollID, voterID)
+	default:
+		err = fmt.Errorf("%w: unknown action %q", ErrInvalidBallot, msg.Action)
+	}
+	if err != nil {
+		ws.writeError(err)
+		return
+	}
+
+	log.Printf("Vote %s via WebSocket for poll %s", msg.Action, pollID)
+	if msg.Action == "vote" {
+		app.notifyVote(poll)
+	}
+	app.broadcastPoll(poll)
+}
+
+// upgradeWebSocket validates the opening handshake and takes over the
+// connection
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	if r.Method != http.MethodGet ||
+		!headerContainsToken(r.Header, "Connection", "upgrade") ||
+		!headerContainsToken(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "Expected WebSocket upgrade", http.StatusBadRequest)
+		return nil, errors.New("not a websocket handshake")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil, errors.New("unsupported websocket version")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		http.Error(w, "Invalid Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, errors.New("invalid websocket key")
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSocket not supported", http.StatusInternalServerError)
+		return nil, errors.New("response writer cannot be hijacked")
+	}
+	conn, brw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	var resp strings.Builder
+	resp.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	resp.WriteString("Upgrade: websocket\r\n")
+	resp.WriteString("Connection: Upgrade\r\n")
+	resp.WriteString("Sec-WebSocket-Accept: " + wsAcceptKey(key) + "\r\n")
+	// Keep headers set by middleware, such as a newly issued voter cookie
+	for _, cookie := range w.Header()["Set-Cookie"] {
+		resp.WriteString("Set-Cookie: " + cookie + "\r\n")
+	}
+	resp.WriteString("\r\n")
+
+	conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	if _, err := conn.Write([]byte(resp.String())); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, br: brw.Reader}, nil
+}
+
+// wsAcceptKey computes Sec-WebSocket-Accept for a client key
+func wsAcceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// ReadMessage returns the next complete data message, answering pings and
+// the closing handshake along the way
+func (ws *wsConn) ReadMessage() ([]byte, error) {
+	var message []byte
+	started := false
+
+	for {
+		fin, opcode, payload, err := ws.readFrame()
+		if err != nil {
+			return nil, err
+		}
+
+		switch opcode {
+		case wsOpPing:
+			if err := ws.writeFrame(wsOpPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case wsOpPong:
+			continue
+		case wsOpClose:
+			// Echo the status code back and finish the handshake
+			code := wsCloseNormal
+			if len(payload) >= 2 {
+				code = int(binary.BigEndian.Uint16(payload))
+			}
+			ws.Close(code, "")
+			return nil, errWSClosed
+		case wsOpText, wsOpBinary:
+			if started {
+				ws.Close(wsCloseProtocolError, "expected continuation frame")
+				return nil, errWSClosed
+			}
+			started = true
+		case wsOpContinuation:
+			if !started {
+				ws.Close(wsCloseProtocolError, "unexpected continuation frame")
+				return nil, errWSClosed
+			}
+		default:
+			ws.Close(wsCloseProtocolError, "unknown opcode")
+			return nil, errWSClosed
+		}
+
+		if len(message)+len(payload) > wsMaxMessageSize {
+			ws.Close(wsCloseTooBig, "message too big")
+			return nil, errWSClosed
+		}
+		message = append(message, payload...)
+		if fin {
+			return message, nil
+		}
+	}
+}
+
+// readFrame reads and unmasks a single frame
+func (ws *wsConn) readFrame() (bool, byte, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(ws.br, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+
+	fin := header[0]&0x80 != 0
+	if header[0]&0x70 != 0 {
+		ws.Close(wsCloseProtocolError, "reserved bits set")
+		return false, 0, nil, errWSClosed
+	}
+	opcode := header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+	if !masked {
+		ws.Close(wsCloseProtocolError, "client frames must be masked")
+		return false, 0, nil, errWSClosed
+	}
+
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(ws.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(ws.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+
+	// Control frames are small and never fragmented
+	if opcode >= wsOpClose && (length > 125 || !fin) {
+		ws.Close(wsCloseProtocolError, "invalid control frame")
+		return false, 0, nil, errWSClosed
+	}
+	if length > wsMaxMessageSize {
+		ws.Close(wsCloseTooBig, "message too big")
+		return false, 0, nil, errWSClosed
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(ws.br, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(ws.br, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, opcode, payload, nil
+}
+
+// WriteText sends a complete text message
+func (ws *wsConn) WriteText(data []byte) error {
+	return ws.writeFrame(wsOpText, data)
+}
+
+// writeEvents sends each event's poll JSON as a text message
+func (ws *wsConn) writeEvents(events []Event) error {
+	for _, ev := range events {
+		if err := ws.WriteText([]byte(ev.Data)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeFrame sends one unmasked, unfragmented frame
+func (ws *wsConn) writeFrame(opcode byte, payload []byte) error {
+	ws.writeMu.Lock()
+	defer ws.writeMu.Unlock()
+
+	frame := make([]byte, 0, len(payload)+10)
+	frame = append(frame, 0x80|opcode)
+	switch n := len(payload); {
+	case n <= 125:
+		frame = append(frame, byte(n))
+	case n <= 0xFFFF:
+		frame = append(frame, 126, byte(n>>8), byte(n))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	frame = append(frame, payload...)
+
+	ws.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	_, err := ws.conn.Write(frame)
+	return err
+}
+
+// writeError sends an API-style error message
+func (ws *wsConn) writeError(err error) {
+	_, code := errorStatus(err)
+	data, _ := json.Marshal(apiError{Error: apiErrorBody{Code: code, Message: err.Error()}})
+	ws.WriteText(data)
+}
+
+// Close sends a close frame and closes the connection
+func (ws *wsConn) Close(code int, reason string) error {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	payload = append(payload, reason...)
+	ws.writeFrame(wsOpClose, payload)
+	return ws.conn.Close()
+}
+
+// headerContainsToken reports whether a comma-separated header contains
+// token, ignoring case
+func headerContainsToken(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sameOrigin reports whether a browser request came from a page on this
+// host. Requests without an Origin header (non-browser clients) pass.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// wsTestClient is a minimal client side of the WebSocket protocol
+type wsTestClient struct {
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+// dialWS performs the opening handshake against a test server
+func dialWS(t *testing.T, server *httptest.Server, app *App, path, voterID, origin string) *wsTestClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL+path, nil)
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	if origin != "" {
+		req.Header.Set("Origin", origin)
+	}
+	if voterID != "" {
+		signIn(app, req, voterID)
+	}
+	if err := req.Write(conn); err != nil {
+		t.Fatalf("Handshake write failed: %v", err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		t.Fatalf("Handshake read failed: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected 101, got %d", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Sec-WebSocket-Accept"); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("Unexpected Sec-WebSocket-Accept %q", got)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return &wsTestClient{conn: conn, br: br}
+}
+
+// send writes one masked frame
+func (c *wsTestClient) send(opcode byte, payload []byte) {
+	mask := []byte{1, 2, 3, 4}
+	frame := []byte{0x80 | opcode, 0x80 | byte(len(payload))}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	c.conn.Write(frame)
+}
+
+// read returns the next frame from the server, skipping viewer counts
+func (c *wsTestClient) read(t *testing.T) (byte, []byte) {
+	t.Helper()
+	for {
+		opcode, payload := c.readFrame(t)
+		if opcode != wsOpText || !bytes.HasPrefix(payload, []byte(`{"viewers":`)) {
+			return opcode, payload
+		}
+	}
+}
+
+// readFrame returns the next frame from the server
+func (c *wsTestClient) readFrame(t *testing.T) (byte, []byte) {
+	t.Helper()
+	var header [2]byte
+	if _, err := io.ReadFull(c.br, header[:]); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	length := int(header[1] & 0x7F)
+	if length == 126 {
+		var ext [2]byte
+		io.ReadFull(c.br, ext[:])
+		length = int(binary.BigEndian.Uint16(ext[:]))
+	}
+	payload := make([]byte, length)
+	io.ReadFull(c.br, payload)
+	return header[0] & 0x0F, payload
+}
+
+// readPoll reads the next poll update
+func (c *wsTestClient) readPoll(t *testing.T) Poll {
+	t.Helper()
+	opcode, payload := c.read(t)
+	var poll Poll
+	if opcode != wsOpText || json.Unmarshal(payload, &poll) != nil {
+		t.Fatalf("Expected poll JSON, got opcode %d %q", opcode, payload)
+	}
+	return poll
+}
+
+// TestWebSocketAcceptKey checks the example from RFC 6455.
+func TestWebSocketAcceptKey(t *testing.T) {
+	if got := wsAcceptKey("dGhlIHNhbXBsZSBub25jZQ=="); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("Unexpected accept key %q", got)
+	}
+}
+
+// TestWebSocketRejectsPlainRequest ensures non-upgrade requests fail
+// cleanly.
+func TestWebSocketRejectsPlainRequest(t *testing.T) {
+	app := NewApp()
+	poll := &Poll{Question: "Q?", Options: []Option{{ID: "a", Text: "A"}, {ID: "b", Text: "B"}}}
+	app.store.Create(poll)
+
+	rec := httptest.NewRecorder()
+	app.Routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ws/"+poll.ID, nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	app.Routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ws/missing", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404, got %d", rec.Code)
+	}
+}
+
+// TestWebSocketVoteAndStream votes over the socket and receives the
+// broadcast update.
+func TestWebSocketVoteAndStream(t *testing.T) {
+	app := NewApp()
+	poll := &Poll{Question: "Q?", Options: []Option{{ID: "a", Text: "A"}, {ID: "b", Text: "B"}}}
+	app.store.Create(poll)
+	server := httptest.NewServer(app.Routes())
+	defer server.Close()
+
+	client := dialWS(t, server, app, "/ws/"+poll.ID, "ws-voter", "")
+	if initial := client.readPoll(t); initial.ID != poll.ID {
+		t.Fatalf("Expected initial poll %s, got %s", poll.ID, initial.ID)
+	}
+
+	client.send(wsOpText, []byte(`{"action":"vote","options":["b"]}`))
+	if updated := client.readPoll(t); updated.Options[1].Votes != 1 {
+		t.Errorf("Expected vote for b, got %+v", updated.Options)
+	}
+
+	client.send(wsOpText, []byte(`{"action":"vote","options":["z"]}`))
+	_, payload := client.read(t)
+	var body apiError
+	json.Unmarshal(payload, &body)
+	if body.Error.Code != "option_not_found" {
+		t.Errorf("Expected option_not_found, got %q", payload)
+	}
+
+	client.send(wsOpPing, []byte("hi"))
+	if opcode, payload := client.read(t); opcode != wsOpPong || string(payload) != "hi" {
+		t.Errorf("Expected pong echo, got opcode %d %q", opcode, payload)
+	}
+
+	client.send(wsOpClose, binary.BigEndian.AppendUint16(nil, wsCloseNormal))
+	if opcode, _ := client.read(t); opcode != wsOpClose {
+		t.Errorf("Expected close frame, got opcode %d", opcode)
+	}
+}
+
+// TestWebSocketCrossOriginVote ensures pages on other sites can watch
+// but not vote.
+func TestWebSocketCrossOriginVote(t *testing.T) {
+	app := NewApp()
+	poll := &Poll{Question: "Q?", Options: []Option{{ID: "a", Text: "A"}, {ID: "b", Text: "B"}}}
+	app.store.Create(poll)
+	server := httptest.NewServer(app.Routes())
+	defer server.Close()
+
+	client := dialWS(t, server, app, "/ws/"+poll.ID, "ws-voter", "https://evil.example")
+	client.readPoll(t)
+
+	client.send(wsOpText, []byte(`{"action":"vote","options":["a"]}`))
+	_, payload := client.read(t)
+	var body apiError
+	json.Unmarshal(payload, &body)
+	if body.Error.Code != "voter_required" {
+		t.Errorf("Expected voter_required, got %q", payload)
+	}
+	if p, _ := app.store.Get(poll.ID); p.Options[0].Votes != 0 {
+		t.Errorf("Cross-origin vote was counted")
+	}
+}